@@ -2,7 +2,9 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"time"
@@ -11,19 +13,64 @@ import (
 )
 
 func main() {
-	log.Println("Hello world")
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal("config:", err)
+	}
+	server := flag.String("server", config.Server, "cito server URL")
+	flag.Parse()
+	config.Server = *server
+
+	switch flag.Arg(0) {
+	case "login":
+		if err := login(config); err != nil {
+			log.Fatal("login:", err)
+		}
+	case "logout":
+		if err := logout(config); err != nil {
+			log.Fatal("logout:", err)
+		}
+	case "export":
+		if err := export(config, flag.Args()[1:]); err != nil {
+			log.Fatal("export:", err)
+		}
+	case "", "chat":
+		chat(config)
+	default:
+		log.Fatalf("unknown command %q, expected login, logout, export or chat", flag.Arg(0))
+	}
+}
+
+// chat sends every line read from stdin over the websocket
+func chat(config *Config) {
+	if config.Token == "" {
+		log.Fatal("not logged in, run cito login first")
+	}
+	u, err := url.Parse(config.Server)
+	if err != nil {
+		log.Fatal("server:", err)
+	}
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	u.Path = "/ws"
 
-	u := url.URL{Scheme: "ws", Host: "127.0.0.1:8080", Path: "/ws"}
 	log.Printf("connecting to %s", u.String())
+	header := http.Header{"Authorization": {"Bearer " + config.Token}}
 	dialer := &websocket.Dialer{HandshakeTimeout: 45 * time.Second}
-	conn, _, err := dialer.Dial(u.String(), nil)
+	conn, resp, err := dialer.Dial(u.String(), header)
+	if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+		log.Fatal("token rejected, run cito login again")
+	}
 	if err != nil {
 		log.Fatal("dial:", err)
 	}
 	defer conn.Close()
 
+	reader := bufio.NewReader(os.Stdin)
 	for {
-		reader := bufio.NewReader(os.Stdin)
 		text, _ := reader.ReadString('\n')
 		err := conn.WriteMessage(websocket.TextMessage, []byte(text))
 
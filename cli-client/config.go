@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+const defaultServer = "http://127.0.0.1:8080"
+
+// Config is stored in the user's config directory, e.g.
+// ~/.config/cito/config.json on Linux
+type Config struct {
+	Server string `json:"server"`
+	Token  string `json:"token,omitempty"`
+}
+
+func configPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "cito", "config.json"), nil
+}
+
+// loadConfig reads the config file, returning defaults when it does not exist
+func loadConfig() (*Config, error) {
+	config := &Config{Server: defaultServer}
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// saveConfig writes the config readable by the current user only since it
+// holds an access token
+func saveConfig(config *Config) error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
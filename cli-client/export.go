@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// exportPollInterval is how often the CLI checks on a running export
+const exportPollInterval = 2 * time.Second
+
+type exportResponse struct {
+	ID          int    `json:"id"`
+	Format      string `json:"format"`
+	Status      string `json:"status"`
+	Exported    int    `json:"exported"`
+	Total       int    `json:"total"`
+	Error       string `json:"error"`
+	DownloadURL string `json:"download_url"`
+}
+
+// apiRequest calls the server API with the stored token
+func apiRequest(config *Config, method string, path string, body io.Reader) (*http.Response, error) {
+	if config.Token == "" {
+		return nil, errors.New("not logged in, run cito login first")
+	}
+	req, err := http.NewRequest(method, config.Server+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+config.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return nil, fmt.Errorf("%s %s failed with status %d: %s", method, path, resp.StatusCode, apiErr.Error)
+	}
+	return resp, nil
+}
+
+// apiJSON calls the server API and decodes the JSON response into v
+func apiJSON(config *Config, method string, path string, body io.Reader, v any) error {
+	resp, err := apiRequest(config, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// export asks the server for an export of the user's conversations, waits
+// for it to be written and downloads it
+func export(config *Config, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "ndjson", "export format, ndjson or zip")
+	output := flags.String("o", "", "file to write, cito-export.<format> by default")
+	flags.Parse(args)
+	if *output == "" {
+		*output = "cito-export." + *format
+	}
+
+	var job exportResponse
+	body := strings.NewReader(fmt.Sprintf(`{"format":%q}`, *format))
+	if err := apiJSON(config, http.MethodPost, "/api/exports", body, &job); err != nil {
+		return err
+	}
+	log.Printf("Export %d requested", job.ID)
+
+	for job.Status != "done" {
+		if job.Status == "failed" {
+			return fmt.Errorf("export failed: %s", job.Error)
+		}
+		time.Sleep(exportPollInterval)
+		if err := apiJSON(config, http.MethodGet, fmt.Sprintf("/api/exports/%d", job.ID), nil, &job); err != nil {
+			return err
+		}
+		if job.Total > 0 {
+			log.Printf("Exported %d of %d messages", job.Exported, job.Total)
+		}
+	}
+
+	resp, err := apiRequest(config, http.MethodGet, job.DownloadURL, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	file, err := os.OpenFile(*output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	log.Printf("Saved %d messages to %s", job.Exported, *output)
+	return nil
+}
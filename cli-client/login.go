@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+type deviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type deviceTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	Error       string `json:"error"`
+}
+
+func postForm(endpoint string, values url.Values, v any) (int, error) {
+	resp, err := http.PostForm(endpoint, values)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(v)
+}
+
+// login runs the device authorization flow: it shows a code for the user to
+// approve in the browser and polls until the server issues a token
+func login(config *Config) error {
+	hostname, _ := os.Hostname()
+	var code deviceCodeResponse
+	status, err := postForm(config.Server+"/device/code", url.Values{"client_name": {"cito CLI on " + hostname}}, &code)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("starting login failed with status %d", status)
+	}
+
+	fmt.Printf("Open %s and enter the code %s\n", code.VerificationURI, code.UserCode)
+	fmt.Printf("or visit %s\n", code.VerificationURIComplete)
+
+	interval := time.Duration(code.Interval) * time.Second
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		var token deviceTokenResponse
+		if _, err := postForm(config.Server+"/device/token", url.Values{"device_code": {code.DeviceCode}}, &token); err != nil {
+			return err
+		}
+		switch token.Error {
+		case "":
+			config.Token = token.AccessToken
+			if err := saveConfig(config); err != nil {
+				return err
+			}
+			log.Println("Logged in")
+			return nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		case "access_denied":
+			return errors.New("login was denied")
+		case "expired_token":
+			return errors.New("login code expired, run cito login again")
+		default:
+			return fmt.Errorf("login failed: %s", token.Error)
+		}
+	}
+	return errors.New("login code expired, run cito login again")
+}
+
+// logout forgets the stored token
+func logout(config *Config) error {
+	config.Token = ""
+	return saveConfig(config)
+}
@@ -4,25 +4,70 @@
 package tests
 
 import (
+	"archive/zip"
+	"bytes"
+	"cito/server/database"
+	"cito/server/migrations"
 	"cito/server/model"
 	"cito/server/service"
+	"cito/server/testutil"
+	"cito/server/totp"
 	"context"
 	"database/sql"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
-	_ "github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/testcontainers/testcontainers-go"
 	"github.com/testcontainers/testcontainers-go/modules/postgres"
 	"github.com/testcontainers/testcontainers-go/wait"
+	"golang.org/x/oauth2"
 )
 
-// setupTestDB creates a PostgreSQL test container and returns a connection
+// testDriver is the backend the suite runs against, TEST_DB_DRIVER=sqlite
+// selects SQLite instead of PostgreSQL
+var testDriver = os.Getenv("TEST_DB_DRIVER")
+
+func init() {
+	if testDriver == "" {
+		testDriver = database.Postgres
+	}
+}
+
+// setupTestDB creates a migrated test database of testDriver and returns a
+// connection
 func setupTestDB(t *testing.T) (*sql.DB, func()) {
 	ctx := context.Background()
 
+	var db *sql.DB
+	var cleanup func()
+	if testDriver == database.SQLite {
+		var err error
+		db, err = database.Open(database.SQLite, filepath.Join(t.TempDir(), "cito_test.db"))
+		require.NoError(t, err, "failed to open database")
+		cleanup = func() { db.Close() }
+	} else {
+		db, cleanup = setupPostgres(t)
+	}
+
+	// Create tables
+	migrator, err := migrations.New(db, testDriver)
+	require.NoError(t, err, "failed to load migrations")
+	_, err = migrator.Up(ctx)
+	require.NoError(t, err, "failed to migrate database")
+
+	return db, cleanup
+}
+
+// setupPostgres creates a PostgreSQL test container and returns a connection
+func setupPostgres(t *testing.T) (*sql.DB, func()) {
+	ctx := context.Background()
+
 	// Create PostgreSQL container
 	pgContainer, err := postgres.RunContainer(ctx,
 		testcontainers.WithImage("postgres:15-alpine"),
@@ -40,27 +85,9 @@ func setupTestDB(t *testing.T) (*sql.DB, func()) {
 	connStr, err := pgContainer.ConnectionString(ctx, "sslmode=disable")
 	require.NoError(t, err, "failed to get connection string")
 
-	// Open database connection
-	db, err := sql.Open("postgres", connStr)
-	require.NoError(t, err, "failed to open database connection")
-
-	// Verify connection
-	err = db.Ping()
-	require.NoError(t, err, "failed to ping database")
-
-	// Create users table
-	createTableSQL := `
-		CREATE TABLE IF NOT EXISTS users (
-			id SERIAL PRIMARY KEY,
-			github_id BIGINT UNIQUE NOT NULL,
-			username VARCHAR(255) NOT NULL,
-			email VARCHAR(255),
-			access_token VARCHAR(255),
-			session_token VARCHAR(255) UNIQUE
-		);
-	`
-	_, err = db.Exec(createTableSQL)
-	require.NoError(t, err, "failed to create users table")
+	// Open and verify database connection
+	db, err := database.Open(database.Postgres, connStr)
+	require.NoError(t, err, "failed to connect to database")
 
 	// Cleanup function
 	cleanup := func() {
@@ -73,11 +100,30 @@ func setupTestDB(t *testing.T) (*sql.DB, func()) {
 	return db, cleanup
 }
 
-func TestIntegration_UserService_UpsertUser(t *testing.T) {
+// newRepository returns the repository of testDriver
+func newRepository(db *sql.DB) service.Repository {
+	if testDriver == database.SQLite {
+		return service.NewSQLiteRepository(db)
+	}
+	return service.NewPostgresRepository(db)
+}
+
+// identityAccessToken returns the decrypted access token stored for an identity
+func identityAccessToken(t *testing.T, db *sql.DB, provider string, subject string) string {
+	var encrypted string
+	err := db.QueryRow("SELECT access_token FROM identities WHERE provider = $1 AND subject = $2", provider, subject).Scan(&encrypted)
+	require.NoError(t, err)
+	accessToken, err := testutil.NewTestKeyring(t).Decrypt(encrypted)
+	require.NoError(t, err)
+	return accessToken
+}
+
+func TestIntegration_UserService_UpsertIdentity(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
 
-	us := service.NewUserService(db)
+	keys := testutil.NewTestKeyring(t)
+	us := service.NewUserService(newRepository(db), keys)
 
 	githubUser := model.GitHubUser{
 		ID:    12345,
@@ -86,20 +132,20 @@ func TestIntegration_UserService_UpsertUser(t *testing.T) {
 	}
 
 	t.Run("inserts new user on first call", func(t *testing.T) {
-		token1, err := us.UpsertUser(githubUser, "access_token_1")
+		userID, err := us.UpsertIdentity(context.Background(), githubUser.Identity(), &oauth2.Token{AccessToken: "access_token_1"})
 		require.NoError(t, err, "should insert user without error")
-		assert.NotEmpty(t, token1, "should return session token")
+		assert.NotZero(t, userID, "should return user ID")
 
-		// Verify user exists in database
-		var count int
-		err = db.QueryRow("SELECT COUNT(*) FROM users WHERE github_id = $1", githubUser.ID).Scan(&count)
+		// Verify the identity is linked to the user
+		var identityUserID int
+		err = db.QueryRow("SELECT user_id FROM identities WHERE provider = 'github' AND subject = '12345'").Scan(&identityUserID)
 		require.NoError(t, err)
-		assert.Equal(t, 1, count, "should have exactly one user")
+		assert.Equal(t, userID, identityUserID, "identity should belong to the new user")
 	})
 
 	t.Run("updates existing user on second call", func(t *testing.T) {
 		// First insert
-		token1, err := us.UpsertUser(githubUser, "access_token_1")
+		userID1, err := us.UpsertIdentity(context.Background(), githubUser.Identity(), &oauth2.Token{AccessToken: "access_token_1"})
 		require.NoError(t, err)
 
 		// Second upsert with same GitHub ID but different data
@@ -108,25 +154,27 @@ func TestIntegration_UserService_UpsertUser(t *testing.T) {
 			Login: "updateduser",
 			Email: "updated@example.com",
 		}
-		token2, err := us.UpsertUser(updatedUser, "access_token_2")
+		userID2, err := us.UpsertIdentity(context.Background(), updatedUser.Identity(), &oauth2.Token{AccessToken: "access_token_2"})
 		require.NoError(t, err)
-		assert.NotEmpty(t, token2)
-		assert.NotEqual(t, token1, token2, "session token should be regenerated")
+		assert.Equal(t, userID1, userID2, "user ID should be stable across upserts")
 
-		// Verify only one user exists
+		// Verify only one identity exists
 		var count int
-		err = db.QueryRow("SELECT COUNT(*) FROM users WHERE github_id = $1", githubUser.ID).Scan(&count)
+		err = db.QueryRow("SELECT COUNT(*) FROM identities WHERE provider = 'github' AND subject = '12345'").Scan(&count)
 		require.NoError(t, err)
-		assert.Equal(t, 1, count, "should still have exactly one user")
+		assert.Equal(t, 1, count, "should still have exactly one identity")
 
-		// Verify user data was updated
+		// Verify identity data was updated
 		var username, email, accessToken string
-		err = db.QueryRow("SELECT username, email, access_token FROM users WHERE github_id = $1", githubUser.ID).
+		err = db.QueryRow("SELECT username, email, access_token FROM identities WHERE provider = 'github' AND subject = '12345'").
 			Scan(&username, &email, &accessToken)
 		require.NoError(t, err)
 		assert.Equal(t, "updateduser", username)
 		assert.Equal(t, "updated@example.com", email)
-		assert.Equal(t, "access_token_2", accessToken)
+		assert.NotEqual(t, "access_token_2", accessToken, "access token must be encrypted at rest")
+		decrypted, err := keys.Decrypt(accessToken)
+		require.NoError(t, err)
+		assert.Equal(t, "access_token_2", decrypted)
 	})
 }
 
@@ -134,7 +182,8 @@ func TestIntegration_UserService_FindUserBySession(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
 
-	us := service.NewUserService(db)
+	us := service.NewUserService(newRepository(db), testutil.NewTestKeyring(t))
+	ss := service.NewSessionService(newRepository(db))
 
 	// Insert a test user
 	githubUser := model.GitHubUser{
@@ -142,38 +191,47 @@ func TestIntegration_UserService_FindUserBySession(t *testing.T) {
 		Login: "sessiontestuser",
 		Email: "session@example.com",
 	}
-	sessionToken, err := us.UpsertUser(githubUser, "access_token")
+	userID, err := us.UpsertIdentity(context.Background(), githubUser.Identity(), &oauth2.Token{AccessToken: "access_token"})
+	require.NoError(t, err)
+	sessionToken, err := ss.CreateSession(userID, "test-agent", "127.0.0.1")
 	require.NoError(t, err)
 
 	t.Run("finds user by valid session token", func(t *testing.T) {
-		user, err := us.FindUserBySession(sessionToken)
+		user, err := us.FindUserBySession(context.Background(), sessionToken)
 		require.NoError(t, err, "should find user without error")
 		require.NotNil(t, user)
-		assert.Equal(t, int64(99999), user.GithubID)
 		assert.Equal(t, "sessiontestuser", user.Username)
 		assert.Equal(t, "session@example.com", user.Email)
-		assert.Equal(t, sessionToken, user.SessionToken)
+		assert.NotZero(t, user.SessionID)
 	})
 
 	t.Run("returns error for invalid session token", func(t *testing.T) {
-		user, err := us.FindUserBySession("invalid_token_12345")
+		user, err := us.FindUserBySession(context.Background(), "invalid_token_12345")
 		require.Error(t, err, "should return error for invalid token")
 		assert.Nil(t, user)
-		assert.Equal(t, sql.ErrNoRows, err)
+		assert.ErrorIs(t, err, service.ErrUserNotFound)
 	})
 
 	t.Run("returns error for empty session token", func(t *testing.T) {
-		user, err := us.FindUserBySession("")
+		user, err := us.FindUserBySession(context.Background(), "")
 		require.Error(t, err)
 		assert.Nil(t, user)
 	})
+
+	t.Run("stores only the token hash", func(t *testing.T) {
+		var count int
+		err := db.QueryRow("SELECT COUNT(*) FROM sessions WHERE token_hash = $1", sessionToken).Scan(&count)
+		require.NoError(t, err)
+		assert.Equal(t, 0, count, "raw session token must not be stored")
+	})
 }
 
 func TestIntegration_SessionTokenUniqueness(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
 
-	us := service.NewUserService(db)
+	us := service.NewUserService(newRepository(db), testutil.NewTestKeyring(t))
+	ss := service.NewSessionService(newRepository(db))
 
 	// Create multiple users
 	users := []model.GitHubUser{
@@ -185,7 +243,9 @@ func TestIntegration_SessionTokenUniqueness(t *testing.T) {
 	tokens := make(map[string]bool)
 
 	for _, user := range users {
-		token, err := us.UpsertUser(user, "access_token")
+		userID, err := us.UpsertIdentity(context.Background(), user.Identity(), &oauth2.Token{AccessToken: "access_token"})
+		require.NoError(t, err)
+		token, err := ss.CreateSession(userID, "test-agent", "127.0.0.1")
 		require.NoError(t, err)
 		assert.NotEmpty(t, token)
 
@@ -198,13 +258,44 @@ func TestIntegration_SessionTokenUniqueness(t *testing.T) {
 	assert.Equal(t, 3, len(tokens), "should have 3 unique session tokens")
 }
 
+func TestIntegration_MultipleSessionsPerUser(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	us := service.NewUserService(newRepository(db), testutil.NewTestKeyring(t))
+	ss := service.NewSessionService(newRepository(db))
+
+	userID, err := us.UpsertIdentity(context.Background(), model.GitHubUser{ID: 4242, Login: "multidevice", Email: "multi@example.com"}.Identity(), &oauth2.Token{AccessToken: "token"})
+	require.NoError(t, err)
+
+	laptop, err := ss.CreateSession(userID, "laptop", "10.0.0.1")
+	require.NoError(t, err)
+	phone, err := ss.CreateSession(userID, "phone", "10.0.0.2")
+	require.NoError(t, err)
+	assert.NotEqual(t, laptop, phone)
+
+	laptopUser, err := us.FindUserBySession(context.Background(), laptop)
+	require.NoError(t, err, "first session should stay valid after a second login")
+	phoneUser, err := us.FindUserBySession(context.Background(), phone)
+	require.NoError(t, err)
+	assert.Equal(t, userID, laptopUser.ID)
+	assert.Equal(t, userID, phoneUser.ID)
+	assert.NotEqual(t, laptopUser.SessionID, phoneUser.SessionID)
+
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM sessions WHERE user_id = $1", userID).Scan(&count)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
 func TestIntegration_DatabaseConstraints(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
 
-	us := service.NewUserService(db)
+	us := service.NewUserService(newRepository(db), testutil.NewTestKeyring(t))
+	ss := service.NewSessionService(newRepository(db))
 
-	t.Run("github_id unique constraint enforced", func(t *testing.T) {
+	t.Run("provider and subject unique constraint enforced", func(t *testing.T) {
 		githubUser := model.GitHubUser{
 			ID:    5555,
 			Login: "constrainttest",
@@ -212,34 +303,38 @@ func TestIntegration_DatabaseConstraints(t *testing.T) {
 		}
 
 		// First insert should succeed
-		token1, err := us.UpsertUser(githubUser, "token1")
+		userID, err := us.UpsertIdentity(context.Background(), githubUser.Identity(), &oauth2.Token{AccessToken: "token1"})
 		require.NoError(t, err)
-		assert.NotEmpty(t, token1)
+		assert.NotZero(t, userID)
 
-		// Second upsert with same github_id should update, not create duplicate
-		_, err = us.UpsertUser(githubUser, "token2")
+		// Second upsert with the same identity should update, not create duplicate
+		_, err = us.UpsertIdentity(context.Background(), githubUser.Identity(), &oauth2.Token{AccessToken: "token2"})
 		require.NoError(t, err)
 
 		// Verify only one row exists
 		var count int
-		err = db.QueryRow("SELECT COUNT(*) FROM users WHERE github_id = $1", githubUser.ID).Scan(&count)
+		err = db.QueryRow("SELECT COUNT(*) FROM identities WHERE provider = 'github' AND subject = '5555'").Scan(&count)
 		require.NoError(t, err)
-		assert.Equal(t, 1, count, "unique constraint should prevent duplicate github_id")
-	})
+		assert.Equal(t, 1, count, "unique constraint should prevent duplicate identities")
 
-	t.Run("session_token unique constraint enforced", func(t *testing.T) {
-		// This is implicitly tested by the upsert mechanism
-		// Session tokens are regenerated on each upsert, ensuring uniqueness
-		user1 := model.GitHubUser{ID: 6001, Login: "user1", Email: "user1@test.com"}
-		user2 := model.GitHubUser{ID: 6002, Login: "user2", Email: "user2@test.com"}
+		_, err = db.Exec(`INSERT INTO identities (user_id, provider, subject, username, created_at)
+			VALUES ($1, 'github', '5555', 'dup', $2)`, userID, time.Now())
+		assert.Error(t, err, "database should reject a duplicate identity")
+	})
 
-		token1, err := us.UpsertUser(user1, "token")
+	t.Run("sessions are removed with their user", func(t *testing.T) {
+		userID, err := us.UpsertIdentity(context.Background(), model.GitHubUser{ID: 6001, Login: "user1", Email: "user1@test.com"}.Identity(), &oauth2.Token{AccessToken: "token"})
+		require.NoError(t, err)
+		_, err = ss.CreateSession(userID, "test-agent", "127.0.0.1")
 		require.NoError(t, err)
 
-		token2, err2 := us.UpsertUser(user2, "token")
-		require.NoError(t, err2)
+		_, err = db.Exec("DELETE FROM users WHERE id = $1", userID)
+		require.NoError(t, err)
 
-		assert.NotEqual(t, token1, token2, "session tokens should be unique")
+		var count int
+		err = db.QueryRow("SELECT COUNT(*) FROM sessions WHERE user_id = $1", userID).Scan(&count)
+		require.NoError(t, err)
+		assert.Equal(t, 0, count, "sessions should cascade on user delete")
 	})
 }
 
@@ -247,7 +342,7 @@ func TestIntegration_ConcurrentOperations(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
 
-	us := service.NewUserService(db)
+	us := service.NewUserService(newRepository(db), testutil.NewTestKeyring(t))
 
 	// Test concurrent upserts of different users
 	t.Run("concurrent upserts of different users", func(t *testing.T) {
@@ -260,7 +355,7 @@ func TestIntegration_ConcurrentOperations(t *testing.T) {
 					Login: "concurrent" + string(rune('a'+id)),
 					Email: "concurrent@test.com",
 				}
-				_, err := us.UpsertUser(user, "token")
+				_, err := us.UpsertIdentity(context.Background(), user.Identity(), &oauth2.Token{AccessToken: "token"})
 				assert.NoError(t, err)
 				done <- true
 			}(i)
@@ -273,7 +368,7 @@ func TestIntegration_ConcurrentOperations(t *testing.T) {
 
 		// Verify all 5 users were created
 		var count int
-		err := db.QueryRow("SELECT COUNT(*) FROM users WHERE github_id >= 7000 AND github_id < 7010").Scan(&count)
+		err := db.QueryRow("SELECT COUNT(*) FROM identities WHERE provider = 'github' AND subject LIKE '700_'").Scan(&count)
 		require.NoError(t, err)
 		assert.Equal(t, 5, count, "all concurrent inserts should succeed")
 	})
@@ -283,7 +378,8 @@ func TestIntegration_FullUserLifecycle(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
 
-	us := service.NewUserService(db)
+	us := service.NewUserService(newRepository(db), testutil.NewTestKeyring(t))
+	ss := service.NewSessionService(newRepository(db))
 
 	// Complete user lifecycle: create, update, find
 	githubUser := model.GitHubUser{
@@ -292,39 +388,707 @@ func TestIntegration_FullUserLifecycle(t *testing.T) {
 		Email: "lifecycle@example.com",
 	}
 
-	// Step 1: Create user
-	token1, err := us.UpsertUser(githubUser, "initial_token")
+	// Step 1: Create user and first session
+	userID, err := us.UpsertIdentity(context.Background(), githubUser.Identity(), &oauth2.Token{AccessToken: "initial_token"})
 	require.NoError(t, err, "should create user")
+	token1, err := ss.CreateSession(userID, "first-device", "127.0.0.1")
+	require.NoError(t, err)
 	assert.NotEmpty(t, token1)
 
 	// Step 2: Find user by session token
-	foundUser, err := us.FindUserBySession(token1)
+	foundUser, err := us.FindUserBySession(context.Background(), token1)
 	require.NoError(t, err, "should find user by session")
-	assert.Equal(t, githubUser.ID, foundUser.GithubID)
 	assert.Equal(t, githubUser.Login, foundUser.Username)
-	assert.Equal(t, "initial_token", foundUser.AccessToken)
+	assert.Equal(t, "initial_token", identityAccessToken(t, db, "github", "8888"))
 
-	// Step 3: Update user (new login session)
+	// Step 3: Update user (new login on another device)
 	updatedGithubUser := model.GitHubUser{
 		ID:    8888, // Same ID
 		Login: "lifecycleuser_updated",
 		Email: "lifecycle_updated@example.com",
 	}
-	token2, err := us.UpsertUser(updatedGithubUser, "updated_token")
+	updatedID, err := us.UpsertIdentity(context.Background(), updatedGithubUser.Identity(), &oauth2.Token{AccessToken: "updated_token"})
 	require.NoError(t, err, "should update user")
-	assert.NotEmpty(t, token2)
+	assert.Equal(t, userID, updatedID)
+	token2, err := ss.CreateSession(updatedID, "second-device", "127.0.0.1")
+	require.NoError(t, err)
 	assert.NotEqual(t, token1, token2, "new session should have new token")
 
-	// Step 4: Old token should no longer work
-	oldUser, err := us.FindUserBySession(token1)
-	require.Error(t, err, "old session token should be invalid")
-	assert.Nil(t, oldUser)
+	// Step 4: Old token keeps working, the cito profile keeps the name the
+	// account was created with
+	oldUser, err := us.FindUserBySession(context.Background(), token1)
+	require.NoError(t, err, "first session should stay valid")
+	assert.Equal(t, "lifecycleuser", oldUser.Username)
 
-	// Step 5: New token should work
-	newUser, err := us.FindUserBySession(token2)
+	// Step 5: New token should work and the identity was refreshed
+	newUser, err := us.FindUserBySession(context.Background(), token2)
 	require.NoError(t, err, "new session token should work")
 	require.NotNil(t, newUser)
-	assert.Equal(t, "lifecycleuser_updated", newUser.Username)
-	assert.Equal(t, "lifecycle_updated@example.com", newUser.Email)
-	assert.Equal(t, "updated_token", newUser.AccessToken)
+	assert.Equal(t, userID, newUser.ID)
+	assert.Equal(t, "updated_token", identityAccessToken(t, db, "github", "8888"))
+	var identityUsername string
+	err = db.QueryRow("SELECT username FROM identities WHERE provider = 'github' AND subject = '8888'").Scan(&identityUsername)
+	require.NoError(t, err)
+	assert.Equal(t, "lifecycleuser_updated", identityUsername)
+}
+
+func TestIntegration_SessionExpiryAndLogout(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	us := service.NewUserService(newRepository(db), testutil.NewTestKeyring(t))
+	ss := service.NewSessionService(newRepository(db))
+
+	userID, err := us.UpsertIdentity(context.Background(), model.GitHubUser{ID: 3131, Login: "expiring", Email: "expiring@example.com"}.Identity(), &oauth2.Token{AccessToken: "token"})
+	require.NoError(t, err)
+
+	t.Run("expired session is rejected", func(t *testing.T) {
+		token, err := ss.CreateSession(userID, "test-agent", "127.0.0.1")
+		require.NoError(t, err)
+		user, err := us.FindUserBySession(context.Background(), token)
+		require.NoError(t, err)
+
+		_, err = db.Exec("UPDATE sessions SET expires_at = $1 WHERE id = $2", time.Now().Add(-time.Minute), user.SessionID)
+		require.NoError(t, err)
+
+		_, err = us.FindUserBySession(context.Background(), token)
+		assert.ErrorIs(t, err, service.ErrUserNotFound)
+	})
+
+	t.Run("rotated token keeps working during grace period", func(t *testing.T) {
+		token, err := ss.CreateSession(userID, "test-agent", "127.0.0.1")
+		require.NoError(t, err)
+		user, err := us.FindUserBySession(context.Background(), token)
+		require.NoError(t, err)
+
+		// Pretend the session was last renewed and rotated long ago
+		_, err = db.Exec("UPDATE sessions SET last_seen_at = $1, rotated_at = $1 WHERE id = $2", time.Now().Add(-48*time.Hour), user.SessionID)
+		require.NoError(t, err)
+
+		rotated, err := ss.RenewSession(user.SessionID, token)
+		require.NoError(t, err)
+		assert.NotEqual(t, token, rotated)
+
+		_, err = us.FindUserBySession(context.Background(), rotated)
+		require.NoError(t, err, "new token should work")
+		_, err = us.FindUserBySession(context.Background(), token)
+		require.NoError(t, err, "previous token should work during the grace period")
+	})
+
+	t.Run("deleted session is rejected", func(t *testing.T) {
+		token, err := ss.CreateSession(userID, "test-agent", "127.0.0.1")
+		require.NoError(t, err)
+		user, err := us.FindUserBySession(context.Background(), token)
+		require.NoError(t, err)
+
+		require.NoError(t, ss.DeleteSession(user.SessionID))
+		_, err = us.FindUserBySession(context.Background(), token)
+		assert.ErrorIs(t, err, service.ErrUserNotFound)
+	})
+}
+
+func TestIntegration_SessionManagement(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	us := service.NewUserService(newRepository(db), testutil.NewTestKeyring(t))
+	ss := service.NewSessionService(newRepository(db))
+
+	userID, err := us.UpsertIdentity(context.Background(), model.GitHubUser{ID: 2020, Login: "manager", Email: "manager@example.com"}.Identity(), &oauth2.Token{AccessToken: "token"})
+	require.NoError(t, err)
+	otherID, err := us.UpsertIdentity(context.Background(), model.GitHubUser{ID: 2021, Login: "other", Email: "other@example.com"}.Identity(), &oauth2.Token{AccessToken: "token"})
+	require.NoError(t, err)
+
+	current, err := ss.CreateSession(userID, "laptop", "10.0.0.1")
+	require.NoError(t, err)
+	_, err = ss.CreateSession(userID, "phone", "10.0.0.2")
+	require.NoError(t, err)
+	_, err = ss.CreateSession(userID, "tablet", "10.0.0.3")
+	require.NoError(t, err)
+	otherToken, err := ss.CreateSession(otherID, "desktop", "10.0.0.4")
+	require.NoError(t, err)
+
+	currentUser, err := us.FindUserBySession(context.Background(), current)
+	require.NoError(t, err)
+	otherUser, err := us.FindUserBySession(context.Background(), otherToken)
+	require.NoError(t, err)
+
+	sessions, err := ss.ListSessions(userID)
+	require.NoError(t, err)
+	require.Len(t, sessions, 3)
+
+	t.Run("cannot revoke another user's session", func(t *testing.T) {
+		err := ss.RevokeSession(userID, otherUser.SessionID)
+		assert.ErrorIs(t, err, service.ErrSessionNotFound)
+	})
+
+	t.Run("revokes a single session", func(t *testing.T) {
+		revokeID := sessions[0].ID
+		if revokeID == currentUser.SessionID {
+			revokeID = sessions[1].ID
+		}
+		require.NoError(t, ss.RevokeSession(userID, revokeID))
+		remaining, err := ss.ListSessions(userID)
+		require.NoError(t, err)
+		assert.Len(t, remaining, 2)
+	})
+
+	t.Run("signs out everywhere else", func(t *testing.T) {
+		revoked, err := ss.RevokeOtherSessions(userID, currentUser.SessionID)
+		require.NoError(t, err)
+		assert.Len(t, revoked, 1)
+
+		remaining, err := ss.ListSessions(userID)
+		require.NoError(t, err)
+		require.Len(t, remaining, 1)
+		assert.Equal(t, currentUser.SessionID, remaining[0].ID)
+
+		_, err = us.FindUserBySession(context.Background(), otherToken)
+		assert.NoError(t, err, "other users keep their sessions")
+	})
+}
+
+func TestIntegration_PersonalAccessTokens(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	us := service.NewUserService(newRepository(db), testutil.NewTestKeyring(t))
+	ts := service.NewTokenService(db)
+
+	userID, err := us.UpsertIdentity(context.Background(), model.GitHubUser{ID: 5151, Login: "botowner", Email: "bot@example.com"}.Identity(), &oauth2.Token{AccessToken: "gh_token"})
+	require.NoError(t, err)
+
+	rawToken, token, err := ts.CreateToken(userID, "deploy bot", model.Scopes{model.ScopeRead}, time.Hour)
+	require.NoError(t, err)
+
+	t.Run("authenticates with the raw token", func(t *testing.T) {
+		user, err := ts.FindUserByPersonalToken(rawToken)
+		require.NoError(t, err)
+		assert.Equal(t, userID, user.ID)
+		assert.Equal(t, token.ID, user.TokenID)
+		assert.Equal(t, model.Scopes{model.ScopeRead}, user.Scopes)
+
+		require.NoError(t, ts.TouchToken(user.TokenID))
+		tokens, err := ts.ListTokens(userID)
+		require.NoError(t, err)
+		require.Len(t, tokens, 1)
+		assert.NotNil(t, tokens[0].LastUsedAt)
+	})
+
+	t.Run("expired token is rejected", func(t *testing.T) {
+		expired, expiredToken, err := ts.CreateToken(userID, "old", model.Scopes{model.ScopeRead}, time.Hour)
+		require.NoError(t, err)
+		_, err = db.Exec("UPDATE personal_access_tokens SET expires_at = $1 WHERE id = $2", time.Now().Add(-time.Minute), expiredToken.ID)
+		require.NoError(t, err)
+
+		_, err = ts.FindUserByPersonalToken(expired)
+		assert.ErrorIs(t, err, service.ErrTokenNotFound)
+	})
+
+	t.Run("revoked token is rejected", func(t *testing.T) {
+		require.NoError(t, ts.RevokeToken(userID, token.ID))
+		_, err := ts.FindUserByPersonalToken(rawToken)
+		assert.ErrorIs(t, err, service.ErrTokenNotFound)
+	})
+}
+
+func TestIntegration_DeviceAuthorization(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	us := service.NewUserService(newRepository(db), testutil.NewTestKeyring(t))
+	ts := service.NewTokenService(db)
+	ds := service.NewDeviceService(db)
+
+	userID, err := us.UpsertIdentity(context.Background(), model.GitHubUser{ID: 6161, Login: "cliuser", Email: "cli@example.com"}.Identity(), &oauth2.Token{AccessToken: "gh_token"})
+	require.NoError(t, err)
+
+	authorization, err := ds.StartAuthorization("laptop")
+	require.NoError(t, err)
+
+	_, err = ds.ExchangeDeviceCode(authorization.DeviceCode)
+	assert.ErrorIs(t, err, service.ErrAuthorizationPending)
+
+	pending, err := ds.FindPendingAuthorization(strings.ToLower(authorization.UserCode))
+	require.NoError(t, err)
+	assert.Equal(t, "laptop", pending.ClientName)
+	require.NoError(t, ds.Approve(userID, authorization.UserCode))
+
+	// Pretend the device waited for the poll interval
+	_, err = db.Exec("UPDATE device_authorizations SET last_polled_at = $1 WHERE id = $2", time.Now().Add(-time.Minute), authorization.ID)
+	require.NoError(t, err)
+	rawToken, err := ds.ExchangeDeviceCode(authorization.DeviceCode)
+	require.NoError(t, err)
+
+	user, err := ts.FindUserByPersonalToken(rawToken)
+	require.NoError(t, err)
+	assert.Equal(t, userID, user.ID)
+	assert.Equal(t, service.DeviceScopes, user.Scopes)
+
+	t.Run("device code can only be exchanged once", func(t *testing.T) {
+		_, err = db.Exec("UPDATE device_authorizations SET last_polled_at = NULL WHERE id = $1", authorization.ID)
+		require.NoError(t, err)
+		_, err := ds.ExchangeDeviceCode(authorization.DeviceCode)
+		assert.ErrorIs(t, err, service.ErrExpiredToken)
+	})
+
+	t.Run("expired authorizations are purged", func(t *testing.T) {
+		purged, err := ds.PurgeExpired(time.Now())
+		require.NoError(t, err)
+		assert.Zero(t, purged, "authorizations are kept until they expire")
+		purged, err = ds.PurgeExpired(authorization.ExpiresAt.Add(time.Second))
+		require.NoError(t, err)
+		assert.Equal(t, 1, purged)
+		_, err = ds.ExchangeDeviceCode(authorization.DeviceCode)
+		assert.ErrorIs(t, err, service.ErrExpiredToken)
+		_, err = ts.FindUserByPersonalToken(rawToken)
+		assert.NoError(t, err, "the issued token outlives its authorization")
+	})
+}
+
+func TestIntegration_LinkIdentities(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	us := service.NewUserService(newRepository(db), testutil.NewTestKeyring(t))
+
+	personal := model.GitHubUser{ID: 9101, Login: "personal", Email: "me@example.com"}.Identity()
+	work := model.GitHubUser{ID: 9102, Login: "work", Email: "me@work.example.com"}.Identity()
+	other := model.GitHubUser{ID: 9103, Login: "someone", Email: "someone@example.com"}.Identity()
+
+	userID, err := us.UpsertIdentity(context.Background(), personal, &oauth2.Token{AccessToken: "token1"})
+	require.NoError(t, err)
+	otherID, err := us.UpsertIdentity(context.Background(), other, &oauth2.Token{AccessToken: "token3"})
+	require.NoError(t, err)
+
+	require.NoError(t, us.LinkIdentity(context.Background(), userID, work, &oauth2.Token{AccessToken: "token2"}))
+	require.NoError(t, us.LinkIdentity(context.Background(), userID, work, &oauth2.Token{AccessToken: "token2b"}), "relinking an own identity is a refresh")
+
+	t.Run("both identities sign in to the same account", func(t *testing.T) {
+		workUserID, err := us.UpsertIdentity(context.Background(), work, &oauth2.Token{AccessToken: "token2c"})
+		require.NoError(t, err)
+		assert.Equal(t, userID, workUserID)
+
+		identities, err := us.ListIdentities(context.Background(), userID)
+		require.NoError(t, err)
+		require.Len(t, identities, 2)
+		assert.Equal(t, "personal", identities[0].Username)
+		assert.Equal(t, "work", identities[1].Username)
+	})
+
+	t.Run("identity of another account is a conflict", func(t *testing.T) {
+		err := us.LinkIdentity(context.Background(), userID, other, &oauth2.Token{AccessToken: "token"})
+		assert.ErrorIs(t, err, service.ErrIdentityConflict)
+
+		identities, err := us.ListIdentities(context.Background(), otherID)
+		require.NoError(t, err)
+		assert.Len(t, identities, 1, "the other account keeps its identity")
+	})
+
+	t.Run("unlink keeps at least one identity", func(t *testing.T) {
+		identities, err := us.ListIdentities(context.Background(), userID)
+		require.NoError(t, err)
+		require.NoError(t, us.UnlinkIdentity(context.Background(), userID, identities[1].ID))
+		assert.ErrorIs(t, us.UnlinkIdentity(context.Background(), userID, identities[0].ID), service.ErrLastIdentity)
+		assert.ErrorIs(t, us.UnlinkIdentity(context.Background(), otherID, identities[0].ID), service.ErrIdentityNotFound)
+	})
+}
+
+func TestIntegration_TwoFactor(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	keys := testutil.NewTestKeyring(t)
+	us := service.NewUserService(newRepository(db), keys)
+	ws := service.NewWorkspaceService(db)
+	tfs := service.NewTwoFactorService(db, keys, ws)
+
+	adminID, err := us.UpsertIdentity(context.Background(), model.GitHubUser{ID: 9201, Login: "admin"}.Identity(), &oauth2.Token{AccessToken: "token1"})
+	require.NoError(t, err)
+	memberID, err := us.UpsertIdentity(context.Background(), model.GitHubUser{ID: 9202, Login: "member"}.Identity(), &oauth2.Token{AccessToken: "token2"})
+	require.NoError(t, err)
+
+	workspace, err := ws.CreateWorkspace(adminID, "Team")
+	require.NoError(t, err)
+	require.NoError(t, ws.InviteMember(adminID, workspace.ID, memberID, model.WorkspaceRoleAdmin))
+	assert.ErrorIs(t, ws.SetRequireTwoFactor(memberID, workspace.ID, true), service.ErrWorkspaceNotFound, "an invite does not grant its role")
+	require.NoError(t, ws.InviteMember(adminID, workspace.ID, memberID, model.WorkspaceRoleMember))
+
+	require.NoError(t, ws.SetRequireTwoFactor(adminID, workspace.ID, true))
+	needs, err := tfs.NeedsSecondFactor(memberID)
+	require.NoError(t, err)
+	assert.False(t, needs, "the policy does not apply before the invite is accepted")
+	invites, err := ws.ListInvites(memberID)
+	require.NoError(t, err)
+	require.Len(t, invites, 1)
+	assert.Equal(t, model.WorkspaceRoleMember, invites[0].Role)
+	workspaces, err := ws.ListWorkspaces(memberID)
+	require.NoError(t, err)
+	assert.Empty(t, workspaces)
+
+	require.NoError(t, ws.AcceptInvite(memberID, workspace.ID))
+	assert.ErrorIs(t, ws.AcceptInvite(memberID, workspace.ID), service.ErrInviteNotFound)
+	assert.ErrorIs(t, ws.SetRequireTwoFactor(memberID, workspace.ID, true), service.ErrNotWorkspaceAdmin)
+	needs, err = tfs.NeedsSecondFactor(memberID)
+	require.NoError(t, err)
+	assert.True(t, needs, "workspace policy forces enrollment")
+	withoutTwoFactor, err := ws.MembersWithoutTwoFactor(workspace.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []int{adminID, memberID}, withoutTwoFactor)
+
+	secret, _, err := tfs.BeginEnrollment(memberID, "member")
+	require.NoError(t, err)
+	code, err := totp.Code(secret, time.Now())
+	require.NoError(t, err)
+	recoveryCodes, err := tfs.ConfirmEnrollment(memberID, code)
+	require.NoError(t, err)
+	require.Len(t, recoveryCodes, service.RecoveryCodeCount)
+	withoutTwoFactor, err = ws.MembersWithoutTwoFactor(workspace.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []int{adminID}, withoutTwoFactor, "enrolled members stay signed in")
+
+	_, _, err = tfs.BeginEnrollment(memberID, "member")
+	assert.ErrorIs(t, err, service.ErrTwoFactorAlreadyEnabled)
+
+	t.Run("TOTP codes are single use", func(t *testing.T) {
+		assert.ErrorIs(t, tfs.Verify(memberID, code), service.ErrInvalidCode, "enrollment code cannot be replayed")
+		next, err := totp.Code(secret, time.Now().Add(totp.Period))
+		require.NoError(t, err)
+		require.NoError(t, tfs.Verify(memberID, next))
+		assert.ErrorIs(t, tfs.Verify(memberID, next), service.ErrInvalidCode)
+	})
+
+	t.Run("recovery codes are single use", func(t *testing.T) {
+		require.NoError(t, tfs.Verify(memberID, strings.ToUpper(recoveryCodes[0])))
+		assert.ErrorIs(t, tfs.Verify(memberID, recoveryCodes[0]), service.ErrInvalidCode)
+		status, err := tfs.Status(memberID)
+		require.NoError(t, err)
+		assert.True(t, status.Enabled)
+		assert.True(t, status.Required)
+		assert.Equal(t, service.RecoveryCodeCount-1, status.RecoveryCodesRemaining)
+	})
+
+	t.Run("required two-factor cannot be disabled", func(t *testing.T) {
+		assert.ErrorIs(t, tfs.Disable(memberID, recoveryCodes[1]), service.ErrTwoFactorRequired)
+		require.NoError(t, ws.SetRequireTwoFactor(adminID, workspace.ID, false))
+		require.NoError(t, tfs.Disable(memberID, recoveryCodes[1]))
+		needs, err := tfs.NeedsSecondFactor(memberID)
+		require.NoError(t, err)
+		assert.False(t, needs)
+	})
+
+	t.Run("login challenge locks after failed attempts", func(t *testing.T) {
+		token, err := tfs.CreateChallenge(adminID)
+		require.NoError(t, err)
+		userID, err := tfs.FindChallenge(token)
+		require.NoError(t, err)
+		assert.Equal(t, adminID, userID)
+		for i := 0; i < 5; i++ {
+			require.NoError(t, tfs.RecordFailedAttempt(token))
+		}
+		_, err = tfs.FindChallenge(token)
+		assert.ErrorIs(t, err, service.ErrTooManyChallengeAttempts)
+		require.NoError(t, tfs.DeleteChallenge(token))
+		_, err = tfs.FindChallenge(token)
+		assert.ErrorIs(t, err, service.ErrChallengeNotFound)
+	})
+}
+
+func TestIntegration_IdentityTokenRevocation(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	keys := testutil.NewTestKeyring(t)
+	us := service.NewUserService(newRepository(db), keys)
+	ss := service.NewSessionService(newRepository(db))
+
+	identity := model.GitHubUser{ID: 9301, Login: "expiring", Email: "expiring@example.com"}.Identity()
+	expiry := time.Now().Add(8 * time.Hour).Truncate(time.Second)
+	userID, err := us.UpsertIdentity(context.Background(), identity, &oauth2.Token{AccessToken: "token1", RefreshToken: "refresh1", Expiry: expiry})
+	require.NoError(t, err)
+	_, err = ss.CreateSession(userID, "browser", "192.0.2.1")
+	require.NoError(t, err)
+
+	identities, err := us.ListIdentities(context.Background(), userID)
+	require.NoError(t, err)
+	require.Len(t, identities, 1)
+	identityID := identities[0].ID
+
+	t.Run("stored token round trips", func(t *testing.T) {
+		identityToken, err := us.FindIdentityToken(context.Background(), userID, identityID)
+		require.NoError(t, err)
+		assert.Equal(t, "token1", identityToken.Token.AccessToken)
+		assert.Equal(t, "refresh1", identityToken.Token.RefreshToken)
+		assert.True(t, expiry.Equal(identityToken.Token.Expiry))
+
+		stale, err := us.IdentityTokensToVerify(context.Background(), model.ProviderGitHub, time.Now().Add(-time.Hour), 10)
+		require.NoError(t, err)
+		assert.Empty(t, stale, "a token stored at sign-in is fresh")
+		stale, err = us.IdentityTokensToVerify(context.Background(), model.ProviderGitHub, time.Now().Add(time.Minute), 10)
+		require.NoError(t, err)
+		assert.Len(t, stale, 1)
+	})
+
+	t.Run("revocation drops the token until the next sign-in", func(t *testing.T) {
+		_, err := us.MarkIdentityRevoked(context.Background(), identityID)
+		require.NoError(t, err)
+		_, err = us.MarkIdentityRevoked(context.Background(), identityID)
+		assert.ErrorIs(t, err, service.ErrIdentityNotFound)
+
+		identityToken, err := us.FindIdentityToken(context.Background(), userID, identityID)
+		require.NoError(t, err)
+		assert.Nil(t, identityToken.Token)
+
+		_, err = us.UpsertIdentity(context.Background(), identity, &oauth2.Token{AccessToken: "token2"})
+		require.NoError(t, err)
+		identities, err := us.ListIdentities(context.Background(), userID)
+		require.NoError(t, err)
+		assert.Nil(t, identities[0].RevokedAt, "signing in again grants access again")
+	})
+}
+
+func TestIntegration_Messages(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	repository := newRepository(db)
+	us := service.NewUserService(repository, testutil.NewTestKeyring(t))
+	alice, err := us.UpsertIdentity(context.Background(), model.GitHubUser{ID: 7171, Login: "alice"}.Identity(), &oauth2.Token{AccessToken: "gh_token"})
+	require.NoError(t, err)
+	bob, err := us.UpsertIdentity(context.Background(), model.GitHubUser{ID: 7172, Login: "bob"}.Identity(), &oauth2.Token{AccessToken: "gh_token"})
+	require.NoError(t, err)
+
+	start := time.Now().Add(-time.Hour)
+	for i, text := range []string{"hi bob", "hi alice", "how are you?"} {
+		from, to := alice, bob
+		if i%2 == 1 {
+			from, to = bob, alice
+		}
+		message := model.Message{FromUserID: from, ToUserId: to, TextContent: text, Time: start.Add(time.Duration(i) * time.Minute)}
+		require.NoError(t, repository.SaveMessage(&message))
+		assert.NotZero(t, message.ID)
+	}
+
+	conversation, err := repository.ListConversation(bob, alice, time.Now(), 2)
+	require.NoError(t, err)
+	require.Len(t, conversation, 2)
+	assert.Equal(t, "how are you?", conversation[0].TextContent, "newest first")
+	assert.Equal(t, "hi alice", conversation[1].TextContent)
+
+	older, err := repository.ListConversation(alice, bob, conversation[1].Time, 10)
+	require.NoError(t, err)
+	require.Len(t, older, 1)
+	assert.Equal(t, "hi bob", older[0].TextContent)
+}
+
+func TestIntegration_Retention(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	repository := newRepository(db)
+	us := service.NewUserService(repository, testutil.NewTestKeyring(t))
+	admin, err := us.UpsertIdentity(context.Background(), model.GitHubUser{ID: 9101, Login: "admin"}.Identity(), &oauth2.Token{AccessToken: "token"})
+	require.NoError(t, err)
+	member, err := us.UpsertIdentity(context.Background(), model.GitHubUser{ID: 9102, Login: "member"}.Identity(), &oauth2.Token{AccessToken: "token"})
+	require.NoError(t, err)
+	other, err := us.UpsertIdentity(context.Background(), model.GitHubUser{ID: 9103, Login: "other"}.Identity(), &oauth2.Token{AccessToken: "token"})
+	require.NoError(t, err)
+
+	for _, message := range []model.Message{
+		{FromUserID: admin, ToUserId: member, TextContent: "expired", Time: time.Now().Add(-40 * 24 * time.Hour)},
+		{FromUserID: member, ToUserId: admin, TextContent: "recent", Time: time.Now()},
+		{FromUserID: other, ToUserId: admin, TextContent: "archived", Time: time.Now().Add(-2 * 24 * time.Hour)},
+	} {
+		require.NoError(t, repository.SaveMessage(&message))
+	}
+
+	rs := service.NewRetentionService(repository, us, model.RetentionPolicy{MaxAge: 30 * 24 * time.Hour}, []int{admin})
+	require.NoError(t, rs.SetConversationPolicy(context.Background(), admin, model.NewConversation(admin, other), model.RetentionPolicy{MaxAge: 24 * time.Hour, Archive: true}))
+
+	policies, err := rs.ListConversationPolicies(admin)
+	require.NoError(t, err)
+	require.Len(t, policies, 2)
+	assert.False(t, policies[0].Override)
+	assert.True(t, policies[1].Override)
+
+	run, err := rs.Purge(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, run.Deleted)
+	assert.Equal(t, 1, run.Archived)
+
+	var archived string
+	require.NoError(t, db.QueryRow("SELECT text_content FROM archived_messages").Scan(&archived))
+	assert.Equal(t, "archived", archived)
+	remaining, err := repository.ListConversation(admin, member, time.Now().Add(time.Minute), 10)
+	require.NoError(t, err)
+	require.Len(t, remaining, 1)
+	assert.Equal(t, "recent", remaining[0].TextContent)
+
+	runs, err := rs.ListPurgeRuns(admin)
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	assert.Equal(t, run.ID, runs[0].ID)
+}
+
+func TestIntegration_Exports(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	repository := newRepository(db)
+	us := service.NewUserService(repository, testutil.NewTestKeyring(t))
+	alice, err := us.UpsertIdentity(context.Background(), model.GitHubUser{ID: 9201, Login: "alice"}.Identity(), &oauth2.Token{AccessToken: "token"})
+	require.NoError(t, err)
+	bob, err := us.UpsertIdentity(context.Background(), model.GitHubUser{ID: 9202, Login: "bob"}.Identity(), &oauth2.Token{AccessToken: "token"})
+	require.NoError(t, err)
+	for _, message := range []model.Message{
+		{FromUserID: alice, ToUserId: bob, TextContent: "hello", Time: time.Now().Add(-time.Minute)},
+		{FromUserID: bob, ToUserId: alice, TextContent: "hi alice", Time: time.Now()},
+	} {
+		require.NoError(t, repository.SaveMessage(&message))
+	}
+
+	es := service.NewExportService(repository, repository, us, t.TempDir())
+	export, err := es.RequestExport(alice, model.ExportFormatNDJSON)
+	require.NoError(t, err)
+	require.NoError(t, es.ProcessExports(context.Background()))
+
+	file, export, err := es.OpenExport(alice, export.ID)
+	require.NoError(t, err)
+	defer file.Close()
+	assert.Equal(t, 2, export.Total)
+	assert.Equal(t, 2, export.Exported)
+	require.NotNil(t, export.FinishedAt)
+	content, err := io.ReadAll(file)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `"username":"alice"`)
+	assert.Contains(t, lines[1], `"text":"hi alice"`)
+
+	exports, err := es.ListExports(bob)
+	require.NoError(t, err)
+	assert.Empty(t, exports)
+}
+
+func TestIntegration_SlackImport(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	repository := newRepository(db)
+	us := service.NewUserService(repository, testutil.NewTestKeyring(t))
+	alice, err := us.UpsertIdentity(context.Background(), model.Identity{Provider: "github", Subject: "9301", Username: "alice", Email: "alice@example.com", EmailVerified: true}, &oauth2.Token{AccessToken: "token"})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for name, content := range map[string]string{
+		"users.json":    `[{"id": "U1", "name": "alice", "profile": {"email": "alice@example.com"}}, {"id": "U2", "name": "bob", "profile": {}}]`,
+		"dms.json":      `[{"id": "D1", "members": ["U1", "U2"]}]`,
+		"channels.json": `[{"id": "C1", "name": "general", "created": 1600000000, "members": ["U1", "U2"]}]`,
+		"general/2021-01-07.json": `[
+			{"type": "message", "user": "U2", "text": "welcome", "ts": "1610000200.000000", "thread_ts": "1610000000.000200"},
+			{"type": "message", "user": "U1", "text": "hello all", "ts": "1610000000.000200", "thread_ts": "1610000000.000200"}
+		]`,
+		"D1/2021-01-07.json": `[
+			{"type": "message", "user": "U1", "text": "question", "ts": "1610000000.000100", "thread_ts": "1610000000.000100"},
+			{"type": "message", "user": "U2", "text": "answer", "ts": "1610000100.000000", "thread_ts": "1610000000.000100"}
+		]`,
+	} {
+		w, err := archive.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, archive.Close())
+	reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+
+	importer := service.NewSlackImporter(repository, repository, repository)
+	result, err := importer.Import(context.Background(), reader)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Rooms)
+	assert.Equal(t, 4, result.Messages)
+	assert.Equal(t, 1, result.UsersMatched)
+	assert.Equal(t, 1, result.UsersCreated)
+
+	messages, err := repository.ListUserMessages(alice, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	assert.True(t, time.Unix(1610000000, 100000).Equal(messages[0].Time))
+	assert.Equal(t, messages[0].ID, messages[1].ReplyToID)
+
+	rooms, err := repository.ListRooms(alice)
+	require.NoError(t, err)
+	require.Len(t, rooms, 1)
+	assert.Equal(t, "general", rooms[0].Name)
+	roomMessages, err := repository.ListRoomMessages(rooms[0].ID, time.Now(), 10)
+	require.NoError(t, err)
+	require.Len(t, roomMessages, 2)
+	assert.True(t, time.Unix(1610000200, 0).Equal(roomMessages[0].Time))
+	assert.Equal(t, roomMessages[1].ID, roomMessages[0].ReplyToID)
+
+	result, err = importer.Import(context.Background(), reader)
+	require.NoError(t, err)
+	assert.Equal(t, 4, result.Duplicates)
+	assert.Zero(t, result.Messages)
+}
+
+func TestIntegration_Migrations(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	migrator, err := migrations.New(db, testDriver)
+	require.NoError(t, err)
+	all, err := migrations.Load(testDriver)
+	require.NoError(t, err)
+
+	applied, err := migrator.Up(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, applied, "setupTestDB already migrated")
+
+	t.Run("every migration reverts and reapplies", func(t *testing.T) {
+		reverted, err := migrator.Down(ctx, len(all))
+		require.NoError(t, err)
+		assert.Len(t, reverted, len(all))
+
+		countTables := `
+			SELECT COUNT(*) FROM information_schema.tables
+			WHERE table_schema = 'public' AND table_name <> 'schema_migrations'
+		`
+		if testDriver == database.SQLite {
+			countTables = `
+				SELECT COUNT(*) FROM sqlite_master
+				WHERE type = 'table' AND name NOT IN ('schema_migrations', 'sqlite_sequence')
+			`
+		}
+		var tables int
+		require.NoError(t, db.QueryRow(countTables).Scan(&tables))
+		assert.Zero(t, tables, "down migrations should drop every table")
+
+		applied, err := migrator.Up(ctx)
+		require.NoError(t, err)
+		assert.Len(t, applied, len(all))
+	})
+
+	t.Run("concurrent runs apply each migration once", func(t *testing.T) {
+		_, err := migrator.Down(ctx, 2)
+		require.NoError(t, err)
+
+		results := make(chan int, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				applied, err := migrator.Up(ctx)
+				assert.NoError(t, err)
+				results <- len(applied)
+			}()
+		}
+		assert.Equal(t, 2, <-results+<-results)
+
+		statuses, err := migrator.Status(ctx)
+		require.NoError(t, err)
+		for _, status := range statuses {
+			assert.NotNil(t, status.AppliedAt, "migration %d should be applied", status.Version)
+		}
+	})
 }
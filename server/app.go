@@ -1,8 +1,14 @@
 package main
 
 import (
+	"cito/server/config"
+	"cito/server/database"
 	"cito/server/handler"
+	"cito/server/messager"
+	"cito/server/metrics"
 	"cito/server/middleware"
+	"cito/server/migrations"
+	"cito/server/model"
 	"cito/server/service"
 	"database/sql"
 	"net/http"
@@ -15,34 +21,187 @@ type HTTPClient interface {
 
 type App struct {
 	userService      *service.UserService
+	sessionService   *service.SessionService
+	tokenService     *service.TokenService
+	deviceService    *service.DeviceService
 	authService      *service.AuthService
-	oauthHandler     *handler.OAuthHandler
-	webSocketHandler *handler.WebSocketHandler
+	workspaceService *service.WorkspaceService
+	twoFactorService *service.TwoFactorService
+	// identityTokenService verifies provider tokens in the background
+	identityTokenService *service.IdentityTokenService
+	retentionService     *service.RetentionService
+	exportService        *service.ExportService
+	accountService       *service.AccountService
+	hub                  *messager.HubManager
+	oauthHandler         *handler.OAuthHandler
+	sessionHandler       *handler.SessionHandler
+	tokenHandler         *handler.TokenHandler
+	deviceHandler        *handler.DeviceHandler
+	accountHandler       *handler.AccountHandler
+	twoFactorHandler     *handler.TwoFactorHandler
+	workspaceHandler     *handler.WorkspaceHandler
+	webSocketHandler     *handler.WebSocketHandler
+	retentionHandler     *handler.RetentionHandler
+	exportHandler        *handler.ExportHandler
+	roomHandler          *handler.RoomHandler
+	healthHandler        *handler.HealthHandler
 }
 
-func NewApp(oauthConfig service.OAuth2TokenExchanger, db *sql.DB) *App {
-	userService := service.NewUserService(db)
-	authService := service.NewAuthService(oauthConfig, &http.Client{})
-	oauthHandler := handler.NewOAuthHandler(authService, userService)
-	webSocketHandler := handler.NewWebSocketHandler()
-	return &App{
-		userService:      userService,
-		authService:      authService,
-		oauthHandler:     oauthHandler,
-		webSocketHandler: webSocketHandler,
+// newRepository returns the repository of the database driver
+func newRepository(db *sql.DB, driver string) service.Repository {
+	if driver == database.SQLite {
+		return service.NewSQLiteRepository(db)
+	}
+	return service.NewPostgresRepository(db)
+}
+
+// NewApp wires the services and handlers with the settings of cfg, which
+// has been validated. migrator tells readiness probes whether the schema is
+// up to date.
+func NewApp(authService *service.AuthService, db *sql.DB, migrator *migrations.Migrator, cfg *config.Config) (*App, error) {
+	tokenKeys, err := cfg.TokenKeys()
+	if err != nil {
+		return nil, err
+	}
+	// adminIDs are the users allowed to manage server-wide settings such as
+	// message retention
+	adminIDs, err := cfg.AdminIDs()
+	if err != nil {
+		return nil, err
+	}
+	retention, err := cfg.RetentionPolicy()
+	if err != nil {
+		return nil, err
 	}
+	deletionPolicy, err := cfg.DeletionPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	repository := newRepository(db, cfg.Database.Driver)
+	userService := service.NewUserService(repository, tokenKeys)
+	sessionService := service.NewSessionService(repository)
+	sessionService.SetLifetimes(cfg.Sessions.TTL, cfg.Sessions.RotateInterval)
+	tokenService := service.NewTokenService(db)
+	deviceService := service.NewDeviceService(db)
+	workspaceService := service.NewWorkspaceService(db)
+	twoFactorService := service.NewTwoFactorService(db, tokenKeys, workspaceService)
+	oauthHandler := handler.NewOAuthHandler(authService, userService, sessionService, twoFactorService)
+	hub := messager.NewHubManager(repository, cfg.Hub.MessageBuffer)
+	go hub.Run()
+	sessionHandler := handler.NewSessionHandler(sessionService, hub)
+	tokenHandler := handler.NewTokenHandler(tokenService, hub)
+	deviceHandler := handler.NewDeviceHandler(deviceService)
+	identityTokenService := service.NewIdentityTokenService(authService, userService, sessionService, tokenService, hub.DisconnectUser)
+	exportService := service.NewExportService(repository, repository, userService, cfg.Exports.Dir)
+	accountService := service.NewAccountService(repository, userService, sessionService, tokenService, workspaceService,
+		twoFactorService, exportService, deletionPolicy, hub.DisconnectUser)
+	accountHandler := handler.NewAccountHandler(authService, userService, identityTokenService, accountService)
+	twoFactorHandler := handler.NewTwoFactorHandler(twoFactorService, sessionService, userService)
+	workspaceHandler := handler.NewWorkspaceHandler(workspaceService, sessionService, tokenService, hub)
+	webSocketHandler := handler.NewWebSocketHandler(hub, cfg.Hub.ReadBufferSize, cfg.Hub.WriteBufferSize)
+	retentionService := service.NewRetentionService(repository, userService, retention, adminIDs)
+	retentionHandler := handler.NewRetentionHandler(retentionService)
+	exportHandler := handler.NewExportHandler(exportService)
+	roomHandler := handler.NewRoomHandler(service.NewRoomService(repository))
+	healthHandler := handler.NewHealthHandler(db, hub, migrator)
+	return &App{
+		userService:          userService,
+		sessionService:       sessionService,
+		tokenService:         tokenService,
+		deviceService:        deviceService,
+		authService:          authService,
+		workspaceService:     workspaceService,
+		twoFactorService:     twoFactorService,
+		identityTokenService: identityTokenService,
+		retentionService:     retentionService,
+		exportService:        exportService,
+		accountService:       accountService,
+		hub:                  hub,
+		oauthHandler:         oauthHandler,
+		sessionHandler:       sessionHandler,
+		tokenHandler:         tokenHandler,
+		deviceHandler:        deviceHandler,
+		accountHandler:       accountHandler,
+		twoFactorHandler:     twoFactorHandler,
+		workspaceHandler:     workspaceHandler,
+		webSocketHandler:     webSocketHandler,
+		retentionHandler:     retentionHandler,
+		exportHandler:        exportHandler,
+		roomHandler:          roomHandler,
+		healthHandler:        healthHandler,
+	}, nil
 }
 
 func (app *App) RegisterRoutes(mux *http.ServeMux) {
 
-	checkAuthMiddleware := middleware.MakeAuthMiddleware(app.userService)
+	checkAuthMiddleware := middleware.MakeAuthMiddleware(app.userService, app.sessionService)
+	apiAuthMiddleware := middleware.MakeAPIAuthMiddleware(app.userService, app.sessionService, app.tokenService)
+	// api wraps an API handler with bearer or cookie auth and a required scope
+	api := func(scope model.TokenScope, h http.HandlerFunc) http.Handler {
+		return middleware.LoggingMiddleware(apiAuthMiddleware(middleware.RequireScope(scope)(h)))
+	}
+
+	// probes and metrics, left out of the request log
+	mux.HandleFunc("GET /healthz", app.healthHandler.LivenessHandler)
+	mux.HandleFunc("GET /readyz", app.healthHandler.ReadinessHandler)
+	mux.Handle("GET /metrics", metrics.Handler())
 
 	// public
-	mux.Handle("/ws", middleware.LoggingMiddleware(checkAuthMiddleware(http.HandlerFunc(app.webSocketHandler.Handler))))
+	mux.Handle("/ws", api(model.ScopeWrite, app.webSocketHandler.Handler))
 	// auth handlers
 	mux.Handle("/login", middleware.LoggingMiddleware(http.HandlerFunc(app.oauthHandler.LoginHandler)))
 	mux.Handle("/oauth2/callback", middleware.LoggingMiddleware(http.HandlerFunc(app.oauthHandler.CallBackHandler)))
+	mux.Handle("/oauth2/callback/{provider}", middleware.LoggingMiddleware(http.HandlerFunc(app.oauthHandler.CallBackHandler)))
+	// second factor step between the OAuth callback and the session
+	mux.Handle("GET /2fa", middleware.LoggingMiddleware(http.HandlerFunc(app.twoFactorHandler.ChallengePageHandler)))
+	mux.Handle("POST /2fa", middleware.LoggingMiddleware(http.HandlerFunc(app.twoFactorHandler.ChallengeHandler)))
+	mux.Handle("POST /logout", middleware.LoggingMiddleware(checkAuthMiddleware(http.HandlerFunc(app.sessionHandler.LogoutHandler))))
+	// device login for the CLI: the device polls, the user approves in the browser
+	mux.Handle("POST /device/code", middleware.LoggingMiddleware(http.HandlerFunc(app.deviceHandler.CodeHandler)))
+	mux.Handle("POST /device/token", middleware.LoggingMiddleware(http.HandlerFunc(app.deviceHandler.TokenHandler)))
+	mux.Handle("GET /device", middleware.LoggingMiddleware(checkAuthMiddleware(http.HandlerFunc(app.deviceHandler.PageHandler))))
+	mux.Handle("POST /device", middleware.LoggingMiddleware(checkAuthMiddleware(http.HandlerFunc(app.deviceHandler.DecisionHandler))))
+
+	// api handlers, usable with personal access tokens
+	mux.Handle("GET /api/sessions", api(model.ScopeRead, app.sessionHandler.ListSessionsHandler))
+	mux.Handle("POST /api/sessions/revoke-others", api(model.ScopeAdmin, app.sessionHandler.RevokeOtherSessionsHandler))
+	mux.Handle("DELETE /api/sessions/{id}", api(model.ScopeAdmin, app.sessionHandler.RevokeSessionHandler))
+	mux.Handle("GET /api/tokens", api(model.ScopeRead, app.tokenHandler.ListTokensHandler))
+	mux.Handle("POST /api/tokens", api(model.ScopeAdmin, app.tokenHandler.CreateTokenHandler))
+	mux.Handle("DELETE /api/tokens/{id}", api(model.ScopeAdmin, app.tokenHandler.RevokeTokenHandler))
+	mux.Handle("GET /api/identities", api(model.ScopeRead, app.accountHandler.ListIdentitiesHandler))
+	mux.Handle("DELETE /api/identities/{id}", api(model.ScopeAdmin, app.accountHandler.UnlinkIdentityHandler))
+	mux.Handle("POST /api/identities/{id}/verify", api(model.ScopeWrite, app.accountHandler.VerifyIdentityHandler))
+	mux.Handle("GET /api/account/data", api(model.ScopeRead, app.accountHandler.PersonalDataHandler))
+	mux.Handle("DELETE /api/account", api(model.ScopeAdmin, app.accountHandler.DeleteAccountHandler))
+	mux.Handle("GET /api/2fa", api(model.ScopeRead, app.twoFactorHandler.StatusHandler))
+	mux.Handle("POST /api/2fa/enroll", api(model.ScopeAdmin, app.twoFactorHandler.EnrollHandler))
+	mux.Handle("POST /api/2fa/confirm", api(model.ScopeAdmin, app.twoFactorHandler.ConfirmHandler))
+	mux.Handle("POST /api/2fa/recovery-codes", api(model.ScopeAdmin, app.twoFactorHandler.RecoveryCodesHandler))
+	mux.Handle("POST /api/2fa/disable", api(model.ScopeAdmin, app.twoFactorHandler.DisableHandler))
+	mux.Handle("GET /api/workspaces", api(model.ScopeRead, app.workspaceHandler.ListWorkspacesHandler))
+	mux.Handle("POST /api/workspaces", api(model.ScopeAdmin, app.workspaceHandler.CreateWorkspaceHandler))
+	mux.Handle("POST /api/workspaces/{id}/members", api(model.ScopeAdmin, app.workspaceHandler.InviteMemberHandler))
+	mux.Handle("GET /api/workspaces/invites", api(model.ScopeRead, app.workspaceHandler.ListInvitesHandler))
+	mux.Handle("POST /api/workspaces/{id}/invite", api(model.ScopeAdmin, app.workspaceHandler.AcceptInviteHandler))
+	mux.Handle("DELETE /api/workspaces/{id}/invite", api(model.ScopeAdmin, app.workspaceHandler.DeclineInviteHandler))
+	mux.Handle("PUT /api/workspaces/{id}/two-factor", api(model.ScopeAdmin, app.workspaceHandler.TwoFactorPolicyHandler))
+	mux.Handle("GET /api/exports", api(model.ScopeRead, app.exportHandler.ListExportsHandler))
+	mux.Handle("POST /api/exports", api(model.ScopeRead, app.exportHandler.CreateExportHandler))
+	mux.Handle("GET /api/exports/{id}", api(model.ScopeRead, app.exportHandler.ExportHandler))
+	mux.Handle("GET /api/exports/{id}/download", api(model.ScopeRead, app.exportHandler.DownloadHandler))
+	mux.Handle("GET /api/rooms", api(model.ScopeRead, app.roomHandler.ListRoomsHandler))
+	mux.Handle("GET /api/rooms/{id}/messages", api(model.ScopeRead, app.roomHandler.RoomMessagesHandler))
+	// server admin handlers
+	mux.Handle("GET /api/admin/retention", api(model.ScopeRead, app.retentionHandler.PoliciesHandler))
+	mux.Handle("PUT /api/admin/retention/conversations/{user_id}/{other_user_id}", api(model.ScopeAdmin, app.retentionHandler.SetConversationPolicyHandler))
+	mux.Handle("DELETE /api/admin/retention/conversations/{user_id}/{other_user_id}", api(model.ScopeAdmin, app.retentionHandler.ClearConversationPolicyHandler))
+	mux.Handle("GET /api/admin/retention/runs", api(model.ScopeRead, app.retentionHandler.PurgeRunsHandler))
 
 	// secure handlers
+	mux.Handle("GET /sessions", middleware.LoggingMiddleware(checkAuthMiddleware(http.HandlerFunc(app.sessionHandler.SessionsPageHandler))))
+	mux.Handle("GET /account", middleware.LoggingMiddleware(checkAuthMiddleware(http.HandlerFunc(app.accountHandler.AccountPageHandler))))
+	mux.Handle("POST /account/link", middleware.LoggingMiddleware(checkAuthMiddleware(http.HandlerFunc(app.accountHandler.LinkHandler))))
 	mux.Handle("/", middleware.LoggingMiddleware(checkAuthMiddleware(http.HandlerFunc(handler.HomeHandler))))
 }
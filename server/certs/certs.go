@@ -0,0 +1,106 @@
+// Package certs serves a TLS certificate that can be replaced while the
+// server runs, without dropping established connections
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reloader keeps the certificate of a certificate and key file pair, read
+// again on Reload or when the files change. New handshakes get the latest
+// certificate, established connections keep theirs.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+	// mu serializes reloads
+	mu sync.Mutex
+	// modTime is when the files loaded last were changed
+	modTime time.Time
+}
+
+// NewReloader loads the certificate of certFile and keyFile
+func NewReloader(certFile string, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files again. The current certificate is kept when they
+// don't hold a valid pair, such as while they are being replaced.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert.Store(&cert)
+	r.modTime = modTime
+
+	slog.Info("Loaded TLS certificate", "file", r.certFile, "subject", cert.Leaf.Subject.String(), "expires_at", cert.Leaf.NotAfter)
+	return nil
+}
+
+// filesModTime is when either file was changed last
+func (r *Reloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// changed reports whether the files were changed since they were loaded
+func (r *Reloader) changed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	modTime, err := r.filesModTime()
+	return err == nil && !modTime.Equal(r.modTime)
+}
+
+// GetCertificate hands the current certificate to TLS handshakes, as
+// tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// Run reloads the certificate when the files change, checking every
+// interval, until ctx is done. A failed reload is tried again on the next
+// check.
+func (r *Reloader) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !r.changed() {
+			continue
+		}
+		if err := r.Reload(); err != nil {
+			slog.Error("Failed to reload TLS certificate", "file", r.certFile, "error", err)
+		}
+	}
+}
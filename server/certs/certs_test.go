@@ -0,0 +1,90 @@
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeCertificate writes a self-signed certificate for name and its key to
+// dir, and returns their paths
+func writeCertificate(t *testing.T, dir string, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+// commonName is the subject of the certificate handshakes get
+func commonName(t *testing.T, r *Reloader) string {
+	cert, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestReloader_Reload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir, "old.example.com")
+	r, err := NewReloader(certFile, keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, "old.example.com", commonName(t, r))
+
+	writeCertificate(t, dir, "new.example.com")
+	require.NoError(t, r.Reload())
+	assert.Equal(t, "new.example.com", commonName(t, r))
+
+	require.NoError(t, os.WriteFile(keyFile, []byte("half written"), 0o600))
+	assert.Error(t, r.Reload())
+	assert.Equal(t, "new.example.com", commonName(t, r), "an invalid pair keeps the current certificate")
+}
+
+func TestNewReloader_MissingFiles(t *testing.T) {
+	_, err := NewReloader(filepath.Join(t.TempDir(), "cert.pem"), filepath.Join(t.TempDir(), "key.pem"))
+	assert.Error(t, err)
+}
+
+func TestReloader_RunReloadsChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertificate(t, dir, "old.example.com")
+	r, err := NewReloader(certFile, keyFile)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx, 10*time.Millisecond)
+
+	writeCertificate(t, dir, "new.example.com")
+	// Coarse file system clocks may give the new files the old time
+	later := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(certFile, later, later))
+
+	assert.Eventually(t, func() bool {
+		return r.cert.Load().Leaf.Subject.CommonName == "new.example.com"
+	}, time.Second, 10*time.Millisecond)
+}
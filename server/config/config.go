@@ -0,0 +1,532 @@
+// Package config loads the server settings from a YAML file, environment
+// variables and command line flags, in increasing order of precedence
+package config
+
+import (
+	"cito/server/database"
+	"cito/server/keyring"
+	"cito/server/logging"
+	"cito/server/messager"
+	"cito/server/model"
+	"cito/server/service"
+	"cito/server/tracing"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileEnv names the environment variable pointing at the configuration file,
+// which the -config flag overrides
+const FileEnv = "CITO_CONFIG"
+
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	Database  DatabaseConfig  `yaml:"database"`
+	GitHub    GitHubConfig    `yaml:"github"`
+	OIDC      OIDCConfig      `yaml:"oidc"`
+	Security  SecurityConfig  `yaml:"security"`
+	Sessions  SessionsConfig  `yaml:"sessions"`
+	Hub       HubConfig       `yaml:"hub"`
+	Retention RetentionConfig `yaml:"retention"`
+	Exports   ExportsConfig   `yaml:"exports"`
+	Accounts  AccountsConfig  `yaml:"accounts"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+	Log       LogConfig       `yaml:"log"`
+}
+
+type ServerConfig struct {
+	Addr string `yaml:"addr"`
+	// ShutdownTimeout bounds the wait for requests and queued messages on
+	// SIGINT or SIGTERM
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// ShutdownDelay is how long /readyz fails before connections close, so
+	// that load balancers stop sending clients first
+	ShutdownDelay time.Duration `yaml:"shutdown_delay"`
+	// TLS is served when both files are set, they are read again on SIGHUP
+	// or when they change
+	TLSCertFile string `yaml:"tls_cert_file"`
+	TLSKeyFile  string `yaml:"tls_key_file"`
+	// HTTPRedirectAddr serves redirects from plain HTTP to HTTPS, when TLS is
+	// on
+	HTTPRedirectAddr string `yaml:"http_redirect_addr"`
+}
+
+type DatabaseConfig struct {
+	// Driver is database.Postgres or database.SQLite, which keeps everything
+	// in the Path file
+	Driver   string `yaml:"driver"`
+	Path     string `yaml:"path"`
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Name     string `yaml:"name"`
+	SSLMode  string `yaml:"sslmode"`
+
+	MaxOpenConns    int           `yaml:"max_open_conns"`
+	MaxIdleConns    int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time"`
+}
+
+type GitHubConfig struct {
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	RedirectURL  string `yaml:"redirect_url"`
+	// APIURL points at a GitHub Enterprise server instead of github.com
+	APIURL string `yaml:"api_url"`
+}
+
+// OIDCConfig sets up an OpenID Connect provider next to GitHub, when Issuer
+// is set
+type OIDCConfig struct {
+	Issuer       string `yaml:"issuer"`
+	Name         string `yaml:"name"`
+	DisplayName  string `yaml:"display_name"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	RedirectURL  string `yaml:"redirect_url"`
+}
+
+type SecurityConfig struct {
+	// AccessTokenKeys encrypt identity provider access tokens at rest,
+	// "version:base64key" entries with the current key first
+	AccessTokenKeys string `yaml:"access_token_keys"`
+	// AdminUserIDs are the comma separated IDs of the users administering
+	// the server
+	AdminUserIDs string `yaml:"admin_user_ids"`
+}
+
+type SessionsConfig struct {
+	TTL            time.Duration `yaml:"ttl"`
+	RotateInterval time.Duration `yaml:"rotate_interval"`
+}
+
+type HubConfig struct {
+	// MessageBuffer is how many routed messages may wait to be delivered
+	MessageBuffer int `yaml:"message_buffer"`
+	// ReadBufferSize and WriteBufferSize are the sizes in bytes of the
+	// buffers of each websocket connection
+	ReadBufferSize  int `yaml:"read_buffer_size"`
+	WriteBufferSize int `yaml:"write_buffer_size"`
+}
+
+type RetentionConfig struct {
+	// MaxAge is how long messages are kept, such as "90d", forever when
+	// empty
+	MaxAge  string `yaml:"max_age"`
+	Archive bool   `yaml:"archive"`
+}
+
+type ExportsConfig struct {
+	// Dir keeps conversation exports until downloaded or expired
+	Dir string `yaml:"dir"`
+}
+
+type AccountsConfig struct {
+	// Deletion is model.DeletionPlaceholder or model.DeletionHard
+	Deletion string `yaml:"deletion"`
+}
+
+type TracingConfig struct {
+	// Exporter is tracing.ExporterOTLP or tracing.ExporterStdout, tracing is
+	// off when empty
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the OTLP/HTTP collector URL, such as
+	// http://localhost:4318, the OTEL_EXPORTER_OTLP_* variables apply when
+	// empty
+	Endpoint string `yaml:"endpoint"`
+	// SampleRatio is the share of new traces recorded
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+type LogConfig struct {
+	// Level is the least severe level logged: debug, info, warn or error
+	Level string `yaml:"level"`
+	// Format is logging.FormatText or logging.FormatJSON
+	Format string `yaml:"format"`
+}
+
+// Default returns the settings used when nothing else is set
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{Addr: ":8080", ShutdownTimeout: 30 * time.Second, ShutdownDelay: 5 * time.Second},
+		Database: DatabaseConfig{
+			Driver:          database.Postgres,
+			Host:            "localhost",
+			Port:            5432,
+			SSLMode:         "disable",
+			MaxOpenConns:    25,
+			MaxIdleConns:    5,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnMaxIdleTime: 5 * time.Minute,
+		},
+		OIDC:     OIDCConfig{Name: "oidc", DisplayName: "single sign-on"},
+		Sessions: SessionsConfig{TTL: service.SessionTTL, RotateInterval: service.SessionRotateInterval},
+		Hub: HubConfig{
+			MessageBuffer:   messager.DefaultMessageBuffer,
+			ReadBufferSize:  messager.DefaultBufferSize,
+			WriteBufferSize: messager.DefaultBufferSize,
+		},
+		Exports:  ExportsConfig{Dir: filepath.Join(os.TempDir(), "cito-exports")},
+		Accounts: AccountsConfig{Deletion: string(model.DeletionPlaceholder)},
+		Tracing:  TracingConfig{SampleRatio: 1},
+		Log:      LogConfig{Level: "info", Format: logging.FormatText},
+	}
+}
+
+// env maps each flag to the environment variable setting it
+var env = map[string]string{
+	"server.addr":                 "SERVER_ADDR",
+	"server.shutdown_timeout":     "SHUTDOWN_TIMEOUT",
+	"server.shutdown_delay":       "SHUTDOWN_DELAY",
+	"server.tls_cert_file":        "TLS_CERT_FILE",
+	"server.tls_key_file":         "TLS_KEY_FILE",
+	"server.http_redirect_addr":   "HTTP_REDIRECT_ADDR",
+	"database.driver":             "DB_DRIVER",
+	"database.path":               "DB_PATH",
+	"database.host":               "DB_HOST",
+	"database.port":               "DB_PORT",
+	"database.user":               "DB_USER",
+	"database.password":           "DB_PASSWORD",
+	"database.name":               "DB_NAME",
+	"database.sslmode":            "DB_SSLMODE",
+	"database.max_open_conns":     "DB_MAX_OPEN_CONNS",
+	"database.max_idle_conns":     "DB_MAX_IDLE_CONNS",
+	"database.conn_max_lifetime":  "DB_CONN_MAX_LIFETIME",
+	"database.conn_max_idle_time": "DB_CONN_MAX_IDLE_TIME",
+	"github.client_id":            "GITHUB_CLIENT_ID",
+	"github.client_secret":        "GITHUB_CLIENT_SECRET",
+	"github.redirect_url":         "GITHUB_REDIRECT_URL",
+	"github.api_url":              "GITHUB_API_URL",
+	"oidc.issuer":                 "OIDC_ISSUER",
+	"oidc.name":                   "OIDC_NAME",
+	"oidc.display_name":           "OIDC_DISPLAY_NAME",
+	"oidc.client_id":              "OIDC_CLIENT_ID",
+	"oidc.client_secret":          "OIDC_CLIENT_SECRET",
+	"oidc.redirect_url":           "OIDC_REDIRECT_URL",
+	"security.access_token_keys":  "ACCESS_TOKEN_KEYS",
+	"security.admin_user_ids":     "ADMIN_USER_IDS",
+	"sessions.ttl":                "SESSION_TTL",
+	"sessions.rotate_interval":    "SESSION_ROTATE_INTERVAL",
+	"hub.message_buffer":          "HUB_MESSAGE_BUFFER",
+	"hub.read_buffer_size":        "HUB_READ_BUFFER_SIZE",
+	"hub.write_buffer_size":       "HUB_WRITE_BUFFER_SIZE",
+	"retention.max_age":           "MESSAGE_RETENTION",
+	"retention.archive":           "MESSAGE_RETENTION_ARCHIVE",
+	"exports.dir":                 "EXPORT_DIR",
+	"accounts.deletion":           "ACCOUNT_DELETION",
+	"tracing.exporter":            "TRACING_EXPORTER",
+	"tracing.endpoint":            "TRACING_ENDPOINT",
+	"tracing.sample_ratio":        "TRACING_SAMPLE_RATIO",
+	"log.level":                   "LOG_LEVEL",
+	"log.format":                  "LOG_FORMAT",
+}
+
+// secrets are the flags whose values Print hides
+var secrets = map[string]bool{
+	"database.password":          true,
+	"github.client_secret":       true,
+	"oidc.client_secret":         true,
+	"security.access_token_keys": true,
+}
+
+// flagSet binds a flag to every setting of c, named after its path in the
+// configuration file
+func (c *Config) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("cito", flag.ContinueOnError)
+	fs.StringVar(&c.Server.Addr, "server.addr", c.Server.Addr, "address to listen on")
+	fs.DurationVar(&c.Server.ShutdownTimeout, "server.shutdown_timeout", c.Server.ShutdownTimeout, "how long shutting down waits for requests and queued messages")
+	fs.DurationVar(&c.Server.ShutdownDelay, "server.shutdown_delay", c.Server.ShutdownDelay, "how long /readyz fails before shutting down closes connections")
+	fs.StringVar(&c.Server.TLSCertFile, "server.tls_cert_file", c.Server.TLSCertFile, "TLS certificate file")
+	fs.StringVar(&c.Server.TLSKeyFile, "server.tls_key_file", c.Server.TLSKeyFile, "TLS private key file")
+	fs.StringVar(&c.Server.HTTPRedirectAddr, "server.http_redirect_addr", c.Server.HTTPRedirectAddr, "address redirecting plain HTTP to HTTPS")
+	fs.StringVar(&c.Database.Driver, "database.driver", c.Database.Driver, "database driver, postgres or sqlite")
+	fs.StringVar(&c.Database.Path, "database.path", c.Database.Path, "SQLite database file")
+	fs.StringVar(&c.Database.Host, "database.host", c.Database.Host, "PostgreSQL host")
+	fs.IntVar(&c.Database.Port, "database.port", c.Database.Port, "PostgreSQL port")
+	fs.StringVar(&c.Database.User, "database.user", c.Database.User, "PostgreSQL user")
+	fs.StringVar(&c.Database.Password, "database.password", c.Database.Password, "PostgreSQL password")
+	fs.StringVar(&c.Database.Name, "database.name", c.Database.Name, "PostgreSQL database name")
+	fs.StringVar(&c.Database.SSLMode, "database.sslmode", c.Database.SSLMode, "PostgreSQL sslmode")
+	fs.IntVar(&c.Database.MaxOpenConns, "database.max_open_conns", c.Database.MaxOpenConns, "maximum open connections, 0 for no limit")
+	fs.IntVar(&c.Database.MaxIdleConns, "database.max_idle_conns", c.Database.MaxIdleConns, "maximum idle connections")
+	fs.DurationVar(&c.Database.ConnMaxLifetime, "database.conn_max_lifetime", c.Database.ConnMaxLifetime, "how long a connection is reused, 0 for ever")
+	fs.DurationVar(&c.Database.ConnMaxIdleTime, "database.conn_max_idle_time", c.Database.ConnMaxIdleTime, "how long a connection stays idle, 0 for ever")
+	fs.StringVar(&c.GitHub.ClientID, "github.client_id", c.GitHub.ClientID, "GitHub OAuth app client ID")
+	fs.StringVar(&c.GitHub.ClientSecret, "github.client_secret", c.GitHub.ClientSecret, "GitHub OAuth app client secret")
+	fs.StringVar(&c.GitHub.RedirectURL, "github.redirect_url", c.GitHub.RedirectURL, "GitHub OAuth callback URL")
+	fs.StringVar(&c.GitHub.APIURL, "github.api_url", c.GitHub.APIURL, "GitHub Enterprise API URL")
+	fs.StringVar(&c.OIDC.Issuer, "oidc.issuer", c.OIDC.Issuer, "OpenID Connect issuer, enables the provider")
+	fs.StringVar(&c.OIDC.Name, "oidc.name", c.OIDC.Name, "OpenID Connect provider name")
+	fs.StringVar(&c.OIDC.DisplayName, "oidc.display_name", c.OIDC.DisplayName, "OpenID Connect provider name shown to users")
+	fs.StringVar(&c.OIDC.ClientID, "oidc.client_id", c.OIDC.ClientID, "OpenID Connect client ID")
+	fs.StringVar(&c.OIDC.ClientSecret, "oidc.client_secret", c.OIDC.ClientSecret, "OpenID Connect client secret")
+	fs.StringVar(&c.OIDC.RedirectURL, "oidc.redirect_url", c.OIDC.RedirectURL, "OpenID Connect callback URL")
+	fs.StringVar(&c.Security.AccessTokenKeys, "security.access_token_keys", c.Security.AccessTokenKeys, "access token encryption keys, version:base64key entries")
+	fs.StringVar(&c.Security.AdminUserIDs, "security.admin_user_ids", c.Security.AdminUserIDs, "comma separated IDs of the admins")
+	fs.DurationVar(&c.Sessions.TTL, "sessions.ttl", c.Sessions.TTL, "how long a session stays valid without activity")
+	fs.DurationVar(&c.Sessions.RotateInterval, "sessions.rotate_interval", c.Sessions.RotateInterval, "how often an active session gets a new token")
+	fs.IntVar(&c.Hub.MessageBuffer, "hub.message_buffer", c.Hub.MessageBuffer, "messages waiting to be delivered")
+	fs.IntVar(&c.Hub.ReadBufferSize, "hub.read_buffer_size", c.Hub.ReadBufferSize, "websocket read buffer size in bytes")
+	fs.IntVar(&c.Hub.WriteBufferSize, "hub.write_buffer_size", c.Hub.WriteBufferSize, "websocket write buffer size in bytes")
+	fs.StringVar(&c.Retention.MaxAge, "retention.max_age", c.Retention.MaxAge, "how long messages are kept, such as 90d")
+	fs.BoolVar(&c.Retention.Archive, "retention.archive", c.Retention.Archive, "archive expired messages instead of deleting them")
+	fs.StringVar(&c.Exports.Dir, "exports.dir", c.Exports.Dir, "directory of conversation exports")
+	fs.StringVar(&c.Accounts.Deletion, "accounts.deletion", c.Accounts.Deletion, "placeholder or hard")
+	fs.StringVar(&c.Tracing.Exporter, "tracing.exporter", c.Tracing.Exporter, "trace exporter, otlp or stdout, off when empty")
+	fs.StringVar(&c.Tracing.Endpoint, "tracing.endpoint", c.Tracing.Endpoint, "OTLP/HTTP collector URL")
+	fs.Float64Var(&c.Tracing.SampleRatio, "tracing.sample_ratio", c.Tracing.SampleRatio, "share of new traces recorded, from 0 to 1")
+	fs.StringVar(&c.Log.Level, "log.level", c.Log.Level, "least severe level logged: debug, info, warn or error")
+	fs.StringVar(&c.Log.Format, "log.format", c.Log.Format, "log format, text or json")
+	return fs
+}
+
+// Load reads the configuration: the defaults, overridden by the file named
+// by -config or CITO_CONFIG, by environment variables and by flags. It
+// returns the arguments following the flags.
+func Load(args []string, lookupEnv func(string) (string, bool)) (*Config, []string, error) {
+	// Flags are parsed first to find the file, and applied last
+	var file string
+	flags := Default().flagSet()
+	flags.StringVar(&file, "config", "", "YAML configuration file")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: cito [flags] [migrate|import-slack|config] ...\n\nflags:\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if file == "" {
+		file, _ = lookupEnv(FileEnv)
+	}
+
+	c := Default()
+	if file != "" {
+		if err := c.readFile(file); err != nil {
+			return nil, nil, err
+		}
+	}
+	fs := c.flagSet()
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		// Empty variables count as unset
+		if value, _ := lookupEnv(env[f.Name]); value != "" && err == nil {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid %s: %w", env[f.Name], setErr)
+			}
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			// Already parsed once, so it can't fail
+			_ = fs.Set(f.Name, f.Value.String())
+		}
+	})
+	return c, flags.Args(), nil
+}
+
+// readFile applies the settings of a YAML file, rejecting unknown keys
+func (c *Config) readFile(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("reading %s: %w", name, err)
+	}
+	return nil
+}
+
+// Validate checks every setting the server needs, reporting all the
+// problems at once
+func (c *Config) Validate() error {
+	errs := []error{c.Database.Validate()}
+	if c.Server.Addr == "" {
+		errs = append(errs, errors.New("server.addr is required"))
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("server.shutdown_timeout must be positive"))
+	}
+	if c.Server.ShutdownDelay < 0 {
+		errs = append(errs, errors.New("server.shutdown_delay must not be negative"))
+	}
+	if (c.Server.TLSCertFile == "") != (c.Server.TLSKeyFile == "") {
+		errs = append(errs, errors.New("server.tls_cert_file and server.tls_key_file are set together"))
+	}
+	if c.Server.HTTPRedirectAddr != "" && c.Server.TLSCertFile == "" {
+		errs = append(errs, errors.New("server.http_redirect_addr needs TLS"))
+	}
+	for _, file := range []string{c.Server.TLSCertFile, c.Server.TLSKeyFile} {
+		if file != "" {
+			if _, err := os.Stat(file); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if c.GitHub.ClientID == "" || c.GitHub.ClientSecret == "" || c.GitHub.RedirectURL == "" {
+		errs = append(errs, errors.New("github.client_id, github.client_secret and github.redirect_url are required"))
+	}
+	if c.OIDC.Issuer != "" && (c.OIDC.ClientID == "" || c.OIDC.RedirectURL == "") {
+		errs = append(errs, errors.New("oidc.client_id and oidc.redirect_url are required with oidc.issuer"))
+	}
+	if _, err := c.TokenKeys(); err != nil {
+		errs = append(errs, fmt.Errorf("security.access_token_keys: %w", err))
+	}
+	if _, err := c.AdminIDs(); err != nil {
+		errs = append(errs, fmt.Errorf("security.admin_user_ids: %w", err))
+	}
+	if c.Sessions.RotateInterval <= 0 || c.Sessions.TTL <= c.Sessions.RotateInterval {
+		errs = append(errs, errors.New("sessions.rotate_interval must be positive and shorter than sessions.ttl"))
+	}
+	if c.Hub.MessageBuffer < 0 {
+		errs = append(errs, errors.New("hub.message_buffer can't be negative"))
+	}
+	if c.Hub.ReadBufferSize <= 0 || c.Hub.WriteBufferSize <= 0 {
+		errs = append(errs, errors.New("hub.read_buffer_size and hub.write_buffer_size must be positive"))
+	}
+	if _, err := c.RetentionPolicy(); err != nil {
+		errs = append(errs, fmt.Errorf("retention.max_age: %w", err))
+	}
+	if c.Exports.Dir == "" {
+		errs = append(errs, errors.New("exports.dir is required"))
+	}
+	if _, err := c.DeletionPolicy(); err != nil {
+		errs = append(errs, fmt.Errorf("accounts.deletion: %w", err))
+	}
+	switch c.Tracing.Exporter {
+	case "", tracing.ExporterOTLP, tracing.ExporterStdout:
+	default:
+		errs = append(errs, fmt.Errorf("tracing.exporter: unknown exporter %q", c.Tracing.Exporter))
+	}
+	if c.Tracing.Endpoint != "" {
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, errors.New("tracing.endpoint must be an http or https URL"))
+		}
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		errs = append(errs, errors.New("tracing.sample_ratio must be between 0 and 1"))
+	}
+	if _, err := c.Logger(io.Discard); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Validate checks the database settings, all that subcommands such as
+// migrate need
+func (d DatabaseConfig) Validate() error {
+	var errs []error
+	switch d.Driver {
+	case database.Postgres:
+		if d.Host == "" || d.User == "" || d.Name == "" {
+			errs = append(errs, errors.New("database.host, database.user and database.name are required"))
+		}
+		if d.Port <= 0 || d.Port > 65535 {
+			errs = append(errs, fmt.Errorf("invalid database.port %d", d.Port))
+		}
+	case database.SQLite:
+		if d.Path == "" {
+			errs = append(errs, errors.New("database.path is required with the sqlite driver"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown database.driver %q, use %q or %q", d.Driver, database.Postgres, database.SQLite))
+	}
+	if d.MaxOpenConns < 0 || d.MaxIdleConns < 0 || d.ConnMaxLifetime < 0 || d.ConnMaxIdleTime < 0 {
+		errs = append(errs, errors.New("database pool settings can't be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// DataSource is what database.Open connects to
+func (d DatabaseConfig) DataSource() string {
+	if d.Driver == database.SQLite {
+		return d.Path
+	}
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		quoteDSN(d.Host), d.Port, quoteDSN(d.User), quoteDSN(d.Password), quoteDSN(d.Name), quoteDSN(d.SSLMode))
+}
+
+// dsnEscaper escapes what is special inside a quoted libpq value
+var dsnEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// quoteDSN quotes a libpq key=value connection string value, so that spaces
+// and quotes, such as in passwords, are kept as they are
+func quoteDSN(value string) string {
+	return "'" + dsnEscaper.Replace(value) + "'"
+}
+
+// TokenKeys parses the access token encryption keys
+func (c *Config) TokenKeys() (*keyring.Keyring, error) {
+	return keyring.Parse(c.Security.AccessTokenKeys)
+}
+
+// AdminIDs parses the comma separated IDs of the admins
+func (c *Config) AdminIDs() ([]int, error) {
+	var ids []int
+	for _, part := range strings.Split(c.Security.AdminUserIDs, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		id, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user id %q", part)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// RetentionPolicy is the server-wide message retention policy
+func (c *Config) RetentionPolicy() (model.RetentionPolicy, error) {
+	maxAge, err := model.ParseMaxAge(c.Retention.MaxAge)
+	if err != nil {
+		return model.RetentionPolicy{}, err
+	}
+	return model.RetentionPolicy{MaxAge: maxAge, Archive: c.Retention.Archive}, nil
+}
+
+// DeletionPolicy is what happens to the messages of deleted accounts
+func (c *Config) DeletionPolicy() (model.DeletionPolicy, error) {
+	return model.ParseDeletionPolicy(c.Accounts.Deletion)
+}
+
+// Logger returns the logger the settings ask for, writing to w
+func (c *Config) Logger(w io.Writer) (*slog.Logger, error) {
+	level, err := logging.ParseLevel(c.Log.Level)
+	if err != nil {
+		return nil, fmt.Errorf("log.level: %w", err)
+	}
+	logger, err := logging.New(w, c.Log.Format, level)
+	if err != nil {
+		return nil, fmt.Errorf("log.format: %w", err)
+	}
+	return logger, nil
+}
+
+// Print writes the effective settings, one per line, with secrets hidden
+func (c *Config) Print(w io.Writer) {
+	c.flagSet().VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secrets[f.Name] && value != "" {
+			value = "[redacted]"
+		}
+		fmt.Fprintf(w, "%s = %s\n", f.Name, value)
+	})
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lookupEnv serves the variables of vars
+func lookupEnv(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := vars[name]
+		return value, ok
+	}
+}
+
+// writeFile writes a configuration file and returns its path
+func writeFile(t *testing.T, content string) string {
+	name := filepath.Join(t.TempDir(), "cito.yaml")
+	require.NoError(t, os.WriteFile(name, []byte(content), 0o600))
+	return name
+}
+
+// valid returns a configuration passing Validate
+func valid() *Config {
+	c := Default()
+	c.Database.User = "cito"
+	c.Database.Name = "cito"
+	c.GitHub = GitHubConfig{ClientID: "id", ClientSecret: "gh-app-secret", RedirectURL: "http://localhost:8080/oauth2/callback"}
+	c.Security.AccessTokenKeys = "1:QkJCQkJCQkJCQkJCQkJCQkJCQkJCQkJCQkJCQkJCQkI="
+	return c
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	file := writeFile(t, `
+server:
+  addr: ":9000"
+database:
+  host: db.internal
+  port: 5433
+  max_open_conns: 10
+sessions:
+  ttl: 48h
+`)
+
+	c, args, err := Load([]string{"-config", file, "-database.port", "6000", "migrate", "status"}, lookupEnv(map[string]string{
+		"DB_HOST":     "db.env",
+		"DB_PORT":     "5999",
+		"DB_PASSWORD": "hunter2",
+		"SERVER_ADDR": "",
+	}))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"migrate", "status"}, args)
+	assert.Equal(t, ":9000", c.Server.Addr, "the file overrides defaults")
+	assert.Equal(t, 10, c.Database.MaxOpenConns)
+	assert.Equal(t, 48*time.Hour, c.Sessions.TTL)
+	assert.Equal(t, "db.env", c.Database.Host, "the environment overrides the file")
+	assert.Equal(t, "hunter2", c.Database.Password)
+	assert.Equal(t, 6000, c.Database.Port, "flags override the environment")
+	assert.Equal(t, 5, c.Database.MaxIdleConns, "defaults are kept")
+}
+
+func TestLoad_FileFromEnv(t *testing.T) {
+	file := writeFile(t, "hub:\n  message_buffer: 16\n  read_buffer_size: 4096\n")
+
+	c, _, err := Load(nil, lookupEnv(map[string]string{FileEnv: file, "HUB_WRITE_BUFFER_SIZE": "2048"}))
+	require.NoError(t, err)
+	assert.Equal(t, 16, c.Hub.MessageBuffer)
+	assert.Equal(t, 4096, c.Hub.ReadBufferSize)
+	assert.Equal(t, 2048, c.Hub.WriteBufferSize)
+}
+
+func TestLoad_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+	}{
+		{name: "unknown key", args: []string{"-config", writeFile(t, "server:\n  adress: \":80\"\n")}},
+		{name: "missing file", args: []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}},
+		{name: "invalid env", env: map[string]string{"DB_PORT": "five"}},
+		{name: "unknown flag", args: []string{"-nope"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := Load(tt.args, lookupEnv(tt.env))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(c *Config)
+		wantErr string
+	}{
+		{name: "valid", change: func(c *Config) {}},
+		{name: "sqlite", change: func(c *Config) { c.Database = DatabaseConfig{Driver: "sqlite", Path: "cito.db"} }},
+		{name: "no address", change: func(c *Config) { c.Server.Addr = "" }, wantErr: "server.addr"},
+		{name: "no shutdown timeout", change: func(c *Config) { c.Server.ShutdownTimeout = 0 }, wantErr: "server.shutdown_timeout"},
+		{name: "no shutdown delay", change: func(c *Config) { c.Server.ShutdownDelay = 0 }},
+		{name: "negative shutdown delay", change: func(c *Config) { c.Server.ShutdownDelay = -time.Second }, wantErr: "server.shutdown_delay"},
+		{name: "unknown driver", change: func(c *Config) { c.Database.Driver = "mysql" }, wantErr: "database.driver"},
+		{name: "sqlite without path", change: func(c *Config) { c.Database.Driver = "sqlite" }, wantErr: "database.path"},
+		{name: "no GitHub app", change: func(c *Config) { c.GitHub.ClientID = "" }, wantErr: "github.client_id"},
+		{name: "redirect without TLS", change: func(c *Config) { c.Server.HTTPRedirectAddr = ":80" }, wantErr: "http_redirect_addr"},
+		{name: "TLS key only", change: func(c *Config) { c.Server.TLSKeyFile = "key.pem" }, wantErr: "tls_cert_file"},
+		{name: "OIDC without client", change: func(c *Config) { c.OIDC.Issuer = "https://sso.example.com" }, wantErr: "oidc.client_id"},
+		{name: "no keys", change: func(c *Config) { c.Security.AccessTokenKeys = "" }, wantErr: "access_token_keys"},
+		{name: "invalid admins", change: func(c *Config) { c.Security.AdminUserIDs = "1,x" }, wantErr: "admin_user_ids"},
+		{name: "rotation after expiry", change: func(c *Config) { c.Sessions.RotateInterval = c.Sessions.TTL }, wantErr: "sessions.rotate_interval"},
+		{name: "negative message buffer", change: func(c *Config) { c.Hub.MessageBuffer = -1 }, wantErr: "hub.message_buffer"},
+		{name: "no read buffer", change: func(c *Config) { c.Hub.ReadBufferSize = 0 }, wantErr: "hub.read_buffer_size"},
+		{name: "no write buffer", change: func(c *Config) { c.Hub.WriteBufferSize = 0 }, wantErr: "hub.write_buffer_size"},
+		{name: "invalid retention", change: func(c *Config) { c.Retention.MaxAge = "soon" }, wantErr: "retention.max_age"},
+		{name: "invalid deletion", change: func(c *Config) { c.Accounts.Deletion = "soft" }, wantErr: "accounts.deletion"},
+		{name: "OTLP tracing", change: func(c *Config) { c.Tracing.Exporter, c.Tracing.Endpoint = "otlp", "http://collector:4318" }},
+		{name: "unknown exporter", change: func(c *Config) { c.Tracing.Exporter = "zipkin" }, wantErr: "tracing.exporter"},
+		{name: "endpoint without scheme", change: func(c *Config) { c.Tracing.Endpoint = "collector:4318" }, wantErr: "tracing.endpoint"},
+		{name: "sample ratio above 1", change: func(c *Config) { c.Tracing.SampleRatio = 2 }, wantErr: "tracing.sample_ratio"},
+		{name: "JSON debug logs", change: func(c *Config) { c.Log = LogConfig{Level: "debug", Format: "json"} }},
+		{name: "unknown log level", change: func(c *Config) { c.Log.Level = "loud" }, wantErr: "log.level"},
+		{name: "unknown log format", change: func(c *Config) { c.Log.Format = "xml" }, wantErr: "log.format"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.change(c)
+			err := c.Validate()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestConfig_Print(t *testing.T) {
+	c := valid()
+	c.Database.Password = "hunter2"
+
+	var buf bytes.Buffer
+	c.Print(&buf)
+	assert.Contains(t, buf.String(), "server.addr = :8080\n")
+	assert.Contains(t, buf.String(), "database.password = [redacted]\n")
+	assert.Contains(t, buf.String(), "oidc.client_secret = \n", "unset secrets show as unset")
+	assert.NotContains(t, buf.String(), "hunter2")
+	assert.NotContains(t, buf.String(), c.GitHub.ClientSecret)
+}
+
+func TestEnvNames(t *testing.T) {
+	Default().flagSet().VisitAll(func(f *flag.Flag) {
+		assert.NotEmpty(t, env[f.Name], "%s has no environment variable", f.Name)
+	})
+}
+
+func TestDatabaseConfig_DataSource(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		want     string
+	}{
+		{name: "plain", password: "cito", want: `password='cito'`},
+		{name: "spaces", password: "correct horse", want: `password='correct horse'`},
+		{name: "quotes", password: `it's"`, want: `password='it\'s"'`},
+		{name: "backslash", password: `a\b`, want: `password='a\\b'`},
+		{name: "empty", password: "", want: `password=''`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := DatabaseConfig{Driver: "postgres", Host: "db", Port: 5432, User: "cito", Password: tt.password, Name: "cito", SSLMode: "disable"}
+			dsn := d.DataSource()
+			assert.Contains(t, dsn, " "+tt.want+" ")
+			_, err := pq.NewConnector(dsn)
+			assert.NoError(t, err, "libpq syntax")
+		})
+	}
+}
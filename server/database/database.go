@@ -0,0 +1,105 @@
+// Package database opens the SQL database the server stores its data in,
+// PostgreSQL or, for single binary deployments, a SQLite file
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"modernc.org/sqlite"
+)
+
+// Supported values of the DB_DRIVER setting
+const (
+	Postgres = "postgres"
+	SQLite   = "sqlite"
+)
+
+// sqliteOptions enforces foreign keys, writes times in a format SQLite can
+// compare and begins transactions with the write lock so that concurrent
+// transactions wait for each other instead of failing
+const sqliteOptions = "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)" +
+	"&_time_format=sqlite&_txlock=immediate"
+
+// Open connects to a database of driverName and checks that it is reachable.
+// dataSource is a connection string for PostgreSQL and a file path for
+// SQLite.
+func Open(driverName string, dataSource string) (*sql.DB, error) {
+	var db *sql.DB
+	switch driverName {
+	case Postgres:
+		connector, err := pq.NewConnector(dataSource)
+		if err != nil {
+			return nil, err
+		}
+		db = sql.OpenDB(timedConnector{connector})
+	case SQLite:
+		if dataSource == "" {
+			return nil, fmt.Errorf("the SQLite database needs a file path")
+		}
+		db = sql.OpenDB(timedConnector{sqliteConnector{dsn: dataSource + "?" + sqliteOptions}})
+	default:
+		return nil, fmt.Errorf("unknown database driver %q, use %q or %q", driverName, Postgres, SQLite)
+	}
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// sqlConn is what database/sql uses of a connection, of either driver
+type sqlConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.ExecerContext
+	driver.QueryerContext
+	driver.Pinger
+	driver.SessionResetter
+	driver.Validator
+}
+
+type sqliteConnector struct {
+	dsn string
+}
+
+func (c sqliteConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Driver().Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	sc, ok := conn.(sqlConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("unsupported SQLite connection %T", conn)
+	}
+	return utcConn{sc}, nil
+}
+
+func (sqliteConnector) Driver() driver.Driver {
+	return &sqlite.Driver{}
+}
+
+// utcConn binds every time in UTC. SQLite stores times as text and compares
+// them as strings, which only orders times of the same zone correctly.
+type utcConn struct {
+	sqlConn
+}
+
+func (utcConn) CheckNamedValue(nv *driver.NamedValue) error {
+	value, err := driver.DefaultParameterConverter.ConvertValue(nv.Value)
+	if err != nil {
+		return err
+	}
+	if t, ok := value.(time.Time); ok {
+		value = t.UTC()
+	}
+	nv.Value = value
+	return nil
+}
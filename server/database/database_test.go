@@ -0,0 +1,93 @@
+package database
+
+import (
+	"cito/server/metrics"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpen_UnknownDriver(t *testing.T) {
+	_, err := Open("mysql", "cito")
+	assert.Error(t, err)
+	_, err = Open(SQLite, "")
+	assert.Error(t, err, "SQLite needs a file")
+}
+
+func TestOpen_SQLite(t *testing.T) {
+	db, err := Open(SQLite, filepath.Join(t.TempDir(), "cito.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec(`
+		CREATE TABLE parents (id INTEGER PRIMARY KEY);
+		CREATE TABLE children (parent_id INTEGER NOT NULL REFERENCES parents(id), at TIMESTAMP NOT NULL);
+		INSERT INTO parents (id) VALUES (1);
+	`)
+	require.NoError(t, err)
+
+	_, err = db.Exec(`INSERT INTO children (parent_id, at) VALUES (2, $1)`, time.Now())
+	assert.Error(t, err, "foreign keys should be enforced")
+
+	// Times of different zones are stored in UTC so that they compare in order
+	now := time.Now()
+	ahead := time.FixedZone("ahead", 10*60*60)
+	_, err = db.Exec(`INSERT INTO children (parent_id, at) VALUES (1, $1), (1, $2)`,
+		now, now.Add(-time.Hour).In(ahead))
+	require.NoError(t, err)
+
+	var count int
+	require.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM children WHERE at < $1`, now.Add(-time.Minute)).Scan(&count))
+	assert.Equal(t, 1, count)
+
+	var latest time.Time
+	require.NoError(t, db.QueryRow(`SELECT at FROM children ORDER BY at DESC LIMIT 1`).Scan(&latest))
+	assert.True(t, latest.Equal(now), "times should be stored to the nanosecond")
+}
+
+// sampleCount is how many statements of kind were timed
+func sampleCount(t *testing.T, kind string) uint64 {
+	var m dto.Metric
+	require.NoError(t, metrics.DBQueryDuration.WithLabelValues(kind).(prometheus.Metric).Write(&m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestOpen_TimesStatements(t *testing.T) {
+	db, err := Open(SQLite, filepath.Join(t.TempDir(), "cito.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	creates, selects := sampleCount(t, "create"), sampleCount(t, "select")
+	_, err = db.Exec(`CREATE TABLE timed (id INTEGER PRIMARY KEY)`)
+	require.NoError(t, err)
+	rows, err := db.Query(`SELECT id FROM timed`)
+	require.NoError(t, err)
+	rows.Close()
+
+	assert.Equal(t, creates+1, sampleCount(t, "create"))
+	assert.Equal(t, selects+1, sampleCount(t, "select"))
+}
+
+func TestStatementKind(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{query: "SELECT 1", want: "select"},
+		{query: "\n\t\tinsert INTO users (username) VALUES ($1)", want: "insert"},
+		{query: "WITH purged AS (DELETE FROM messages) SELECT 1", want: "with"},
+		{query: "PRAGMA foreign_keys", want: "other"},
+		{query: "", want: "other"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			assert.Equal(t, tt.want, statementKind(tt.query))
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package database
+
+import (
+	"cito/server/metrics"
+	"context"
+	"database/sql/driver"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// timedConnector records how long the statements of its connections take
+type timedConnector struct {
+	driver.Connector
+}
+
+func (c timedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sc, ok := conn.(sqlConn)
+	if !ok {
+		// database/sql falls back to prepared statements, left untimed
+		return conn, nil
+	}
+	return timedConn{sc}, nil
+}
+
+type timedConn struct {
+	sqlConn
+}
+
+func (c timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	defer observeStatement(query, time.Now())
+	return c.sqlConn.ExecContext(ctx, query, args)
+}
+
+// QueryContext times the query until its first rows are ready
+func (c timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	defer observeStatement(query, time.Now())
+	return c.sqlConn.QueryContext(ctx, query, args)
+}
+
+// CheckNamedValue keeps the argument conversions of the wrapped driver
+func (c timedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.sqlConn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func observeStatement(query string, start time.Time) {
+	metrics.DBQueryDuration.WithLabelValues(statementKind(query)).Observe(time.Since(start).Seconds())
+}
+
+// statementKinds bound the label values of the query duration metric
+var statementKinds = map[string]bool{
+	"select": true, "insert": true, "update": true, "delete": true, "with": true,
+	"create": true, "alter": true, "drop": true,
+}
+
+// statementKind is the lowercased first keyword of a statement, such as
+// "select", or "other"
+func statementKind(query string) string {
+	query = strings.TrimLeftFunc(query, unicode.IsSpace)
+	if end := strings.IndexFunc(query, unicode.IsSpace); end >= 0 {
+		query = query[:end]
+	}
+	if kind := strings.ToLower(query); statementKinds[kind] {
+		return kind
+	}
+	return "other"
+}
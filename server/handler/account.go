@@ -0,0 +1,281 @@
+package handler
+
+import (
+	"cito/server/logging"
+	"cito/server/middleware"
+	"cito/server/model"
+	"cito/server/service"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// AccountHandler manages the identities a user can sign in with, their
+// personal data and the deletion of their account
+type AccountHandler struct {
+	authService          *service.AuthService
+	userService          *service.UserService
+	identityTokenService *service.IdentityTokenService
+	accountService       *service.AccountService
+}
+
+func NewAccountHandler(authService *service.AuthService, userService *service.UserService, identityTokenService *service.IdentityTokenService, accountService *service.AccountService) *AccountHandler {
+	return &AccountHandler{authService: authService, userService: userService, identityTokenService: identityTokenService, accountService: accountService}
+}
+
+type deleteAccountRequest struct {
+	// Confirm must be the username of the account
+	Confirm string `json:"confirm"`
+}
+
+// startedWriter records whether the response body was started, after which
+// errors can no longer change the status
+type startedWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (sw *startedWriter) Write(b []byte) (int, error) {
+	sw.started = true
+	return sw.ResponseWriter.Write(b)
+}
+
+// PersonalDataHandler serves GET /api/account/data with everything stored
+// about the user, messages included, as a JSON download
+func (accountHandler *AccountHandler) PersonalDataHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="cito-personal-data.json"`)
+	sw := &startedWriter{ResponseWriter: w}
+	err := accountHandler.accountService.WritePersonalData(r.Context(), user.ID, sw)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to write personal data", "error", err, "user_id", user.ID)
+		if !sw.started {
+			w.Header().Del("Content-Disposition")
+			writeJSONError(w, http.StatusInternalServerError, "failed to export personal data")
+		}
+	}
+}
+
+// DeleteAccountHandler serves DELETE /api/account. The body confirms the
+// deletion with the account's username.
+func (accountHandler *AccountHandler) DeleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	var req deleteAccountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	err := accountHandler.accountService.DeleteAccount(r.Context(), user.ID, req.Confirm)
+	switch {
+	case errors.Is(err, service.ErrDeletionNotConfirmed):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, service.ErrUserNotFound):
+		writeJSONError(w, http.StatusNotFound, "user not found")
+	case err != nil:
+		logging.FromContext(r.Context()).Error("Failed to delete account", "error", err, "user_id", user.ID)
+		writeJSONError(w, http.StatusInternalServerError, "failed to delete account")
+	default:
+		middleware.ClearSessionCookie(w, r)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ListIdentitiesHandler serves GET /api/identities
+func (accountHandler *AccountHandler) ListIdentitiesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+
+	identities, err := accountHandler.userService.ListIdentities(r.Context(), user.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to list identities", "error", err, "user_id", user.ID)
+		writeJSONError(w, http.StatusInternalServerError, "failed to list identities")
+		return
+	}
+	writeJSON(w, http.StatusOK, identities)
+}
+
+// UnlinkIdentityHandler serves DELETE /api/identities/{id}. The last
+// identity of an account cannot be unlinked.
+func (accountHandler *AccountHandler) UnlinkIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	identityID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid identity id")
+		return
+	}
+
+	err = accountHandler.userService.UnlinkIdentity(r.Context(), user.ID, identityID)
+	switch {
+	case errors.Is(err, service.ErrIdentityNotFound):
+		writeJSONError(w, http.StatusNotFound, "identity not found")
+	case errors.Is(err, service.ErrLastIdentity):
+		writeJSONError(w, http.StatusConflict, err.Error())
+	case err != nil:
+		logging.FromContext(r.Context()).Error("Failed to unlink identity", "error", err, "identity_id", identityID)
+		writeJSONError(w, http.StatusInternalServerError, "failed to unlink identity")
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// VerifyIdentityHandler serves POST /api/identities/{id}/verify, checking
+// the identity's token with its provider now. A revoked authorization ends
+// every session of the account.
+func (accountHandler *AccountHandler) VerifyIdentityHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	identityID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid identity id")
+		return
+	}
+
+	identity, err := accountHandler.identityTokenService.VerifyIdentity(r.Context(), user.ID, identityID)
+	if errors.Is(err, service.ErrIdentityNotFound) {
+		writeJSONError(w, http.StatusNotFound, "identity not found")
+		return
+	}
+	if errors.Is(err, service.ErrProviderFailed) {
+		logging.FromContext(r.Context()).Error("Failed to verify identity", "error", err, "identity_id", identityID)
+		writeJSONError(w, http.StatusBadGateway, "failed to verify identity with its provider")
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to verify identity", "error", err, "identity_id", identityID)
+		writeJSONError(w, http.StatusInternalServerError, "failed to verify identity")
+		return
+	}
+	writeJSON(w, http.StatusOK, identity)
+}
+
+// LinkHandler serves POST /account/link and sends the user to the provider.
+// The callback then links the identity instead of signing in with it, to
+// the account of the session that started the link only.
+func (accountHandler *AccountHandler) LinkHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok || user.SessionID == 0 {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	provider, err := accountHandler.authService.Provider(r.FormValue("provider"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	attempt := accountHandler.authService.NewLoginAttempt()
+	setLoginAttemptCookies(w, r, attempt)
+	setCallbackCookie(w, r, linkCookieName, strconv.Itoa(user.SessionID))
+	http.Redirect(w, r, provider.AuthCodeURL(attempt), http.StatusSeeOther)
+}
+
+var accountPage = template.Must(template.New("account").Parse(`<h1>Your account</h1>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+{{if .Identities}}
+<h2>Sign-in methods</h2>
+<table>
+<tr><th>Provider</th><th>Account</th><th>Email</th><th></th></tr>
+{{range .Identities}}<tr>
+<td>{{.Provider}}</td><td>{{.Username}}</td><td>{{.Email}}{{if .RevokedAt}} (access revoked, sign in with it again){{end}}</td>
+<td>{{if gt (len $.Identities) 1}}<button onclick="unlink({{.ID}})">Unlink</button>{{end}}</td>
+</tr>{{end}}
+</table>
+{{end}}
+{{range .Providers}}<form method="post" action="/account/link">
+<input type="hidden" name="provider" value="{{.Name}}">
+<button>Link a {{.DisplayName}} account</button>
+</form>
+{{end}}
+{{if .Username}}<h2>Your data</h2>
+<p><a href="/api/account/data">Download your data</a></p>
+<p>Deleting your account signs you out everywhere and removes your sign-in methods, sessions and tokens.
+{{if .KeepsMessages}}Your messages stay with the people you wrote to, from a "deleted user".{{else}}Your messages are deleted too.{{end}}
+Download your data first if you want to keep it.</p>
+<button onclick="deleteAccount()">Delete account</button>
+{{end}}
+<p><a href="/">Back</a></p>
+<script>
+function unlink(id) {
+	fetch("/api/identities/" + id, {method: "DELETE"}).then(() => location.reload());
+}
+function deleteAccount() {
+	const confirm = prompt("Type your username, {{.Username}}, to delete your account");
+	if (confirm === null) {
+		return;
+	}
+	fetch("/api/account", {method: "DELETE", body: JSON.stringify({confirm: confirm})}).then(resp => {
+		if (resp.ok) {
+			location = "/login";
+		} else {
+			resp.json().then(body => alert(body.error));
+		}
+	});
+}
+</script>
+`))
+
+type accountPageData struct {
+	Message    string
+	Identities []model.Identity
+	Providers  []service.IdentityProvider
+	// Username offers the deletion of the account
+	Username      string
+	KeepsMessages bool
+}
+
+// renderAccountMessage shows a notice about the account, such as a link conflict
+func renderAccountMessage(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	if err := accountPage.Execute(w, accountPageData{Message: message}); err != nil {
+		slog.Error("Failed to render account page", "error", err)
+	}
+}
+
+// AccountPageHandler serves GET /account
+func (accountHandler *AccountHandler) AccountPageHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	identities, err := accountHandler.userService.ListIdentities(r.Context(), user.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to list identities", "error", err, "user_id", user.ID)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	data := accountPageData{
+		Identities:    identities,
+		Providers:     accountHandler.authService.Providers(),
+		Username:      user.Username,
+		KeepsMessages: accountHandler.accountService.DeletionPolicy() == model.DeletionPlaceholder,
+	}
+	if err := accountPage.Execute(w, data); err != nil {
+		logging.FromContext(r.Context()).Error("Failed to render account page", "error", err)
+	}
+}
@@ -0,0 +1,273 @@
+package handler
+
+import (
+	"cito/server/model"
+	"cito/server/service"
+	"cito/server/testutil"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// seedIdentities signs in a user with a "personal" GitHub identity, links one
+// more identity per extra login and returns the user and identity IDs
+func seedIdentities(t *testing.T, userService *service.UserService, extra ...string) (int, []int) {
+	token := &oauth2.Token{AccessToken: "gh_token"}
+	userID, err := userService.UpsertIdentity(context.Background(), model.GitHubUser{ID: 100, Login: "personal", Email: "me@example.com"}.Identity(), token)
+	require.NoError(t, err)
+	for i, login := range extra {
+		identity := model.GitHubUser{ID: int64(101 + i), Login: login}.Identity()
+		require.NoError(t, userService.LinkIdentity(context.Background(), userID, identity, token))
+	}
+
+	identities, err := userService.ListIdentities(context.Background(), userID)
+	require.NoError(t, err)
+	var identityIDs []int
+	for _, identity := range identities {
+		identityIDs = append(identityIDs, identity.ID)
+	}
+	return userID, identityIDs
+}
+
+// newTestAccountService returns an account service deleting from repository
+// with policy, without the services of database-only data
+func newTestAccountService(t *testing.T, repository *service.MemoryRepository, userService *service.UserService, policy model.DeletionPolicy) *service.AccountService {
+	exportService := service.NewExportService(repository, repository, userService, t.TempDir())
+	return service.NewAccountService(repository, userService, service.NewSessionService(repository), nil, nil, nil, exportService, policy, func(int) {})
+}
+
+func TestAccountHandler_UnlinkIdentityHandler(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra []string
+		// id picks the path value from the seeded identity IDs
+		id         func(identityIDs []int) string
+		wantStatus int
+		wantLeft   int
+	}{
+		{
+			name:       "unlinks identity",
+			extra:      []string{"work"},
+			id:         func(identityIDs []int) string { return strconv.Itoa(identityIDs[1]) },
+			wantStatus: http.StatusNoContent,
+			wantLeft:   1,
+		},
+		{
+			name:       "last identity",
+			id:         func(identityIDs []int) string { return strconv.Itoa(identityIDs[0]) },
+			wantStatus: http.StatusConflict,
+			wantLeft:   1,
+		},
+		{
+			name:       "unknown identity",
+			extra:      []string{"work"},
+			id:         func([]int) string { return "9" },
+			wantStatus: http.StatusNotFound,
+			wantLeft:   2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userService := service.NewUserService(service.NewMemoryRepository(), testutil.NewTestKeyring(t))
+			userID, identityIDs := seedIdentities(t, userService, tt.extra...)
+			id := tt.id(identityIDs)
+
+			handler := NewAccountHandler(service.NewAuthService(), userService, nil, nil)
+			req := httptest.NewRequest(http.MethodDelete, "/api/identities/"+id, nil)
+			req.SetPathValue("id", id)
+			req = req.WithContext(model.NewContextWithUserValue(req.Context(), &model.UserModel{ID: userID}))
+			rec := httptest.NewRecorder()
+			handler.UnlinkIdentityHandler(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			identities, err := userService.ListIdentities(context.Background(), userID)
+			require.NoError(t, err)
+			assert.Len(t, identities, tt.wantLeft)
+		})
+	}
+}
+
+func TestAccountHandler_AccountPageHandler(t *testing.T) {
+	userService := service.NewUserService(service.NewMemoryRepository(), testutil.NewTestKeyring(t))
+	userID, identityIDs := seedIdentities(t, userService, "work")
+	_, err := userService.MarkIdentityRevoked(context.Background(), identityIDs[1])
+	require.NoError(t, err)
+
+	authService := service.NewAuthService(service.NewGitHubProvider(&testutil.MockOAuth2Config{}, nil, ""))
+	handler := NewAccountHandler(authService, userService, nil, newTestAccountService(t, service.NewMemoryRepository(), userService, model.DeletionHard))
+	req := httptest.NewRequest(http.MethodGet, "/account", nil)
+	req = req.WithContext(model.NewContextWithUserValue(req.Context(), &model.UserModel{ID: userID, Username: "personal"}))
+	rec := httptest.NewRecorder()
+	handler.AccountPageHandler(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	assert.Contains(t, body, "personal")
+	assert.Contains(t, body, "work")
+	assert.Equal(t, 2, strings.Count(body, "Unlink</button>"))
+	assert.Contains(t, body, "Link a GitHub account")
+	assert.Equal(t, 1, strings.Count(body, "access revoked"), "the revoked identity is flagged")
+	assert.Contains(t, body, "Delete account")
+	assert.Contains(t, body, "Your messages are deleted too")
+}
+
+func TestAccountHandler_LinkHandler(t *testing.T) {
+	mockOAuth := &testutil.MockOAuth2Config{
+		AuthCodeURLFunc: func(state string, opts ...oauth2.AuthCodeOption) string {
+			return "https://github.com/login/oauth/authorize"
+		},
+	}
+	handler := NewAccountHandler(service.NewAuthService(service.NewGitHubProvider(mockOAuth, nil, "")), service.NewUserService(service.NewMemoryRepository(), testutil.NewTestKeyring(t)), nil, nil)
+
+	signedIn := func(req *http.Request) *http.Request {
+		return req.WithContext(model.NewContextWithUserValue(req.Context(), &model.UserModel{ID: 3, SessionID: 10}))
+	}
+
+	t.Run("redirects to the provider with link cookies", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/account/link", strings.NewReader(url.Values{"provider": {"github"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler.LinkHandler(rec, signedIn(req))
+
+		assert.Equal(t, http.StatusSeeOther, rec.Code)
+		assert.Equal(t, "https://github.com/login/oauth/authorize", rec.Header().Get("Location"))
+		cookies := map[string]string{}
+		for _, cookie := range rec.Result().Cookies() {
+			cookies[cookie.Name] = cookie.Value
+			assert.Equal(t, "/oauth2/callback", cookie.Path)
+		}
+		assert.NotEmpty(t, cookies[verifierCookieName])
+		assert.NotEmpty(t, cookies[stateCookieName])
+		assert.NotEmpty(t, cookies[nonceCookieName])
+		assert.Equal(t, "10", cookies[linkCookieName], "the link is tied to the session that started it")
+	})
+
+	t.Run("unknown provider", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/account/link", strings.NewReader("provider=gitlab"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler.LinkHandler(rec, signedIn(req))
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
+	t.Run("without a session", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/account/link", strings.NewReader("provider=github"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = req.WithContext(model.NewContextWithUserValue(req.Context(), &model.UserModel{ID: 3, TokenID: 4}))
+		rec := httptest.NewRecorder()
+		handler.LinkHandler(rec, req)
+		assert.Equal(t, http.StatusFound, rec.Code)
+		assert.Empty(t, rec.Result().Cookies())
+	})
+}
+
+func TestAccountHandler_VerifyIdentityHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         func(identityIDs []int) string
+		providers  []service.IdentityProvider
+		wantStatus int
+	}{
+		{
+			name:       "revoked identity reports its state",
+			id:         func(identityIDs []int) string { return strconv.Itoa(identityIDs[0]) },
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "unknown identity",
+			id:         func([]int) string { return "9" },
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "provider fails",
+			id:         func(identityIDs []int) string { return strconv.Itoa(identityIDs[1]) },
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name:       "provider no longer configured",
+			id:         func(identityIDs []int) string { return strconv.Itoa(identityIDs[1]) },
+			providers:  []service.IdentityProvider{},
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repository := service.NewMemoryRepository()
+			providers := tt.providers
+			if providers == nil {
+				unavailable := &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+					return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: io.NopCloser(strings.NewReader("")), Header: http.Header{}}, nil
+				})}
+				providers = []service.IdentityProvider{service.NewGitHubProvider(&testutil.MockOAuth2Config{}, unavailable, "")}
+			}
+			authService := service.NewAuthService(providers...)
+			userService := service.NewUserService(repository, testutil.NewTestKeyring(t))
+			userID, identityIDs := seedIdentities(t, userService, "work")
+			_, err := userService.MarkIdentityRevoked(context.Background(), identityIDs[0])
+			require.NoError(t, err)
+			id := tt.id(identityIDs)
+
+			identityTokenService := service.NewIdentityTokenService(authService, userService, service.NewSessionService(repository), nil, func(int) {})
+			handler := NewAccountHandler(authService, userService, identityTokenService, nil)
+
+			req := httptest.NewRequest(http.MethodPost, "/api/identities/"+id+"/verify", nil)
+			req.SetPathValue("id", id)
+			req = req.WithContext(model.NewContextWithUserValue(req.Context(), &model.UserModel{ID: userID}))
+			rec := httptest.NewRecorder()
+			handler.VerifyIdentityHandler(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			if tt.wantStatus == http.StatusOK {
+				assert.Contains(t, rec.Body.String(), `"revoked_at"`)
+			}
+		})
+	}
+}
+
+func TestAccountHandler_DeleteAccountHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{name: "confirmed", body: `{"confirm":"personal"}`, wantStatus: http.StatusNoContent},
+		{name: "wrong username", body: `{"confirm":"someone"}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid body", body: `{`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repository := service.NewMemoryRepository()
+			userService := service.NewUserService(repository, testutil.NewTestKeyring(t))
+			userID, _ := seedIdentities(t, userService)
+			handler := NewAccountHandler(service.NewAuthService(), userService, nil, newTestAccountService(t, repository, userService, model.DeletionPlaceholder))
+
+			req := httptest.NewRequest(http.MethodDelete, "/api/account", strings.NewReader(tt.body))
+			req = req.WithContext(model.NewContextWithUserValue(req.Context(), &model.UserModel{ID: userID}))
+			rec := httptest.NewRecorder()
+			handler.DeleteAccountHandler(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			user, err := userService.FindUserByID(context.Background(), userID)
+			require.NoError(t, err)
+			if tt.wantStatus == http.StatusNoContent {
+				assert.Equal(t, model.DeletedUsername, user.Username)
+				require.Len(t, rec.Result().Cookies(), 1)
+				assert.Equal(t, -1, rec.Result().Cookies()[0].MaxAge, "the session cookie is cleared")
+			} else {
+				assert.Equal(t, "personal", user.Username)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"cito/server/logging"
+	"cito/server/model"
+	"cito/server/service"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DeviceHandler implements an OAuth 2.0 device authorization grant (RFC 8628)
+// style login for clients without a browser, such as the CLI
+type DeviceHandler struct {
+	deviceService *service.DeviceService
+}
+
+func NewDeviceHandler(deviceService *service.DeviceService) *DeviceHandler {
+	return &DeviceHandler{deviceService: deviceService}
+}
+
+type deviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type deviceTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	Scope       string `json:"scope"`
+}
+
+// requestValue reads a parameter from a JSON or form encoded body
+func requestValue(r *http.Request, name string) string {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			return ""
+		}
+		return body[name]
+	}
+	return r.FormValue(name)
+}
+
+// verificationURL is the absolute URL of the approval page
+func verificationURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return (&url.URL{Scheme: scheme, Host: r.Host, Path: "/device"}).String()
+}
+
+// CodeHandler serves POST /device/code, starting a device login
+func (deviceHandler *DeviceHandler) CodeHandler(w http.ResponseWriter, r *http.Request) {
+	authorization, err := deviceHandler.deviceService.StartAuthorization(requestValue(r, "client_name"))
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to start device authorization", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to start device authorization")
+		return
+	}
+
+	verificationURI := verificationURL(r)
+	writeJSON(w, http.StatusOK, deviceCodeResponse{
+		DeviceCode:              authorization.DeviceCode,
+		UserCode:                authorization.UserCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?user_code=" + url.QueryEscape(authorization.UserCode),
+		ExpiresIn:               int(service.DeviceCodeTTL.Seconds()),
+		Interval:                int(service.DevicePollInterval.Seconds()),
+	})
+}
+
+// TokenHandler serves POST /device/token, polled by the device until the
+// user approved or denied the login
+func (deviceHandler *DeviceHandler) TokenHandler(w http.ResponseWriter, r *http.Request) {
+	deviceCode := requestValue(r, "device_code")
+	if deviceCode == "" {
+		writeJSONError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+
+	rawToken, err := deviceHandler.deviceService.ExchangeDeviceCode(deviceCode)
+	switch {
+	case errors.Is(err, service.ErrAuthorizationPending),
+		errors.Is(err, service.ErrSlowDown),
+		errors.Is(err, service.ErrAccessDenied),
+		errors.Is(err, service.ErrExpiredToken):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	case err != nil:
+		logging.FromContext(r.Context()).Error("Failed to exchange device code", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, deviceTokenResponse{
+		AccessToken: rawToken,
+		TokenType:   "bearer",
+		Scope:       service.DeviceScopes.String(),
+	})
+}
+
+var devicePage = template.Must(template.New("device").Parse(`<h1>Connect a device</h1>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+{{if .Authorization}}
+<p><b>{{.Authorization.ClientName}}</b> wants to access your cito account as {{.Username}}.</p>
+<form method="post" action="/device">
+<input type="hidden" name="user_code" value="{{.Authorization.UserCode}}">
+<button name="action" value="approve">Approve</button>
+<button name="action" value="deny">Deny</button>
+</form>
+{{else if not .Done}}
+<form method="get" action="/device">
+<label>Code shown by your device <input name="user_code" value="{{.UserCode}}" autofocus></label>
+<button>Continue</button>
+</form>
+{{end}}
+`))
+
+type devicePageData struct {
+	Username      string
+	UserCode      string
+	Authorization *model.DeviceAuthorization
+	Message       string
+	Done          bool
+}
+
+// PageHandler serves GET /device where a logged-in user enters the code
+// shown by the device and confirms it
+func (deviceHandler *DeviceHandler) PageHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	data := devicePageData{Username: user.Username, UserCode: r.URL.Query().Get("user_code")}
+	if data.UserCode != "" {
+		authorization, err := deviceHandler.deviceService.FindPendingAuthorization(data.UserCode)
+		switch {
+		case errors.Is(err, service.ErrUserCodeNotFound):
+			data.Message = "That code is invalid or has expired."
+		case err != nil:
+			logging.FromContext(r.Context()).Error("Failed to look up device authorization", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		default:
+			data.Authorization = authorization
+		}
+	}
+	if err := devicePage.Execute(w, data); err != nil {
+		logging.FromContext(r.Context()).Error("Failed to render device page", "error", err)
+	}
+}
+
+// DecisionHandler serves POST /device with the user's approve or deny choice
+func (deviceHandler *DeviceHandler) DecisionHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	userCode := r.FormValue("user_code")
+	var err error
+	data := devicePageData{Username: user.Username, Done: true}
+	switch r.FormValue("action") {
+	case "approve":
+		err = deviceHandler.deviceService.Approve(user.ID, userCode)
+		data.Message = "Device approved. You can return to your terminal."
+	case "deny":
+		err = deviceHandler.deviceService.Deny(user.ID, userCode)
+		data.Message = "Device denied."
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, service.ErrUserCodeNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		data.Message = "That code is invalid or has expired."
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to decide device authorization", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := devicePage.Execute(w, data); err != nil {
+		logging.FromContext(r.Context()).Error("Failed to render device page", "error", err)
+	}
+}
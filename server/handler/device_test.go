@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"cito/server/model"
+	"cito/server/service"
+	"cito/server/testutil"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceHandler_CodeHandler(t *testing.T) {
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	mock.ExpectQuery(`INSERT INTO device_authorizations`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "laptop", model.DeviceStatusPending, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+
+	handler := NewDeviceHandler(service.NewDeviceService(db))
+	req := httptest.NewRequest(http.MethodPost, "http://chat.example.com/device/code", strings.NewReader(`{"client_name":"laptop"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	handler.CodeHandler(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	var response deviceCodeResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.NotEmpty(t, response.DeviceCode)
+	assert.Equal(t, "http://chat.example.com/device", response.VerificationURI)
+	assert.Equal(t, response.VerificationURI+"?user_code="+response.UserCode, response.VerificationURIComplete)
+	assert.Equal(t, 5, response.Interval)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDeviceHandler_TokenHandler(t *testing.T) {
+	columns := []string{"id", "status", "client_name", "user_id", "expires_at", "last_polled_at"}
+
+	tests := []struct {
+		name       string
+		body       string
+		mockSetup  func(sqlmock.Sqlmock)
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name: "authorization pending",
+			body: "device_code=abc",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT (.+) FROM device_authorizations`).
+					WillReturnRows(sqlmock.NewRows(columns).AddRow(1, model.DeviceStatusPending, "cli", 0, time.Now().Add(time.Minute), nil))
+				mock.ExpectExec(`UPDATE device_authorizations SET last_polled_at`).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `"error":"authorization_pending"`,
+		},
+		{
+			name: "approved",
+			body: "device_code=abc",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT (.+) FROM device_authorizations`).
+					WillReturnRows(sqlmock.NewRows(columns).AddRow(1, model.DeviceStatusApproved, "cli", 2, time.Now().Add(time.Minute), nil))
+				mock.ExpectExec(`UPDATE device_authorizations SET last_polled_at`).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE device_authorizations SET status`).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery(`INSERT INTO personal_access_tokens`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+				mock.ExpectCommit()
+			},
+			wantStatus: http.StatusOK,
+			wantBody:   `"access_token":"` + service.PersonalTokenPrefix,
+		},
+		{
+			name:       "missing device code",
+			body:       "",
+			mockSetup:  func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `"error":"invalid_request"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.SetupMockDB(t)
+			defer cleanup()
+			tt.mockSetup(mock)
+
+			handler := NewDeviceHandler(service.NewDeviceService(db))
+			req := httptest.NewRequest(http.MethodPost, "/device/token", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			rec := httptest.NewRecorder()
+			handler.TokenHandler(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Contains(t, rec.Body.String(), tt.wantBody)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestDeviceHandler_DecisionHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		action     string
+		affected   int64
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "approve", action: "approve", affected: 1, wantStatus: http.StatusOK, wantBody: "Device approved"},
+		{name: "deny", action: "deny", affected: 1, wantStatus: http.StatusOK, wantBody: "Device denied"},
+		{name: "expired code", action: "approve", affected: 0, wantStatus: http.StatusNotFound, wantBody: "invalid or has expired"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.SetupMockDB(t)
+			defer cleanup()
+			mock.ExpectExec(`UPDATE device_authorizations SET status = \$1, user_id = \$2`).
+				WithArgs(sqlmock.AnyArg(), 1, "BCDF-GHJK", model.DeviceStatusPending, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, tt.affected))
+
+			handler := NewDeviceHandler(service.NewDeviceService(db))
+			form := url.Values{"user_code": {"BCDF-GHJK"}, "action": {tt.action}}
+			req := httptest.NewRequest(http.MethodPost, "/device", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req = req.WithContext(model.NewContextWithUserValue(req.Context(), &model.UserModel{ID: 1, Username: "alice"}))
+			rec := httptest.NewRecorder()
+			handler.DecisionHandler(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Contains(t, rec.Body.String(), tt.wantBody)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"cito/server/model"
+	"cito/server/service"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+type ExportHandler struct {
+	exportService *service.ExportService
+}
+
+func NewExportHandler(exportService *service.ExportService) *ExportHandler {
+	return &ExportHandler{exportService: exportService}
+}
+
+type createExportRequest struct {
+	Format string `json:"format"`
+}
+
+// writeExportError maps export service errors to API responses
+func writeExportError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, service.ErrExportNotFound):
+		writeJSONError(w, http.StatusNotFound, "export not found")
+	case errors.Is(err, service.ErrInvalidExportFormat):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, service.ErrExportInProgress), errors.Is(err, service.ErrExportNotReady):
+		writeJSONError(w, http.StatusConflict, err.Error())
+	default:
+		slog.Error("Export request failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "export request failed")
+	}
+}
+
+// withDownloadURL points finished exports at their download
+func withDownloadURL(export model.Export) model.Export {
+	if export.Status == model.ExportStatusDone {
+		export.DownloadURL = fmt.Sprintf("/api/exports/%d/download", export.ID)
+	}
+	return export
+}
+
+// CreateExportHandler serves POST /api/exports, answering 202 while the
+// export is written in the background
+func (exportHandler *ExportHandler) CreateExportHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	req := createExportRequest{Format: model.ExportFormatNDJSON}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	export, err := exportHandler.exportService.RequestExport(user.ID, req.Format)
+	if err != nil {
+		writeExportError(w, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/api/exports/%d", export.ID))
+	writeJSON(w, http.StatusAccepted, export)
+}
+
+// ListExportsHandler serves GET /api/exports
+func (exportHandler *ExportHandler) ListExportsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	exports, err := exportHandler.exportService.ListExports(user.ID)
+	if err != nil {
+		writeExportError(w, err)
+		return
+	}
+	for i := range exports {
+		exports[i] = withDownloadURL(exports[i])
+	}
+	writeJSON(w, http.StatusOK, exports)
+}
+
+// ExportHandler serves GET /api/exports/{id} with the progress of an export
+func (exportHandler *ExportHandler) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	exportID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid export id")
+		return
+	}
+	export, err := exportHandler.exportService.FindExport(user.ID, exportID)
+	if err != nil {
+		writeExportError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, withDownloadURL(*export))
+}
+
+// DownloadHandler serves GET /api/exports/{id}/download with the file of a
+// finished export
+func (exportHandler *ExportHandler) DownloadHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	exportID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid export id")
+		return
+	}
+	file, export, err := exportHandler.exportService.OpenExport(user.ID, exportID)
+	if err != nil {
+		writeExportError(w, err)
+		return
+	}
+	defer file.Close()
+
+	contentType := "application/x-ndjson"
+	if export.Format == model.ExportFormatZip {
+		contentType = "application/zip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"cito-export-%d.%s\"", export.ID, export.Format))
+	http.ServeContent(w, r, "", *export.FinishedAt, file)
+}
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"cito/server/model"
+	"cito/server/service"
+	"cito/server/testutil"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestExportHandler returns a handler for users 1 and 2, where 2 sent 1
+// a message
+func newTestExportHandler(t *testing.T) (*ExportHandler, *service.ExportService) {
+	repo := service.NewMemoryRepository()
+	userService := service.NewUserService(repo, testutil.NewTestKeyring(t))
+	for i := 1; i <= 2; i++ {
+		_, err := repo.UpsertIdentity(model.GitHubUser{ID: int64(i), Login: "user"}.Identity(), service.SealedToken{AccessToken: "token"}, time.Now())
+		require.NoError(t, err)
+	}
+	require.NoError(t, repo.SaveMessage(&model.Message{FromUserID: 2, ToUserId: 1, TextContent: "hi", Time: time.Now()}))
+	exportService := service.NewExportService(repo, repo, userService, t.TempDir())
+	return NewExportHandler(exportService), exportService
+}
+
+func TestExportHandler_CreateExportHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{name: "ndjson", body: `{"format":"ndjson"}`, wantStatus: http.StatusAccepted},
+		{name: "zip", body: `{"format":"zip"}`, wantStatus: http.StatusAccepted},
+		{name: "unknown format", body: `{"format":"csv"}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid body", body: `{`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, _ := newTestExportHandler(t)
+			req := httptest.NewRequest(http.MethodPost, "/api/exports", strings.NewReader(tt.body))
+			req = req.WithContext(model.NewContextWithUserValue(req.Context(), &model.UserModel{ID: 1}))
+			rec := httptest.NewRecorder()
+			handler.CreateExportHandler(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+		})
+	}
+}
+
+func TestExportHandler_Download(t *testing.T) {
+	handler, exportService := newTestExportHandler(t)
+	export, err := exportService.RequestExport(1, model.ExportFormatNDJSON)
+	require.NoError(t, err)
+	id := fmt.Sprint(export.ID)
+
+	get := func(handle http.HandlerFunc, userID int, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.SetPathValue("id", id)
+		req = req.WithContext(model.NewContextWithUserValue(req.Context(), &model.UserModel{ID: userID}))
+		rec := httptest.NewRecorder()
+		handle(rec, req)
+		return rec
+	}
+
+	rec := get(handler.DownloadHandler, 1, "/api/exports/"+id+"/download")
+	assert.Equal(t, http.StatusConflict, rec.Code, "pending exports can't be downloaded")
+
+	require.NoError(t, exportService.ProcessExports(context.Background()))
+	rec = get(handler.ExportHandler, 1, "/api/exports/"+id)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var status model.Export
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.Equal(t, model.ExportStatusDone, status.Status)
+	assert.Equal(t, "/api/exports/"+id+"/download", status.DownloadURL)
+
+	rec = get(handler.DownloadHandler, 1, status.DownloadURL)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Header().Get("Content-Disposition"), "attachment")
+	assert.Contains(t, rec.Body.String(), `"text":"hi"`)
+
+	rec = get(handler.DownloadHandler, 2, status.DownloadURL)
+	assert.Equal(t, http.StatusNotFound, rec.Code, "exports are private to their user")
+}
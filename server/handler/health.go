@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"cito/server/messager"
+	"cito/server/migrations"
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// readinessTimeout bounds the checks of a readiness probe
+const readinessTimeout = 2 * time.Second
+
+// HealthHandler answers the liveness and readiness probes of load balancers
+// and orchestrators
+type HealthHandler struct {
+	db       *sql.DB
+	hub      *messager.HubManager
+	migrator *migrations.Migrator
+	// draining is set once the server starts shutting down
+	draining atomic.Bool
+}
+
+func NewHealthHandler(db *sql.DB, hub *messager.HubManager, migrator *migrations.Migrator) *HealthHandler {
+	return &HealthHandler{db: db, hub: hub, migrator: migrator}
+}
+
+const (
+	statusOK          = "ok"
+	statusUnavailable = "unavailable"
+)
+
+// componentStatus is the state of one dependency of the server
+type componentStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]componentStatus `json:"components,omitempty"`
+}
+
+// Drain makes the readiness probe fail from now on, ahead of shutting down
+func (healthHandler *HealthHandler) Drain() {
+	healthHandler.draining.Store(true)
+}
+
+// LivenessHandler reports that the process is up and serving requests
+func (healthHandler *HealthHandler) LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, healthResponse{Status: statusOK})
+}
+
+// ReadinessHandler reports whether the server can take new clients: the
+// database answers, the hub routes messages and the schema is up to date. It
+// fails as soon as the server starts draining, so that load balancers send
+// new WebSocket clients elsewhere before connections close.
+func (healthHandler *HealthHandler) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	components := map[string]componentStatus{
+		"server":     healthHandler.serverStatus(),
+		"database":   check("database", healthHandler.db.PingContext(ctx)),
+		"hub":        healthHandler.hubStatus(),
+		"migrations": healthHandler.migrationsStatus(ctx),
+	}
+	response := healthResponse{Status: statusOK, Components: components}
+	status := http.StatusOK
+	for _, component := range components {
+		if component.Status != statusOK {
+			response.Status = statusUnavailable
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJSON(w, status, response)
+}
+
+func (healthHandler *HealthHandler) serverStatus() componentStatus {
+	if healthHandler.draining.Load() {
+		return componentStatus{Status: statusUnavailable, Error: "shutting down"}
+	}
+	return componentStatus{Status: statusOK}
+}
+
+func (healthHandler *HealthHandler) hubStatus() componentStatus {
+	switch {
+	case healthHandler.hub.ShuttingDown():
+		return componentStatus{Status: statusUnavailable, Error: "shutting down"}
+	case !healthHandler.hub.Running():
+		return componentStatus{Status: statusUnavailable, Error: "not running"}
+	}
+	return componentStatus{Status: statusOK}
+}
+
+func (healthHandler *HealthHandler) migrationsStatus(ctx context.Context) componentStatus {
+	pending, err := healthHandler.migrator.Pending(ctx)
+	if err != nil {
+		return check("migrations", err)
+	}
+	if pending > 0 {
+		return componentStatus{Status: statusUnavailable, Error: fmt.Sprintf("%d migrations pending", pending)}
+	}
+	return componentStatus{Status: statusOK}
+}
+
+// check turns the outcome of checking a component into its status. Errors
+// are logged rather than shown, probes are not authenticated.
+func check(component string, err error) componentStatus {
+	if err != nil {
+		slog.Warn("Readiness check failed", "component", component, "error", err)
+		return componentStatus{Status: statusUnavailable, Error: "check failed"}
+	}
+	return componentStatus{Status: statusOK}
+}
@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"cito/server/database"
+	"cito/server/messager"
+	"cito/server/migrations"
+	"cito/server/service"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthHandler_LivenessHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	NewHealthHandler(nil, nil, nil).LivenessHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"status": "ok"}`, rec.Body.String())
+}
+
+func TestHealthHandler_ReadinessHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		migrate    bool
+		runHub     bool
+		shutdown   bool
+		drain      bool
+		closeDB    bool
+		wantStatus int
+		wantFailed []string
+	}{
+		{name: "ready", migrate: true, runHub: true, wantStatus: http.StatusOK},
+		{name: "pending migrations", runHub: true, wantStatus: http.StatusServiceUnavailable, wantFailed: []string{"migrations"}},
+		{name: "hub not running", migrate: true, wantStatus: http.StatusServiceUnavailable, wantFailed: []string{"hub"}},
+		{name: "shutting down", migrate: true, runHub: true, shutdown: true, wantStatus: http.StatusServiceUnavailable, wantFailed: []string{"hub"}},
+		{name: "draining", migrate: true, runHub: true, drain: true, wantStatus: http.StatusServiceUnavailable, wantFailed: []string{"server"}},
+		{name: "database closed", migrate: true, runHub: true, closeDB: true, wantStatus: http.StatusServiceUnavailable, wantFailed: []string{"database", "migrations"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := database.Open(database.SQLite, filepath.Join(t.TempDir(), "cito.db"))
+			require.NoError(t, err)
+			defer db.Close()
+			migrator, err := migrations.New(db, database.SQLite)
+			require.NoError(t, err)
+			if tt.migrate {
+				_, err := migrator.Up(context.Background())
+				require.NoError(t, err)
+			}
+			hub := messager.NewHubManager(service.NewMemoryRepository(), messager.DefaultMessageBuffer)
+			if tt.runHub {
+				go hub.Run()
+				require.Eventually(t, hub.Running, time.Second, 10*time.Millisecond)
+			}
+			if tt.shutdown {
+				require.NoError(t, hub.Shutdown(context.Background()))
+			}
+			if tt.closeDB {
+				db.Close()
+			}
+
+			healthHandler := NewHealthHandler(db, hub, migrator)
+			if tt.drain {
+				healthHandler.Drain()
+			}
+			rec := httptest.NewRecorder()
+			healthHandler.ReadinessHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			var response healthResponse
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+			var failed []string
+			for _, name := range []string{"database", "hub", "migrations", "server"} {
+				require.Contains(t, response.Components, name)
+				if response.Components[name].Status != statusOK {
+					failed = append(failed, name)
+				}
+			}
+			assert.Equal(t, tt.wantFailed, failed)
+		})
+	}
+}
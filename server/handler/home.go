@@ -1,20 +1,20 @@
 package handler
 
 import (
+	"cito/server/logging"
 	"cito/server/model"
 	"fmt"
-	"log/slog"
 	"net/http"
 )
 
 func HomeHandler(w http.ResponseWriter, r *http.Request) {
-	slog.Info("Home page accessed")
+	logging.FromContext(r.Context()).Info("Home page accessed")
 	// User is logged in - show greeting
 	user, ok := model.GetUserValueFromContext(r.Context())
-	slog.Info("Get Values ", "user", user, "ok", ok)
+	logging.FromContext(r.Context()).Info("Get Values ", "user", user, "ok", ok)
 
 	if !ok {
-		slog.Info("redirect to login")
+		logging.FromContext(r.Context()).Info("redirect to login")
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
 	}
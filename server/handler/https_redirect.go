@@ -0,0 +1,30 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HTTPSRedirectHandler sends plain HTTP requests to the same URL over HTTPS,
+// served on the port of httpsAddr
+func HTTPSRedirectHandler(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if hostname, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = hostname
+		}
+		host = strings.Trim(host, "[]")
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			// IPv6 addresses keep their brackets
+			host = "[" + host + "]"
+		}
+		target := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		// 308 keeps the method and body of form posts
+		http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,33 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPSRedirectHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		httpsAddr string
+		target    string
+		want      string
+	}{
+		{name: "default port", httpsAddr: ":443", target: "http://chat.example.com/login?next=%2F", want: "https://chat.example.com/login?next=%2F"},
+		{name: "other port", httpsAddr: ":8443", target: "http://chat.example.com:8080/ws", want: "https://chat.example.com:8443/ws"},
+		{name: "IPv6", httpsAddr: "[::]:443", target: "http://[::1]:8080/", want: "https://[::1]/"},
+		{name: "IPv6 other port", httpsAddr: "[::]:8443", target: "http://[::1]/", want: "https://[::1]:8443/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			HTTPSRedirectHandler(tt.httpsAddr).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tt.target, nil))
+
+			assert.Equal(t, http.StatusPermanentRedirect, rec.Code)
+			assert.Equal(t, tt.want, rec.Header().Get("Location"))
+		})
+	}
+}
@@ -1,67 +1,268 @@
 package handler
 
 import (
+	"cito/server/logging"
+	"cito/server/middleware"
+	"cito/server/model"
 	"cito/server/service"
-	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
-	"log/slog"
+	"html/template"
+	"net"
 	"net/http"
+	"strconv"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// verifierCookieName holds the PKCE code verifier between /login and the callback
+	verifierCookieName = "oauth_verifier"
+	// stateCookieName and nonceCookieName hold the state and OpenID Connect
+	// nonce of the same login attempt
+	stateCookieName = "oauth_state"
+	nonceCookieName = "oauth_nonce"
+	// linkCookieName marks a provider round trip started from the account
+	// page to link an identity rather than to sign in. It holds the ID of
+	// the session that started it.
+	linkCookieName = "oauth_link"
 )
 
+// setCallbackCookie stores value for the OAuth callback. Over TLS the
+// cookie is never sent in plain HTTP.
+func setCallbackCookie(w http.ResponseWriter, r *http.Request, name string, value string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/oauth2/callback",
+		MaxAge:   600, // 10 minutes to complete the provider round trip
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearCallbackCookie(w http.ResponseWriter, r *http.Request, name string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    "",
+		Path:     "/oauth2/callback",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// errLoginAttempt rejects callbacks that do not complete the login attempt
+// of the browser, such as forged ones
+var errLoginAttempt = errors.New("callback does not match the login attempt")
+
+// setLoginAttemptCookies stores the values of attempt for the callback
+func setLoginAttemptCookies(w http.ResponseWriter, r *http.Request, attempt service.LoginAttempt) {
+	setCallbackCookie(w, r, verifierCookieName, attempt.Verifier)
+	setCallbackCookie(w, r, stateCookieName, attempt.State)
+	setCallbackCookie(w, r, nonceCookieName, attempt.Nonce)
+}
+
+// loginAttempt returns the login attempt the callback completes, once the
+// state the provider sent back matches the one stored in the browser
+func loginAttempt(r *http.Request) (service.LoginAttempt, error) {
+	var attempt service.LoginAttempt
+	for name, value := range map[string]*string{
+		verifierCookieName: &attempt.Verifier,
+		stateCookieName:    &attempt.State,
+		nonceCookieName:    &attempt.Nonce,
+	} {
+		cookie, err := r.Cookie(name)
+		if err != nil || cookie.Value == "" {
+			return attempt, fmt.Errorf("%w: no %s cookie", errLoginAttempt, name)
+		}
+		*value = cookie.Value
+	}
+	if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("state")), []byte(attempt.State)) != 1 {
+		return attempt, fmt.Errorf("%w: state mismatch", errLoginAttempt)
+	}
+	return attempt, nil
+}
+
+func clearLoginAttemptCookies(w http.ResponseWriter, r *http.Request) {
+	for _, name := range []string{verifierCookieName, stateCookieName, nonceCookieName} {
+		clearCallbackCookie(w, r, name)
+	}
+}
+
 type OAuthHandler struct {
-	authService service.AuthService
-	userService service.UserService
+	authService    service.AuthService
+	userService    service.UserService
+	sessionService service.SessionService
+	// twoFactorService decides whether a sign-in needs a second step
+	twoFactorService *service.TwoFactorService
 }
 
-func NewOAuthHandler(authService *service.AuthService, userService *service.UserService) *OAuthHandler {
-	return &OAuthHandler{authService: *authService, userService: *userService}
+func NewOAuthHandler(authService *service.AuthService, userService *service.UserService, sessionService *service.SessionService, twoFactorService *service.TwoFactorService) *OAuthHandler {
+	return &OAuthHandler{authService: *authService, userService: *userService, sessionService: *sessionService, twoFactorService: twoFactorService}
 }
 
+var loginPage = template.Must(template.New("login").Parse(`{{range .}}<p><a href="{{.URL}}">Sign in with {{.DisplayName}}</a></p>
+{{end}}`))
+
+type loginLink struct {
+	DisplayName string
+	URL         string
+}
+
+// LoginHandler offers every configured identity provider. The links share
+// one login attempt since only one of them will be followed.
 func (oauthHandler *OAuthHandler) LoginHandler(w http.ResponseWriter, r *http.Request) {
-	slog.Info("login page")
-	url := oauthHandler.authService.GetLoginURL()
-	slog.Info("OAuth URL generated", "url", url)
-	html := fmt.Sprintf(`<a href="%s">Sign in with GitHub</a>`, url)
-	w.Write([]byte(html))
+	logging.FromContext(r.Context()).Info("login page")
+	attempt := oauthHandler.authService.NewLoginAttempt()
+	setLoginAttemptCookies(w, r, attempt)
+	// An abandoned link attempt must not turn this login into one
+	clearCallbackCookie(w, r, linkCookieName)
+	var links []loginLink
+	for _, provider := range oauthHandler.authService.Providers() {
+		links = append(links, loginLink{
+			DisplayName: provider.DisplayName(),
+			URL:         provider.AuthCodeURL(attempt),
+		})
+	}
+	if err := loginPage.Execute(w, links); err != nil {
+		logging.FromContext(r.Context()).Error("Failed to render login page", "error", err)
+	}
 }
 
+// CallBackHandler completes a login at /oauth2/callback/{provider}. The bare
+// /oauth2/callback path is kept for GitHub apps registered before other
+// providers existed.
 func (oauthHandler *OAuthHandler) CallBackHandler(w http.ResponseWriter, r *http.Request) {
 	code := r.URL.Query().Get("code")
-	slog.Info("OAuth callback received", "code", code)
-	tok, err := oauthHandler.authService.GetGHToken(context.TODO(), code)
+	providerName := r.PathValue("provider")
+	if providerName == "" {
+		providerName = model.ProviderGitHub
+	}
+	logging.FromContext(r.Context()).Info("OAuth callback received", "provider", providerName)
+	attempt, err := loginAttempt(r)
+	// The attempt is single use
+	clearLoginAttemptCookies(w, r)
 	if err != nil {
-		slog.Error("OAuth exchange error", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		logging.FromContext(r.Context()).Warn("OAuth callback rejected", "provider", providerName, "error", err)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	// Fetch GitHub user information
-	githubUser, err := oauthHandler.authService.FetchGitHubUser(tok.AccessToken)
+	identity, tok, err := oauthHandler.authService.Authenticate(r.Context(), providerName, code, attempt)
+	if errors.Is(err, service.ErrUnknownProvider) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, service.ErrInvalidIDToken) {
+		logging.FromContext(r.Context()).Warn("OAuth login rejected", "provider", providerName, "error", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 	if err != nil {
-		slog.Error("Failed to fetch GitHub user", "error", err)
+		logging.FromContext(r.Context()).Error("OAuth login failed", "provider", providerName, "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	slog.Info("GitHub user authenticated", "id", githubUser.ID, "login", githubUser.Login, "email", githubUser.Email)
+	logging.FromContext(r.Context()).Info("User authenticated", "provider", identity.Provider, "subject", identity.Subject, "username", identity.Username)
+
+	if linkCookie, err := r.Cookie(linkCookieName); err == nil {
+		clearCallbackCookie(w, r, linkCookieName)
+		oauthHandler.linkIdentity(w, r, linkCookie.Value, identity, tok)
+		return
+	}
+
+	userID, err := oauthHandler.userService.UpsertIdentity(r.Context(), *identity, tok)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to upsert user", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	// Upsert user and get session token
-	sessionToken, err := oauthHandler.userService.UpsertUser(*githubUser, tok.AccessToken)
+	// Users with two-factor authentication, or whose workspace requires it,
+	// only get a session after the second step
+	needsSecondFactor, err := oauthHandler.twoFactorService.NeedsSecondFactor(userID)
 	if err != nil {
-		slog.Error("Failed to upsert user", "error", err)
+		logging.FromContext(r.Context()).Error("Failed to check two-factor status", "error", err, "user_id", userID)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if needsSecondFactor {
+		challengeToken, err := oauthHandler.twoFactorService.CreateChallenge(userID)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("Failed to create login challenge", "error", err, "user_id", userID)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		setChallengeCookie(w, r, challengeToken)
+		http.Redirect(w, r, "/2fa", http.StatusFound)
+		return
+	}
 
-	// Set session cookie
-	http.SetCookie(w, &http.Cookie{
-		Name:     "session_token",
-		Value:    sessionToken,
-		Path:     "/",
-		MaxAge:   86400 * 7, // 7 days
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-	})
+	if err := startSession(w, r, &oauthHandler.sessionService, userID); err != nil {
+		logging.FromContext(r.Context()).Error("Failed to create session", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
+
+// startSession opens a new session for this device and sets its cookie,
+// other devices stay logged in
+func startSession(w http.ResponseWriter, r *http.Request, sessionService *service.SessionService, userID int) error {
+	sessionToken, err := sessionService.CreateSession(userID, r.UserAgent(), clientIP(r))
+	if err != nil {
+		return err
+	}
+	middleware.SetSessionCookie(w, r, sessionToken, sessionService.TTL())
+	return nil
+}
+
+// linkIdentity attaches identity to the account signed in with the session
+// cookie instead of signing in with it. The session must be the one that
+// started the link, linkSessionID.
+func (oauthHandler *OAuthHandler) linkIdentity(w http.ResponseWriter, r *http.Request, linkSessionID string, identity *model.Identity, token *oauth2.Token) {
+	sessionCookie, err := r.Cookie(middleware.SessionCookieName)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	user, err := oauthHandler.userService.FindUserBySession(r.Context(), sessionCookie.Value)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("Identity link without a valid session", "error", err)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	if strconv.Itoa(user.SessionID) != linkSessionID {
+		logging.FromContext(r.Context()).Warn("Identity link from another session", "user_id", user.ID, "session_id", user.SessionID)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = oauthHandler.userService.LinkIdentity(r.Context(), user.ID, *identity, token)
+	if errors.Is(err, service.ErrIdentityConflict) {
+		renderAccountMessage(w, http.StatusConflict, "This "+identity.Provider+" account ("+identity.Username+
+			") is already linked to another cito account. Sign in with it and unlink it there first.")
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to link identity", "error", err, "user_id", user.ID)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/account", http.StatusFound)
+}
+
+// clientIP returns the remote address of the request without its port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -5,12 +5,14 @@ import (
 	"cito/server/service"
 	"cito/server/testutil"
 	"context"
+	"crypto/tls"
 	"database/sql"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/oauth2"
@@ -33,6 +35,44 @@ func mockHTTPClient(statusCode int, body string) *http.Client {
 	}
 }
 
+// expectNewIdentity expects the first login of an identity, creating userID
+func expectNewIdentity(mock sqlmock.Sqlmock, userID int) {
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE identities`).WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(`UPDATE users`).WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(`INSERT INTO users`).
+		WillReturnRows(testutil.NewMockRows([]string{"id"}).AddRow(userID))
+	mock.ExpectExec(`INSERT INTO identities`).
+		WithArgs(userID, "github", "12345", "testuser", "test@example.com", true, sqlmock.AnyArg(), nil, nil, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+// expectTwoFactorStatus expects the two-factor check of a sign-in
+func expectTwoFactorStatus(mock sqlmock.Sqlmock, userID int, enabled bool) {
+	mock.ExpectQuery(`SELECT (.+) FROM user_totp`).WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"enabled", "remaining"}).AddRow(enabled, 0))
+	mock.ExpectQuery(`FROM workspace_members`).WithArgs(userID).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+}
+
+// newTestOAuthHandler builds an OAuthHandler with every service on db
+func newTestOAuthHandler(t *testing.T, authService *service.AuthService, db *sql.DB) *OAuthHandler {
+	keys := testutil.NewTestKeyring(t)
+	twoFactorService := service.NewTwoFactorService(db, keys, service.NewWorkspaceService(db))
+	return NewOAuthHandler(authService, service.NewUserService(service.NewPostgresRepository(db), keys), service.NewSessionService(service.NewPostgresRepository(db)), twoFactorService)
+}
+
+// testLoginAttempt is the login attempt the callbacks of the tests complete
+var testLoginAttempt = service.LoginAttempt{State: "test_state", Nonce: "test_nonce", Verifier: "test_verifier"}
+
+// addLoginAttemptCookies adds the cookies the login page sets for attempt
+func addLoginAttemptCookies(req *http.Request, attempt service.LoginAttempt) {
+	req.AddCookie(&http.Cookie{Name: verifierCookieName, Value: attempt.Verifier})
+	req.AddCookie(&http.Cookie{Name: stateCookieName, Value: attempt.State})
+	req.AddCookie(&http.Cookie{Name: nonceCookieName, Value: attempt.Nonce})
+}
+
 func TestOAuthHandler_LoginHandler(t *testing.T) {
 	tests := []struct {
 		name             string
@@ -44,21 +84,23 @@ func TestOAuthHandler_LoginHandler(t *testing.T) {
 			name:             "returns HTML with OAuth URL",
 			authCodeURL:      "https://github.com/login/oauth/authorize?client_id=test&state=state",
 			wantStatus:       http.StatusOK,
-			wantBodyContains: `<a href="https://github.com/login/oauth/authorize?client_id=test&state=state">Sign in with GitHub</a>`,
+			wantBodyContains: `<a href="https://github.com/login/oauth/authorize?client_id=test&amp;state=state">Sign in with GitHub</a>`,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			var gotOpts []oauth2.AuthCodeOption
+			var gotState string
 			mockOAuth := &testutil.MockOAuth2Config{
 				AuthCodeURLFunc: func(state string, opts ...oauth2.AuthCodeOption) string {
+					gotState, gotOpts = state, opts
 					return tt.authCodeURL
 				},
 			}
 
-			authService := service.NewAuthService(mockOAuth, nil)
-			userService := service.NewUserService(nil)
-			handler := NewOAuthHandler(authService, userService)
+			authService := service.NewAuthService(service.NewGitHubProvider(mockOAuth, nil, ""))
+			handler := newTestOAuthHandler(t, authService, nil)
 
 			req := httptest.NewRequest("GET", "/login", nil)
 			rec := httptest.NewRecorder()
@@ -67,6 +109,51 @@ func TestOAuthHandler_LoginHandler(t *testing.T) {
 
 			assert.Equal(t, tt.wantStatus, rec.Code, "status code should match")
 			assert.Contains(t, rec.Body.String(), tt.wantBodyContains, "body should contain OAuth URL")
+			assert.Len(t, gotOpts, 1, "PKCE challenge should be passed to AuthCodeURL")
+
+			cookies := map[string]*http.Cookie{}
+			for _, cookie := range rec.Result().Cookies() {
+				cookies[cookie.Name] = cookie
+			}
+			for _, name := range []string{verifierCookieName, stateCookieName, nonceCookieName} {
+				cookie := cookies[name]
+				require.NotNil(t, cookie, "%s cookie should be set", name)
+				assert.NotEmpty(t, cookie.Value)
+				assert.True(t, cookie.HttpOnly, "%s cookie should be HttpOnly", name)
+				assert.Equal(t, "/oauth2/callback", cookie.Path)
+			}
+			assert.Equal(t, cookies[stateCookieName].Value, gotState, "the state should be the one of the attempt")
+		})
+	}
+}
+
+func TestSignInCookies_SecureOverTLS(t *testing.T) {
+	tests := []struct {
+		name       string
+		tls        bool
+		wantSecure bool
+	}{
+		{name: "plain HTTP", tls: false, wantSecure: false},
+		{name: "TLS", tls: true, wantSecure: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			rec := httptest.NewRecorder()
+			setCallbackCookie(rec, req, linkCookieName, "1")
+			clearCallbackCookie(rec, req, linkCookieName)
+			setChallengeCookie(rec, req, "token")
+			clearChallengeCookie(rec, req)
+
+			cookies := rec.Result().Cookies()
+			require.Len(t, cookies, 4)
+			for _, cookie := range cookies {
+				assert.Equal(t, tt.wantSecure, cookie.Secure, cookie.Name)
+			}
 		})
 	}
 }
@@ -78,6 +165,9 @@ func TestOAuthHandler_CallBackHandler(t *testing.T) {
 		mockOAuth    *testutil.MockOAuth2Config
 		httpClient   *http.Client
 		setupMockDB  func() (*sql.DB, func())
+		noVerifier   bool
+		state        string
+		provider     string
 		wantStatus   int
 		wantLocation string
 		wantCookie   bool
@@ -87,20 +177,75 @@ func TestOAuthHandler_CallBackHandler(t *testing.T) {
 			code: "valid_code",
 			mockOAuth: &testutil.MockOAuth2Config{
 				ExchangeFunc: func(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+					if len(opts) != 1 {
+						return nil, assert.AnError
+					}
 					return &oauth2.Token{AccessToken: "github_access_token"}, nil
 				},
 			},
 			httpClient: mockHTTPClient(http.StatusOK, `{"id":12345,"login":"testuser","email":"test@example.com"}`),
 			setupMockDB: func() (*sql.DB, func()) {
 				db, mock, cleanup := testutil.SetupMockDB(t)
-				mock.ExpectQuery(`INSERT INTO users`).
-					WillReturnRows(testutil.NewMockRows([]string{"session_token"}).AddRow("new_session_token"))
+				expectNewIdentity(mock, 1)
+				expectTwoFactorStatus(mock, 1, false)
+				mock.ExpectQuery(`INSERT INTO sessions`).
+					WithArgs(sqlmock.AnyArg(), 1, sqlmock.AnyArg(), sqlmock.AnyArg(), "Go-http-client/1.1", "192.0.2.1").
+					WillReturnRows(testutil.NewMockRows([]string{"id"}).AddRow(10))
 				return db, cleanup
 			},
 			wantStatus:   http.StatusFound,
 			wantLocation: "/",
 			wantCookie:   true,
 		},
+		{
+			name: "two-factor user is sent to the second step",
+			code: "valid_code",
+			mockOAuth: &testutil.MockOAuth2Config{
+				ExchangeFunc: func(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+					return &oauth2.Token{AccessToken: "github_access_token"}, nil
+				},
+			},
+			httpClient: mockHTTPClient(http.StatusOK, `{"id":12345,"login":"testuser","email":"test@example.com"}`),
+			setupMockDB: func() (*sql.DB, func()) {
+				db, mock, cleanup := testutil.SetupMockDB(t)
+				expectNewIdentity(mock, 1)
+				expectTwoFactorStatus(mock, 1, true)
+				mock.ExpectExec(`INSERT INTO login_challenges`).
+					WithArgs(sqlmock.AnyArg(), 1, sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				return db, cleanup
+			},
+			wantStatus:   http.StatusFound,
+			wantLocation: "/2fa",
+			wantCookie:   false,
+		},
+		{
+			name:       "missing login attempt cookies",
+			code:       "valid_code",
+			mockOAuth:  &testutil.MockOAuth2Config{},
+			httpClient: mockHTTPClient(http.StatusOK, ""),
+			noVerifier: true,
+			wantStatus: http.StatusBadRequest,
+			wantCookie: false,
+		},
+		{
+			name:       "state does not match the login attempt",
+			code:       "valid_code",
+			mockOAuth:  &testutil.MockOAuth2Config{},
+			httpClient: mockHTTPClient(http.StatusOK, ""),
+			state:      "forged",
+			wantStatus: http.StatusBadRequest,
+			wantCookie: false,
+		},
+		{
+			name:       "unknown provider",
+			code:       "valid_code",
+			mockOAuth:  &testutil.MockOAuth2Config{},
+			httpClient: mockHTTPClient(http.StatusOK, ""),
+			provider:   "gitlab",
+			wantStatus: http.StatusNotFound,
+			wantCookie: false,
+		},
 		{
 			name: "OAuth exchange fails",
 			code: "invalid_code",
@@ -138,7 +283,29 @@ func TestOAuthHandler_CallBackHandler(t *testing.T) {
 			httpClient: mockHTTPClient(http.StatusOK, `{"id":12345,"login":"testuser","email":"test@example.com"}`),
 			setupMockDB: func() (*sql.DB, func()) {
 				db, mock, cleanup := testutil.SetupMockDB(t)
-				mock.ExpectQuery(`INSERT INTO users`).
+				mock.ExpectBegin()
+				mock.ExpectQuery(`UPDATE identities`).
+					WillReturnError(sql.ErrConnDone)
+				mock.ExpectRollback()
+				return db, cleanup
+			},
+			wantStatus: http.StatusInternalServerError,
+			wantCookie: false,
+		},
+		{
+			name: "session creation fails",
+			code: "valid_code",
+			mockOAuth: &testutil.MockOAuth2Config{
+				ExchangeFunc: func(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+					return &oauth2.Token{AccessToken: "github_access_token"}, nil
+				},
+			},
+			httpClient: mockHTTPClient(http.StatusOK, `{"id":12345,"login":"testuser","email":"test@example.com"}`),
+			setupMockDB: func() (*sql.DB, func()) {
+				db, mock, cleanup := testutil.SetupMockDB(t)
+				expectNewIdentity(mock, 1)
+				expectTwoFactorStatus(mock, 1, false)
+				mock.ExpectQuery(`INSERT INTO sessions`).
 					WillReturnError(sql.ErrConnDone)
 				return db, cleanup
 			},
@@ -156,11 +323,19 @@ func TestOAuthHandler_CallBackHandler(t *testing.T) {
 				defer cleanup()
 			}
 
-			authService := service.NewAuthService(tt.mockOAuth, tt.httpClient)
-			userService := service.NewUserService(db)
-			handler := NewOAuthHandler(authService, userService)
+			authService := service.NewAuthService(service.NewGitHubProvider(tt.mockOAuth, tt.httpClient, ""))
+			handler := newTestOAuthHandler(t, authService, db)
 
-			req := httptest.NewRequest("GET", "/oauth2/callback?code="+tt.code, nil)
+			state := tt.state
+			if state == "" {
+				state = testLoginAttempt.State
+			}
+			req := httptest.NewRequest("GET", "/oauth2/callback?code="+tt.code+"&state="+state, nil)
+			req.Header.Set("User-Agent", "Go-http-client/1.1")
+			req.SetPathValue("provider", tt.provider)
+			if !tt.noVerifier {
+				addLoginAttemptCookies(req, testLoginAttempt)
+			}
 			rec := httptest.NewRecorder()
 
 			handler.CallBackHandler(rec, req)
@@ -193,4 +368,88 @@ func TestOAuthHandler_CallBackHandler(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+func TestOAuthHandler_CallBackHandler_LinkIdentity(t *testing.T) {
+	sessionRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "username", "email", "session_id"}).AddRow(3, "me", "me@example.com", 10)
+	}
+
+	tests := []struct {
+		name    string
+		session bool
+		// linkSession is the session that started the link, 10 unless set
+		linkSession  string
+		mockSetup    func(sqlmock.Sqlmock)
+		wantStatus   int
+		wantLocation string
+	}{
+		{
+			name:    "links identity to the signed in account",
+			session: true,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT (.+) FROM sessions s JOIN users u`).WillReturnRows(sessionRows())
+				mock.ExpectQuery(`INSERT INTO identities (.+) ON CONFLICT`).
+					WithArgs(3, "github", "12345", "testuser", "test@example.com", true, sqlmock.AnyArg(), nil, nil, sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(3))
+			},
+			wantStatus:   http.StatusFound,
+			wantLocation: "/account",
+		},
+		{
+			name:    "identity belongs to another account",
+			session: true,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT (.+) FROM sessions s JOIN users u`).WillReturnRows(sessionRows())
+				mock.ExpectQuery(`INSERT INTO identities (.+) ON CONFLICT`).WillReturnError(sql.ErrNoRows)
+			},
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:        "link started by another session",
+			session:     true,
+			linkSession: "11",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT (.+) FROM sessions s JOIN users u`).WillReturnRows(sessionRows())
+			},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:         "link without a session",
+			mockSetup:    func(mock sqlmock.Sqlmock) {},
+			wantStatus:   http.StatusFound,
+			wantLocation: "/login",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.SetupMockDB(t)
+			defer cleanup()
+			tt.mockSetup(mock)
+
+			authService := service.NewAuthService(service.NewGitHubProvider(&testutil.MockOAuth2Config{},
+				mockHTTPClient(http.StatusOK, `{"id":12345,"login":"testuser","email":"test@example.com"}`), ""))
+			handler := newTestOAuthHandler(t, authService, db)
+
+			req := httptest.NewRequest("GET", "/oauth2/callback?code=valid_code&state="+testLoginAttempt.State, nil)
+			addLoginAttemptCookies(req, testLoginAttempt)
+			linkSession := tt.linkSession
+			if linkSession == "" {
+				linkSession = "10"
+			}
+			req.AddCookie(&http.Cookie{Name: linkCookieName, Value: linkSession})
+			if tt.session {
+				req.AddCookie(&http.Cookie{Name: "session_token", Value: "session"})
+			}
+			rec := httptest.NewRecorder()
+			handler.CallBackHandler(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, tt.wantLocation, rec.Header().Get("Location"))
+			for _, cookie := range rec.Result().Cookies() {
+				assert.NotEqual(t, "session_token", cookie.Name, "linking must not start a new session")
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
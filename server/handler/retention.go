@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"cito/server/model"
+	"cito/server/service"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+type RetentionHandler struct {
+	retentionService *service.RetentionService
+}
+
+func NewRetentionHandler(retentionService *service.RetentionService) *RetentionHandler {
+	return &RetentionHandler{retentionService: retentionService}
+}
+
+type retentionResponse struct {
+	Default       model.RetentionPolicy         `json:"default"`
+	Conversations []model.ConversationRetention `json:"conversations"`
+}
+
+// writeRetentionError maps retention service errors to API responses
+func writeRetentionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, service.ErrNotAdmin):
+		writeJSONError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, service.ErrUserNotFound):
+		writeJSONError(w, http.StatusNotFound, "user not found")
+	case errors.Is(err, service.ErrRetentionPolicyNotFound):
+		writeJSONError(w, http.StatusNotFound, "conversation follows the default policy")
+	case errors.Is(err, service.ErrInvalidRetention):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	default:
+		slog.Error("Retention request failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "retention request failed")
+	}
+}
+
+// pathConversation reads the {user_id} and {other_user_id} path values
+func pathConversation(w http.ResponseWriter, r *http.Request) (model.Conversation, bool) {
+	userID, err := strconv.Atoi(r.PathValue("user_id"))
+	otherUserID, otherErr := strconv.Atoi(r.PathValue("other_user_id"))
+	if err != nil || otherErr != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid user id")
+		return model.Conversation{}, false
+	}
+	return model.NewConversation(userID, otherUserID), true
+}
+
+// PoliciesHandler serves GET /api/admin/retention with the default policy
+// and the policy in effect for each conversation
+func (retentionHandler *RetentionHandler) PoliciesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	defaultPolicy, err := retentionHandler.retentionService.DefaultPolicy(user.ID)
+	if err != nil {
+		writeRetentionError(w, err)
+		return
+	}
+	conversations, err := retentionHandler.retentionService.ListConversationPolicies(user.ID)
+	if err != nil {
+		writeRetentionError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, retentionResponse{Default: defaultPolicy, Conversations: conversations})
+}
+
+// SetConversationPolicyHandler serves
+// PUT /api/admin/retention/conversations/{user_id}/{other_user_id}
+func (retentionHandler *RetentionHandler) SetConversationPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	conversation, ok := pathConversation(w, r)
+	if !ok {
+		return
+	}
+	var policy model.RetentionPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "max_age must be a duration such as \"30d\" or \"12h\"")
+		return
+	}
+	if err := retentionHandler.retentionService.SetConversationPolicy(r.Context(), user.ID, conversation, policy); err != nil {
+		writeRetentionError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ClearConversationPolicyHandler serves
+// DELETE /api/admin/retention/conversations/{user_id}/{other_user_id}
+func (retentionHandler *RetentionHandler) ClearConversationPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	conversation, ok := pathConversation(w, r)
+	if !ok {
+		return
+	}
+	if err := retentionHandler.retentionService.ClearConversationPolicy(r.Context(), user.ID, conversation); err != nil {
+		writeRetentionError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PurgeRunsHandler serves GET /api/admin/retention/runs
+func (retentionHandler *RetentionHandler) PurgeRunsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	runs, err := retentionHandler.retentionService.ListPurgeRuns(user.ID)
+	if err != nil {
+		writeRetentionError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, runs)
+}
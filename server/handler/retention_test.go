@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"cito/server/model"
+	"cito/server/service"
+	"cito/server/testutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRetentionHandler returns a handler administered by user 1, with
+// users 1 and 2 and a 30 day default policy
+func newTestRetentionHandler(t *testing.T) (*RetentionHandler, *service.MemoryRepository) {
+	repo := service.NewMemoryRepository()
+	userService := service.NewUserService(repo, testutil.NewTestKeyring(t))
+	for i := 1; i <= 2; i++ {
+		_, err := repo.UpsertIdentity(model.GitHubUser{ID: int64(i), Login: "user"}.Identity(), service.SealedToken{AccessToken: "token"}, time.Now())
+		require.NoError(t, err)
+	}
+	defaultPolicy := model.RetentionPolicy{MaxAge: 30 * 24 * time.Hour}
+	return NewRetentionHandler(service.NewRetentionService(repo, userService, defaultPolicy, []int{1})), repo
+}
+
+func TestRetentionHandler_SetConversationPolicyHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		userID     int
+		otherID    string
+		body       string
+		wantStatus int
+	}{
+		{name: "admin sets policy", userID: 1, otherID: "2", body: `{"max_age":"7d","archive":true}`, wantStatus: http.StatusNoContent},
+		{name: "empty max age keeps forever", userID: 1, otherID: "2", body: `{"max_age":""}`, wantStatus: http.StatusNoContent},
+		{name: "not an admin", userID: 2, otherID: "2", body: `{"max_age":"7d"}`, wantStatus: http.StatusForbidden},
+		{name: "unknown user", userID: 1, otherID: "9", body: `{"max_age":"7d"}`, wantStatus: http.StatusNotFound},
+		{name: "invalid max age", userID: 1, otherID: "2", body: `{"max_age":"a week"}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid id", userID: 1, otherID: "abc", body: `{"max_age":"7d"}`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler, _ := newTestRetentionHandler(t)
+			req := httptest.NewRequest(http.MethodPut, "/api/admin/retention/conversations/1/"+tt.otherID, strings.NewReader(tt.body))
+			req.SetPathValue("user_id", "1")
+			req.SetPathValue("other_user_id", tt.otherID)
+			req = req.WithContext(model.NewContextWithUserValue(req.Context(), &model.UserModel{ID: tt.userID}))
+			rec := httptest.NewRecorder()
+			handler.SetConversationPolicyHandler(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+		})
+	}
+}
+
+func TestRetentionHandler_PoliciesHandler(t *testing.T) {
+	handler, repo := newTestRetentionHandler(t)
+	require.NoError(t, repo.SaveMessage(&model.Message{FromUserID: 2, ToUserId: 1, TextContent: "hi", Time: time.Now()}))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/retention", nil)
+	req = req.WithContext(model.NewContextWithUserValue(req.Context(), &model.UserModel{ID: 1}))
+	rec := httptest.NewRecorder()
+	handler.PoliciesHandler(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{
+		"default": {"max_age": "30d", "archive": false},
+		"conversations": [
+			{"user_id": 1, "other_user_id": 2, "policy": {"max_age": "30d", "archive": false}, "override": false}
+		]
+	}`, rec.Body.String())
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"cito/server/model"
+	"cito/server/service"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type RoomHandler struct {
+	roomService *service.RoomService
+}
+
+func NewRoomHandler(roomService *service.RoomService) *RoomHandler {
+	return &RoomHandler{roomService: roomService}
+}
+
+// ListRoomsHandler serves GET /api/rooms
+func (roomHandler *RoomHandler) ListRoomsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	rooms, err := roomHandler.roomService.ListRooms(user.ID)
+	if err != nil {
+		slog.Error("Failed to list rooms", "error", err, "user_id", user.ID)
+		writeJSONError(w, http.StatusInternalServerError, "failed to list rooms")
+		return
+	}
+	writeJSON(w, http.StatusOK, rooms)
+}
+
+// RoomMessagesHandler serves GET /api/rooms/{id}/messages, newest first.
+// The optional before query value, an RFC 3339 time, pages back in time.
+func (roomHandler *RoomHandler) RoomMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	roomID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid room id")
+		return
+	}
+	before := time.Now()
+	if value := r.URL.Query().Get("before"); value != "" {
+		if before, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid before time")
+			return
+		}
+	}
+	messages, err := roomHandler.roomService.ListMessages(user.ID, roomID, before)
+	if errors.Is(err, service.ErrRoomNotFound) {
+		writeJSONError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to list room messages", "error", err, "room_id", roomID)
+		writeJSONError(w, http.StatusInternalServerError, "failed to list room messages")
+		return
+	}
+	writeJSON(w, http.StatusOK, messages)
+}
@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"cito/server/model"
+	"cito/server/service"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoomHandler_RoomMessagesHandler(t *testing.T) {
+	repo := service.NewMemoryRepository()
+	for _, name := range []string{"alice", "bob"} {
+		_, err := repo.CreateUser(name, "")
+		require.NoError(t, err)
+	}
+	room := model.Room{Name: "general", CreatedAt: time.Now()}
+	require.NoError(t, repo.CreateRoom(&room))
+	require.NoError(t, repo.AddRoomMember(room.ID, 1))
+	require.NoError(t, repo.SaveRoomMessage(&model.Message{RoomID: room.ID, FromUserID: 1, TextContent: "hi", Time: time.Now().Add(-time.Minute)}))
+	handler := NewRoomHandler(service.NewRoomService(repo))
+
+	tests := []struct {
+		name       string
+		userID     int
+		roomID     string
+		query      string
+		wantStatus int
+		wantCount  int
+	}{
+		{name: "member", userID: 1, roomID: "1", wantStatus: http.StatusOK, wantCount: 1},
+		{name: "before the first message", userID: 1, roomID: "1", query: "?before=2001-01-01T00:00:00Z", wantStatus: http.StatusOK},
+		{name: "not a member", userID: 2, roomID: "1", wantStatus: http.StatusNotFound},
+		{name: "unknown room", userID: 1, roomID: "9", wantStatus: http.StatusNotFound},
+		{name: "invalid room", userID: 1, roomID: "general", wantStatus: http.StatusBadRequest},
+		{name: "invalid before", userID: 1, roomID: "1", query: "?before=yesterday", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/rooms/"+tt.roomID+"/messages"+tt.query, nil)
+			req.SetPathValue("id", tt.roomID)
+			req = req.WithContext(model.NewContextWithUserValue(req.Context(), &model.UserModel{ID: tt.userID}))
+			rec := httptest.NewRecorder()
+			handler.RoomMessagesHandler(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			if tt.wantStatus == http.StatusOK {
+				var messages []model.Message
+				require.NoError(t, json.NewDecoder(rec.Body).Decode(&messages))
+				assert.Len(t, messages, tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestRoomHandler_ListRoomsHandler(t *testing.T) {
+	repo := service.NewMemoryRepository()
+	_, err := repo.CreateUser("alice", "")
+	require.NoError(t, err)
+	room := model.Room{Name: "general", CreatedAt: time.Now()}
+	require.NoError(t, repo.CreateRoom(&room))
+	require.NoError(t, repo.AddRoomMember(room.ID, 1))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/rooms", nil)
+	req = req.WithContext(model.NewContextWithUserValue(req.Context(), &model.UserModel{ID: 1}))
+	rec := httptest.NewRecorder()
+	NewRoomHandler(service.NewRoomService(repo)).ListRoomsHandler(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	var rooms []model.Room
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&rooms))
+	require.Len(t, rooms, 1)
+	assert.Equal(t, "general", rooms[0].Name)
+}
@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"cito/server/logging"
+	"cito/server/messager"
+	"cito/server/middleware"
+	"cito/server/model"
+	"cito/server/service"
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type SessionHandler struct {
+	sessionService *service.SessionService
+	hub            *messager.HubManager
+}
+
+func NewSessionHandler(sessionService *service.SessionService, hub *messager.HubManager) *SessionHandler {
+	return &SessionHandler{sessionService: sessionService, hub: hub}
+}
+
+// sessionResponse is the API view of a session
+type sessionResponse struct {
+	ID         int       `json:"id"`
+	Device     string    `json:"device"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+// LogoutHandler ends the current session and drops its WebSocket connections
+func (sessionHandler *SessionHandler) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if err := sessionHandler.sessionService.DeleteSession(user.SessionID); err != nil {
+		logging.FromContext(r.Context()).Error("Failed to delete session", "error", err, "session_id", user.SessionID)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	sessionHandler.hub.DisconnectSession(user.SessionID)
+
+	middleware.ClearSessionCookie(w, r)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// listSessions returns the active sessions of the current user
+func (sessionHandler *SessionHandler) listSessions(user *model.UserModel) ([]sessionResponse, error) {
+	sessions, err := sessionHandler.sessionService.ListSessions(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	response := make([]sessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, sessionResponse{
+			ID:         session.ID,
+			Device:     session.UserAgent,
+			IPAddress:  session.IPAddress,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+			ExpiresAt:  session.ExpiresAt,
+			Current:    session.ID == user.SessionID,
+		})
+	}
+	return response, nil
+}
+
+// ListSessionsHandler serves GET /api/sessions
+func (sessionHandler *SessionHandler) ListSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+
+	sessions, err := sessionHandler.listSessions(user)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to list sessions", "error", err, "user_id", user.ID)
+		writeJSONError(w, http.StatusInternalServerError, "failed to list sessions")
+		return
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// RevokeSessionHandler serves DELETE /api/sessions/{id}. The session's
+// WebSocket connections are dropped right away.
+func (sessionHandler *SessionHandler) RevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	sessionID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid session id")
+		return
+	}
+
+	err = sessionHandler.sessionService.RevokeSession(user.ID, sessionID)
+	if errors.Is(err, service.ErrSessionNotFound) {
+		writeJSONError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to revoke session", "error", err, "session_id", sessionID)
+		writeJSONError(w, http.StatusInternalServerError, "failed to revoke session")
+		return
+	}
+	sessionHandler.hub.DisconnectSession(sessionID)
+
+	if sessionID == user.SessionID {
+		middleware.ClearSessionCookie(w, r)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeOtherSessionsHandler serves POST /api/sessions/revoke-others, signing
+// the user out everywhere except the current session
+func (sessionHandler *SessionHandler) RevokeOtherSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+
+	revoked, err := sessionHandler.sessionService.RevokeOtherSessions(user.ID, user.SessionID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to revoke sessions", "error", err, "user_id", user.ID)
+		writeJSONError(w, http.StatusInternalServerError, "failed to revoke sessions")
+		return
+	}
+	for _, sessionID := range revoked {
+		sessionHandler.hub.DisconnectSession(sessionID)
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"revoked": len(revoked)})
+}
+
+var sessionsPage = template.Must(template.New("sessions").Parse(`<h1>Your sessions</h1>
+<table>
+<tr><th>Device</th><th>IP</th><th>Last seen</th><th></th></tr>
+{{range .}}<tr>
+<td>{{.Device}}</td><td>{{.IPAddress}}</td><td>{{.LastSeenAt.Format "2006-01-02 15:04"}}</td>
+<td>{{if .Current}}this device{{else}}<button onclick="revoke({{.ID}})">Sign out</button>{{end}}</td>
+</tr>{{end}}
+</table>
+<button onclick="revokeOthers()">Sign out everywhere else</button>
+<form method="post" action="/logout"><button>Log out</button></form>
+<script>
+function revoke(id) {
+	fetch("/api/sessions/" + id, {method: "DELETE"}).then(() => location.reload());
+}
+function revokeOthers() {
+	fetch("/api/sessions/revoke-others", {method: "POST"}).then(() => location.reload());
+}
+</script>
+`))
+
+// SessionsPageHandler serves GET /sessions, a page listing the user's sessions
+func (sessionHandler *SessionHandler) SessionsPageHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	sessions, err := sessionHandler.listSessions(user)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to list sessions", "error", err, "user_id", user.ID)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err := sessionsPage.Execute(w, sessions); err != nil {
+		logging.FromContext(r.Context()).Error("Failed to render sessions page", "error", err)
+	}
+}
@@ -0,0 +1,235 @@
+package handler
+
+import (
+	"cito/server/messager"
+	"cito/server/model"
+	"cito/server/service"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// seedSessions stores a user with one session per device in repository and
+// returns the user and session IDs
+func seedSessions(t *testing.T, repository *service.MemoryRepository, devices ...string) (int, []int) {
+	now := time.Now()
+	userID, err := repository.UpsertIdentity(model.Identity{Provider: "github", Subject: "1", Username: "testuser"}, service.SealedToken{AccessToken: "sealed"}, now)
+	require.NoError(t, err)
+
+	var sessionIDs []int
+	for i, device := range devices {
+		sessionID, err := repository.CreateSession(model.SessionModel{
+			UserID:    userID,
+			CreatedAt: now.Add(-time.Duration(i) * time.Minute),
+			ExpiresAt: now.Add(time.Hour),
+			UserAgent: device,
+			IPAddress: "10.0.0." + strconv.Itoa(i+1),
+		}, "hash_"+device)
+		require.NoError(t, err)
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	return userID, sessionIDs
+}
+
+// failingSessions is a session repository whose deletes fail
+type failingSessions struct {
+	*service.MemoryRepository
+}
+
+func (failingSessions) DeleteSession(sessionID int) error {
+	return errors.New("connection refused")
+}
+
+func newTestSessionHandler(sessions service.SessionRepository) *SessionHandler {
+	return NewSessionHandler(service.NewSessionService(sessions), messager.NewHubManager(service.NewMemoryRepository(), messager.DefaultMessageBuffer))
+}
+
+func TestSessionHandler_LogoutHandler(t *testing.T) {
+	tests := []struct {
+		name         string
+		user         bool
+		failing      bool
+		wantStatus   int
+		wantLocation string
+		wantCleared  bool
+	}{
+		{
+			name:         "deletes session and clears cookie",
+			user:         true,
+			wantStatus:   http.StatusSeeOther,
+			wantLocation: "/login",
+			wantCleared:  true,
+		},
+		{
+			name:         "without user redirects to login",
+			wantStatus:   http.StatusFound,
+			wantLocation: "/login",
+		},
+		{
+			name:       "database error",
+			user:       true,
+			failing:    true,
+			wantStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repository := service.NewMemoryRepository()
+			userID, sessionIDs := seedSessions(t, repository, "laptop")
+			var sessions service.SessionRepository = repository
+			if tt.failing {
+				sessions = failingSessions{repository}
+			}
+			handler := newTestSessionHandler(sessions)
+
+			req := httptest.NewRequest(http.MethodPost, "/logout", nil)
+			if tt.user {
+				req = req.WithContext(model.NewContextWithUserValue(req.Context(), &model.UserModel{ID: userID, SessionID: sessionIDs[0]}))
+			}
+			rec := httptest.NewRecorder()
+			handler.LogoutHandler(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, tt.wantLocation, rec.Header().Get("Location"))
+			cleared := false
+			for _, cookie := range rec.Result().Cookies() {
+				if cookie.Name == "session_token" {
+					require.Less(t, cookie.MaxAge, 0)
+					cleared = true
+				}
+			}
+			assert.Equal(t, tt.wantCleared, cleared)
+
+			remaining, err := repository.ListSessions(userID, time.Now())
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantCleared, len(remaining) == 0, "the session is deleted on logout")
+		})
+	}
+}
+
+func sessionRequest(method, target string, user *model.UserModel) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	if user != nil {
+		req = req.WithContext(model.NewContextWithUserValue(req.Context(), user))
+	}
+	return req
+}
+
+func TestSessionHandler_ListSessionsHandler(t *testing.T) {
+	repository := service.NewMemoryRepository()
+	userID, sessionIDs := seedSessions(t, repository, "laptop", "phone")
+
+	handler := newTestSessionHandler(repository)
+	rec := httptest.NewRecorder()
+	handler.ListSessionsHandler(rec, sessionRequest(http.MethodGet, "/api/sessions", &model.UserModel{ID: userID, SessionID: sessionIDs[0]}))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	var sessions []sessionResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &sessions))
+	require.Len(t, sessions, 2)
+	assert.Equal(t, "laptop", sessions[0].Device)
+	assert.True(t, sessions[0].Current)
+	assert.Equal(t, "10.0.0.2", sessions[1].IPAddress)
+	assert.False(t, sessions[1].Current)
+}
+
+func TestSessionHandler_RevokeSessionHandler(t *testing.T) {
+	tests := []struct {
+		name string
+		// id returns the path value from the seeded laptop and phone sessions
+		id          func(sessionIDs []int) string
+		wantStatus  int
+		wantCleared bool
+		wantLeft    int
+	}{
+		{
+			name:       "revokes another session",
+			id:         func(sessionIDs []int) string { return strconv.Itoa(sessionIDs[1]) },
+			wantStatus: http.StatusNoContent,
+			wantLeft:   1,
+		},
+		{
+			name:        "revoking the current session clears the cookie",
+			id:          func(sessionIDs []int) string { return strconv.Itoa(sessionIDs[0]) },
+			wantStatus:  http.StatusNoContent,
+			wantCleared: true,
+			wantLeft:    1,
+		},
+		{
+			name:       "session of another user is not found",
+			id:         func([]int) string { return "99" },
+			wantStatus: http.StatusNotFound,
+			wantLeft:   2,
+		},
+		{
+			name:       "invalid id",
+			id:         func([]int) string { return "abc" },
+			wantStatus: http.StatusBadRequest,
+			wantLeft:   2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repository := service.NewMemoryRepository()
+			userID, sessionIDs := seedSessions(t, repository, "laptop", "phone")
+			id := tt.id(sessionIDs)
+
+			handler := newTestSessionHandler(repository)
+			req := sessionRequest(http.MethodDelete, "/api/sessions/"+id, &model.UserModel{ID: userID, SessionID: sessionIDs[0]})
+			req.SetPathValue("id", id)
+			rec := httptest.NewRecorder()
+			handler.RevokeSessionHandler(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			cleared := false
+			for _, cookie := range rec.Result().Cookies() {
+				if cookie.Name == "session_token" && cookie.MaxAge < 0 {
+					cleared = true
+				}
+			}
+			assert.Equal(t, tt.wantCleared, cleared)
+
+			remaining, err := repository.ListSessions(userID, time.Now())
+			require.NoError(t, err)
+			assert.Len(t, remaining, tt.wantLeft)
+		})
+	}
+}
+
+func TestSessionHandler_RevokeOtherSessionsHandler(t *testing.T) {
+	repository := service.NewMemoryRepository()
+	userID, sessionIDs := seedSessions(t, repository, "laptop", "phone", "tablet")
+
+	handler := newTestSessionHandler(repository)
+	rec := httptest.NewRecorder()
+	handler.RevokeOtherSessionsHandler(rec, sessionRequest(http.MethodPost, "/api/sessions/revoke-others", &model.UserModel{ID: userID, SessionID: sessionIDs[0]}))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"revoked":2}`, rec.Body.String())
+	remaining, err := repository.ListSessions(userID, time.Now())
+	require.NoError(t, err)
+	require.Len(t, remaining, 1)
+	assert.Equal(t, sessionIDs[0], remaining[0].ID)
+}
+
+func TestSessionHandler_SessionsPageHandler_EscapesDevice(t *testing.T) {
+	repository := service.NewMemoryRepository()
+	userID, sessionIDs := seedSessions(t, repository, "<script>alert(1)</script>")
+
+	handler := newTestSessionHandler(repository)
+	rec := httptest.NewRecorder()
+	handler.SessionsPageHandler(rec, sessionRequest(http.MethodGet, "/sessions", &model.UserModel{ID: userID, SessionID: sessionIDs[0]}))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "<script>alert(1)</script>")
+	assert.Contains(t, rec.Body.String(), "this device")
+}
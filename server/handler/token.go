@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"cito/server/logging"
+	"cito/server/messager"
+	"cito/server/model"
+	"cito/server/service"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// defaultTokenExpiryDays applies when a token request names no expiry
+const defaultTokenExpiryDays = 30
+
+type TokenHandler struct {
+	tokenService *service.TokenService
+	hub          *messager.HubManager
+}
+
+func NewTokenHandler(tokenService *service.TokenService, hub *messager.HubManager) *TokenHandler {
+	return &TokenHandler{tokenService: tokenService, hub: hub}
+}
+
+type createTokenRequest struct {
+	Name          string       `json:"name"`
+	Scopes        model.Scopes `json:"scopes"`
+	ExpiresInDays int          `json:"expires_in_days"`
+}
+
+type createTokenResponse struct {
+	model.PersonalAccessToken
+	// Token is only ever shown in this response
+	Token string `json:"token"`
+}
+
+// ListTokensHandler serves GET /api/tokens
+func (tokenHandler *TokenHandler) ListTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+
+	tokens, err := tokenHandler.tokenService.ListTokens(user.ID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to list tokens", "error", err, "user_id", user.ID)
+		writeJSONError(w, http.StatusInternalServerError, "failed to list tokens")
+		return
+	}
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+// CreateTokenHandler serves POST /api/tokens
+func (tokenHandler *TokenHandler) CreateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+
+	var req createTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if req.ExpiresInDays == 0 {
+		req.ExpiresInDays = defaultTokenExpiryDays
+	}
+	// A credential cannot mint a token more powerful than itself
+	for _, scope := range req.Scopes {
+		if !user.Scopes.Allows(scope) {
+			writeJSONError(w, http.StatusForbidden, "cannot grant scope "+string(scope))
+			return
+		}
+	}
+
+	rawToken, token, err := tokenHandler.tokenService.CreateToken(user.ID, req.Name, req.Scopes, time.Duration(req.ExpiresInDays)*24*time.Hour)
+	if errors.Is(err, service.ErrInvalidToken) {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to create token", "error", err, "user_id", user.ID)
+		writeJSONError(w, http.StatusInternalServerError, "failed to create token")
+		return
+	}
+	writeJSON(w, http.StatusCreated, createTokenResponse{PersonalAccessToken: *token, Token: rawToken})
+}
+
+// RevokeTokenHandler serves DELETE /api/tokens/{id}. Connections opened with
+// the token are dropped right away.
+func (tokenHandler *TokenHandler) RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	tokenID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid token id")
+		return
+	}
+
+	err = tokenHandler.tokenService.RevokeToken(user.ID, tokenID)
+	if errors.Is(err, service.ErrTokenNotFound) {
+		writeJSONError(w, http.StatusNotFound, "token not found")
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to revoke token", "error", err, "token_id", tokenID)
+		writeJSONError(w, http.StatusInternalServerError, "failed to revoke token")
+		return
+	}
+	tokenHandler.hub.DisconnectToken(tokenID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"cito/server/messager"
+	"cito/server/model"
+	"cito/server/service"
+	"cito/server/testutil"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenHandler_CreateTokenHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		user       *model.UserModel
+		body       string
+		mockSetup  func(sqlmock.Sqlmock)
+		wantStatus int
+	}{
+		{
+			name: "creates token with default expiry",
+			user: &model.UserModel{ID: 1, Scopes: model.AllScopes},
+			body: `{"name":"ci","scopes":["read","write"]}`,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`INSERT INTO personal_access_tokens`).
+					WithArgs(1, "ci", sqlmock.AnyArg(), "read,write", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+			},
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "token cannot mint a more powerful token",
+			user:       &model.UserModel{ID: 1, TokenID: 9, Scopes: model.Scopes{model.ScopeWrite}},
+			body:       `{"name":"escalate","scopes":["admin"]}`,
+			mockSetup:  func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "invalid scope",
+			user:       &model.UserModel{ID: 1, Scopes: model.AllScopes},
+			body:       `{"name":"ci","scopes":[]}`,
+			mockSetup:  func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid JSON",
+			user:       &model.UserModel{ID: 1, Scopes: model.AllScopes},
+			body:       `{`,
+			mockSetup:  func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.SetupMockDB(t)
+			defer cleanup()
+			tt.mockSetup(mock)
+
+			handler := NewTokenHandler(service.NewTokenService(db), messager.NewHubManager(service.NewMemoryRepository(), messager.DefaultMessageBuffer))
+			req := httptest.NewRequest(http.MethodPost, "/api/tokens", strings.NewReader(tt.body))
+			req = req.WithContext(model.NewContextWithUserValue(req.Context(), tt.user))
+			rec := httptest.NewRecorder()
+			handler.CreateTokenHandler(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			if tt.wantStatus == http.StatusCreated {
+				var response createTokenResponse
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+				assert.True(t, strings.HasPrefix(response.Token, service.PersonalTokenPrefix))
+				assert.Equal(t, 3, response.ID)
+				assert.WithinDuration(t, time.Now().Add(defaultTokenExpiryDays*24*time.Hour), response.ExpiresAt, time.Minute)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestTokenHandler_ListTokensHandler_HidesSecrets(t *testing.T) {
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	now := time.Now()
+	mock.ExpectQuery(`SELECT (.+) FROM personal_access_tokens WHERE user_id`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "name", "scopes", "created_at", "expires_at", "last_used_at"}).
+			AddRow(2, 1, "cli", "read", now, now.Add(time.Hour), nil))
+
+	handler := NewTokenHandler(service.NewTokenService(db), messager.NewHubManager(service.NewMemoryRepository(), messager.DefaultMessageBuffer))
+	req := httptest.NewRequest(http.MethodGet, "/api/tokens", nil)
+	req = req.WithContext(model.NewContextWithUserValue(req.Context(), &model.UserModel{ID: 1, Scopes: model.AllScopes}))
+	rec := httptest.NewRecorder()
+	handler.ListTokensHandler(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"name":"cli"`)
+	assert.NotContains(t, rec.Body.String(), `"token"`)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTokenHandler_RevokeTokenHandler(t *testing.T) {
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	mock.ExpectExec(`DELETE FROM personal_access_tokens WHERE id = \$1 AND user_id = \$2`).
+		WithArgs(2, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM personal_access_tokens WHERE id = \$1 AND user_id = \$2`).
+		WithArgs(3, 1).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	handler := NewTokenHandler(service.NewTokenService(db), messager.NewHubManager(service.NewMemoryRepository(), messager.DefaultMessageBuffer))
+	for _, tt := range []struct {
+		id         string
+		wantStatus int
+	}{{"2", http.StatusNoContent}, {"3", http.StatusNotFound}} {
+		req := httptest.NewRequest(http.MethodDelete, "/api/tokens/"+tt.id, nil)
+		req = req.WithContext(model.NewContextWithUserValue(req.Context(), &model.UserModel{ID: 1, Scopes: model.AllScopes}))
+		req.SetPathValue("id", tt.id)
+		rec := httptest.NewRecorder()
+		handler.RevokeTokenHandler(rec, req)
+		assert.Equal(t, tt.wantStatus, rec.Code, "token %s", tt.id)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
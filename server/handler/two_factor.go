@@ -0,0 +1,332 @@
+package handler
+
+import (
+	"cito/server/logging"
+	"cito/server/model"
+	"cito/server/service"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+)
+
+// challengeCookieName holds the pending sign-in between the OAuth callback
+// and the second factor step
+const challengeCookieName = "login_challenge"
+
+func setChallengeCookie(w http.ResponseWriter, r *http.Request, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     challengeCookieName,
+		Value:    token,
+		Path:     "/2fa",
+		MaxAge:   int(service.LoginChallengeTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearChallengeCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     challengeCookieName,
+		Value:    "",
+		Path:     "/2fa",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+type TwoFactorHandler struct {
+	twoFactorService *service.TwoFactorService
+	sessionService   *service.SessionService
+	userService      *service.UserService
+}
+
+func NewTwoFactorHandler(twoFactorService *service.TwoFactorService, sessionService *service.SessionService, userService *service.UserService) *TwoFactorHandler {
+	return &TwoFactorHandler{twoFactorService: twoFactorService, sessionService: sessionService, userService: userService}
+}
+
+var twoFactorPage = template.Must(template.New("2fa").Parse(`<h1>Two-factor authentication</h1>
+{{if .Message}}<p>{{.Message}}</p>{{end}}
+{{if .RecoveryCodes}}
+<p>Save these recovery codes somewhere safe. Each one signs you in once if you lose your authenticator.</p>
+<pre>{{range .RecoveryCodes}}{{.}}
+{{end}}</pre>
+<p><a href="/">Continue</a></p>
+{{else if .Secret}}
+<p>Your workspace requires two-factor authentication. Add this account to your authenticator app, then enter the code it shows.</p>
+<p><a href="{{.URI}}">{{.URI}}</a></p>
+<p>Secret: <code>{{.Secret}}</code></p>
+<form method="post" action="/2fa">
+<label>Code <input name="code" autocomplete="one-time-code" autofocus></label>
+<button>Enable</button>
+</form>
+{{else if .Verify}}
+<form method="post" action="/2fa">
+<label>Code from your authenticator app, or a recovery code <input name="code" autocomplete="one-time-code" autofocus></label>
+<button>Verify</button>
+</form>
+{{end}}
+`))
+
+type twoFactorPageData struct {
+	Message       string
+	Verify        bool
+	Secret        string
+	URI           string
+	RecoveryCodes []string
+}
+
+func renderTwoFactorPage(w http.ResponseWriter, status int, data twoFactorPageData) {
+	w.WriteHeader(status)
+	if err := twoFactorPage.Execute(w, data); err != nil {
+		slog.Error("Failed to render two-factor page", "error", err)
+	}
+}
+
+// challengeUser returns the user of the pending sign-in, rendering an error
+// page when there is none
+func (twoFactorHandler *TwoFactorHandler) challengeUser(w http.ResponseWriter, r *http.Request) (string, int, bool) {
+	cookie, err := r.Cookie(challengeCookieName)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return "", 0, false
+	}
+	userID, err := twoFactorHandler.twoFactorService.FindChallenge(cookie.Value)
+	switch {
+	case errors.Is(err, service.ErrChallengeNotFound):
+		clearChallengeCookie(w, r)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return "", 0, false
+	case errors.Is(err, service.ErrTooManyChallengeAttempts):
+		clearChallengeCookie(w, r)
+		renderTwoFactorPage(w, http.StatusTooManyRequests, twoFactorPageData{Message: "Too many attempts. Sign in again."})
+		return "", 0, false
+	case err != nil:
+		logging.FromContext(r.Context()).Error("Failed to look up login challenge", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return "", 0, false
+	}
+	return cookie.Value, userID, true
+}
+
+// ChallengePageHandler serves GET /2fa. Users with two-factor authentication
+// enter a code; users whose workspace requires it enroll first.
+func (twoFactorHandler *TwoFactorHandler) ChallengePageHandler(w http.ResponseWriter, r *http.Request) {
+	_, userID, ok := twoFactorHandler.challengeUser(w, r)
+	if !ok {
+		return
+	}
+
+	status, err := twoFactorHandler.twoFactorService.Status(userID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to check two-factor status", "error", err, "user_id", userID)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if status.Enabled {
+		renderTwoFactorPage(w, http.StatusOK, twoFactorPageData{Verify: true})
+		return
+	}
+
+	twoFactorHandler.renderEnrollment(w, r, userID, http.StatusOK, "")
+}
+
+// renderEnrollment shows the secret awaiting confirmation to a user whose
+// workspace requires two-factor authentication. The same secret is shown
+// until a code confirms it.
+func (twoFactorHandler *TwoFactorHandler) renderEnrollment(w http.ResponseWriter, r *http.Request, userID int, status int, message string) {
+	user, err := twoFactorHandler.userService.FindUserByID(r.Context(), userID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to find user", "error", err, "user_id", userID)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	secret, uri, err := twoFactorHandler.twoFactorService.ResumeEnrollment(userID, user.Username)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to begin two-factor enrollment", "error", err, "user_id", userID)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	renderTwoFactorPage(w, status, twoFactorPageData{Message: message, Secret: secret, URI: uri})
+}
+
+// ChallengeHandler serves POST /2fa, checking the code and issuing the
+// session the OAuth callback held back
+func (twoFactorHandler *TwoFactorHandler) ChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	challengeToken, userID, ok := twoFactorHandler.challengeUser(w, r)
+	if !ok {
+		return
+	}
+
+	code := r.FormValue("code")
+	var recoveryCodes []string
+	err := twoFactorHandler.twoFactorService.Verify(userID, code)
+	enrolling := errors.Is(err, service.ErrTwoFactorNotEnrolled)
+	if enrolling {
+		// Enrollment forced by a workspace policy
+		recoveryCodes, err = twoFactorHandler.twoFactorService.ConfirmEnrollment(userID, code)
+	}
+	if errors.Is(err, service.ErrInvalidCode) || errors.Is(err, service.ErrTwoFactorNotEnrolled) {
+		if err := twoFactorHandler.twoFactorService.RecordFailedAttempt(challengeToken); err != nil {
+			logging.FromContext(r.Context()).Error("Failed to record login attempt", "error", err)
+		}
+		logging.FromContext(r.Context()).Warn("Invalid second factor", "user_id", userID)
+		if enrolling {
+			twoFactorHandler.renderEnrollment(w, r, userID, http.StatusUnauthorized, "That code is not valid.")
+			return
+		}
+		renderTwoFactorPage(w, http.StatusUnauthorized, twoFactorPageData{Message: "That code is not valid.", Verify: true})
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to verify second factor", "error", err, "user_id", userID)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if err := twoFactorHandler.twoFactorService.DeleteChallenge(challengeToken); err != nil {
+		logging.FromContext(r.Context()).Error("Failed to delete login challenge", "error", err)
+	}
+	clearChallengeCookie(w, r)
+	if err := startSession(w, r, twoFactorHandler.sessionService, userID); err != nil {
+		logging.FromContext(r.Context()).Error("Failed to create session", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if len(recoveryCodes) > 0 {
+		renderTwoFactorPage(w, http.StatusOK, twoFactorPageData{RecoveryCodes: recoveryCodes})
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+type twoFactorCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type enrollmentResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// readCode decodes the code of a JSON request body
+func readCode(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var request twoFactorCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Code == "" {
+		writeJSONError(w, http.StatusBadRequest, "code is required")
+		return "", false
+	}
+	return request.Code, true
+}
+
+// writeTwoFactorError maps two-factor service errors to API responses
+func writeTwoFactorError(w http.ResponseWriter, err error, userID int) {
+	switch {
+	case errors.Is(err, service.ErrInvalidCode):
+		writeJSONError(w, http.StatusUnauthorized, err.Error())
+	case errors.Is(err, service.ErrTwoFactorNotEnrolled), errors.Is(err, service.ErrTwoFactorAlreadyEnabled),
+		errors.Is(err, service.ErrTwoFactorRequired):
+		writeJSONError(w, http.StatusConflict, err.Error())
+	default:
+		slog.Error("Two-factor request failed", "error", err, "user_id", userID)
+		writeJSONError(w, http.StatusInternalServerError, "two-factor request failed")
+	}
+}
+
+// StatusHandler serves GET /api/2fa
+func (twoFactorHandler *TwoFactorHandler) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	status, err := twoFactorHandler.twoFactorService.Status(user.ID)
+	if err != nil {
+		writeTwoFactorError(w, err, user.ID)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// EnrollHandler serves POST /api/2fa/enroll, returning a new secret to add
+// to an authenticator app
+func (twoFactorHandler *TwoFactorHandler) EnrollHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	secret, uri, err := twoFactorHandler.twoFactorService.BeginEnrollment(user.ID, user.Username)
+	if err != nil {
+		writeTwoFactorError(w, err, user.ID)
+		return
+	}
+	writeJSON(w, http.StatusOK, enrollmentResponse{Secret: secret, URI: uri})
+}
+
+// ConfirmHandler serves POST /api/2fa/confirm, enabling two-factor
+// authentication and returning the recovery codes
+func (twoFactorHandler *TwoFactorHandler) ConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	code, ok := readCode(w, r)
+	if !ok {
+		return
+	}
+	recoveryCodes, err := twoFactorHandler.twoFactorService.ConfirmEnrollment(user.ID, code)
+	if err != nil {
+		writeTwoFactorError(w, err, user.ID)
+		return
+	}
+	writeJSON(w, http.StatusOK, recoveryCodesResponse{RecoveryCodes: recoveryCodes})
+}
+
+// RecoveryCodesHandler serves POST /api/2fa/recovery-codes, replacing the
+// recovery codes
+func (twoFactorHandler *TwoFactorHandler) RecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	code, ok := readCode(w, r)
+	if !ok {
+		return
+	}
+	recoveryCodes, err := twoFactorHandler.twoFactorService.RegenerateRecoveryCodes(user.ID, code)
+	if err != nil {
+		writeTwoFactorError(w, err, user.ID)
+		return
+	}
+	writeJSON(w, http.StatusOK, recoveryCodesResponse{RecoveryCodes: recoveryCodes})
+}
+
+// DisableHandler serves POST /api/2fa/disable
+func (twoFactorHandler *TwoFactorHandler) DisableHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	code, ok := readCode(w, r)
+	if !ok {
+		return
+	}
+	if err := twoFactorHandler.twoFactorService.Disable(user.ID, code); err != nil {
+		writeTwoFactorError(w, err, user.ID)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,194 @@
+package handler
+
+import (
+	"cito/server/service"
+	"cito/server/testutil"
+	"cito/server/totp"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTwoFactorHandler_ChallengeHandler(t *testing.T) {
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	keys := testutil.NewTestKeyring(t)
+	encrypted, err := keys.Encrypt(secret)
+	require.NoError(t, err)
+	code, err := totp.Code(secret, time.Now())
+	require.NoError(t, err)
+
+	expectChallenge := func(mock sqlmock.Sqlmock) {
+		mock.ExpectQuery(`SELECT user_id, attempts FROM login_challenges`).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id", "attempts"}).AddRow(1, 0))
+		mock.ExpectQuery(`SELECT secret FROM user_totp`).WithArgs(1).
+			WillReturnRows(sqlmock.NewRows([]string{"secret"}).AddRow(encrypted))
+	}
+
+	tests := []struct {
+		name         string
+		code         string
+		mockSetup    func(sqlmock.Sqlmock)
+		noChallenge  bool
+		wantStatus   int
+		wantLocation string
+		wantSession  bool
+		wantBody     string
+	}{
+		{
+			name: "valid code starts the session",
+			code: code,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectChallenge(mock)
+				mock.ExpectExec(`UPDATE user_totp SET last_used_step`).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`DELETE FROM login_challenges`).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery(`INSERT INTO sessions`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(10))
+			},
+			wantStatus:   http.StatusSeeOther,
+			wantLocation: "/",
+			wantSession:  true,
+		},
+		{
+			name: "invalid code counts an attempt",
+			code: "000000",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				expectChallenge(mock)
+				mock.ExpectExec(`UPDATE login_challenges SET attempts = attempts \+ 1`).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "invalid enrollment code shows the same secret",
+			code: "000000",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT user_id, attempts FROM login_challenges`).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "attempts"}).AddRow(1, 0))
+				mock.ExpectQuery(`SELECT secret FROM user_totp`).WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"secret"}))
+				mock.ExpectQuery(`SELECT secret, enabled_at FROM user_totp`).WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"secret", "enabled_at"}).AddRow(encrypted, nil))
+				mock.ExpectExec(`UPDATE login_challenges SET attempts = attempts \+ 1`).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery(`SELECT id, username, (.+) FROM users WHERE id`).WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email"}).AddRow(1, "alice", "alice@example.com"))
+				mock.ExpectQuery(`SELECT secret, enabled_at FROM user_totp`).WithArgs(1).
+					WillReturnRows(sqlmock.NewRows([]string{"secret", "enabled_at"}).AddRow(encrypted, nil))
+			},
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "<code>" + secret + "</code>",
+		},
+		{
+			name: "too many attempts",
+			code: code,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT user_id, attempts FROM login_challenges`).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id", "attempts"}).AddRow(1, 5))
+			},
+			wantStatus: http.StatusTooManyRequests,
+		},
+		{
+			name:         "no pending sign-in",
+			code:         code,
+			mockSetup:    func(mock sqlmock.Sqlmock) {},
+			noChallenge:  true,
+			wantStatus:   http.StatusFound,
+			wantLocation: "/login",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.SetupMockDB(t)
+			defer cleanup()
+			tt.mockSetup(mock)
+
+			twoFactorService := service.NewTwoFactorService(db, keys, service.NewWorkspaceService(db))
+			handler := NewTwoFactorHandler(twoFactorService, service.NewSessionService(service.NewPostgresRepository(db)), service.NewUserService(service.NewPostgresRepository(db), keys))
+
+			form := url.Values{"code": {tt.code}}
+			req := httptest.NewRequest(http.MethodPost, "/2fa", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if !tt.noChallenge {
+				req.AddCookie(&http.Cookie{Name: challengeCookieName, Value: "challenge"})
+			}
+			rec := httptest.NewRecorder()
+			handler.ChallengeHandler(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, tt.wantLocation, rec.Header().Get("Location"))
+			var session bool
+			for _, cookie := range rec.Result().Cookies() {
+				if cookie.Name == "session_token" {
+					session = true
+				}
+			}
+			assert.Equal(t, tt.wantSession, session)
+			assert.Contains(t, rec.Body.String(), tt.wantBody)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestTwoFactorHandler_ChallengePageHandler_Enrollment(t *testing.T) {
+	const pendingSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	keys := testutil.NewTestKeyring(t)
+	encrypted, err := keys.Encrypt(pendingSecret)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		pending    bool
+		wantSecret string
+	}{
+		{name: "begins enrollment"},
+		{name: "keeps the pending secret", pending: true, wantSecret: pendingSecret},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.SetupMockDB(t)
+			defer cleanup()
+
+			mock.ExpectQuery(`SELECT user_id, attempts FROM login_challenges`).
+				WillReturnRows(sqlmock.NewRows([]string{"user_id", "attempts"}).AddRow(1, 0))
+			mock.ExpectQuery(`SELECT (.+) FROM user_totp`).WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"enabled", "remaining"}).AddRow(false, 0))
+			mock.ExpectQuery(`FROM workspace_members`).WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+			mock.ExpectQuery(`SELECT id, username, (.+) FROM users WHERE id`).WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email"}).AddRow(1, "alice", "alice@example.com"))
+			pending := sqlmock.NewRows([]string{"secret", "enabled_at"})
+			if tt.pending {
+				pending.AddRow(encrypted, nil)
+			}
+			mock.ExpectQuery(`SELECT secret, enabled_at FROM user_totp`).WithArgs(1).WillReturnRows(pending)
+			if !tt.pending {
+				mock.ExpectExec(`INSERT INTO user_totp`).WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			twoFactorService := service.NewTwoFactorService(db, keys, service.NewWorkspaceService(db))
+			handler := NewTwoFactorHandler(twoFactorService, service.NewSessionService(service.NewPostgresRepository(db)), service.NewUserService(service.NewPostgresRepository(db), keys))
+
+			req := httptest.NewRequest(http.MethodGet, "/2fa", nil)
+			req.AddCookie(&http.Cookie{Name: challengeCookieName, Value: "challenge"})
+			rec := httptest.NewRecorder()
+			handler.ChallengePageHandler(rec, req)
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Contains(t, rec.Body.String(), "requires two-factor authentication")
+			assert.Contains(t, rec.Body.String(), "otpauth://totp/cito:alice")
+			if tt.wantSecret != "" {
+				assert.Contains(t, rec.Body.String(), "<code>"+tt.wantSecret+"</code>")
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -1,9 +1,10 @@
 package handler
 
 import (
+	"cito/server/logging"
 	"cito/server/messager"
 	"cito/server/model"
-	"log/slog"
+	"context"
 	"net/http"
 
 	"github.com/gorilla/websocket"
@@ -14,14 +15,13 @@ type WebSocketHandler struct {
 	hub      *messager.HubManager
 }
 
-func NewWebSocketHandler() *WebSocketHandler {
+// NewWebSocketHandler returns a handler upgrading connections with buffers
+// of readBufferSize and writeBufferSize bytes
+func NewWebSocketHandler(hubManager *messager.HubManager, readBufferSize int, writeBufferSize int) *WebSocketHandler {
 	upgrader := websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
+		ReadBufferSize:  readBufferSize,
+		WriteBufferSize: writeBufferSize,
 	}
-	hubManager := messager.NewHubManager()
-
-	go hubManager.Run()
 
 	return &WebSocketHandler{upgrader: upgrader, hub: hubManager}
 }
@@ -30,19 +30,27 @@ func (webSocketService *WebSocketHandler) Handler(w http.ResponseWriter, r *http
 
 	user, ok := model.GetUserValueFromContext(r.Context())
 	if !ok {
-		slog.Info("redirect to login")
+		logging.FromContext(r.Context()).Info("redirect to login")
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
 	}
 
+	// Clients retry elsewhere while the server drains its connections
+	if webSocketService.hub.ShuttingDown() {
+		writeJSONError(w, http.StatusServiceUnavailable, "server shutting down")
+		return
+	}
+
 	conn, err := webSocketService.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		slog.Error("WebSocket upgrade failed", "error", err)
+		logging.FromContext(r.Context()).Error("WebSocket upgrade failed", "error", err)
 		return
 	}
-	slog.Info("user info", "user", user)
+	logging.FromContext(r.Context()).Info("user info", "user", user)
 
-	go webSocketService.hub.HandelConnection(user.ID, conn)
+	// The request context ends with this handler, its trace goes on with the
+	// connection
+	go webSocketService.hub.HandelConnection(context.WithoutCancel(r.Context()), user, conn)
 
 	// defer conn.Close()
 	// for {
@@ -0,0 +1,219 @@
+package handler
+
+import (
+	"cito/server/logging"
+	"cito/server/messager"
+	"cito/server/model"
+	"cito/server/service"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+type WorkspaceHandler struct {
+	workspaceService *service.WorkspaceService
+	sessionService   *service.SessionService
+	tokenService     *service.TokenService
+	hub              *messager.HubManager
+}
+
+func NewWorkspaceHandler(workspaceService *service.WorkspaceService, sessionService *service.SessionService, tokenService *service.TokenService, hub *messager.HubManager) *WorkspaceHandler {
+	return &WorkspaceHandler{workspaceService: workspaceService, sessionService: sessionService, tokenService: tokenService, hub: hub}
+}
+
+type createWorkspaceRequest struct {
+	Name string `json:"name"`
+}
+
+type addMemberRequest struct {
+	UserID int    `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+type twoFactorPolicyRequest struct {
+	Required bool `json:"required"`
+}
+
+// writeWorkspaceError maps workspace service errors to API responses
+func writeWorkspaceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, service.ErrWorkspaceNotFound), errors.Is(err, service.ErrInviteNotFound):
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, service.ErrNotWorkspaceAdmin):
+		writeJSONError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, service.ErrInvalidWorkspace):
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	default:
+		slog.Error("Workspace request failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, "workspace request failed")
+	}
+}
+
+// ListWorkspacesHandler serves GET /api/workspaces
+func (workspaceHandler *WorkspaceHandler) ListWorkspacesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	workspaces, err := workspaceHandler.workspaceService.ListWorkspaces(user.ID)
+	if err != nil {
+		writeWorkspaceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, workspaces)
+}
+
+// CreateWorkspaceHandler serves POST /api/workspaces
+func (workspaceHandler *WorkspaceHandler) CreateWorkspaceHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	var request createWorkspaceRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	workspace, err := workspaceHandler.workspaceService.CreateWorkspace(user.ID, request.Name)
+	if err != nil {
+		writeWorkspaceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, workspace)
+}
+
+// workspaceID reads the {id} path value
+func workspaceID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid workspace id")
+		return 0, false
+	}
+	return id, true
+}
+
+// InviteMemberHandler serves POST /api/workspaces/{id}/members. The user
+// joins once they accept the invite.
+func (workspaceHandler *WorkspaceHandler) InviteMemberHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	id, ok := workspaceID(w, r)
+	if !ok {
+		return
+	}
+	var request addMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.UserID == 0 {
+		writeJSONError(w, http.StatusBadRequest, "user_id is required")
+		return
+	}
+	if request.Role == "" {
+		request.Role = model.WorkspaceRoleMember
+	}
+	if err := workspaceHandler.workspaceService.InviteMember(user.ID, id, request.UserID, request.Role); err != nil {
+		writeWorkspaceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ListInvitesHandler serves GET /api/workspaces/invites
+func (workspaceHandler *WorkspaceHandler) ListInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	invites, err := workspaceHandler.workspaceService.ListInvites(user.ID)
+	if err != nil {
+		writeWorkspaceError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, invites)
+}
+
+// AcceptInviteHandler serves POST /api/workspaces/{id}/invite
+func (workspaceHandler *WorkspaceHandler) AcceptInviteHandler(w http.ResponseWriter, r *http.Request) {
+	workspaceHandler.answerInvite(w, r, workspaceHandler.workspaceService.AcceptInvite)
+}
+
+// DeclineInviteHandler serves DELETE /api/workspaces/{id}/invite
+func (workspaceHandler *WorkspaceHandler) DeclineInviteHandler(w http.ResponseWriter, r *http.Request) {
+	workspaceHandler.answerInvite(w, r, workspaceHandler.workspaceService.DeclineInvite)
+}
+
+// answerInvite answers the current user's invite to the {id} workspace
+func (workspaceHandler *WorkspaceHandler) answerInvite(w http.ResponseWriter, r *http.Request, answer func(userID int, workspaceID int) error) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	id, ok := workspaceID(w, r)
+	if !ok {
+		return
+	}
+	if err := answer(user.ID, id); err != nil {
+		writeWorkspaceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// TwoFactorPolicyHandler serves PUT /api/workspaces/{id}/two-factor.
+// Turning the requirement on signs out the members without two-factor
+// authentication everywhere, they enroll when signing in again.
+func (workspaceHandler *WorkspaceHandler) TwoFactorPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := model.GetUserValueFromContext(r.Context())
+	if !ok {
+		writeJSONError(w, http.StatusUnauthorized, "not authenticated")
+		return
+	}
+	id, ok := workspaceID(w, r)
+	if !ok {
+		return
+	}
+	var request twoFactorPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if err := workspaceHandler.workspaceService.SetRequireTwoFactor(user.ID, id, request.Required); err != nil {
+		writeWorkspaceError(w, err)
+		return
+	}
+	if request.Required {
+		if err := workspaceHandler.signOutMembersWithoutTwoFactor(id); err != nil {
+			logging.FromContext(r.Context()).Error("Failed to sign out members without two-factor", "error", err, "workspace_id", id)
+			writeJSONError(w, http.StatusInternalServerError, "failed to sign out members without two-factor")
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// signOutMembersWithoutTwoFactor revokes the sessions and personal access
+// tokens of the members of a workspace who must enroll, and drops their
+// connections
+func (workspaceHandler *WorkspaceHandler) signOutMembersWithoutTwoFactor(workspaceID int) error {
+	userIDs, err := workspaceHandler.workspaceService.MembersWithoutTwoFactor(workspaceID)
+	if err != nil {
+		return err
+	}
+	for _, userID := range userIDs {
+		if _, err := workspaceHandler.sessionService.RevokeAllSessions(userID); err != nil {
+			return err
+		}
+		if _, err := workspaceHandler.tokenService.RevokeAllTokens(userID); err != nil {
+			return err
+		}
+		workspaceHandler.hub.DisconnectUser(userID)
+	}
+	return nil
+}
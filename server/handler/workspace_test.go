@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"cito/server/messager"
+	"cito/server/model"
+	"cito/server/service"
+	"cito/server/testutil"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestWorkspaceHandler(db *sql.DB, sessionService *service.SessionService) *WorkspaceHandler {
+	hub := messager.NewHubManager(service.NewMemoryRepository(), messager.DefaultMessageBuffer)
+	return NewWorkspaceHandler(service.NewWorkspaceService(db), sessionService, service.NewTokenService(db), hub)
+}
+
+func TestWorkspaceHandler_TwoFactorPolicyHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         string
+		body       string
+		role       string
+		wantStatus int
+	}{
+		{name: "admin requires two-factor", id: "2", body: `{"required":true}`, role: model.WorkspaceRoleAdmin, wantStatus: http.StatusNoContent},
+		{name: "admin lifts the requirement", id: "2", body: `{"required":false}`, role: model.WorkspaceRoleAdmin, wantStatus: http.StatusNoContent},
+		{name: "member is forbidden", id: "2", body: `{"required":true}`, role: model.WorkspaceRoleMember, wantStatus: http.StatusForbidden},
+		{name: "not a member", id: "2", body: `{"required":true}`, wantStatus: http.StatusNotFound},
+		{name: "invalid id", id: "abc", body: `{"required":true}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid body", id: "2", body: `{`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.SetupMockDB(t)
+			defer cleanup()
+
+			if tt.id == "2" && tt.body != `{` {
+				rows := sqlmock.NewRows([]string{"role"})
+				if tt.role != "" {
+					rows.AddRow(tt.role)
+				}
+				mock.ExpectQuery(`SELECT role FROM workspace_members`).WithArgs(2, 1).WillReturnRows(rows)
+				required := tt.body == `{"required":true}`
+				if tt.wantStatus == http.StatusNoContent {
+					mock.ExpectExec(`UPDATE workspaces SET require_two_factor`).WithArgs(required, 2).
+						WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+				if tt.wantStatus == http.StatusNoContent && required {
+					mock.ExpectQuery(`SELECT m.user_id FROM workspace_members m`).WithArgs(2).
+						WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(3))
+					mock.ExpectBegin()
+					mock.ExpectExec(`UPDATE device_authorizations SET status`).WillReturnResult(sqlmock.NewResult(0, 0))
+					mock.ExpectQuery(`DELETE FROM personal_access_tokens WHERE user_id = \$1`).WithArgs(3).
+						WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+					mock.ExpectCommit()
+				}
+			}
+
+			repository := service.NewMemoryRepository()
+			var memberID int
+			for _, username := range []string{"admin", "other", "member"} {
+				var err error
+				memberID, err = repository.CreateUser(username, "")
+				require.NoError(t, err)
+			}
+			sessionService := service.NewSessionService(repository)
+			_, err := sessionService.CreateSession(memberID, "test", "127.0.0.1")
+			require.NoError(t, err)
+			handler := newTestWorkspaceHandler(db, sessionService)
+			req := httptest.NewRequest(http.MethodPut, "/api/workspaces/"+tt.id+"/two-factor", strings.NewReader(tt.body))
+			req.SetPathValue("id", tt.id)
+			req = req.WithContext(model.NewContextWithUserValue(req.Context(), &model.UserModel{ID: 1}))
+			rec := httptest.NewRecorder()
+			handler.TwoFactorPolicyHandler(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.NoError(t, mock.ExpectationsWereMet())
+			sessions, err := sessionService.ListSessions(memberID)
+			require.NoError(t, err)
+			if tt.name == "admin requires two-factor" {
+				assert.Empty(t, sessions, "members without two-factor are signed out")
+			} else {
+				assert.Len(t, sessions, 1)
+			}
+		})
+	}
+}
+
+func TestWorkspaceHandler_AcceptInviteHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         string
+		invited    bool
+		wantStatus int
+	}{
+		{name: "accepts invite", id: "2", invited: true, wantStatus: http.StatusNoContent},
+		{name: "not invited", id: "2", wantStatus: http.StatusNotFound},
+		{name: "invalid id", id: "abc", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.SetupMockDB(t)
+			defer cleanup()
+
+			if tt.id == "2" {
+				affected := int64(0)
+				if tt.invited {
+					affected = 1
+				}
+				mock.ExpectExec(`UPDATE workspace_members SET accepted_at`).WithArgs(sqlmock.AnyArg(), 2, 1).
+					WillReturnResult(sqlmock.NewResult(0, affected))
+			}
+
+			handler := newTestWorkspaceHandler(db, service.NewSessionService(service.NewMemoryRepository()))
+			req := httptest.NewRequest(http.MethodPost, "/api/workspaces/"+tt.id+"/invite", nil)
+			req.SetPathValue("id", tt.id)
+			req = req.WithContext(model.NewContextWithUserValue(req.Context(), &model.UserModel{ID: 1}))
+			rec := httptest.NewRecorder()
+			handler.AcceptInviteHandler(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
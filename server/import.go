@@ -0,0 +1,88 @@
+package main
+
+import (
+	"archive/zip"
+	"cito/server/service"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const importSlackUsage = `usage: cito import-slack <export.zip>
+       cito import-slack suggested
+       cito import-slack confirm <slack-user-id> [<user-id>]
+
+Imports a Slack workspace export: channels and group conversations become
+rooms with their members, direct conversations stay direct. Running it
+again with the same export only adds what is missing.
+
+Slack users are matched to cito users by email only when the email was
+verified by the identity provider. A Slack user sharing an unverified email
+with a cito user gets a placeholder account instead: "suggested" lists them
+and "confirm" maps one to the suggested cito user, with its messages and
+rooms. Given a user ID, "confirm" maps any Slack user still on a placeholder
+to that user instead. Placeholders left are claimed by whoever first signs in
+with their email verified by the identity provider.`
+
+// runImportSlack implements the "cito import-slack" subcommand
+func runImportSlack(ctx context.Context, importer *service.SlackImporter, args []string, out io.Writer) error {
+	switch {
+	case len(args) == 1 && args[0] == "suggested":
+		suggested, err := importer.SuggestedUsers()
+		if err != nil {
+			return err
+		}
+		for _, user := range suggested {
+			fmt.Fprintf(out, "%s: placeholder user %d, suggested user %d\n", user.ExternalID, user.UserID, user.SuggestedUserID)
+		}
+		if len(suggested) == 0 {
+			fmt.Fprintln(out, "no mappings to confirm")
+		}
+		return nil
+	case (len(args) == 2 || len(args) == 3) && args[0] == "confirm":
+		userID := 0
+		if len(args) == 3 {
+			var err error
+			if userID, err = strconv.Atoi(args[2]); err != nil || userID <= 0 {
+				return fmt.Errorf("invalid user ID %q", args[2])
+			}
+		}
+		confirmed, err := importer.ConfirmUser(args[1], userID)
+		if errors.Is(err, service.ErrUserNotFound) && userID != 0 {
+			return fmt.Errorf("no Slack user %q or user %d", args[1], userID)
+		}
+		if errors.Is(err, service.ErrUserNotFound) {
+			return fmt.Errorf("no suggested user for Slack user %q", args[1])
+		}
+		if errors.Is(err, service.ErrNotPlaceholder) {
+			return fmt.Errorf("no placeholder to move, Slack user %q is mapped to an account already", args[1])
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "mapped %s to user %d, placeholder user %d removed\n", confirmed.ExternalID, confirmed.SuggestedUserID, confirmed.UserID)
+		return nil
+	case len(args) != 1:
+		return errors.New(importSlackUsage)
+	}
+	archive, err := zip.OpenReader(args[0])
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	result, err := importer.Import(ctx, &archive.Reader)
+	if result != nil {
+		fmt.Fprintf(out, "imported %d rooms and %d messages, %d already imported, %d skipped\n", result.Rooms, result.Messages, result.Duplicates, result.Skipped)
+		fmt.Fprintf(out, "matched %d users by verified email, created %d placeholder users\n", result.UsersMatched, result.UsersCreated)
+		if result.UsersToConfirm > 0 {
+			fmt.Fprintf(out, "%d placeholder users share an unverified email with a user, review them with \"cito import-slack suggested\"\n", result.UsersToConfirm)
+		}
+		if result.SkippedConversations > 0 {
+			fmt.Fprintf(out, "skipped %d notes to self\n", result.SkippedConversations)
+		}
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+package keyring
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// KeySize is the length of an AES-256 key in bytes
+const KeySize = 32
+
+var ErrUnknownKeyVersion = errors.New("unknown key version")
+
+// Keyring encrypts secrets with AES-256-GCM. Every ciphertext is prefixed
+// with the version of the key that sealed it ("v2:..."), so after a rotation
+// the old keys keep decrypting existing values while new values use the
+// current key.
+type Keyring struct {
+	current int
+	aeads   map[int]cipher.AEAD
+}
+
+// New builds a keyring from versioned keys. current selects the key used
+// for encryption and must be one of keys.
+func New(current int, keys map[int][]byte) (*Keyring, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("current key version %d: %w", current, ErrUnknownKeyVersion)
+	}
+	aeads := make(map[int]cipher.AEAD, len(keys))
+	for version, key := range keys {
+		if len(key) != KeySize {
+			return nil, fmt.Errorf("key version %d must be %d bytes, got %d", version, KeySize, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key version %d: %w", version, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key version %d: %w", version, err)
+		}
+		aeads[version] = aead
+	}
+	return &Keyring{current: current, aeads: aeads}, nil
+}
+
+// Parse reads a comma separated list of "version:base64key" entries, e.g.
+// "2:q83v...,1:Zm9v...". The first entry is the current key.
+func Parse(spec string) (*Keyring, error) {
+	keys := make(map[int][]byte)
+	current := 0
+	for i, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		versionText, encodedKey, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("key entry %d: expected version:base64key", i+1)
+		}
+		version, err := strconv.Atoi(versionText)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("key entry %d: invalid version %q", i+1, versionText)
+		}
+		key, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil {
+			return nil, fmt.Errorf("key version %d: %w", version, err)
+		}
+		if _, dup := keys[version]; dup {
+			return nil, fmt.Errorf("key version %d listed twice", version)
+		}
+		keys[version] = key
+		if i == 0 {
+			current = version
+		}
+	}
+	return New(current, keys)
+}
+
+// CurrentVersion is the key version new ciphertexts are sealed with
+func (k *Keyring) CurrentVersion() int {
+	return k.current
+}
+
+// Encrypt seals plaintext with the current key
+func (k *Keyring) Encrypt(plaintext string) (string, error) {
+	aead := k.aeads[k.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return "v" + strconv.Itoa(k.current) + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value produced by Encrypt with any key of the keyring
+func (k *Keyring) Decrypt(ciphertext string) (string, error) {
+	version, payload, ok := Version(ciphertext)
+	if !ok {
+		return "", errors.New("ciphertext has no key version")
+	}
+	aead, ok := k.aeads[version]
+	if !ok {
+		return "", fmt.Errorf("key version %d: %w", version, ErrUnknownKeyVersion)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode ciphertext: %w", err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// Version splits a ciphertext into its key version and payload. ok is false
+// for values that were not produced by a Keyring, such as legacy plaintext.
+func Version(ciphertext string) (version int, payload string, ok bool) {
+	prefix, payload, found := strings.Cut(ciphertext, ":")
+	if !found || !strings.HasPrefix(prefix, "v") {
+		return 0, "", false
+	}
+	version, err := strconv.Atoi(prefix[1:])
+	if err != nil || version <= 0 {
+		return 0, "", false
+	}
+	return version, payload, true
+}
+
+// NeedsRotation reports whether a stored value should be re-encrypted with
+// the current key, either because an older key sealed it or because it is
+// still plaintext.
+func (k *Keyring) NeedsRotation(ciphertext string) bool {
+	version, _, ok := Version(ciphertext)
+	return !ok || version != k.current
+}
@@ -0,0 +1,104 @@
+package keyring
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func key(b byte) []byte {
+	return bytes.Repeat([]byte{b}, KeySize)
+}
+
+func TestKeyring_EncryptDecrypt(t *testing.T) {
+	k, err := New(1, map[int][]byte{1: key(1)})
+	require.NoError(t, err)
+
+	ciphertext, err := k.Encrypt("gho_secret")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(ciphertext, "v1:"), "ciphertext should record key version")
+	assert.NotContains(t, ciphertext, "gho_secret")
+
+	again, err := k.Encrypt("gho_secret")
+	require.NoError(t, err)
+	assert.NotEqual(t, ciphertext, again, "nonces should make ciphertexts unique")
+
+	plaintext, err := k.Decrypt(ciphertext)
+	require.NoError(t, err)
+	assert.Equal(t, "gho_secret", plaintext)
+}
+
+func TestKeyring_Rotation(t *testing.T) {
+	old, err := New(1, map[int][]byte{1: key(1)})
+	require.NoError(t, err)
+	ciphertext, err := old.Encrypt("gho_secret")
+	require.NoError(t, err)
+
+	rotated, err := New(2, map[int][]byte{1: key(1), 2: key(2)})
+	require.NoError(t, err)
+	assert.True(t, rotated.NeedsRotation(ciphertext))
+
+	plaintext, err := rotated.Decrypt(ciphertext)
+	require.NoError(t, err, "old key should still decrypt")
+	assert.Equal(t, "gho_secret", plaintext)
+
+	reencrypted, err := rotated.Encrypt(plaintext)
+	require.NoError(t, err)
+	assert.False(t, rotated.NeedsRotation(reencrypted))
+	assert.True(t, rotated.NeedsRotation("gho_legacy_plaintext"))
+
+	_, err = old.Decrypt(reencrypted)
+	assert.ErrorIs(t, err, ErrUnknownKeyVersion)
+}
+
+func TestKeyring_DecryptRejectsTampering(t *testing.T) {
+	k, err := New(1, map[int][]byte{1: key(1)})
+	require.NoError(t, err)
+	ciphertext, err := k.Encrypt("gho_secret")
+	require.NoError(t, err)
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ciphertext, "v1:"))
+	require.NoError(t, err)
+	sealed[len(sealed)-1] ^= 0xff
+	_, err = k.Decrypt("v1:" + base64.StdEncoding.EncodeToString(sealed))
+	assert.Error(t, err)
+
+	_, err = k.Decrypt("gho_legacy_plaintext")
+	assert.Error(t, err)
+}
+
+func TestParse(t *testing.T) {
+	encoded := func(b byte) string { return base64.StdEncoding.EncodeToString(key(b)) }
+
+	tests := []struct {
+		name        string
+		spec        string
+		wantCurrent int
+		wantErr     bool
+	}{
+		{name: "single key", spec: "1:" + encoded(1), wantCurrent: 1},
+		{name: "first entry is current", spec: "3:" + encoded(3) + ", 1:" + encoded(1), wantCurrent: 3},
+		{name: "empty", spec: "", wantErr: true},
+		{name: "missing version", spec: encoded(1), wantErr: true},
+		{name: "bad version", spec: "x:" + encoded(1), wantErr: true},
+		{name: "bad base64", spec: "1:not-base64!", wantErr: true},
+		{name: "short key", spec: "1:" + base64.StdEncoding.EncodeToString([]byte("short")), wantErr: true},
+		{name: "duplicate version", spec: "1:" + encoded(1) + ",1:" + encoded(2), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := Parse(tt.spec)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantCurrent, k.CurrentVersion())
+		})
+	}
+}
@@ -0,0 +1,77 @@
+// Package logging sets up the structured logs of the server and carries a
+// request-scoped logger in contexts
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// Formats logs can be written in
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// New returns a logger writing the records of level and above to w, in
+// format
+func New(w io.Writer, format string, level slog.Level) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case FormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
+
+// ParseLevel reads a level such as debug, info, warn or error
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(s))
+	return level, err
+}
+
+type contextKey struct{}
+
+// scope holds the logger of a request, which gains attributes while the
+// request is handled, such as the user once authenticated
+type scope struct {
+	mu     sync.Mutex
+	logger *slog.Logger
+}
+
+// NewContext returns a copy of ctx carrying logger for the request it
+// belongs to
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, &scope{logger: logger})
+}
+
+// FromContext returns the request logger of ctx, or the default logger
+// outside requests
+func FromContext(ctx context.Context) *slog.Logger {
+	s, ok := ctx.Value(contextKey{}).(*scope)
+	if !ok {
+		return slog.Default()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.logger
+}
+
+// With adds attributes to the request logger of ctx. They are on every line
+// logged through it from then on, including those of the middleware that
+// created it once the handler returns.
+func With(ctx context.Context, args ...any) {
+	s, ok := ctx.Value(contextKey{}).(*scope)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger = s.logger.With(args...)
+}
@@ -0,0 +1,74 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		level    slog.Level
+		wantLine string
+		wantErr  bool
+	}{
+		{name: "text", format: FormatText, level: slog.LevelInfo, wantLine: "level=INFO msg=shown"},
+		{name: "json", format: FormatJSON, level: slog.LevelInfo, wantLine: `"level":"INFO","msg":"shown"`},
+		{name: "warnings only", format: FormatText, level: slog.LevelWarn},
+		{name: "unknown format", format: "xml", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := New(&buf, tt.format, tt.level)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			logger.Debug("hidden")
+			logger.Info("shown")
+			assert.NotContains(t, buf.String(), "hidden")
+			if tt.wantLine == "" {
+				assert.Empty(t, buf.String())
+				return
+			}
+			assert.Contains(t, buf.String(), tt.wantLine)
+		})
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("debug")
+	require.NoError(t, err)
+	assert.Equal(t, slog.LevelDebug, level)
+	level, err = ParseLevel("WARN")
+	require.NoError(t, err)
+	assert.Equal(t, slog.LevelWarn, level)
+	_, err = ParseLevel("loud")
+	assert.Error(t, err)
+}
+
+func TestFromContext(t *testing.T) {
+	assert.Same(t, slog.Default(), FromContext(context.Background()), "outside requests")
+	With(context.Background(), "user_id", 7)
+
+	var buf bytes.Buffer
+	ctx := NewContext(context.Background(), slog.New(slog.NewJSONHandler(&buf, nil)).With("request_id", "abc"))
+	// Attributes added deeper in the handler chain reach the outer logger
+	With(context.WithValue(ctx, struct{}{}, "inner"), "user_id", 7)
+	FromContext(ctx).Info("Response sent")
+
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "abc", line["request_id"])
+	assert.Equal(t, float64(7), line["user_id"])
+}
@@ -1,83 +1,266 @@
 package main
 
 import (
-	"database/sql"
+	"cito/server/certs"
+	"cito/server/config"
+	"cito/server/database"
+	"cito/server/handler"
+	"cito/server/migrations"
+	"cito/server/service"
+	"cito/server/tracing"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
-	_ "github.com/lib/pq"
 	"golang.org/x/oauth2"
 )
 
 func main() {
 
-	// Build connection string from environment variables
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		os.Getenv("DB_HOST"),
-		os.Getenv("DB_PORT"),
-		os.Getenv("DB_USER"),
-		os.Getenv("DB_PASSWORD"),
-		os.Getenv("DB_NAME"),
-	)
-
-	// Open connection
-	db, err := sql.Open("postgres", connStr)
+	cfg, args, err := config.Load(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		slog.Error("Failed to open database connection", "error", err)
+		slog.Error("Failed to load configuration", "error", err)
 		os.Exit(1)
 	}
-	defer db.Close()
+	// Logs follow the configured level and format from here on
+	logger, err := cfg.Logger(os.Stderr)
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+	}
+	// Subcommands only need the database
+	validate := cfg.Database.Validate
+	if command == "" || command == "config" {
+		validate = cfg.Validate
+	}
+	if err := validate(); err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	// "cito config" prints the effective configuration and exits
+	if command == "config" {
+		cfg.Print(os.Stdout)
+		return
+	}
 
-	// Verify connection
-	err = db.Ping()
+	driver := cfg.Database.Driver
+	db, err := database.Open(driver, cfg.Database.DataSource())
 	if err != nil {
-		slog.Error("Failed to ping database", "error", err)
+		slog.Error("Failed to connect to database", "driver", driver, "error", err)
 		os.Exit(1)
 	}
+	defer db.Close()
+	db.SetMaxOpenConns(cfg.Database.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.Database.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.Database.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(cfg.Database.ConnMaxIdleTime)
 	fmt.Println("Successfully connected!")
 
-	// Create users table
-	createTableSQL := `
-		CREATE TABLE IF NOT EXISTS users (
-			id SERIAL PRIMARY KEY,
-			github_id BIGINT UNIQUE NOT NULL,
-			username VARCHAR(255) NOT NULL,
-			email VARCHAR(255),
-			access_token VARCHAR(255),
-			session_token VARCHAR(255) UNIQUE
-		);
-	`
-	_, err = db.Exec(createTableSQL)
+	migrator, err := migrations.New(db, driver)
+	if err != nil {
+		slog.Error("Failed to load migrations", "error", err)
+		os.Exit(1)
+	}
+	// "cito migrate ..." manages the schema and exits
+	if command == "migrate" {
+		if err := runMigrate(context.Background(), migrator, args[1:], os.Stdout); err != nil {
+			slog.Error("Migration failed", "error", err)
+			db.Close()
+			os.Exit(1)
+		}
+		return
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		slog.Error("Failed to migrate database", "error", err)
+		os.Exit(1)
+	}
+	fmt.Println("Schema up to date!")
+
+	// "cito import-slack export.zip" loads a Slack workspace export and exits
+	if command == "import-slack" {
+		repository := newRepository(db, driver)
+		if err := runImportSlack(context.Background(), service.NewSlackImporter(repository, repository, repository), args[1:], os.Stdout); err != nil {
+			slog.Error("Slack import failed", "error", err)
+			db.Close()
+			os.Exit(1)
+		}
+		return
+	}
+	if command != "" {
+		slog.Error("Unknown command", "command", command)
+		db.Close()
+		os.Exit(2)
+	}
+	cfg.Print(os.Stdout)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing.Exporter, cfg.Tracing.Endpoint, cfg.Tracing.SampleRatio)
 	if err != nil {
-		slog.Error("Failed to create users table", "error", err)
+		slog.Error("Failed to set up tracing", "error", err)
 		os.Exit(1)
 	}
-	fmt.Println("Users table ready!")
+	// Identity provider API calls are traced as part of the login
+	providerClient := &http.Client{Timeout: 10 * time.Second, Transport: tracing.Transport(http.DefaultTransport)}
 
 	conf := &oauth2.Config{
-		ClientID:     os.Getenv("GITHUB_CLIENT_ID"),
-		ClientSecret: os.Getenv("GITHUB_CLIENT_SECRET"),
+		ClientID:     cfg.GitHub.ClientID,
+		ClientSecret: cfg.GitHub.ClientSecret,
 		Scopes:       []string{"user:email"},
 		Endpoint: oauth2.Endpoint{
 			AuthURL:  "https://github.com/login/oauth/authorize",
 			TokenURL: "https://github.com/login/oauth/access_token",
 		},
-		RedirectURL: os.Getenv("GITHUB_REDIRECT_URL"),
+		RedirectURL: cfg.GitHub.RedirectURL,
 	}
 
-	app := NewApp(conf, db)
+	providers := []service.IdentityProvider{service.NewGitHubProvider(conf, providerClient, cfg.GitHub.APIURL)}
+	// An OpenID Connect provider is offered next to GitHub when configured
+	if cfg.OIDC.Issuer != "" {
+		oidcProvider, err := service.NewOIDCProvider(context.Background(), service.OIDCConfig{
+			Name:         cfg.OIDC.Name,
+			DisplayName:  cfg.OIDC.DisplayName,
+			Issuer:       cfg.OIDC.Issuer,
+			ClientID:     cfg.OIDC.ClientID,
+			ClientSecret: cfg.OIDC.ClientSecret,
+			RedirectURL:  cfg.OIDC.RedirectURL,
+		}, providerClient)
+		if err != nil {
+			slog.Error("Failed to set up OIDC provider", "error", err)
+			os.Exit(1)
+		}
+		providers = append(providers, oidcProvider)
+	}
+
+	app, err := NewApp(service.NewAuthService(providers...), db, migrator, cfg)
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+
+	// Seal tokens still in plaintext or under a retired key
+	if _, err := app.userService.ReencryptAccessTokens(context.Background()); err != nil {
+		slog.Error("Failed to re-encrypt access tokens", "error", err)
+		os.Exit(1)
+	}
+
+	// SIGINT or SIGTERM drain the server, a second one kills it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Stored provider tokens are checked in the background so that revoked
+	// authorizations sign their accounts out, expired messages and device
+	// authorizations are purged and exports written
+	var jobs sync.WaitGroup
+	for _, run := range []func(context.Context, time.Duration){app.identityTokenService.Run, app.retentionService.Run, app.exportService.Run, app.deviceService.Run} {
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			run(ctx, time.Hour)
+		}()
+	}
 
 	mux := http.NewServeMux()
 
 	app.RegisterRoutes(mux)
 
-	server := http.Server{Addr: os.Getenv("SERVER_ADDR"), Handler: mux}
-	slog.Info("Server listening", "addr", server.Addr)
-	if err := server.ListenAndServe(); err != nil {
+	server := &http.Server{Addr: cfg.Server.Addr, Handler: tracing.Handler(mux, "/healthz", "/readyz", "/metrics")}
+	servers := []*http.Server{server}
+	tlsOn := cfg.Server.TLSCertFile != ""
+	if tlsOn {
+		// Renewed certificates are picked up on SIGHUP or when the files
+		// change, established connections keep theirs
+		reloader, err := certs.NewReloader(cfg.Server.TLSCertFile, cfg.Server.TLSKeyFile)
+		if err != nil {
+			slog.Error("Failed to load TLS certificate", "error", err)
+			os.Exit(1)
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate, MinVersion: tls.VersionTLS12}
+		jobs.Add(1)
+		go func() {
+			defer jobs.Done()
+			reloader.Run(ctx, 30*time.Second)
+		}()
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := reloader.Reload(); err != nil {
+					slog.Error("Failed to reload TLS certificate", "error", err)
+				}
+			}
+		}()
+
+		if cfg.Server.HTTPRedirectAddr != "" {
+			servers = append(servers, &http.Server{
+				Addr:              cfg.Server.HTTPRedirectAddr,
+				Handler:           handler.HTTPSRedirectHandler(cfg.Server.Addr),
+				ReadHeaderTimeout: 10 * time.Second,
+			})
+		}
+	}
+
+	serverErr := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func() {
+			if srv == server && tlsOn {
+				slog.Info("Server listening", "addr", srv.Addr, "tls", true)
+				serverErr <- srv.ListenAndServeTLS("", "")
+				return
+			}
+			slog.Info("Server listening", "addr", srv.Addr, "tls", false, "redirect", srv != server)
+			serverErr <- srv.ListenAndServe()
+		}()
+	}
+	select {
+	case err := <-serverErr:
 		slog.Error("Server failed", "error", err)
+		db.Close()
 		os.Exit(1)
+	case <-ctx.Done():
+	}
+	stop()
+
+	// Load balancers see /readyz fail and stop sending clients before
+	// connections close
+	app.healthHandler.Drain()
+	slog.Info("Draining", "delay", cfg.Server.ShutdownDelay)
+	time.Sleep(cfg.Server.ShutdownDelay)
+
+	slog.Info("Shutting down", "timeout", cfg.Server.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	// WebSocket clients are told to reconnect elsewhere first, their queued
+	// messages are stored before the database closes
+	if err := app.hub.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to drain WebSocket connections", "error", err)
+	}
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Failed to finish requests", "addr", srv.Addr, "error", err)
+		}
+	}
+	jobs.Wait()
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
+	}
+	if err := db.Close(); err != nil {
+		slog.Error("Failed to close database", "error", err)
 	}
 	slog.Info("Server closed")
 }
@@ -1,92 +1,393 @@
 package messager
 
 import (
+	"cito/server/logging"
+	"cito/server/metrics"
 	"cito/server/model"
+	"cito/server/service"
+	"cito/server/tracing"
+	"context"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// DefaultMessageBuffer is how many routed messages may wait for the Run loop
+// unless configured otherwise
+const DefaultMessageBuffer = 256
+
+// DefaultBufferSize is the size in bytes of the read and write buffers of
+// websocket connections unless configured otherwise
+const DefaultBufferSize = 1024
+
+// credential identifies what a connection was authenticated with: a browser
+// session or a personal access token
+type credential struct {
+	sessionId int
+	tokenId   int
+}
+
+// queuedMessage is a message waiting for the Run loop, with the context of
+// the trace it was received in
+type queuedMessage struct {
+	ctx     context.Context
+	message model.Message
+}
+
+// Store keeps the messages the hub routes and knows the members of rooms
+type Store interface {
+	service.MessageRepository
+	service.RoomRepository
+}
+
 type HubManager struct {
-	clients  map[int]*websocket.Conn
-	messages chan model.Message
-	mu       sync.Mutex
+	// clients maps a user ID to its open connections and the credential each
+	// connection was authenticated with. A user may be connected from
+	// several devices at once.
+	clients  map[int]map[*websocket.Conn]credential
+	messages chan queuedMessage
+	// store keeps every routed message, also those for offline users
+	store Store
+	mu    sync.Mutex
+	// senders counts the read loops and AddMessage calls that may still queue
+	// messages, Shutdown waits for them before closing messages
+	senders      sync.WaitGroup
+	shuttingDown bool
+	running      atomic.Bool
+	// done is closed once Run has handled every queued message
+	done chan struct{}
 }
 
-func NewHubManager() *HubManager {
-	return &HubManager{clients: make(map[int]*websocket.Conn)}
+// NewHubManager returns a hub where up to bufferSize routed messages wait for
+// the Run loop
+func NewHubManager(store Store, bufferSize int) *HubManager {
+	return &HubManager{
+		clients:  make(map[int]map[*websocket.Conn]credential),
+		messages: make(chan queuedMessage, bufferSize),
+		store:    store,
+		done:     make(chan struct{}),
+	}
 }
 
-func (h *HubManager) Register(clientId int, con *websocket.Conn) {
+// Register adds a connection of user, which holds off Shutdown until it stops
+// reading. It returns false once the hub is shutting down.
+func (h *HubManager) Register(user *model.UserModel, con *websocket.Conn) bool {
 	h.mu.Lock()
-	h.clients[clientId] = con
-	h.mu.Unlock()
+	defer h.mu.Unlock()
+	if h.shuttingDown {
+		return false
+	}
+	if h.clients[user.ID] == nil {
+		h.clients[user.ID] = make(map[*websocket.Conn]credential)
+	}
+	h.clients[user.ID][con] = credential{sessionId: user.SessionID, tokenId: user.TokenID}
+	h.senders.Add(1)
+	h.observeClients()
+	return true
 }
 
-func (h *HubManager) Unregister(clientId int) {
+func (h *HubManager) Unregister(clientId int, con *websocket.Conn) {
 	h.mu.Lock()
-	delete(h.clients, clientId)
+	delete(h.clients[clientId], con)
+	if len(h.clients[clientId]) == 0 {
+		delete(h.clients, clientId)
+	}
+	h.observeClients()
 	h.mu.Unlock()
+}
 
+// observeClients sets the connection gauges, with mu held
+func (h *HubManager) observeClients() {
+	conns := 0
+	for _, userConns := range h.clients {
+		conns += len(userConns)
+	}
+	metrics.WebSocketConnections.Set(float64(conns))
+	metrics.WebSocketUsers.Set(float64(len(h.clients)))
 }
 
-// Process all the messages receive in messages channel
+// connections returns a snapshot of the open connections of a user
+func (h *HubManager) connections(clientId int) []*websocket.Conn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	conns := make([]*websocket.Conn, 0, len(h.clients[clientId]))
+	for conn := range h.clients[clientId] {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// Process all the messages receive in messages channel, until Shutdown
 func (h *HubManager) Run() {
+	h.running.Store(true)
+	defer close(h.done)
+	defer h.running.Store(false)
 
-	for message := range h.messages {
-		h.mu.Lock()
-		conn, ok := h.clients[message.ToUserId]
-		h.mu.Unlock()
-		if !ok {
-			slog.Error("No websocket connection found:", "ToUserId", message.ToUserId)
-			continue
+	for queued := range h.messages {
+		if queued.message.RoomID != 0 {
+			h.routeRoom(queued.ctx, queued.message)
+		} else {
+			h.route(queued.ctx, queued.message)
 		}
-		// Write the message to the websocket
-		byteMessage, err := json.Marshal(message)
-		if err != nil {
-			slog.Error("Marshal message :", "err", err)
-			continue
+	}
+}
+
+// route stores a message and writes it to every connection of its recipient
+func (h *HubManager) route(ctx context.Context, message model.Message) {
+	ctx, span := tracing.Tracer().Start(ctx, "hub.route", trace.WithAttributes(attribute.Int("cito.to_user_id", message.ToUserId)))
+	defer span.End()
+	logger := logging.FromContext(ctx)
+
+	_, persist := tracing.Tracer().Start(ctx, "hub.persist")
+	err := h.store.SaveMessage(&message)
+	tracing.End(persist, err)
+	if err != nil {
+		logger.Error("Failed to store message", "error", err, "from_user_id", message.FromUserID, "to_user_id", message.ToUserId)
+	}
+	conns := h.connections(message.ToUserId)
+	if len(conns) == 0 {
+		logger.Debug("No websocket connection found", "to_user_id", message.ToUserId)
+		countMessage(span, metrics.MessageUndeliverable)
+		return
+	}
+	countMessage(span, h.write(ctx, message, conns))
+}
+
+// routeRoom stores a room message and writes it to every connection of the
+// other members of the room. Messages of senders who are not members are
+// dropped.
+func (h *HubManager) routeRoom(ctx context.Context, message model.Message) {
+	ctx, span := tracing.Tracer().Start(ctx, "hub.route", trace.WithAttributes(attribute.Int("cito.room_id", message.RoomID)))
+	defer span.End()
+	logger := logging.FromContext(ctx)
+
+	_, persist := tracing.Tracer().Start(ctx, "hub.persist")
+	err := h.store.SaveRoomMessage(&message)
+	tracing.End(persist, err)
+	if errors.Is(err, service.ErrRoomNotFound) {
+		logger.Warn("Message to a room the sender is not a member of", "from_user_id", message.FromUserID, "room_id", message.RoomID)
+		countMessage(span, metrics.MessageDropped)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to store room message", "error", err, "from_user_id", message.FromUserID, "room_id", message.RoomID)
+		countMessage(span, metrics.MessageDropped)
+		return
+	}
+	members, err := h.store.ListRoomMembers(message.RoomID)
+	if err != nil {
+		logger.Error("Failed to list room members", "error", err, "room_id", message.RoomID)
+		countMessage(span, metrics.MessageDropped)
+		return
+	}
+	var conns []*websocket.Conn
+	for _, member := range members {
+		if member != message.FromUserID {
+			conns = append(conns, h.connections(member)...)
 		}
-		err = conn.WriteMessage(websocket.TextMessage, byteMessage)
+	}
+	if len(conns) == 0 {
+		logger.Debug("No room member connected", "room_id", message.RoomID)
+		countMessage(span, metrics.MessageUndeliverable)
+		return
+	}
+	countMessage(span, h.write(ctx, message, conns))
+}
 
+// write sends message to conns and returns the routing outcome
+func (h *HubManager) write(ctx context.Context, message model.Message, conns []*websocket.Conn) string {
+	logger := logging.FromContext(ctx)
+	// Write the message to the websocket
+	byteMessage, err := json.Marshal(message)
+	if err != nil {
+		logger.Error("Marshal message :", "err", err)
+		return metrics.MessageDropped
+	}
+	outcome := metrics.MessageDropped
+	for _, conn := range conns {
+		_, write := tracing.Tracer().Start(ctx, "hub.write")
+		err = conn.WriteMessage(websocket.TextMessage, byteMessage)
+		tracing.End(write, err)
 		if err != nil {
-			slog.Error("Marshal message :", "err", err)
+			logger.Error("Write message :", "err", err)
 			continue
 		}
+		outcome = metrics.MessageRouted
 	}
+	return outcome
+}
+
+// countMessage records the outcome of routing a message on its span and in
+// the metrics
+func countMessage(span trace.Span, outcome string) {
+	span.SetAttributes(attribute.String("cito.message_outcome", outcome))
+	metrics.Messages.WithLabelValues(outcome).Inc()
 }
 
-func (h *HubManager) HandelConnection(clientId int, conn *websocket.Conn) {
-	h.Register(clientId, conn)
-	defer h.Unregister(clientId)
+// disconnect closes every connection whose credential matches
+func (h *HubManager) disconnect(match func(credential) bool, reason string) int {
+	h.mu.Lock()
+	var conns []*websocket.Conn
+	for _, userConns := range h.clients {
+		for conn, cred := range userConns {
+			if match(cred) {
+				conns = append(conns, conn)
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	for _, conn := range conns {
+		closeConnection(conn, websocket.ClosePolicyViolation, reason)
+	}
+	return len(conns)
+}
+
+// DisconnectSession closes every connection opened with the given session
+func (h *HubManager) DisconnectSession(sessionId int) {
+	count := h.disconnect(func(cred credential) bool { return cred.sessionId == sessionId }, "session ended")
+	slog.Info("Disconnected session", "session_id", sessionId, "connections", count)
+}
+
+// DisconnectToken closes every connection opened with the given personal
+// access token
+func (h *HubManager) DisconnectToken(tokenId int) {
+	count := h.disconnect(func(cred credential) bool { return cred.tokenId == tokenId }, "token revoked")
+	slog.Info("Disconnected token", "token_id", tokenId, "connections", count)
+}
+
+// DisconnectUser closes every connection of a user, whatever it was opened
+// with, once the account is deleted or signed out everywhere
+func (h *HubManager) DisconnectUser(userId int) {
+	conns := h.connections(userId)
+	for _, conn := range conns {
+		closeConnection(conn, websocket.ClosePolicyViolation, "signed out")
+	}
+	slog.Info("Disconnected user", "user_id", userId, "connections", len(conns))
+}
+
+// closeConnection sends a close frame and closes the connection. The read
+// loop in HandelConnection then fails and unregisters it.
+func closeConnection(conn *websocket.Conn, code int, reason string) {
+	deadline := time.Now().Add(time.Second)
+	err := conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+	if err != nil {
+		slog.Warn("WebSocket close frame failed", "error", err)
+	}
+	conn.Close()
+}
+
+// HandelConnection reads the messages of a connection until it closes. ctx
+// carries the trace of the upgrade request, each message received continues
+// it.
+func (h *HubManager) HandelConnection(ctx context.Context, user *model.UserModel, conn *websocket.Conn) {
+	clientId := user.ID
+	logger := logging.FromContext(ctx)
+	if !h.Register(user, conn) {
+		closeConnection(conn, websocket.CloseGoingAway, "server shutting down")
+		return
+	}
+	defer h.senders.Done()
+	defer h.Unregister(clientId, conn)
 	defer conn.Close()
 
 	for {
 		// read messsage
 		_, recvBytes, err := conn.ReadMessage()
 		if err != nil {
-			slog.Error("WebSocket read error", "error", err)
+			logger.Error("WebSocket read error", "error", err)
 			return
 		}
 
+		msgCtx, span := tracing.Tracer().Start(ctx, "hub.receive", trace.WithAttributes(attribute.Int("cito.from_user_id", clientId)))
 		var message model.Message
 		err = json.Unmarshal(recvBytes, &message)
 		if err != nil {
-			slog.Error("Unmarshal message", "error", err)
+			logger.Error("Unmarshal message", "error", err)
+			tracing.End(span, err)
+			continue
 		}
 
-		slog.Info("WebSocket message received", "message", message)
+		logger.Debug("WebSocket message received", "to_user_id", message.ToUserId, "room_id", message.RoomID)
 		message.FromUserID = clientId
+		if message.RoomID != 0 {
+			message.ToUserId = 0
+		}
 		message.Time = time.Now()
 		// send messages
-		h.messages <- message
-		// echo in console
+		h.messages <- queuedMessage{ctx: msgCtx, message: message}
+		span.End()
 	}
 }
 
-func (h *HubManager) AddMessage(message model.Message) {
-	h.messages <- message
+// AddMessage queues a message for routing, as part of the trace of ctx. It
+// returns false once the hub is shutting down.
+func (h *HubManager) AddMessage(ctx context.Context, message model.Message) bool {
+	h.mu.Lock()
+	if h.shuttingDown {
+		h.mu.Unlock()
+		metrics.Messages.WithLabelValues(metrics.MessageDropped).Inc()
+		return false
+	}
+	h.senders.Add(1)
+	h.mu.Unlock()
+	defer h.senders.Done()
+
+	h.messages <- queuedMessage{ctx: ctx, message: message}
+	return true
+}
+
+// Running reports whether Run is routing messages
+func (h *HubManager) Running() bool {
+	return h.running.Load()
+}
+
+// ShuttingDown reports whether Shutdown was called, new connections are
+// refused from then on
+func (h *HubManager) ShuttingDown() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.shuttingDown
+}
+
+// Shutdown refuses new connections, closes the open ones as going away and
+// returns once Run has stored the messages still queued, or when ctx is done
+func (h *HubManager) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	first := !h.shuttingDown
+	h.shuttingDown = true
+	var conns []*websocket.Conn
+	for _, userConns := range h.clients {
+		for conn := range userConns {
+			conns = append(conns, conn)
+		}
+	}
+	h.mu.Unlock()
+
+	if first {
+		for _, conn := range conns {
+			closeConnection(conn, websocket.CloseGoingAway, "server shutting down")
+		}
+		slog.Info("Hub shutting down", "connections", len(conns), "queued_messages", len(h.messages))
+		// The read loops return once their connection is closed, what they
+		// had received is still queued
+		go func() {
+			h.senders.Wait()
+			close(h.messages)
+		}()
+	}
+
+	select {
+	case <-h.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
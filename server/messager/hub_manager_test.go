@@ -0,0 +1,295 @@
+package messager
+
+import (
+	"cito/server/metrics"
+	"cito/server/model"
+	"cito/server/service"
+	"cito/server/testutil"
+	"cito/server/tracing"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// newTestHub serves hub connections on an httptest server. The user and
+// session of each connection come from the "user" and "session" query values.
+func newTestHub(t *testing.T) (*HubManager, string) {
+	return newTestHubWithStore(t, service.NewMemoryRepository())
+}
+
+func newTestHubWithStore(t *testing.T, store Store) (*HubManager, string) {
+	hub := NewHubManager(store, DefaultMessageBuffer)
+	go hub.Run()
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := strconv.Atoi(r.URL.Query().Get("user"))
+		sessionID, _ := strconv.Atoi(r.URL.Query().Get("session"))
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		go hub.HandelConnection(r.Context(), &model.UserModel{ID: userID, SessionID: sessionID}, conn)
+	}))
+	t.Cleanup(server.Close)
+	return hub, "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func dial(t *testing.T, url string, userID, sessionID int) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?user="+strconv.Itoa(userID)+"&session="+strconv.Itoa(sessionID), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func waitForConnections(t *testing.T, hub *HubManager, userID int, want int) {
+	require.Eventually(t, func() bool {
+		return len(hub.connections(userID)) == want
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestHubManager_RoutesToEveryDeviceOfUser(t *testing.T) {
+	hub, url := newTestHub(t)
+	laptop := dial(t, url, 1, 10)
+	phone := dial(t, url, 1, 11)
+	waitForConnections(t, hub, 1, 2)
+
+	hub.AddMessage(context.Background(), model.Message{FromUserID: 2, ToUserId: 1, TextContent: "hello"})
+
+	for _, conn := range []*websocket.Conn{laptop, phone} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		var got model.Message
+		require.NoError(t, conn.ReadJSON(&got))
+		assert.Equal(t, "hello", got.TextContent)
+	}
+}
+
+func TestHubManager_DisconnectSession(t *testing.T) {
+	hub, url := newTestHub(t)
+	laptop := dial(t, url, 1, 10)
+	phone := dial(t, url, 1, 11)
+	waitForConnections(t, hub, 1, 2)
+
+	hub.DisconnectSession(10)
+
+	laptop.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := laptop.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "laptop should get a close frame, got %v", err)
+	waitForConnections(t, hub, 1, 1)
+
+	// The other session stays connected
+	hub.AddMessage(context.Background(), model.Message{FromUserID: 2, ToUserId: 1, TextContent: "still here"})
+	phone.SetReadDeadline(time.Now().Add(time.Second))
+	var got model.Message
+	require.NoError(t, phone.ReadJSON(&got))
+	assert.Equal(t, "still here", got.TextContent)
+}
+
+func TestHubManager_DisconnectUser(t *testing.T) {
+	hub, url := newTestHub(t)
+	laptop := dial(t, url, 1, 10)
+	phone := dial(t, url, 1, 11)
+	other := dial(t, url, 2, 20)
+	waitForConnections(t, hub, 1, 2)
+	waitForConnections(t, hub, 2, 1)
+
+	hub.DisconnectUser(1)
+
+	for _, conn := range []*websocket.Conn{laptop, phone} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err := conn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "got %v", err)
+	}
+	waitForConnections(t, hub, 1, 0)
+
+	hub.AddMessage(context.Background(), model.Message{FromUserID: 1, ToUserId: 2, TextContent: "other users stay"})
+	other.SetReadDeadline(time.Now().Add(time.Second))
+	var got model.Message
+	require.NoError(t, other.ReadJSON(&got))
+	assert.Equal(t, "other users stay", got.TextContent)
+}
+
+func TestHubManager_StoresMessages(t *testing.T) {
+	store := service.NewMemoryRepository()
+	hub, url := newTestHubWithStore(t, store)
+	sender := dial(t, url, 1, 10)
+	waitForConnections(t, hub, 1, 1)
+
+	// The recipient is offline, the message is kept anyway
+	require.NoError(t, sender.WriteJSON(model.Message{ToUserId: 2, TextContent: "are you there?"}))
+
+	var stored []model.Message
+	require.Eventually(t, func() bool {
+		var err error
+		stored, err = store.ListConversation(2, 1, time.Now().Add(time.Second), 10)
+		return err == nil && len(stored) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.NotZero(t, stored[0].ID)
+	assert.Equal(t, 1, stored[0].FromUserID, "the sender is the authenticated user")
+	assert.Equal(t, "are you there?", stored[0].TextContent)
+}
+
+func TestHubManager_RoutesRoomMessages(t *testing.T) {
+	store := service.NewMemoryRepository()
+	for _, name := range []string{"alice", "bob", "carol", "mallory"} {
+		_, err := store.CreateUser(name, "")
+		require.NoError(t, err)
+	}
+	room := model.Room{Name: "general", CreatedAt: time.Now()}
+	require.NoError(t, store.CreateRoom(&room))
+	for _, userID := range []int{1, 2, 3} {
+		require.NoError(t, store.AddRoomMember(room.ID, userID))
+	}
+	hub, url := newTestHubWithStore(t, store)
+	alice := dial(t, url, 1, 10)
+	bob := dial(t, url, 2, 20)
+	mallory := dial(t, url, 4, 40)
+	for _, userID := range []int{1, 2, 4} {
+		waitForConnections(t, hub, userID, 1)
+	}
+
+	require.NoError(t, mallory.WriteJSON(model.Message{RoomID: room.ID, TextContent: "let me in"}))
+	require.NoError(t, alice.WriteJSON(model.Message{RoomID: room.ID, ToUserId: 4, TextContent: "hello room"}))
+
+	bob.SetReadDeadline(time.Now().Add(time.Second))
+	var got model.Message
+	require.NoError(t, bob.ReadJSON(&got))
+	assert.Equal(t, "hello room", got.TextContent, "messages of non-members are dropped")
+	assert.Equal(t, 1, got.FromUserID)
+	assert.Zero(t, got.ToUserId)
+	mallory.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err := mallory.ReadMessage()
+	assert.Error(t, err, "non-members get nothing")
+
+	stored, err := store.ListRoomMessages(room.ID, time.Now().Add(time.Second), 10)
+	require.NoError(t, err)
+	require.Len(t, stored, 1, "the offline member reads it later")
+	assert.Equal(t, "hello room", stored[0].TextContent)
+}
+
+func TestHubManager_Shutdown(t *testing.T) {
+	store := service.NewMemoryRepository()
+	hub, url := newTestHubWithStore(t, store)
+	sender := dial(t, url, 1, 10)
+	recipient := dial(t, url, 2, 20)
+	waitForConnections(t, hub, 1, 1)
+	waitForConnections(t, hub, 2, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, hub.Shutdown(ctx))
+	assert.True(t, hub.ShuttingDown())
+
+	for _, conn := range []*websocket.Conn{sender, recipient} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err := conn.ReadMessage()
+		assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "got %v", err)
+	}
+	late, _, err := websocket.DefaultDialer.Dial(url+"?user=3&session=30", nil)
+	require.NoError(t, err)
+	defer late.Close()
+	late.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = late.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "new connections are refused, got %v", err)
+	assert.False(t, hub.AddMessage(context.Background(), model.Message{FromUserID: 1, ToUserId: 2}))
+	assert.NoError(t, hub.Shutdown(ctx), "shutting down again waits for the same drain")
+}
+
+func TestHubManager_ShutdownStoresQueuedMessages(t *testing.T) {
+	store := service.NewMemoryRepository()
+	hub := NewHubManager(store, 8)
+	for i := 0; i < 3; i++ {
+		require.True(t, hub.AddMessage(context.Background(), model.Message{FromUserID: 1, ToUserId: 2, TextContent: strconv.Itoa(i), Time: time.Now()}))
+	}
+
+	assert.False(t, hub.Running())
+	go hub.Run()
+	require.Eventually(t, hub.Running, time.Second, 10*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, hub.Shutdown(ctx))
+	assert.False(t, hub.Running(), "Run returns once the queue is drained")
+
+	stored, err := store.ListUserMessages(1, 0, 10)
+	require.NoError(t, err)
+	assert.Len(t, stored, 3)
+}
+
+func TestHubManager_CountsMessages(t *testing.T) {
+	count := func(outcome string) float64 {
+		return promtestutil.ToFloat64(metrics.Messages.WithLabelValues(outcome))
+	}
+	routed, undeliverable, dropped := count(metrics.MessageRouted), count(metrics.MessageUndeliverable), count(metrics.MessageDropped)
+
+	hub, url := newTestHub(t)
+	recipient := dial(t, url, 1, 10)
+	waitForConnections(t, hub, 1, 1)
+	require.True(t, hub.AddMessage(context.Background(), model.Message{FromUserID: 2, ToUserId: 1, TextContent: "online"}))
+	recipient.SetReadDeadline(time.Now().Add(time.Second))
+	var got model.Message
+	require.NoError(t, recipient.ReadJSON(&got))
+	require.True(t, hub.AddMessage(context.Background(), model.Message{FromUserID: 1, ToUserId: 3, TextContent: "offline"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, hub.Shutdown(ctx))
+	assert.False(t, hub.AddMessage(context.Background(), model.Message{FromUserID: 1, ToUserId: 2}))
+
+	assert.Equal(t, routed+1, count(metrics.MessageRouted))
+	assert.Equal(t, undeliverable+1, count(metrics.MessageUndeliverable))
+	assert.Equal(t, dropped+1, count(metrics.MessageDropped), "messages refused while shutting down are dropped")
+}
+
+func TestHubManager_TracesMessages(t *testing.T) {
+	recorder := testutil.RecordSpans(t)
+	hub := NewHubManager(service.NewMemoryRepository(), DefaultMessageBuffer)
+	go hub.Run()
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(tracing.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := strconv.Atoi(r.URL.Query().Get("user"))
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		go hub.HandelConnection(context.WithoutCancel(r.Context()), &model.UserModel{ID: userID}, conn)
+	})))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+	recipient := dial(t, url, 2, 20)
+	sender := dial(t, url, 1, 10)
+	waitForConnections(t, hub, 1, 1)
+	waitForConnections(t, hub, 2, 1)
+
+	require.NoError(t, sender.WriteJSON(model.Message{ToUserId: 2, TextContent: "traced"}))
+	recipient.SetReadDeadline(time.Now().Add(time.Second))
+	var got model.Message
+	require.NoError(t, recipient.ReadJSON(&got))
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	require.Eventually(t, func() bool {
+		for _, span := range recorder.Ended() {
+			spans[span.Name()] = span
+		}
+		return spans["hub.route"] != nil
+	}, time.Second, 10*time.Millisecond)
+	receive, route := spans["hub.receive"], spans["hub.route"]
+	require.NotNil(t, receive)
+	assert.True(t, receive.Parent().IsValid(), "the message continues the trace of the connection")
+	assert.Equal(t, receive.SpanContext().SpanID(), route.Parent().SpanID())
+	for _, name := range []string{"hub.persist", "hub.write"} {
+		require.Contains(t, spans, name)
+		assert.Equal(t, route.SpanContext().SpanID(), spans[name].Parent().SpanID(), "%s is a step of routing", name)
+	}
+	for _, name := range []string{"hub.route", "hub.persist", "hub.write"} {
+		assert.Equal(t, receive.SpanContext().TraceID(), spans[name].SpanContext().TraceID(), "%s is part of the trace", name)
+	}
+}
@@ -0,0 +1,85 @@
+// Package metrics holds the Prometheus metrics of the server, served at
+// /metrics
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Outcomes of routing a message through the hub
+const (
+	// MessageRouted was written to at least one connection of the recipient
+	MessageRouted = "routed"
+	// MessageUndeliverable found the recipient offline, it is only stored
+	MessageUndeliverable = "undeliverable"
+	// MessageDropped could not be queued or written anywhere
+	MessageDropped = "dropped"
+)
+
+var (
+	// Registry holds every metric of the server, along with the Go runtime
+	// and process metrics
+	Registry = prometheus.NewRegistry()
+
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cito_http_requests_total",
+		Help: "HTTP requests by route pattern, method and status code.",
+	}, []string{"route", "method", "code"})
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cito_http_request_duration_seconds",
+		Help:    "Time to handle HTTP requests by route pattern and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	WebSocketConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cito_websocket_connections",
+		Help: "Open WebSocket connections.",
+	})
+	WebSocketUsers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cito_websocket_users",
+		Help: "Users with at least one open WebSocket connection.",
+	})
+	Messages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cito_messages_total",
+		Help: "Messages handled by the hub by outcome: routed, undeliverable or dropped.",
+	}, []string{"outcome"})
+
+	DBQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cito_db_query_duration_seconds",
+		Help:    "Time to run SQL statements by kind, such as select or insert.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"statement"})
+
+	OAuthLogins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "cito_oauth_logins_total",
+		Help: "Identity provider logins by provider and result: success or failure.",
+	}, []string{"provider", "result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPRequestDuration,
+		WebSocketConnections,
+		WebSocketUsers,
+		Messages,
+		DBQueryDuration,
+		OAuthLogins,
+	)
+	// Outcomes are listed from the start so that rates work before the
+	// first of each happens
+	for _, outcome := range []string{MessageRouted, MessageUndeliverable, MessageDropped} {
+		Messages.WithLabelValues(outcome)
+	}
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
@@ -1,50 +1,260 @@
 package middleware
 
 import (
+	"bufio"
+	"cito/server/logging"
+	"cito/server/metrics"
 	"cito/server/model"
 	"cito/server/service"
+	"crypto/rand"
 	"log/slog"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
-func MakeAuthMiddleware(userService *service.UserService) func(next http.Handler) http.Handler {
+// SessionCookieName is the cookie carrying the raw session token
+const SessionCookieName = "session_token"
+
+// SetSessionCookie hands a session token to the browser, to keep for as long
+// as the session lasts. Over TLS the cookie is never sent in plain HTTP.
+func SetSessionCookie(w http.ResponseWriter, r *http.Request, sessionToken string, ttl time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    sessionToken,
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ClearSessionCookie removes the session cookie from the browser
+func ClearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// authenticateSession resolves the session cookie of r, renewing the session
+// on activity. ok is false when there is no valid session; an invalid cookie
+// is cleared.
+func authenticateSession(w http.ResponseWriter, r *http.Request, userService *service.UserService, sessionService *service.SessionService) (*model.UserModel, bool) {
+	// Check for session cookie
+	cookie, err := r.Cookie(SessionCookieName)
+	if err != nil {
+		return nil, false
+	}
+
+	// Look up user by session token, expired sessions are not found
+	user, err := userService.FindUserBySession(r.Context(), cookie.Value)
+	if err != nil || user == nil {
+		logging.FromContext(r.Context()).Warn("Invalid session", "error", err)
+		ClearSessionCookie(w, r)
+		return nil, false
+	}
+
+	// Slide the expiry on activity, the token may get rotated
+	sessionToken, err := sessionService.RenewSession(user.SessionID, cookie.Value)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("Failed to renew session", "error", err, "session_id", user.SessionID)
+	} else if sessionToken != "" {
+		SetSessionCookie(w, r, sessionToken, sessionService.TTL())
+	}
+	return user, true
+}
+
+// withUser returns r authenticated as user, whose ID the request logger
+// carries from then on
+func withUser(r *http.Request, user *model.UserModel) *http.Request {
+	ctx := model.NewContextWithUserValue(r.Context(), user)
+	logging.With(ctx, "user_id", user.ID)
+	return r.WithContext(ctx)
+}
+
+func MakeAuthMiddleware(userService *service.UserService, sessionService *service.SessionService) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Check for session cookie
-			cookie, err := r.Cookie("session_token")
-			if err != nil {
-				// No session cookie - show login link
+			user, ok := authenticateSession(w, r, userService, sessionService)
+			if !ok {
+				// No or invalid session - show login link
 				http.Redirect(w, r, "/login", http.StatusFound)
 				return
 			}
 
-			// Look up user by session token
-			user, err := userService.FindUserBySession(cookie.Value)
-			if err != nil || user == nil {
-				// Invalid session - show login link
-				slog.Warn("Invalid session", "error", err)
-				http.Redirect(w, r, "/login", http.StatusFound)
+			r = withUser(r, user)
+			logging.FromContext(r.Context()).Debug("Auth check success", "username", user.Username)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// bearerToken returns the credential of an "Authorization: Bearer" header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// MakeAPIAuthMiddleware authenticates API and bot clients. A personal access
+// token sent as "Authorization: Bearer" takes precedence, otherwise the
+// session cookie is used like in MakeAuthMiddleware. Failures get a 401
+// instead of a redirect to the login page.
+func MakeAPIAuthMiddleware(userService *service.UserService, sessionService *service.SessionService, tokenService *service.TokenService) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var user *model.UserModel
+			if rawToken, ok := bearerToken(r); ok {
+				var err error
+				user, err = tokenService.FindUserByPersonalToken(rawToken)
+				if err != nil {
+					logging.FromContext(r.Context()).Warn("Invalid personal access token", "error", err)
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+					http.Error(w, "invalid or expired token", http.StatusUnauthorized)
+					return
+				}
+				if err := tokenService.TouchToken(user.TokenID); err != nil {
+					logging.FromContext(r.Context()).Error("Failed to record token use", "error", err, "token_id", user.TokenID)
+				}
+			} else {
+				user, ok = authenticateSession(w, r, userService, sessionService)
+				if !ok {
+					w.Header().Set("WWW-Authenticate", "Bearer")
+					http.Error(w, "authentication required", http.StatusUnauthorized)
+					return
+				}
+			}
+
+			r = withUser(r, user)
+			logging.FromContext(r.Context()).Debug("API auth check success", "username", user.Username, "token_id", user.TokenID)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireScope rejects requests whose credential does not grant scope. It
+// must run after one of the auth middlewares.
+func RequireScope(scope model.TokenScope) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := model.GetUserValueFromContext(r.Context())
+			if !ok || !user.Scopes.Allows(scope) {
+				http.Error(w, "insufficient scope, requires "+string(scope), http.StatusForbidden)
 				return
 			}
-			slog.Info("Auth check success ", "user", user)
-			ctx := model.NewContextWithUserValue(r.Context(), user)
-			user2, ok := model.GetUserValueFromContext(ctx)
-			slog.Info(" got user from context", "user2", user2, "ok", ok)
-			next.ServeHTTP(w, r.WithContext(ctx))
+			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-// Middleware function signature
+// RequestIDHeader carries the ID correlating the log lines of a request. It
+// is taken from the caller, such as a proxy, or generated, and sent back.
+const RequestIDHeader = "X-Request-ID"
+
+// requestID returns the valid request ID sent with r, or a new one
+func requestID(r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if id == "" || len(id) > 128 {
+		return rand.Text()
+	}
+	// IDs are logged as is, they may not forge log lines
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return rand.Text()
+		}
+	}
+	return id
+}
+
+// LoggingMiddleware gives the request a logger carrying its ID, the trace
+// and, once authenticated, the user, and logs the response with its status,
+// size and duration
 func LoggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// BEFORE the handler runs
-		slog.Info("Request received", "method", r.Method, "path", r.URL.Path)
+		id := requestID(r)
+		w.Header().Set(RequestIDHeader, id)
+		logger := slog.Default().With("request_id", id)
+		if span := trace.SpanContextFromContext(r.Context()); span.IsValid() {
+			logger = logger.With("trace_id", span.TraceID().String())
+		}
+		r = r.WithContext(logging.NewContext(r.Context(), logger))
+		logger.Debug("Request received", "method", r.Method, "path", r.URL.Path)
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
 
 		// Call the next handler in the chain
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(rec, r)
 
 		// AFTER the handler runs
-		slog.Info("Response sent", "method", r.Method, "path", r.URL.Path)
+		logging.FromContext(r.Context()).Info("Response sent", "method", r.Method, "path", r.URL.Path,
+			"status", rec.Status(), "bytes", rec.bytes, "duration", time.Since(start))
+		// Routes are labelled by pattern, paths would give a series per ID
+		metrics.HTTPRequests.WithLabelValues(r.Pattern, r.Method, strconv.Itoa(rec.Status())).Inc()
+		metrics.HTTPRequestDuration.WithLabelValues(r.Pattern, r.Method).Observe(time.Since(start).Seconds())
 	})
 }
+
+// statusRecorder remembers the status code and body size written through
+// it. It can still be hijacked, for WebSocket upgrades, and flushed.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Status is the status code sent, 200 when the handler wrote nothing
+func (rec *statusRecorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+// Hijack hands the connection over, as WebSocket upgrades do once they have
+// written the 101 response themselves
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(rec.ResponseWriter).Hijack()
+	if err == nil && rec.status == 0 {
+		rec.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (rec *statusRecorder) Flush() {
+	http.NewResponseController(rec.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
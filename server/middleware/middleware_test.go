@@ -1,11 +1,29 @@
 package middleware
 
 import (
+	"bytes"
+	"cito/server/logging"
+	"cito/server/metrics"
+	"cito/server/model"
+	"cito/server/service"
+	"cito/server/testutil"
+	"crypto/sha256"
+	"crypto/tls"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/websocket"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLoggingMiddleware(t *testing.T) {
@@ -100,3 +118,352 @@ func TestLoggingMiddleware_ChainMultipleHandlers(t *testing.T) {
 	assert.Equal(t, http.StatusOK, rec.Code)
 	assert.Equal(t, "final handler", rec.Body.String())
 }
+
+// seedSessions stores a user in repository with a session for every cookie
+// value, last seen the given time ago, and returns the session IDs by cookie
+func seedSessions(t *testing.T, repository *service.MemoryRepository, ages map[string]time.Duration) map[string]int {
+	now := time.Now()
+	userID, err := repository.UpsertIdentity(model.Identity{Provider: "github", Subject: "1", Username: "testuser"}, service.SealedToken{AccessToken: "sealed"}, now)
+	require.NoError(t, err)
+
+	sessionIDs := make(map[string]int)
+	for cookie, age := range ages {
+		// Sessions are stored by the SHA-256 of their token
+		sum := sha256.Sum256([]byte(cookie))
+		sessionIDs[cookie], err = repository.CreateSession(model.SessionModel{
+			UserID:    userID,
+			CreatedAt: now.Add(-age),
+			ExpiresAt: now.Add(time.Hour),
+		}, hex.EncodeToString(sum[:]))
+		require.NoError(t, err)
+	}
+	return sessionIDs
+}
+
+func TestMakeAuthMiddleware(t *testing.T) {
+	keys := testutil.NewTestKeyring(t)
+
+	tests := []struct {
+		name          string
+		cookie        string
+		wantStatus    int
+		wantLocation  string
+		handlerCalled bool
+		// wantCookie is "" when no session cookie should be written,
+		// "cleared" when it should be removed and "set" when it is (re)issued
+		wantCookie string
+	}{
+		{
+			name:         "no cookie redirects to login",
+			wantStatus:   http.StatusFound,
+			wantLocation: "/login",
+		},
+		{
+			name:         "unknown or expired session redirects and clears cookie",
+			cookie:       "expired_token",
+			wantStatus:   http.StatusFound,
+			wantLocation: "/login",
+			wantCookie:   "cleared",
+		},
+		{
+			name:          "recently renewed session passes through",
+			cookie:        "fresh_token",
+			wantStatus:    http.StatusOK,
+			handlerCalled: true,
+		},
+		{
+			name:          "renewed session slides the cookie",
+			cookie:        "idle_token",
+			wantStatus:    http.StatusOK,
+			handlerCalled: true,
+			wantCookie:    "set",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repository := service.NewMemoryRepository()
+			sessionIDs := seedSessions(t, repository, map[string]time.Duration{"fresh_token": 0, "idle_token": 5 * time.Minute})
+
+			var gotUser *model.UserModel
+			handlerCalled := false
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handlerCalled = true
+				gotUser, _ = model.GetUserValueFromContext(r.Context())
+			})
+			authMiddleware := MakeAuthMiddleware(service.NewUserService(repository, keys), service.NewSessionService(repository))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: SessionCookieName, Value: tt.cookie})
+			}
+			rec := httptest.NewRecorder()
+			authMiddleware(next).ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, tt.wantLocation, rec.Header().Get("Location"))
+			assert.Equal(t, tt.handlerCalled, handlerCalled)
+			if tt.handlerCalled {
+				require.NotNil(t, gotUser)
+				assert.Equal(t, sessionIDs[tt.cookie], gotUser.SessionID)
+			}
+
+			var sessionCookie *http.Cookie
+			for _, cookie := range rec.Result().Cookies() {
+				if cookie.Name == SessionCookieName {
+					sessionCookie = cookie
+				}
+			}
+			switch tt.wantCookie {
+			case "":
+				assert.Nil(t, sessionCookie)
+			case "cleared":
+				require.NotNil(t, sessionCookie)
+				assert.Less(t, sessionCookie.MaxAge, 0)
+			case "set":
+				require.NotNil(t, sessionCookie)
+				assert.Equal(t, tt.cookie, sessionCookie.Value)
+				assert.Equal(t, int(service.SessionTTL.Seconds()), sessionCookie.MaxAge)
+			}
+		})
+	}
+}
+
+func TestMakeAPIAuthMiddleware(t *testing.T) {
+	keys := testutil.NewTestKeyring(t)
+
+	tests := []struct {
+		name          string
+		authorization string
+		cookie        string
+		mockSetup     func(sqlmock.Sqlmock)
+		wantStatus    int
+		wantTokenID   int
+		wantSessionID int
+	}{
+		{
+			name:          "valid bearer token",
+			authorization: "Bearer " + service.PersonalTokenPrefix + "abc",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT (.+) FROM personal_access_tokens t JOIN users u`).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email", "token_id", "scopes"}).
+						AddRow(1, "testuser", "test@example.com", 7, "read"))
+				mock.ExpectExec(`UPDATE personal_access_tokens SET last_used_at`).
+					WithArgs(7, sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantStatus:  http.StatusOK,
+			wantTokenID: 7,
+		},
+		{
+			name:          "unknown bearer token is rejected without trying the cookie",
+			authorization: "Bearer " + service.PersonalTokenPrefix + "unknown",
+			cookie:        "valid_token",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT (.+) FROM personal_access_tokens t JOIN users u`).
+					WillReturnError(sql.ErrNoRows)
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:          "falls back to session cookie",
+			cookie:        "valid_token",
+			mockSetup:     func(mock sqlmock.Sqlmock) {},
+			wantStatus:    http.StatusOK,
+			wantSessionID: 1,
+		},
+		{
+			name:       "no credentials",
+			mockSetup:  func(mock sqlmock.Sqlmock) {},
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.SetupMockDB(t)
+			defer cleanup()
+			tt.mockSetup(mock)
+			// Users and sessions live in memory, personal access tokens in the mocked database
+			repository := service.NewMemoryRepository()
+			seedSessions(t, repository, map[string]time.Duration{"valid_token": 0})
+
+			var gotUser *model.UserModel
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotUser, _ = model.GetUserValueFromContext(r.Context())
+			})
+			authMiddleware := MakeAPIAuthMiddleware(service.NewUserService(repository, keys), service.NewSessionService(repository), service.NewTokenService(db))
+
+			req := httptest.NewRequest(http.MethodGet, "/api/sessions", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: SessionCookieName, Value: tt.cookie})
+			}
+			rec := httptest.NewRecorder()
+			authMiddleware(next).ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Empty(t, rec.Header().Get("Location"), "API auth should never redirect")
+			if tt.wantStatus == http.StatusOK {
+				require.NotNil(t, gotUser)
+				assert.Equal(t, tt.wantTokenID, gotUser.TokenID)
+				assert.Equal(t, tt.wantSessionID, gotUser.SessionID)
+			} else {
+				assert.Nil(t, gotUser)
+				assert.NotEmpty(t, rec.Header().Get("WWW-Authenticate"))
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	tests := []struct {
+		name       string
+		user       *model.UserModel
+		required   model.TokenScope
+		wantStatus int
+	}{
+		{name: "browser session may do everything", user: &model.UserModel{Scopes: model.AllScopes}, required: model.ScopeAdmin, wantStatus: http.StatusOK},
+		{name: "write includes read", user: &model.UserModel{Scopes: model.Scopes{model.ScopeWrite}}, required: model.ScopeRead, wantStatus: http.StatusOK},
+		{name: "read does not include write", user: &model.UserModel{Scopes: model.Scopes{model.ScopeRead}}, required: model.ScopeWrite, wantStatus: http.StatusForbidden},
+		{name: "write does not include admin", user: &model.UserModel{Scopes: model.Scopes{model.ScopeRead, model.ScopeWrite}}, required: model.ScopeAdmin, wantStatus: http.StatusForbidden},
+		{name: "no user", required: model.ScopeRead, wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.user != nil {
+				req = req.WithContext(model.NewContextWithUserValue(req.Context(), tt.user))
+			}
+			rec := httptest.NewRecorder()
+			RequireScope(tt.required)(next).ServeHTTP(rec, req)
+			assert.Equal(t, tt.wantStatus, rec.Code)
+		})
+	}
+}
+
+func TestSetSessionCookie_SecureOverTLS(t *testing.T) {
+	tests := []struct {
+		name       string
+		tls        bool
+		wantSecure bool
+	}{
+		{name: "plain HTTP", tls: false, wantSecure: false},
+		{name: "TLS", tls: true, wantSecure: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			rec := httptest.NewRecorder()
+			SetSessionCookie(rec, req, "token", time.Hour)
+			ClearSessionCookie(rec, req)
+
+			cookies := rec.Result().Cookies()
+			require.Len(t, cookies, 2)
+			for _, cookie := range cookies {
+				assert.Equal(t, tt.wantSecure, cookie.Secure)
+			}
+		})
+	}
+}
+
+func TestLoggingMiddleware_RecordsMetrics(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /items/{id}", LoggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})))
+	upgrader := websocket.Upgrader{}
+	mux.Handle("GET /ws", LoggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err == nil {
+			conn.Close()
+		}
+	})))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	notFound := metrics.HTTPRequests.WithLabelValues("GET /items/{id}", "GET", "404")
+	switched := metrics.HTTPRequests.WithLabelValues("GET /ws", "GET", "101")
+	notFoundBefore, switchedBefore := promtestutil.ToFloat64(notFound), promtestutil.ToFloat64(switched)
+
+	resp, err := http.Get(server.URL + "/items/7")
+	require.NoError(t, err)
+	resp.Body.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	require.NoError(t, err, "the recorder can be hijacked")
+	conn.Close()
+
+	// Requests are counted once the handler returns, after the client has its
+	// response
+	assert.Eventually(t, func() bool {
+		return promtestutil.ToFloat64(notFound) == notFoundBefore+1 && promtestutil.ToFloat64(switched) == switchedBefore+1
+	}, time.Second, 10*time.Millisecond, "requests are counted by route pattern and status")
+}
+
+func TestLoggingMiddleware_RequestLogger(t *testing.T) {
+	tests := []struct {
+		name   string
+		sentID string
+		wantID string
+	}{
+		{name: "ID from the caller", sentID: "proxy-7f3a", wantID: "proxy-7f3a"},
+		{name: "generated ID"},
+		{name: "forged log line", sentID: "abc\nlevel=ERROR"},
+		{name: "oversized ID", sentID: strings.Repeat("a", 129)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			previous := slog.Default()
+			slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+			defer slog.SetDefault(previous)
+
+			handler := LoggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r = withUser(r, &model.UserModel{ID: 42})
+				logging.FromContext(r.Context()).Info("Handling")
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte("hello"))
+			}))
+			req := httptest.NewRequest("POST", "/items", nil)
+			if tt.sentID != "" {
+				req.Header.Set(RequestIDHeader, tt.sentID)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			id := rec.Header().Get(RequestIDHeader)
+			if tt.wantID != "" {
+				assert.Equal(t, tt.wantID, id)
+			} else {
+				assert.NotEqual(t, tt.sentID, id)
+				assert.Len(t, id, 26, "a new ID is generated")
+			}
+
+			var lines []map[string]any
+			for _, line := range bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n")) {
+				var entry map[string]any
+				require.NoError(t, json.Unmarshal(line, &entry))
+				lines = append(lines, entry)
+			}
+			require.Len(t, lines, 2)
+			for _, line := range lines {
+				assert.Equal(t, id, line["request_id"], "every line of the request carries its ID")
+				assert.Equal(t, float64(42), line["user_id"])
+			}
+			assert.Equal(t, "Response sent", lines[1]["msg"])
+			assert.Equal(t, float64(http.StatusCreated), lines[1]["status"])
+			assert.Equal(t, float64(5), lines[1]["bytes"])
+			assert.Contains(t, lines[1], "duration")
+		})
+	}
+}
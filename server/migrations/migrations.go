@@ -0,0 +1,327 @@
+// Package migrations versions the database schema. The SQL files embedded
+// from sql/, or sqlite/ for SQLite databases, are named
+// <version>_<name>.up.sql and <version>_<name>.down.sql and applied in
+// version order; applied versions are recorded in the schema_migrations
+// table.
+package migrations
+
+import (
+	"cito/server/database"
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//go:embed sql/*.sql sqlite/*.sql
+var files embed.FS
+
+// lockKey is the PostgreSQL advisory lock that keeps two processes, such as
+// two server replicas starting at once, from migrating at the same time
+const lockKey int64 = 0x63_69_74_6f // "cito"
+
+// dialect is what differs between the supported databases
+type dialect struct {
+	dir string
+	// lock and unlock are empty for SQLite, whose database file belongs to
+	// a single server process
+	lock      string
+	unlock    string
+	timestamp string
+}
+
+var dialects = map[string]dialect{
+	database.Postgres: {
+		dir:       "sql",
+		lock:      `SELECT pg_advisory_lock($1)`,
+		unlock:    `SELECT pg_advisory_unlock($1)`,
+		timestamp: "TIMESTAMPTZ",
+	},
+	database.SQLite: {dir: "sqlite", timestamp: "TIMESTAMP"},
+}
+
+var fileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// ErrSchemaTooNew is returned when the database has migrations this binary
+// does not know, such as after rolling back to an older release
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary")
+
+// Migration is one schema change with the SQL to apply and revert it
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status is a migration and when it was applied, nil while pending
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Load returns the embedded migrations of driverName in version order
+func Load(driverName string) ([]Migration, error) {
+	dialect, ok := dialects[driverName]
+	if !ok {
+		return nil, fmt.Errorf("no migrations for database driver %q", driverName)
+	}
+	return load(files, dialect.dir)
+}
+
+func load(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		match := fileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file %q", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		}
+		if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has two names, %q and %q", version, migration.Name, match[2])
+		}
+		if match[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrator applies and reverts migrations on a database
+type Migrator struct {
+	db         *sql.DB
+	dialect    dialect
+	migrations []Migration
+	// mu serializes the runs of this process, the database lock the runs of
+	// different processes
+	mu sync.Mutex
+}
+
+// New returns a Migrator for the embedded migrations of driverName
+func New(db *sql.DB, driverName string) (*Migrator, error) {
+	migrations, err := Load(driverName)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, dialect: dialects[driverName], migrations: migrations}, nil
+}
+
+// Up applies every pending migration and returns the ones it applied
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var applied []Migration
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := m.checkKnown(versions); err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if _, ok := versions[migration.Version]; ok {
+				continue
+			}
+			err := inTx(ctx, conn, migration.Up,
+				`INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`,
+				migration.Version, migration.Name, time.Now())
+			if err != nil {
+				return fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+			}
+			slog.Info("Applied migration", "version", migration.Version, "name", migration.Name)
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down reverts the latest steps applied migrations and returns the ones it
+// reverted
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var reverted []Migration
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if err := m.checkKnown(versions); err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := versions[migration.Version]; !ok {
+				continue
+			}
+			err := inTx(ctx, conn, migration.Down, `DELETE FROM schema_migrations WHERE version = $1`, migration.Version)
+			if err != nil {
+				return fmt.Errorf("reverting migration %d_%s failed: %w", migration.Version, migration.Name, err)
+			}
+			slog.Info("Reverted migration", "version", migration.Version, "name", migration.Name)
+			reverted = append(reverted, migration)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Status lists every known migration and whether it was applied
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			status := Status{Migration: migration}
+			if appliedAt, ok := versions[migration.Version]; ok {
+				status.AppliedAt = &appliedAt
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// Pending counts the migrations not applied yet. Unlike Status it doesn't
+// wait for the migration lock, so that it can be polled.
+func (m *Migrator) Pending(ctx context.Context) (int, error) {
+	versions, err := appliedVersions(ctx, m.db)
+	if err != nil {
+		return 0, err
+	}
+	pending := 0
+	for _, migration := range m.migrations {
+		if _, ok := versions[migration.Version]; !ok {
+			pending++
+		}
+	}
+	return pending, nil
+}
+
+// checkKnown refuses to touch a database migrated by a newer binary
+func (m *Migrator) checkKnown(versions map[int]time.Time) error {
+	known := make(map[int]bool, len(m.migrations))
+	for _, migration := range m.migrations {
+		known[migration.Version] = true
+	}
+	for version := range versions {
+		if !known[version] {
+			return fmt.Errorf("%w: unknown migration %d", ErrSchemaTooNew, version)
+		}
+	}
+	return nil
+}
+
+// withLock runs fn on one connection holding the migration lock
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if m.dialect.lock != "" {
+		if _, err := conn.ExecContext(ctx, m.dialect.lock, lockKey); err != nil {
+			return fmt.Errorf("failed to take migration lock: %w", err)
+		}
+		defer func() {
+			// The lock belongs to the session, release it even if ctx is done
+			if _, err := conn.ExecContext(context.Background(), m.dialect.unlock, lockKey); err != nil {
+				slog.Error("Failed to release migration lock", "error", err)
+			}
+		}()
+	}
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			applied_at `+m.dialect.timestamp+` NOT NULL
+		)
+	`)
+	if err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// queryer is a connection or the pool
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// appliedVersions returns when each applied migration ran
+func appliedVersions(ctx context.Context, conn queryer) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		versions[version] = appliedAt
+	}
+	return versions, rows.Err()
+}
+
+// inTx runs a migration script and its bookkeeping statement atomically
+func inTx(ctx context.Context, conn *sql.Conn, script string, record string, args ...any) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,192 @@
+package migrations
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"cito/server/database"
+	"cito/server/testutil"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	postgres, err := Load(database.Postgres)
+	require.NoError(t, err)
+	require.NotEmpty(t, postgres)
+	for i, migration := range postgres {
+		assert.Equal(t, i+1, migration.Version, "versions should be consecutive")
+		assert.NotEmpty(t, migration.Up)
+		assert.NotEmpty(t, migration.Down)
+	}
+
+	sqlite, err := Load(database.SQLite)
+	require.NoError(t, err)
+	require.Len(t, sqlite, len(postgres), "every migration needs a SQLite version")
+	for i, migration := range sqlite {
+		assert.Equal(t, postgres[i].Version, migration.Version)
+		assert.Equal(t, postgres[i].Name, migration.Name)
+	}
+
+	_, err = Load("mysql")
+	assert.Error(t, err)
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	file := func(content string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(content)} }
+
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+	}{
+		{name: "missing down", files: fstest.MapFS{"sql/0001_users.up.sql": file("CREATE TABLE users ()")}},
+		{name: "unexpected file", files: fstest.MapFS{"sql/users.sql": file("CREATE TABLE users ()")}},
+		{
+			name: "mismatched names",
+			files: fstest.MapFS{
+				"sql/0001_users.up.sql":      file("CREATE TABLE users ()"),
+				"sql/0001_accounts.down.sql": file("DROP TABLE users"),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := load(tt.files, "sql")
+			assert.Error(t, err)
+		})
+	}
+}
+
+var testMigrations = []Migration{
+	{Version: 1, Name: "users", Up: "CREATE TABLE users ()", Down: "DROP TABLE users"},
+	{Version: 2, Name: "sessions", Up: "CREATE TABLE sessions ()", Down: "DROP TABLE sessions"},
+}
+
+// expectLock expects the advisory lock and the schema_migrations table,
+// then returns the applied versions
+func expectLock(mock sqlmock.Sqlmock, applied ...int) {
+	mock.ExpectExec(`SELECT pg_advisory_lock`).WithArgs(lockKey).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS schema_migrations`).WillReturnResult(sqlmock.NewResult(0, 0))
+	rows := sqlmock.NewRows([]string{"version", "applied_at"})
+	for _, version := range applied {
+		rows.AddRow(version, time.Now())
+	}
+	mock.ExpectQuery(`SELECT version, applied_at FROM schema_migrations`).WillReturnRows(rows)
+}
+
+func expectUnlock(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(`SELECT pg_advisory_unlock`).WithArgs(lockKey).WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestMigrator_Up(t *testing.T) {
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	expectLock(mock, 1)
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TABLE sessions`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO schema_migrations`).WithArgs(2, "sessions", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectUnlock(mock)
+
+	migrator := &Migrator{db: db, dialect: dialects[database.Postgres], migrations: testMigrations}
+	applied, err := migrator.Up(context.Background())
+	require.NoError(t, err)
+	require.Len(t, applied, 1, "only the pending migration runs")
+	assert.Equal(t, 2, applied[0].Version)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrator_Up_FailedMigrationRollsBack(t *testing.T) {
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	expectLock(mock)
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TABLE users`).WillReturnError(assert.AnError)
+	mock.ExpectRollback()
+	expectUnlock(mock)
+
+	migrator := &Migrator{db: db, dialect: dialects[database.Postgres], migrations: testMigrations}
+	applied, err := migrator.Up(context.Background())
+	assert.ErrorIs(t, err, assert.AnError)
+	assert.Empty(t, applied)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrator_Up_SchemaTooNew(t *testing.T) {
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	expectLock(mock, 1, 2, 3)
+	expectUnlock(mock)
+
+	migrator := &Migrator{db: db, dialect: dialects[database.Postgres], migrations: testMigrations}
+	_, err := migrator.Up(context.Background())
+	assert.ErrorIs(t, err, ErrSchemaTooNew)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrator_Down(t *testing.T) {
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	expectLock(mock, 1, 2)
+	mock.ExpectBegin()
+	mock.ExpectExec(`DROP TABLE sessions`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DELETE FROM schema_migrations`).WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectUnlock(mock)
+
+	migrator := &Migrator{db: db, dialect: dialects[database.Postgres], migrations: testMigrations}
+	reverted, err := migrator.Down(context.Background(), 1)
+	require.NoError(t, err)
+	require.Len(t, reverted, 1, "only the latest migration is reverted")
+	assert.Equal(t, 2, reverted[0].Version)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMigrator_SQLite(t *testing.T) {
+	db, err := database.Open(database.SQLite, filepath.Join(t.TempDir(), "cito.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	migrator, err := New(db, database.SQLite)
+	require.NoError(t, err)
+	_, err = migrator.Pending(ctx)
+	assert.Error(t, err, "a database never migrated has no schema_migrations")
+
+	applied, err := migrator.Up(ctx)
+	require.NoError(t, err)
+	assert.Len(t, applied, len(migrator.migrations))
+	pending, err := migrator.Pending(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, pending)
+
+	statuses, err := migrator.Status(ctx)
+	require.NoError(t, err)
+	for _, status := range statuses {
+		assert.NotNil(t, status.AppliedAt, "migration %d should be applied", status.Version)
+	}
+
+	reverted, err := migrator.Down(ctx, len(migrator.migrations))
+	require.NoError(t, err)
+	assert.Len(t, reverted, len(migrator.migrations))
+	pending, err = migrator.Pending(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, len(migrator.migrations), pending)
+	var tables int
+	require.NoError(t, db.QueryRow(`
+		SELECT COUNT(*) FROM sqlite_master
+		WHERE type = 'table' AND name NOT IN ('schema_migrations', 'sqlite_sequence')
+	`).Scan(&tables))
+	assert.Zero(t, tables, "down migrations should drop every table")
+}
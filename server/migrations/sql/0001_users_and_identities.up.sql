@@ -0,0 +1,39 @@
+-- Written with IF NOT EXISTS so databases created before migrations existed
+-- are adopted as they are
+CREATE TABLE IF NOT EXISTS users (
+	id SERIAL PRIMARY KEY,
+	username VARCHAR(255) NOT NULL,
+	email VARCHAR(255)
+);
+-- sessions live in their own table
+ALTER TABLE users DROP COLUMN IF EXISTS session_token;
+
+CREATE TABLE IF NOT EXISTS identities (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	provider VARCHAR(64) NOT NULL,
+	subject VARCHAR(255) NOT NULL,
+	username VARCHAR(255) NOT NULL,
+	email VARCHAR(255),
+	access_token TEXT,
+	created_at TIMESTAMPTZ NOT NULL,
+	UNIQUE (provider, subject)
+);
+CREATE INDEX IF NOT EXISTS identities_user_id_idx ON identities (user_id);
+-- provider token refresh and revocation tracking
+ALTER TABLE identities ADD COLUMN IF NOT EXISTS refresh_token TEXT;
+ALTER TABLE identities ADD COLUMN IF NOT EXISTS token_expires_at TIMESTAMPTZ;
+ALTER TABLE identities ADD COLUMN IF NOT EXISTS token_checked_at TIMESTAMPTZ;
+ALTER TABLE identities ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMPTZ;
+
+-- accounts used to be keyed by github_id, move them to identities
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'github_id') THEN
+		INSERT INTO identities (user_id, provider, subject, username, email, access_token, created_at)
+		SELECT id, 'github', github_id::text, username, email, access_token, NOW() FROM users
+		ON CONFLICT (provider, subject) DO NOTHING;
+		ALTER TABLE users DROP COLUMN github_id;
+		ALTER TABLE users DROP COLUMN access_token;
+	END IF;
+END $$;
@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS user_totp (
+	user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+	secret TEXT NOT NULL,
+	enabled_at TIMESTAMPTZ,
+	last_used_step BIGINT NOT NULL DEFAULT 0,
+	created_at TIMESTAMPTZ NOT NULL
+);
+CREATE TABLE IF NOT EXISTS recovery_codes (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	code_hash VARCHAR(64) NOT NULL,
+	used_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS recovery_codes_user_id_idx ON recovery_codes(user_id);
+CREATE TABLE IF NOT EXISTS login_challenges (
+	id SERIAL PRIMARY KEY,
+	token_hash VARCHAR(64) UNIQUE NOT NULL,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	created_at TIMESTAMPTZ NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL
+);
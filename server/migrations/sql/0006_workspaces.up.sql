@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS workspaces (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	require_two_factor BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at TIMESTAMPTZ NOT NULL
+);
+CREATE TABLE IF NOT EXISTS workspace_members (
+	workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	role VARCHAR(16) NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	PRIMARY KEY (workspace_id, user_id)
+);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS messages (
+	id SERIAL PRIMARY KEY,
+	from_user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	to_user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	text_content TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS messages_from_to_idx ON messages (from_user_id, to_user_id, created_at);
+CREATE INDEX IF NOT EXISTS messages_to_from_idx ON messages (to_user_id, from_user_id, created_at);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS exports (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	format VARCHAR(16) NOT NULL,
+	status VARCHAR(16) NOT NULL,
+	exported INTEGER NOT NULL DEFAULT 0,
+	total INTEGER NOT NULL DEFAULT 0,
+	error TEXT,
+	created_at TIMESTAMPTZ NOT NULL,
+	finished_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS exports_user_id_idx ON exports (user_id);
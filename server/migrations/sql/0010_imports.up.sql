@@ -0,0 +1,18 @@
+-- replies point at the first message of their thread, which retention may
+-- have purged since
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS reply_to_id INTEGER;
+
+-- users and messages brought in from other chat services, by their ID there
+CREATE TABLE IF NOT EXISTS imported_users (
+	source VARCHAR(32) NOT NULL,
+	external_id VARCHAR(255) NOT NULL,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	PRIMARY KEY (source, external_id)
+);
+CREATE TABLE IF NOT EXISTS imported_messages (
+	source VARCHAR(32) NOT NULL,
+	external_id VARCHAR(255) NOT NULL,
+	message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+	PRIMARY KEY (source, external_id)
+);
+CREATE INDEX IF NOT EXISTS users_email_idx ON users (LOWER(email));
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS exports_unfinished_user_id_idx;
@@ -0,0 +1,6 @@
+-- a user has at most one export in progress; when concurrent requests left
+-- several, all but the oldest are failed first
+UPDATE exports SET status = 'failed', error = 'superseded'
+WHERE status IN ('pending', 'running')
+	AND id > (SELECT MIN(e.id) FROM exports e WHERE e.user_id = exports.user_id AND e.status IN ('pending', 'running'));
+CREATE UNIQUE INDEX IF NOT EXISTS exports_unfinished_user_id_idx ON exports (user_id) WHERE status IN ('pending', 'running');
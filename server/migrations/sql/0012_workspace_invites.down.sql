@@ -0,0 +1,2 @@
+DELETE FROM workspace_members WHERE accepted_at IS NULL;
+ALTER TABLE workspace_members DROP COLUMN IF EXISTS accepted_at;
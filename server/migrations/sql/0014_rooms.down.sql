@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS imported_room_messages;
+DROP TABLE IF EXISTS imported_rooms;
+DROP TABLE IF EXISTS room_messages;
+DROP TABLE IF EXISTS room_members;
+DROP TABLE IF EXISTS rooms;
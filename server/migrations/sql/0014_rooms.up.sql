@@ -0,0 +1,39 @@
+-- rooms are conversations of any number of members, such as the channels
+-- of an imported chat service
+CREATE TABLE IF NOT EXISTS rooms (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+CREATE TABLE IF NOT EXISTS room_members (
+	room_id INTEGER NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	PRIMARY KEY (room_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS room_members_user_idx ON room_members (user_id);
+-- replies point at the first message of their thread, which may have been
+-- deleted since
+CREATE TABLE IF NOT EXISTS room_messages (
+	id SERIAL PRIMARY KEY,
+	room_id INTEGER NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+	from_user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	text_content TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL,
+	reply_to_id INTEGER
+);
+CREATE INDEX IF NOT EXISTS room_messages_room_idx ON room_messages (room_id, created_at);
+
+-- the rooms and room messages imported, a deleted room message stays
+-- imported so running an import again does not bring it back
+CREATE TABLE IF NOT EXISTS imported_rooms (
+	source VARCHAR(32) NOT NULL,
+	external_id VARCHAR(255) NOT NULL,
+	room_id INTEGER NOT NULL REFERENCES rooms(id) ON DELETE CASCADE,
+	PRIMARY KEY (source, external_id)
+);
+CREATE TABLE IF NOT EXISTS imported_room_messages (
+	source VARCHAR(32) NOT NULL,
+	external_id VARCHAR(255) NOT NULL,
+	room_message_id INTEGER REFERENCES room_messages(id) ON DELETE SET NULL,
+	PRIMARY KEY (source, external_id)
+);
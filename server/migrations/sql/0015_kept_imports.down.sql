@@ -0,0 +1,5 @@
+DELETE FROM imported_messages WHERE message_id IS NULL;
+ALTER TABLE imported_messages DROP CONSTRAINT IF EXISTS imported_messages_message_id_fkey;
+ALTER TABLE imported_messages ALTER COLUMN message_id SET NOT NULL;
+ALTER TABLE imported_messages ADD CONSTRAINT imported_messages_message_id_fkey
+	FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE;
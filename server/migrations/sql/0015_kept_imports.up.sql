@@ -0,0 +1,6 @@
+-- an imported message stays imported once retention or a deleted user took
+-- it, so running an import again does not bring it back
+ALTER TABLE imported_messages DROP CONSTRAINT IF EXISTS imported_messages_message_id_fkey;
+ALTER TABLE imported_messages ALTER COLUMN message_id DROP NOT NULL;
+ALTER TABLE imported_messages ADD CONSTRAINT imported_messages_message_id_fkey
+	FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE SET NULL;
@@ -0,0 +1,24 @@
+-- SQLite databases start from the current schema, sql/ holds the history
+-- of PostgreSQL ones. Times are TIMESTAMP columns so that they scan as times.
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	username VARCHAR(255) NOT NULL,
+	email VARCHAR(255)
+);
+
+CREATE TABLE IF NOT EXISTS identities (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	provider VARCHAR(64) NOT NULL,
+	subject VARCHAR(255) NOT NULL,
+	username VARCHAR(255) NOT NULL,
+	email VARCHAR(255),
+	access_token TEXT,
+	refresh_token TEXT,
+	token_expires_at TIMESTAMP,
+	token_checked_at TIMESTAMP,
+	revoked_at TIMESTAMP,
+	created_at TIMESTAMP NOT NULL,
+	UNIQUE (provider, subject)
+);
+CREATE INDEX IF NOT EXISTS identities_user_id_idx ON identities (user_id);
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS sessions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	token_hash VARCHAR(64) UNIQUE NOT NULL,
+	previous_token_hash VARCHAR(64),
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	created_at TIMESTAMP NOT NULL,
+	last_seen_at TIMESTAMP NOT NULL,
+	rotated_at TIMESTAMP NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	user_agent TEXT,
+	ip_address VARCHAR(64)
+);
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id);
+CREATE INDEX IF NOT EXISTS sessions_previous_token_hash_idx ON sessions (previous_token_hash);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS personal_access_tokens (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	name VARCHAR(255) NOT NULL,
+	token_hash VARCHAR(64) UNIQUE NOT NULL,
+	scopes VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	last_used_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS personal_access_tokens_user_id_idx ON personal_access_tokens (user_id);
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS device_authorizations (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	device_code_hash VARCHAR(64) UNIQUE NOT NULL,
+	user_code VARCHAR(16) UNIQUE NOT NULL,
+	client_name VARCHAR(255) NOT NULL,
+	user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+	status VARCHAR(16) NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	last_polled_at TIMESTAMP
+);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS workspaces (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name VARCHAR(255) NOT NULL,
+	require_two_factor BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS workspace_members (
+	workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	role VARCHAR(16) NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (workspace_id, user_id)
+);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS messages (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	from_user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	to_user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	text_content TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS messages_from_to_idx ON messages (from_user_id, to_user_id, created_at);
+CREATE INDEX IF NOT EXISTS messages_to_from_idx ON messages (to_user_id, from_user_id, created_at);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS messages_created_at_idx;
+DROP TABLE IF EXISTS purge_runs;
+DROP TABLE IF EXISTS archived_messages;
+DROP TABLE IF EXISTS retention_policies;
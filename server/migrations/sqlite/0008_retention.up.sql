@@ -0,0 +1,30 @@
+-- conversations keeping messages longer or shorter than the default policy
+CREATE TABLE IF NOT EXISTS retention_policies (
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	other_user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	max_age_seconds BIGINT NOT NULL,
+	archive BOOLEAN NOT NULL,
+	updated_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (user_id, other_user_id)
+);
+
+-- expired messages of policies that archive, they keep their message ID
+CREATE TABLE IF NOT EXISTS archived_messages (
+	id INTEGER PRIMARY KEY,
+	from_user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	to_user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	text_content TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	archived_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS purge_runs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	started_at TIMESTAMP NOT NULL,
+	finished_at TIMESTAMP NOT NULL,
+	deleted INTEGER NOT NULL,
+	archived INTEGER NOT NULL,
+	error TEXT
+);
+
+CREATE INDEX IF NOT EXISTS messages_created_at_idx ON messages (created_at);
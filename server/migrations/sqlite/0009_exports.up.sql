@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS exports (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	format VARCHAR(16) NOT NULL,
+	status VARCHAR(16) NOT NULL,
+	exported INTEGER NOT NULL DEFAULT 0,
+	total INTEGER NOT NULL DEFAULT 0,
+	error TEXT,
+	created_at TIMESTAMP NOT NULL,
+	finished_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS exports_user_id_idx ON exports (user_id);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS users_email_idx;
+DROP TABLE IF EXISTS imported_messages;
+DROP TABLE IF EXISTS imported_users;
+ALTER TABLE messages DROP COLUMN reply_to_id;
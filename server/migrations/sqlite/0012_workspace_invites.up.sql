@@ -0,0 +1,4 @@
+-- members are invited and join once they accept; who was added before
+-- invites existed has joined already
+ALTER TABLE workspace_members ADD COLUMN accepted_at TIMESTAMP;
+UPDATE workspace_members SET accepted_at = created_at;
@@ -0,0 +1,4 @@
+ALTER TABLE imported_users DROP COLUMN suggested_user_id;
+DROP INDEX IF EXISTS identities_email_idx;
+CREATE INDEX IF NOT EXISTS users_email_idx ON users (LOWER(email));
+ALTER TABLE identities DROP COLUMN email_verified;
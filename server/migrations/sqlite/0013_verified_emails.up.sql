@@ -0,0 +1,9 @@
+-- whether the provider verified the email of an identity, only verified
+-- emails tell who an address belongs to
+ALTER TABLE identities ADD COLUMN email_verified BOOLEAN NOT NULL DEFAULT FALSE;
+DROP INDEX IF EXISTS users_email_idx;
+CREATE INDEX IF NOT EXISTS identities_email_idx ON identities (LOWER(email));
+
+-- an existing user sharing an unverified email with an imported one, until
+-- an admin confirms they are the same person
+ALTER TABLE imported_users ADD COLUMN suggested_user_id INTEGER REFERENCES users(id) ON DELETE SET NULL;
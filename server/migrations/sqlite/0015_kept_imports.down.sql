@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS imported_messages_cascade (
+	source VARCHAR(32) NOT NULL,
+	external_id VARCHAR(255) NOT NULL,
+	message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+	PRIMARY KEY (source, external_id)
+);
+INSERT INTO imported_messages_cascade (source, external_id, message_id)
+SELECT source, external_id, message_id FROM imported_messages WHERE message_id IS NOT NULL;
+DROP TABLE imported_messages;
+ALTER TABLE imported_messages_cascade RENAME TO imported_messages;
@@ -0,0 +1,13 @@
+-- an imported message stays imported once retention or a deleted user took
+-- it, so running an import again does not bring it back; SQLite cannot alter
+-- a foreign key, the table is copied instead
+CREATE TABLE IF NOT EXISTS imported_messages_kept (
+	source VARCHAR(32) NOT NULL,
+	external_id VARCHAR(255) NOT NULL,
+	message_id INTEGER REFERENCES messages(id) ON DELETE SET NULL,
+	PRIMARY KEY (source, external_id)
+);
+INSERT INTO imported_messages_kept (source, external_id, message_id)
+SELECT source, external_id, message_id FROM imported_messages;
+DROP TABLE imported_messages;
+ALTER TABLE imported_messages_kept RENAME TO imported_messages;
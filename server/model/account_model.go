@@ -0,0 +1,31 @@
+package model
+
+import "fmt"
+
+// DeletionPolicy is what happens to the messages of deleted accounts
+type DeletionPolicy string
+
+const (
+	// DeletionPlaceholder keeps the account's messages, sent by an anonymous
+	// "deleted user" left in its place
+	DeletionPlaceholder DeletionPolicy = "placeholder"
+	// DeletionHard removes the account with every message it sent. The
+	// messages it received stay with their senders, addressed to a
+	// "deleted user".
+	DeletionHard DeletionPolicy = "hard"
+)
+
+// DeletedUsername is the name of accounts deleted with DeletionPlaceholder,
+// and of the recipient left by DeletionHard
+const DeletedUsername = "deleted user"
+
+// ParseDeletionPolicy reads a deletion policy, DeletionPlaceholder when empty
+func ParseDeletionPolicy(value string) (DeletionPolicy, error) {
+	switch policy := DeletionPolicy(value); policy {
+	case "":
+		return DeletionPlaceholder, nil
+	case DeletionPlaceholder, DeletionHard:
+		return policy, nil
+	}
+	return "", fmt.Errorf("unknown deletion policy %q, expected %s or %s", value, DeletionPlaceholder, DeletionHard)
+}
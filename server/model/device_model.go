@@ -0,0 +1,25 @@
+package model
+
+import "time"
+
+// Device authorization states
+const (
+	DeviceStatusPending  = "pending"
+	DeviceStatusApproved = "approved"
+	DeviceStatusDenied   = "denied"
+	DeviceStatusIssued   = "issued"
+)
+
+// DeviceAuthorization is a login request started by a client without a
+// browser, such as the CLI. The user approves it by entering UserCode while
+// logged in; the client polls with DeviceCode until a token is issued.
+type DeviceAuthorization struct {
+	ID         int
+	DeviceCode string
+	UserCode   string
+	ClientName string
+	UserID     int
+	Status     string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+}
@@ -0,0 +1,43 @@
+package model
+
+import "time"
+
+// Export formats
+const (
+	// ExportFormatNDJSON writes one JSON object per message
+	ExportFormatNDJSON = "ndjson"
+	// ExportFormatZip writes a zip archive holding the messages as an mbox
+	// style file
+	ExportFormatZip = "zip"
+)
+
+// Export states
+const (
+	ExportStatusPending = "pending"
+	ExportStatusRunning = "running"
+	ExportStatusDone    = "done"
+	ExportStatusFailed  = "failed"
+)
+
+// Export is a job writing a user's conversations to a file they download
+// once it is done
+type Export struct {
+	ID     int    `json:"id"`
+	UserID int    `json:"-"`
+	Format string `json:"format"`
+	Status string `json:"status"`
+	// Exported counts the messages written so far out of Total, which is
+	// known once the export runs
+	Exported   int        `json:"exported"`
+	Total      int        `json:"total"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	// DownloadURL is set once the export is done
+	DownloadURL string `json:"download_url,omitempty"`
+}
+
+// Finished reports whether the export stopped, successfully or not
+func (e Export) Finished() bool {
+	return e.Status == ExportStatusDone || e.Status == ExportStatusFailed
+}
@@ -0,0 +1,39 @@
+package model
+
+import (
+	"strconv"
+	"time"
+)
+
+// ProviderGitHub is the name of the built-in GitHub identity provider
+const ProviderGitHub = "github"
+
+// Identity is an account at an identity provider, such as a GitHub user or
+// an OpenID Connect subject, linked to a cito user
+type Identity struct {
+	ID       int    `json:"id"`
+	UserID   int    `json:"-"`
+	Provider string `json:"provider"`
+	// Subject is the provider's stable identifier for the account
+	Subject  string `json:"subject"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	// EmailVerified is whether the provider verified Email. Only verified
+	// emails are trusted to tell who an address belongs to.
+	EmailVerified bool      `json:"email_verified"`
+	CreatedAt     time.Time `json:"created_at"`
+	// RevokedAt is set once the provider stopped accepting the identity's
+	// token, signing in with it again clears it
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Identity converts a GitHub API user into a provider identity
+func (u GitHubUser) Identity() Identity {
+	return Identity{
+		Provider:      ProviderGitHub,
+		Subject:       strconv.FormatInt(u.ID, 10),
+		Username:      u.Login,
+		Email:         u.Email,
+		EmailVerified: u.EmailVerified,
+	}
+}
@@ -0,0 +1,12 @@
+package model
+
+// ImportedUser maps a user of another chat service to a cito user
+type ImportedUser struct {
+	Source     string `json:"source"`
+	ExternalID string `json:"external_id"`
+	UserID     int    `json:"user_id"`
+	// SuggestedUserID is an existing user whose unverified email is the
+	// imported user's. Until an admin confirms they are the same person, the
+	// imported messages stay with UserID, a placeholder.
+	SuggestedUserID int `json:"suggested_user_id,omitempty"`
+}
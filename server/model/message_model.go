@@ -3,8 +3,16 @@ package model
 import "time"
 
 type Message struct {
-	FromUserID  int
-	ToUserId    int
+	// ID is set once the message is stored
+	ID         int
+	FromUserID int
+	// ToUserId is the recipient of a direct message, 0 for room messages
+	ToUserId int
+	// RoomID is the room a message was sent to, 0 for direct messages
+	RoomID      int
 	TextContent string
 	Time        time.Time
+	// ReplyToID is the first message of the thread a reply belongs to, 0
+	// for messages outside threads
+	ReplyToID int
 }
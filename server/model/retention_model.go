@@ -0,0 +1,107 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Conversation is the messages exchanged by two users. UserID is the lower
+// of the two user IDs.
+type Conversation struct {
+	UserID      int `json:"user_id"`
+	OtherUserID int `json:"other_user_id"`
+}
+
+// NewConversation returns the conversation of two users given in any order
+func NewConversation(userID int, otherUserID int) Conversation {
+	if otherUserID < userID {
+		userID, otherUserID = otherUserID, userID
+	}
+	return Conversation{UserID: userID, OtherUserID: otherUserID}
+}
+
+// RetentionPolicy is how long messages are kept
+type RetentionPolicy struct {
+	// MaxAge is zero to keep messages forever
+	MaxAge time.Duration
+	// Archive moves expired messages to the archive instead of deleting them
+	Archive bool
+}
+
+// retentionPolicyJSON writes MaxAge as a duration such as "30d" or "12h",
+// empty for forever
+type retentionPolicyJSON struct {
+	MaxAge  string `json:"max_age"`
+	Archive bool   `json:"archive"`
+}
+
+func (p RetentionPolicy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(retentionPolicyJSON{MaxAge: FormatMaxAge(p.MaxAge), Archive: p.Archive})
+}
+
+func (p *RetentionPolicy) UnmarshalJSON(data []byte) error {
+	var policy retentionPolicyJSON
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return err
+	}
+	maxAge, err := ParseMaxAge(policy.MaxAge)
+	if err != nil {
+		return err
+	}
+	*p = RetentionPolicy{MaxAge: maxAge, Archive: policy.Archive}
+	return nil
+}
+
+// ParseMaxAge parses a retention duration. On top of time.ParseDuration
+// units it accepts whole days, such as "90d". Empty means forever.
+func ParseMaxAge(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid retention %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	maxAge, err := time.ParseDuration(value)
+	if err != nil || maxAge < 0 {
+		return 0, fmt.Errorf("invalid retention %q", value)
+	}
+	return maxAge, nil
+}
+
+// FormatMaxAge writes a retention duration the way ParseMaxAge reads it
+func FormatMaxAge(maxAge time.Duration) string {
+	if maxAge == 0 {
+		return ""
+	}
+	if maxAge%(24*time.Hour) == 0 {
+		return strconv.Itoa(int(maxAge/(24*time.Hour))) + "d"
+	}
+	return maxAge.String()
+}
+
+// ConversationRetention is the policy in effect for a conversation
+type ConversationRetention struct {
+	Conversation
+	Policy RetentionPolicy `json:"policy"`
+	// Override is false when the conversation follows the default policy
+	Override bool `json:"override"`
+}
+
+// PurgeRun records one round of the retention job
+type PurgeRun struct {
+	ID         int       `json:"id"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Deleted    int       `json:"deleted"`
+	Archived   int       `json:"archived"`
+	// Error is empty unless the round stopped early
+	Error string `json:"error,omitempty"`
+}
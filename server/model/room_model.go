@@ -0,0 +1,11 @@
+package model
+
+import "time"
+
+// Room is a conversation of any number of members. Messages sent to a room
+// reach every member.
+type Room struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,15 @@
+package model
+
+import "time"
+
+// SessionModel is one logged-in device of a user. The raw session token is
+// only ever handed to the client; the database keeps its hash.
+type SessionModel struct {
+	ID         int
+	UserID     int
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	UserAgent  string
+	IPAddress  string
+}
@@ -0,0 +1,72 @@
+package model
+
+import (
+	"strings"
+	"time"
+)
+
+// TokenScope limits what a personal access token may do. Scopes are ordered:
+// write includes read and admin includes both.
+type TokenScope string
+
+const (
+	ScopeRead  TokenScope = "read"
+	ScopeWrite TokenScope = "write"
+	ScopeAdmin TokenScope = "admin"
+)
+
+var scopeRank = map[TokenScope]int{ScopeRead: 1, ScopeWrite: 2, ScopeAdmin: 3}
+
+// Valid reports whether s is a known scope
+func (s TokenScope) Valid() bool {
+	_, ok := scopeRank[s]
+	return ok
+}
+
+// Scopes is the set of scopes granted to a request or token
+type Scopes []TokenScope
+
+// AllScopes is granted to browser sessions
+var AllScopes = Scopes{ScopeRead, ScopeWrite, ScopeAdmin}
+
+// Allows reports whether any granted scope covers required
+func (s Scopes) Allows(required TokenScope) bool {
+	for _, scope := range s {
+		if scopeRank[scope] >= scopeRank[required] {
+			return true
+		}
+	}
+	return false
+}
+
+// String joins the scopes the way they are stored, e.g. "read,write"
+func (s Scopes) String() string {
+	parts := make([]string, len(s))
+	for i, scope := range s {
+		parts[i] = string(scope)
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseScopes splits a stored scope list
+func ParseScopes(value string) Scopes {
+	scopes := Scopes{}
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			scopes = append(scopes, TokenScope(part))
+		}
+	}
+	return scopes
+}
+
+// PersonalAccessToken is a named, scoped credential a user creates for
+// scripts and API clients. Only its hash is stored.
+type PersonalAccessToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"-"`
+	Name       string     `json:"name"`
+	Scopes     Scopes     `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
@@ -1,20 +1,43 @@
 package model
 
-import "context"
+import (
+	"context"
+	"log/slog"
+)
 
 type GitHubUser struct {
 	ID    int64  `json:"id"`
 	Login string `json:"login"`
 	Email string `json:"email"`
+	// EmailVerified is not part of the user resource, it is set from the
+	// user's email addresses
+	EmailVerified bool `json:"-"`
 }
 
 type UserModel struct {
-	ID           int
-	GithubID     int64
-	Username     string
-	Email        string
-	AccessToken  string
-	SessionToken string
+	ID       int
+	Username string
+	Email    string
+	// SessionID is the session the user was authenticated through, if any
+	SessionID int
+	// TokenID is the personal access token the user was authenticated
+	// through, if any
+	TokenID int
+	// Scopes is what the current credential may do
+	Scopes Scopes
+}
+
+// LogValue keeps logs to identifiers
+func (u *UserModel) LogValue() slog.Value {
+	if u == nil {
+		return slog.StringValue("<nil>")
+	}
+	return slog.GroupValue(
+		slog.Int("id", u.ID),
+		slog.String("username", u.Username),
+		slog.Int("session_id", u.SessionID),
+		slog.Int("token_id", u.TokenID),
+	)
 }
 
 type userContextKey struct{}
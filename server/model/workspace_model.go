@@ -0,0 +1,20 @@
+package model
+
+import "time"
+
+const (
+	WorkspaceRoleAdmin  = "admin"
+	WorkspaceRoleMember = "member"
+)
+
+// Workspace groups users. Workspace admins invite members and set policies,
+// such as requiring two-factor authentication, for those who accepted.
+type Workspace struct {
+	ID               int       `json:"id"`
+	Name             string    `json:"name"`
+	RequireTwoFactor bool      `json:"require_two_factor"`
+	CreatedAt        time.Time `json:"created_at"`
+	// Role is the current user's role in the workspace, or the role they are
+	// invited to
+	Role string `json:"role"`
+}
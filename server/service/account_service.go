@@ -0,0 +1,196 @@
+package service
+
+import (
+	"cito/server/logging"
+	"cito/server/model"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+var ErrDeletionNotConfirmed = errors.New("type your username to confirm the deletion")
+
+// AccountService gives users their personal data and deletes their account
+// when they ask
+type AccountService struct {
+	users            UserRepository
+	userService      *UserService
+	sessionService   *SessionService
+	tokenService     *TokenService
+	workspaceService *WorkspaceService
+	twoFactorService *TwoFactorService
+	exportService    *ExportService
+	policy           model.DeletionPolicy
+	// disconnectUser closes the connections of a deleted account
+	disconnectUser func(userID int)
+}
+
+// NewAccountService returns a service deleting accounts with policy
+func NewAccountService(users UserRepository, userService *UserService, sessionService *SessionService, tokenService *TokenService,
+	workspaceService *WorkspaceService, twoFactorService *TwoFactorService, exportService *ExportService,
+	policy model.DeletionPolicy, disconnectUser func(userID int)) *AccountService {
+	return &AccountService{
+		users:            users,
+		userService:      userService,
+		sessionService:   sessionService,
+		tokenService:     tokenService,
+		workspaceService: workspaceService,
+		twoFactorService: twoFactorService,
+		exportService:    exportService,
+		policy:           policy,
+		disconnectUser:   disconnectUser,
+	}
+}
+
+// DeletionPolicy returns what happens to the messages of deleted accounts
+func (as *AccountService) DeletionPolicy() model.DeletionPolicy {
+	return as.policy
+}
+
+type personalUser struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+type personalSession struct {
+	ID         int       `json:"id"`
+	Device     string    `json:"device"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// personalData is everything stored about a user but their messages, which
+// follow it in the same document
+type personalData struct {
+	User       personalUser                `json:"user"`
+	Identities []model.Identity            `json:"identities"`
+	Sessions   []personalSession           `json:"sessions"`
+	Tokens     []model.PersonalAccessToken `json:"tokens"`
+	Workspaces []model.Workspace           `json:"workspaces"`
+	TwoFactor  *TwoFactorStatus            `json:"two_factor"`
+	Exports    []model.Export              `json:"exports"`
+}
+
+func (as *AccountService) personalData(ctx context.Context, userID int) (*personalData, error) {
+	user, err := as.userService.FindUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	data := &personalData{User: personalUser{ID: user.ID, Username: user.Username, Email: user.Email}, Sessions: []personalSession{}}
+	if data.Identities, err = as.userService.ListIdentities(ctx, userID); err != nil {
+		return nil, err
+	}
+	sessions, err := as.sessionService.ListSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, session := range sessions {
+		data.Sessions = append(data.Sessions, personalSession{
+			ID:         session.ID,
+			Device:     session.UserAgent,
+			IPAddress:  session.IPAddress,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+			ExpiresAt:  session.ExpiresAt,
+		})
+	}
+	if data.Tokens, err = as.tokenService.ListTokens(userID); err != nil {
+		return nil, err
+	}
+	if data.Workspaces, err = as.workspaceService.ListWorkspaces(userID); err != nil {
+		return nil, err
+	}
+	if data.TwoFactor, err = as.twoFactorService.Status(userID); err != nil {
+		return nil, err
+	}
+	if data.Exports, err = as.exportService.ListExports(userID); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WritePersonalData writes everything stored about a user as one JSON
+// document, reading their messages in batches
+func (as *AccountService) WritePersonalData(ctx context.Context, userID int, w io.Writer) error {
+	data, err := as.personalData(ctx, userID)
+	if err != nil {
+		return err
+	}
+	head, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	// The messages are appended to the object as they are read
+	if _, err := io.WriteString(w, strings.TrimSuffix(string(head), "}")+`,"messages":[`); err != nil {
+		return err
+	}
+
+	users := map[int]exportedUser{}
+	afterID := 0
+	for first := true; ; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		messages, err := as.exportService.messages.ListUserMessages(userID, afterID, exportBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			break
+		}
+		for _, message := range messages {
+			exported, err := as.exportService.exportedMessage(ctx, users, message)
+			if err != nil {
+				return err
+			}
+			line, err := json.Marshal(exported)
+			if err != nil {
+				return err
+			}
+			if !first {
+				line = append([]byte(","), line...)
+			}
+			first = false
+			if _, err := w.Write(line); err != nil {
+				return err
+			}
+			afterID = message.ID
+		}
+	}
+	_, err = io.WriteString(w, "]}\n")
+	return err
+}
+
+// DeleteAccount deletes the account of userID following the deletion
+// policy, once confirm matches their username, and closes its connections
+func (as *AccountService) DeleteAccount(ctx context.Context, userID int, confirm string) error {
+	user, err := as.userService.FindUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if confirm != user.Username {
+		return ErrDeletionNotConfirmed
+	}
+
+	if err := as.exportService.RemoveExports(userID); err != nil {
+		return err
+	}
+	if as.policy == model.DeletionHard {
+		err = as.users.DeleteUser(userID, model.DeletedUsername)
+	} else {
+		err = as.users.AnonymizeUser(userID, model.DeletedUsername)
+	}
+	if err != nil {
+		return err
+	}
+	as.disconnectUser(userID)
+
+	logging.FromContext(ctx).Info("Account deleted", "user_id", userID, "policy", as.policy)
+	return nil
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"bytes"
+	"cito/server/model"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"cito/server/testutil"
+)
+
+// newTestAccountService returns a service on a SQLite database with two
+// users, 1 wrote to 2, with a session, a token and a workspace each. It
+// records the disconnected users.
+func newTestAccountService(t *testing.T, policy model.DeletionPolicy) (*AccountService, *SQLiteRepository, *[]int) {
+	sr := newTestSQLiteRepository(t)
+	keys := testutil.NewTestKeyring(t)
+	userService := NewUserService(sr, keys)
+	sessionService := NewSessionService(sr)
+	tokenService := NewTokenService(sr.db)
+	workspaceService := NewWorkspaceService(sr.db)
+	for i := 1; i <= 2; i++ {
+		userID, err := sr.UpsertIdentity(model.GitHubUser{ID: int64(i), Login: "user" + strconv.Itoa(i), Email: "user@example.com"}.Identity(), SealedToken{AccessToken: "token"}, time.Now())
+		require.NoError(t, err)
+		_, err = sessionService.CreateSession(userID, "browser", "127.0.0.1")
+		require.NoError(t, err)
+		_, _, err = tokenService.CreateToken(userID, "cli", model.Scopes{model.ScopeRead}, time.Hour)
+		require.NoError(t, err)
+		_, err = workspaceService.CreateWorkspace(userID, "team")
+		require.NoError(t, err)
+	}
+	require.NoError(t, sr.SaveMessage(&model.Message{FromUserID: 1, ToUserId: 2, TextContent: "hello", Time: time.Now()}))
+
+	exportService := NewExportService(sr, sr, userService, t.TempDir())
+	var disconnected []int
+	as := NewAccountService(sr, userService, sessionService, tokenService, workspaceService, NewTwoFactorService(sr.db, keys, workspaceService),
+		exportService, policy, func(userID int) { disconnected = append(disconnected, userID) })
+	return as, sr, &disconnected
+}
+
+// countRows counts the rows of a table belonging to userID
+func countRows(t *testing.T, sr *SQLiteRepository, table string, userID int) int {
+	var count int
+	require.NoError(t, sr.db.QueryRow(`SELECT COUNT(*) FROM `+table+` WHERE user_id = $1`, userID).Scan(&count))
+	return count
+}
+
+func TestAccountService_WritePersonalData(t *testing.T) {
+	as, _, _ := newTestAccountService(t, model.DeletionPlaceholder)
+
+	var buf bytes.Buffer
+	require.NoError(t, as.WritePersonalData(context.Background(), 1, &buf))
+	var data struct {
+		personalData
+		Messages []exportedMessage `json:"messages"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &data), buf.String())
+	assert.Equal(t, personalUser{ID: 1, Username: "user1", Email: "user@example.com"}, data.User)
+	assert.Len(t, data.Identities, 1)
+	assert.Len(t, data.Sessions, 1)
+	assert.Len(t, data.Tokens, 1)
+	assert.Len(t, data.Workspaces, 1)
+	assert.False(t, data.TwoFactor.Enabled)
+	require.Len(t, data.Messages, 1)
+	assert.Equal(t, "hello", data.Messages[0].Text)
+
+	assert.ErrorIs(t, as.WritePersonalData(context.Background(), 9, &buf), ErrUserNotFound)
+}
+
+func TestAccountService_DeleteAccount(t *testing.T) {
+	t.Run("placeholder keeps messages", func(t *testing.T) {
+		as, sr, disconnected := newTestAccountService(t, model.DeletionPlaceholder)
+		_, err := as.exportService.RequestExport(1, model.ExportFormatNDJSON)
+		require.NoError(t, err)
+		require.NoError(t, as.exportService.ProcessExports(context.Background()))
+
+		assert.ErrorIs(t, as.DeleteAccount(context.Background(), 1, "user2"), ErrDeletionNotConfirmed)
+		require.NoError(t, as.DeleteAccount(context.Background(), 1, "user1"))
+		assert.Equal(t, []int{1}, *disconnected)
+
+		user, err := sr.FindUserByID(1)
+		require.NoError(t, err)
+		assert.Equal(t, model.UserModel{ID: 1, Username: model.DeletedUsername}, *user)
+		for _, table := range anonymizedTables {
+			assert.Zero(t, countRows(t, sr, table, 1), table)
+		}
+		assert.Equal(t, 1, countRows(t, sr, "sessions", 2), "other users keep theirs")
+		messages, err := sr.ListUserMessages(2, 0, 10)
+		require.NoError(t, err)
+		assert.Len(t, messages, 1)
+		assert.NoFileExists(t, filepath.Join(as.exportService.dir, "export-1.ndjson"), "export files are removed")
+	})
+
+	t.Run("hard delete removes sent messages", func(t *testing.T) {
+		as, sr, disconnected := newTestAccountService(t, model.DeletionHard)
+		require.NoError(t, sr.SaveMessage(&model.Message{FromUserID: 2, ToUserId: 1, TextContent: "hi back", Time: time.Now()}))
+		policy := model.RetentionPolicy{MaxAge: time.Hour}
+		require.NoError(t, sr.SetRetentionPolicy(model.NewConversation(1, 2), policy, time.Now()))
+
+		require.NoError(t, as.DeleteAccount(context.Background(), 1, "user1"))
+		assert.Equal(t, []int{1}, *disconnected)
+		_, err := sr.FindUserByID(1)
+		assert.ErrorIs(t, err, ErrUserNotFound)
+		messages, err := sr.ListUserMessages(2, 0, 10)
+		require.NoError(t, err)
+		require.Len(t, messages, 1, "messages sent to the account are kept")
+		assert.Equal(t, "hi back", messages[0].TextContent)
+		placeholder, err := sr.FindUserByID(messages[0].ToUserId)
+		require.NoError(t, err)
+		assert.Equal(t, model.DeletedUsername, placeholder.Username)
+		policies, err := sr.RetentionPolicies()
+		require.NoError(t, err)
+		assert.Equal(t, map[model.Conversation]model.RetentionPolicy{model.NewConversation(2, placeholder.ID): policy}, policies)
+		assert.Equal(t, 1, countRows(t, sr, "workspace_members", 2))
+
+		assert.ErrorIs(t, as.DeleteAccount(context.Background(), 1, "user1"), ErrUserNotFound)
+	})
+}
@@ -1,15 +1,16 @@
 package service
 
 import (
+	"cito/server/metrics"
 	"cito/server/model"
+	"cito/server/tracing"
 	"context"
-	"encoding/json"
+	"crypto/rand"
 	"errors"
 	"fmt"
-	"io"
-	"log/slog"
-	"net/http"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/oauth2"
 )
 
@@ -17,117 +18,146 @@ import (
 type OAuth2TokenExchanger interface {
 	Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error)
 	AuthCodeURL(state string, opts ...oauth2.AuthCodeOption) string
+	TokenSource(ctx context.Context, t *oauth2.Token) oauth2.TokenSource
 }
 
-type AuthService struct {
-	oauthConfig OAuth2TokenExchanger
-	httpClient  *http.Client
-}
-
-func NewAuthService(oauthConfig OAuth2TokenExchanger, httpClient *http.Client) *AuthService {
-	return &AuthService{oauthConfig: oauthConfig, httpClient: httpClient}
+// IdentityProvider signs users in through an OAuth 2.0 authorization code
+// flow and tells who they are
+type IdentityProvider interface {
+	// Name identifies the provider in URLs and in the identities table
+	Name() string
+	// DisplayName is shown on the login page
+	DisplayName() string
+	// AuthCodeURL builds the authorization URL of attempt, carrying its
+	// state and the S256 challenge of its verifier
+	AuthCodeURL(attempt LoginAttempt) string
+	// Exchange trades the authorization code for tokens, proving possession of verifier
+	Exchange(ctx context.Context, code string, verifier string) (*oauth2.Token, error)
+	// FetchProfile returns the provider account the tokens belong to. ID
+	// tokens must carry nonce, the one of the login attempt.
+	FetchProfile(ctx context.Context, token *oauth2.Token, nonce string) (*model.Identity, error)
 }
 
-func (as *AuthService) GetLoginURL() string {
-	return as.oauthConfig.AuthCodeURL("state")
+// LoginAttempt holds the single use values of one provider round trip. The
+// browser keeps them until the callback, which only completes the attempt
+// it started.
+type LoginAttempt struct {
+	// State comes back with the authorization code, tying the callback to
+	// the browser that was sent to the provider
+	State string
+	// Nonce comes back in OpenID Connect ID tokens, so that a token issued
+	// for another login is refused
+	Nonce string
+	// Verifier is the PKCE code verifier
+	Verifier string
 }
 
-func (as *AuthService) GetGHToken(ctx context.Context, code string) (*oauth2.Token, error) {
-	return as.oauthConfig.Exchange(ctx, code)
+// TokenVerifier is implemented by identity providers that can tell whether
+// a stored token still grants access
+type TokenVerifier interface {
+	// VerifyToken checks token with the provider, refreshing it first when
+	// it expired. It returns ErrTokenRevoked when the user withdrew the
+	// authorization, otherwise the token to store from now on.
+	VerifyToken(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error)
 }
 
-func (as *AuthService) FetchGitHubUserEmail(accessToken string) (string, error) {
-	req, err := http.NewRequest("GET", "https://api.github.com/user/emails", nil)
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
-	}
-
-	req.Header.Add("Authorization", "Bearer "+accessToken)
-
-	httpClient := as.httpClient
-	if httpClient == nil {
-		httpClient = &http.Client{}
-	}
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to fetch user info: %w", err)
-	}
-	defer resp.Body.Close()
+var (
+	ErrUnknownProvider = errors.New("unknown identity provider")
+	ErrTokenRevoked    = errors.New("authorization revoked")
+	// ErrProviderFailed wraps the errors of a provider verifying a token
+	ErrProviderFailed = errors.New("identity provider failed")
+)
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("GitHub API returned status %d", resp.StatusCode)
-	}
+// AuthService holds the configured identity providers in login page order
+type AuthService struct {
+	providers []IdentityProvider
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response body: %w", err)
-	}
-	slog.Info("client eamil body gh:", "email", body)
-	type Email struct {
-		Email   string `json:"email"`
-		Primary bool   `json:"primary"`
-	}
-	var emails []Email
+func NewAuthService(providers ...IdentityProvider) *AuthService {
+	return &AuthService{providers: providers}
+}
 
-	if err := json.Unmarshal(body, &emails); err != nil {
-		return "", fmt.Errorf("failed to parse GitHub emails: %w", err)
+// NewLoginAttempt returns fresh random values for a single login attempt
+func (as *AuthService) NewLoginAttempt() LoginAttempt {
+	return LoginAttempt{State: rand.Text(), Nonce: rand.Text(), Verifier: oauth2.GenerateVerifier()}
+}
 
-	}
-	slog.Info("client emails unmarsh body gh:", "emails", emails)
+// Providers returns the configured identity providers
+func (as *AuthService) Providers() []IdentityProvider {
+	return as.providers
+}
 
-	for _, email := range emails {
-		if email.Primary == true {
-			return email.Email, nil
+// Provider returns the identity provider called name
+func (as *AuthService) Provider(name string) (IdentityProvider, error) {
+	for _, provider := range as.providers {
+		if provider.Name() == name {
+			return provider, nil
 		}
 	}
-	return "", errors.New("No email found")
-
+	return nil, ErrUnknownProvider
 }
 
-// fetchGitHubUser fetches user information from GitHub API
-func (as *AuthService) FetchGitHubUser(accessToken string) (*model.GitHubUser, error) {
-
-	apiURL := "https://api.github.com/user"
+// Authenticate completes attempt with providerName: it exchanges the
+// authorization code and fetches the identity it was issued for
+func (as *AuthService) Authenticate(ctx context.Context, providerName string, code string, attempt LoginAttempt) (*model.Identity, *oauth2.Token, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "oauth.authenticate", trace.WithAttributes(attribute.String("oauth.provider", providerName)))
+	identity, token, err := as.authenticate(ctx, providerName, code, attempt)
+	tracing.End(span, err)
+	return identity, token, err
+}
 
-	req, err := http.NewRequest("GET", apiURL, nil)
+func (as *AuthService) authenticate(ctx context.Context, providerName string, code string, attempt LoginAttempt) (*model.Identity, *oauth2.Token, error) {
+	// Unknown names aren't counted, they come from the request
+	provider, err := as.Provider(providerName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, nil, err
 	}
-
-	req.Header.Add("Authorization", "Bearer "+accessToken)
-
-	httpClient := as.httpClient
-	if httpClient == nil {
-		httpClient = &http.Client{}
+	exchangeCtx, span := tracing.Tracer().Start(ctx, "oauth.exchange")
+	token, err := provider.Exchange(exchangeCtx, code, attempt.Verifier)
+	tracing.End(span, err)
+	if err != nil {
+		metrics.OAuthLogins.WithLabelValues(providerName, "failure").Inc()
+		return nil, nil, fmt.Errorf("%s exchange failed: %w", providerName, err)
 	}
-
-	resp, err := httpClient.Do(req)
+	profileCtx, span := tracing.Tracer().Start(ctx, "oauth.profile")
+	identity, err := provider.FetchProfile(profileCtx, token, attempt.Nonce)
+	tracing.End(span, err)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch user info: %w", err)
+		metrics.OAuthLogins.WithLabelValues(providerName, "failure").Inc()
+		return nil, nil, fmt.Errorf("%s profile failed: %w", providerName, err)
 	}
-	defer resp.Body.Close()
+	metrics.OAuthLogins.WithLabelValues(providerName, "success").Inc()
+	return identity, token, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("GitHub API returned status %d", resp.StatusCode)
+// VerificationProviders returns the providers whose tokens can be verified
+func (as *AuthService) VerificationProviders() []string {
+	var names []string
+	for _, provider := range as.providers {
+		if _, ok := provider.(TokenVerifier); ok {
+			names = append(names, provider.Name())
+		}
 	}
+	return names
+}
 
-	body, err := io.ReadAll(resp.Body)
+// VerifyToken checks a stored token of providerName. Tokens of providers
+// that cannot verify them are returned unchanged. Failures of the provider
+// other than a revoked authorization wrap ErrProviderFailed.
+func (as *AuthService) VerifyToken(ctx context.Context, providerName string, token *oauth2.Token) (*oauth2.Token, error) {
+	provider, err := as.Provider(providerName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+		return nil, err
 	}
-	slog.Info("client body gh:", "body", body)
-	var githubUser model.GitHubUser
-	if err := json.Unmarshal(body, &githubUser); err != nil {
-		return nil, fmt.Errorf("failed to parse GitHub user: %w", err)
+	verifier, ok := provider.(TokenVerifier)
+	if !ok {
+		return token, nil
 	}
-
-	if githubUser.Email == "" {
-		githubUser.Email, err = as.FetchGitHubUserEmail(accessToken)
-		if err != nil {
-			return nil, fmt.Errorf("failed to fetch Email: %w", err)
-		}
+	ctx, span := tracing.Tracer().Start(ctx, "oauth.verify", trace.WithAttributes(attribute.String("oauth.provider", providerName)))
+	token, err = verifier.VerifyToken(ctx, token)
+	tracing.End(span, err)
+	if err != nil && !errors.Is(err, ErrTokenRevoked) {
+		return nil, fmt.Errorf("%w: %w", ErrProviderFailed, err)
 	}
-
-	return &githubUser, nil
+	return token, err
 }
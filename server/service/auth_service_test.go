@@ -0,0 +1,77 @@
+package service
+
+import (
+	"cito/server/metrics"
+	"cito/server/model"
+	"cito/server/testutil"
+	"context"
+	"testing"
+
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	"golang.org/x/oauth2"
+)
+
+// fakeProvider is an IdentityProvider returning a fixed identity
+type fakeProvider struct {
+	name     string
+	identity *model.Identity
+	err      error
+}
+
+func (fp *fakeProvider) Name() string        { return fp.name }
+func (fp *fakeProvider) DisplayName() string { return fp.name }
+func (fp *fakeProvider) AuthCodeURL(attempt LoginAttempt) string {
+	return "https://" + fp.name + "/authorize"
+}
+func (fp *fakeProvider) Exchange(ctx context.Context, code string, verifier string) (*oauth2.Token, error) {
+	return &oauth2.Token{AccessToken: code}, nil
+}
+func (fp *fakeProvider) FetchProfile(ctx context.Context, token *oauth2.Token, nonce string) (*model.Identity, error) {
+	return fp.identity, fp.err
+}
+
+func TestAuthService_Authenticate(t *testing.T) {
+	as := NewAuthService(
+		&fakeProvider{name: "github", identity: &model.Identity{Provider: "github", Subject: "1"}},
+		&fakeProvider{name: "corp", identity: &model.Identity{Provider: "corp", Subject: "alice"}},
+		&fakeProvider{name: "broken", err: assert.AnError},
+	)
+
+	logins := func(provider, result string) float64 {
+		return promtestutil.ToFloat64(metrics.OAuthLogins.WithLabelValues(provider, result))
+	}
+	successes, failures := logins("corp", "success"), logins("broken", "failure")
+
+	identity, token, err := as.Authenticate(context.Background(), "corp", "code", LoginAttempt{Verifier: "verifier"})
+	require.NoError(t, err)
+	assert.Equal(t, "alice", identity.Subject)
+	assert.Equal(t, "code", token.AccessToken)
+
+	_, _, err = as.Authenticate(context.Background(), "gitlab", "code", LoginAttempt{Verifier: "verifier"})
+	assert.ErrorIs(t, err, ErrUnknownProvider)
+
+	_, _, err = as.Authenticate(context.Background(), "broken", "code", LoginAttempt{Verifier: "verifier"})
+	assert.ErrorIs(t, err, assert.AnError)
+
+	assert.Equal(t, successes+1, logins("corp", "success"))
+	assert.Equal(t, failures+1, logins("broken", "failure"))
+}
+
+func TestAuthService_AuthenticateTraces(t *testing.T) {
+	recorder := testutil.RecordSpans(t)
+	as := NewAuthService(&fakeProvider{name: "broken", err: assert.AnError})
+
+	_, _, err := as.Authenticate(context.Background(), "broken", "code", LoginAttempt{Verifier: "verifier"})
+	require.Error(t, err)
+
+	assert.Equal(t, []string{"oauth.exchange", "oauth.profile", "oauth.authenticate"}, testutil.SpanNames(recorder))
+	spans := recorder.Ended()
+	for _, child := range spans[:2] {
+		assert.Equal(t, spans[2].SpanContext().SpanID(), child.Parent().SpanID(), "%s is part of the login", child.Name())
+	}
+	assert.Equal(t, codes.Error, spans[1].Status().Code, "the failed step is marked")
+	assert.Equal(t, codes.Error, spans[2].Status().Code)
+}
@@ -0,0 +1,269 @@
+package service
+
+import (
+	"cito/server/model"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	// DeviceCodeTTL is how long a user has to approve a device login
+	DeviceCodeTTL = 10 * time.Minute
+	// DevicePollInterval is the minimum time between two token polls
+	DevicePollInterval = 5 * time.Second
+	// DeviceTokenTTL is the lifetime of tokens issued to devices
+	DeviceTokenTTL = 90 * 24 * time.Hour
+	// userCodeAlphabet avoids vowels and look-alike characters, see RFC 8628 6.1
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+)
+
+// Errors returned while polling for a device token, named after the RFC 8628
+// error codes they map to
+var (
+	ErrAuthorizationPending = errors.New("authorization_pending")
+	ErrSlowDown             = errors.New("slow_down")
+	ErrAccessDenied         = errors.New("access_denied")
+	ErrExpiredToken         = errors.New("expired_token")
+	// ErrUserCodeNotFound is returned when a user code is unknown, expired or
+	// already used
+	ErrUserCodeNotFound = errors.New("user code not found")
+)
+
+// DeviceScopes are granted to tokens issued through the device flow
+var DeviceScopes = model.Scopes{model.ScopeRead, model.ScopeWrite}
+
+type DeviceService struct {
+	db *sql.DB
+}
+
+func NewDeviceService(db *sql.DB) *DeviceService {
+	return &DeviceService{db: db}
+}
+
+// generateUserCode returns a code like "BCDF-GHJK" that is easy to type
+func generateUserCode() (string, error) {
+	var code strings.Builder
+	for i := 0; i < 8; i++ {
+		if i == 4 {
+			code.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code.WriteByte(userCodeAlphabet[n.Int64()])
+	}
+	return code.String(), nil
+}
+
+// NormalizeUserCode accepts user input in any case, with or without the dash
+func NormalizeUserCode(input string) string {
+	code := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(input))
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+// StartAuthorization begins a device login for clientName
+func (ds *DeviceService) StartAuthorization(clientName string) (*model.DeviceAuthorization, error) {
+	clientName = strings.TrimSpace(clientName)
+	if clientName == "" {
+		clientName = "cito CLI"
+	}
+	if len(clientName) > 100 {
+		clientName = clientName[:100]
+	}
+	deviceCode, err := generateSessionToken()
+	if err != nil {
+		return nil, err
+	}
+	userCode, err := generateUserCode()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	authorization := &model.DeviceAuthorization{
+		DeviceCode: deviceCode,
+		UserCode:   userCode,
+		ClientName: clientName,
+		Status:     model.DeviceStatusPending,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(DeviceCodeTTL),
+	}
+	query := `
+		INSERT INTO device_authorizations (device_code_hash, user_code, client_name, status, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`
+	err = ds.db.QueryRow(query, hashToken(deviceCode), userCode, clientName, authorization.Status, now, authorization.ExpiresAt).Scan(&authorization.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("Started device authorization", "id", authorization.ID, "client", clientName)
+	return authorization, nil
+}
+
+// FindPendingAuthorization returns the pending, unexpired authorization for
+// a user code so it can be shown to the user before approval
+func (ds *DeviceService) FindPendingAuthorization(userCode string) (*model.DeviceAuthorization, error) {
+	query := `
+		SELECT id, user_code, client_name, status, created_at, expires_at
+		FROM device_authorizations
+		WHERE user_code = $1 AND status = $2 AND expires_at > $3
+	`
+	var authorization model.DeviceAuthorization
+	err := ds.db.QueryRow(query, NormalizeUserCode(userCode), model.DeviceStatusPending, time.Now()).Scan(
+		&authorization.ID,
+		&authorization.UserCode,
+		&authorization.ClientName,
+		&authorization.Status,
+		&authorization.CreatedAt,
+		&authorization.ExpiresAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserCodeNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &authorization, nil
+}
+
+// decide moves a pending authorization to approved or denied on behalf of userID
+func (ds *DeviceService) decide(userID int, userCode string, status string) error {
+	query := `
+		UPDATE device_authorizations SET status = $1, user_id = $2
+		WHERE user_code = $3 AND status = $4 AND expires_at > $5
+	`
+	result, err := ds.db.Exec(query, status, userID, NormalizeUserCode(userCode), model.DeviceStatusPending, time.Now())
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrUserCodeNotFound
+	}
+
+	slog.Info("Device authorization decided", "user_id", userID, "status", status)
+	return nil
+}
+
+// Approve lets the device holding userCode log in as userID
+func (ds *DeviceService) Approve(userID int, userCode string) error {
+	return ds.decide(userID, userCode, model.DeviceStatusApproved)
+}
+
+// Deny rejects the device holding userCode
+func (ds *DeviceService) Deny(userID int, userCode string) error {
+	return ds.decide(userID, userCode, model.DeviceStatusDenied)
+}
+
+// ExchangeDeviceCode is polled by the device. Once the user approved, it
+// issues a personal access token exactly once and returns it.
+func (ds *DeviceService) ExchangeDeviceCode(deviceCode string) (string, error) {
+	now := time.Now()
+	query := `
+		SELECT id, status, client_name, COALESCE(user_id, 0), expires_at, last_polled_at
+		FROM device_authorizations
+		WHERE device_code_hash = $1
+	`
+	var authorization model.DeviceAuthorization
+	var lastPolledAt sql.NullTime
+	err := ds.db.QueryRow(query, hashToken(deviceCode)).Scan(
+		&authorization.ID,
+		&authorization.Status,
+		&authorization.ClientName,
+		&authorization.UserID,
+		&authorization.ExpiresAt,
+		&lastPolledAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrExpiredToken
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := ds.db.Exec(`UPDATE device_authorizations SET last_polled_at = $1 WHERE id = $2`, now, authorization.ID); err != nil {
+		return "", err
+	}
+
+	switch {
+	case authorization.Status == model.DeviceStatusDenied:
+		return "", ErrAccessDenied
+	case authorization.Status == model.DeviceStatusIssued || !now.Before(authorization.ExpiresAt):
+		return "", ErrExpiredToken
+	case lastPolledAt.Valid && now.Sub(lastPolledAt.Time) < DevicePollInterval:
+		return "", ErrSlowDown
+	case authorization.Status == model.DeviceStatusPending:
+		return "", ErrAuthorizationPending
+	}
+
+	// Claim the approval so concurrent polls cannot issue two tokens. The
+	// claim is undone when the token cannot be stored, so the next poll
+	// gets another try.
+	tx, err := ds.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(`UPDATE device_authorizations SET status = $1 WHERE id = $2 AND status = $3`,
+		model.DeviceStatusIssued, authorization.ID, model.DeviceStatusApproved)
+	if err != nil {
+		return "", err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return "", ErrExpiredToken
+	}
+
+	rawToken, token, err := createToken(tx, authorization.UserID, authorization.ClientName, DeviceScopes, DeviceTokenTTL)
+	if err != nil {
+		return "", fmt.Errorf("failed to issue device token: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	slog.Info("Issued device token", "user_id", authorization.UserID, "token_id", token.ID, "authorization_id", authorization.ID)
+	return rawToken, nil
+}
+
+// PurgeExpired deletes the authorizations that expired before now, whatever
+// became of them, and returns how many were deleted
+func (ds *DeviceService) PurgeExpired(now time.Time) (int, error) {
+	result, err := ds.db.Exec(`DELETE FROM device_authorizations WHERE expires_at < $1`, now)
+	if err != nil {
+		return 0, err
+	}
+	purged, err := result.RowsAffected()
+	return int(purged), err
+}
+
+// Run purges expired authorizations every interval until ctx is done
+func (ds *DeviceService) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if purged, err := ds.PurgeExpired(time.Now()); err != nil {
+			slog.Error("Device authorization purge failed", "error", err)
+		} else if purged > 0 {
+			slog.Info("Purged expired device authorizations", "count", purged)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package service
+
+import (
+	"cito/server/model"
+	"database/sql"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"cito/server/testutil"
+)
+
+func TestGenerateUserCode(t *testing.T) {
+	code, err := generateUserCode()
+	require.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile(`^[`+userCodeAlphabet+`]{4}-[`+userCodeAlphabet+`]{4}$`), code)
+}
+
+func TestNormalizeUserCode(t *testing.T) {
+	assert.Equal(t, "BCDF-GHJK", NormalizeUserCode("bcdfghjk"))
+	assert.Equal(t, "BCDF-GHJK", NormalizeUserCode(" bcdf-ghjk"))
+	assert.Equal(t, "ABC", NormalizeUserCode("abc"))
+}
+
+func TestDeviceService_StartAuthorization(t *testing.T) {
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	mock.ExpectQuery(`INSERT INTO device_authorizations`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "cito CLI", model.DeviceStatusPending, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+
+	authorization, err := NewDeviceService(db).StartAuthorization("  ")
+	require.NoError(t, err)
+	assert.Equal(t, 4, authorization.ID)
+	assert.Len(t, authorization.DeviceCode, 64)
+	assert.WithinDuration(t, time.Now().Add(DeviceCodeTTL), authorization.ExpiresAt, time.Minute)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDeviceService_Approve(t *testing.T) {
+	tests := []struct {
+		name     string
+		affected int64
+		wantErr  error
+	}{
+		{name: "approves pending code", affected: 1},
+		{name: "unknown or expired code", affected: 0, wantErr: ErrUserCodeNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.SetupMockDB(t)
+			defer cleanup()
+
+			mock.ExpectExec(`UPDATE device_authorizations SET status = \$1, user_id = \$2`).
+				WithArgs(model.DeviceStatusApproved, 1, "BCDF-GHJK", model.DeviceStatusPending, sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, tt.affected))
+
+			err := NewDeviceService(db).Approve(1, "bcdfghjk")
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestDeviceService_ExchangeDeviceCode(t *testing.T) {
+	columns := []string{"id", "status", "client_name", "user_id", "expires_at", "last_polled_at"}
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+	}{
+		{
+			name: "pending authorization",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT (.+) FROM device_authorizations`).
+					WillReturnRows(sqlmock.NewRows(columns).AddRow(1, model.DeviceStatusPending, "cli", 0, now.Add(time.Minute), nil))
+				mock.ExpectExec(`UPDATE device_authorizations SET last_polled_at`).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantErr: ErrAuthorizationPending,
+		},
+		{
+			name: "polling too fast",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT (.+) FROM device_authorizations`).
+					WillReturnRows(sqlmock.NewRows(columns).AddRow(1, model.DeviceStatusPending, "cli", 0, now.Add(time.Minute), now))
+				mock.ExpectExec(`UPDATE device_authorizations SET last_polled_at`).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantErr: ErrSlowDown,
+		},
+		{
+			name: "denied by the user",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT (.+) FROM device_authorizations`).
+					WillReturnRows(sqlmock.NewRows(columns).AddRow(1, model.DeviceStatusDenied, "cli", 1, now.Add(time.Minute), nil))
+				mock.ExpectExec(`UPDATE device_authorizations SET last_polled_at`).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantErr: ErrAccessDenied,
+		},
+		{
+			name: "expired code",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT (.+) FROM device_authorizations`).
+					WillReturnRows(sqlmock.NewRows(columns).AddRow(1, model.DeviceStatusApproved, "cli", 1, now.Add(-time.Minute), nil))
+				mock.ExpectExec(`UPDATE device_authorizations SET last_polled_at`).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			wantErr: ErrExpiredToken,
+		},
+		{
+			name: "unknown device code",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT (.+) FROM device_authorizations`).WillReturnError(sql.ErrNoRows)
+			},
+			wantErr: ErrExpiredToken,
+		},
+		{
+			name: "token already issued to a concurrent poll",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT (.+) FROM device_authorizations`).
+					WillReturnRows(sqlmock.NewRows(columns).AddRow(1, model.DeviceStatusApproved, "cli", 1, now.Add(time.Minute), nil))
+				mock.ExpectExec(`UPDATE device_authorizations SET last_polled_at`).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE device_authorizations SET status`).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectRollback()
+			},
+			wantErr: ErrExpiredToken,
+		},
+		{
+			name: "token not stored keeps the approval",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT (.+) FROM device_authorizations`).
+					WillReturnRows(sqlmock.NewRows(columns).AddRow(1, model.DeviceStatusApproved, "cli", 7, now.Add(time.Minute), nil))
+				mock.ExpectExec(`UPDATE device_authorizations SET last_polled_at`).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE device_authorizations SET status`).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery(`INSERT INTO personal_access_tokens`).WillReturnError(sql.ErrConnDone)
+				mock.ExpectRollback()
+			},
+			wantErr: sql.ErrConnDone,
+		},
+		{
+			name: "approved authorization issues a token",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT (.+) FROM device_authorizations`).
+					WillReturnRows(sqlmock.NewRows(columns).AddRow(1, model.DeviceStatusApproved, "cli", 7, now.Add(time.Minute), nil))
+				mock.ExpectExec(`UPDATE device_authorizations SET last_polled_at`).WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectBegin()
+				mock.ExpectExec(`UPDATE device_authorizations SET status`).
+					WithArgs(model.DeviceStatusIssued, 1, model.DeviceStatusApproved).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery(`INSERT INTO personal_access_tokens`).
+					WithArgs(7, "cli", sqlmock.AnyArg(), "read,write", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+				mock.ExpectCommit()
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.SetupMockDB(t)
+			defer cleanup()
+			tt.mockSetup(mock)
+
+			rawToken, err := NewDeviceService(db).ExchangeDeviceCode("device-code")
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.Empty(t, rawToken)
+			} else {
+				require.NoError(t, err)
+				assert.True(t, strings.HasPrefix(rawToken, PersonalTokenPrefix))
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestDeviceService_PurgeExpired(t *testing.T) {
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	now := time.Now()
+	mock.ExpectExec(`DELETE FROM device_authorizations WHERE expires_at < \$1`).WithArgs(now).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	purged, err := NewDeviceService(db).PurgeExpired(now)
+	require.NoError(t, err)
+	assert.Equal(t, 2, purged)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
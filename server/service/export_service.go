@@ -0,0 +1,373 @@
+package service
+
+import (
+	"archive/zip"
+	"bufio"
+	"cito/server/model"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// exportBatchSize limits the messages read at once while exporting
+	exportBatchSize = 500
+	// ExportTTL is how long exports are kept for download
+	ExportTTL = 24 * time.Hour
+)
+
+var (
+	ErrExportInProgress    = errors.New("an export is already in progress")
+	ErrInvalidExportFormat = errors.New("export format must be ndjson or zip")
+	ErrExportNotReady      = errors.New("export is not ready")
+)
+
+// ExportService writes a user's conversations to a file in the background,
+// so large exports don't hold an HTTP request open. Messages are the only
+// thing exported: they have no attachments or reactions to carry along.
+type ExportService struct {
+	exports     ExportRepository
+	messages    MessageRepository
+	userService *UserService
+	dir         string
+	// wake starts pending exports without waiting for the next tick
+	wake chan struct{}
+	// mu keeps two rounds from writing the same export
+	mu sync.Mutex
+}
+
+// NewExportService returns a service writing export files to dir
+func NewExportService(exports ExportRepository, messages MessageRepository, userService *UserService, dir string) *ExportService {
+	return &ExportService{exports: exports, messages: messages, userService: userService, dir: dir, wake: make(chan struct{}, 1)}
+}
+
+// RequestExport queues an export of the user's messages in format. A user
+// has at most one export in progress.
+func (es *ExportService) RequestExport(userID int, format string) (*model.Export, error) {
+	if format != model.ExportFormatNDJSON && format != model.ExportFormatZip {
+		return nil, ErrInvalidExportFormat
+	}
+	export := &model.Export{UserID: userID, Format: format, Status: model.ExportStatusPending, CreatedAt: time.Now()}
+	if err := es.exports.CreateExport(export); err != nil {
+		return nil, err
+	}
+	select {
+	case es.wake <- struct{}{}:
+	default:
+	}
+
+	slog.Info("Export requested", "user_id", userID, "export_id", export.ID, "format", format)
+	return export, nil
+}
+
+// FindExport returns one of the user's exports
+func (es *ExportService) FindExport(userID int, exportID int) (*model.Export, error) {
+	return es.exports.FindExport(userID, exportID)
+}
+
+// ListExports returns the user's exports, latest first
+func (es *ExportService) ListExports(userID int) ([]model.Export, error) {
+	return es.exports.ListExports(userID)
+}
+
+// OpenExport opens the file of a finished export for download
+func (es *ExportService) OpenExport(userID int, exportID int) (*os.File, *model.Export, error) {
+	export, err := es.exports.FindExport(userID, exportID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if export.Status != model.ExportStatusDone {
+		return nil, nil, ErrExportNotReady
+	}
+	file, err := os.Open(es.path(*export))
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, export, nil
+}
+
+// RemoveExports deletes the files of the user's exports, ahead of deleting
+// their account
+func (es *ExportService) RemoveExports(userID int) error {
+	exports, err := es.exports.ListExports(userID)
+	if err != nil {
+		return err
+	}
+	for _, export := range exports {
+		es.removeFile(export)
+	}
+	return nil
+}
+
+// removeFile deletes the file of an export, if it was written
+func (es *ExportService) removeFile(export model.Export) {
+	if err := os.Remove(es.path(export)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Error("Failed to remove export file", "export_id", export.ID, "error", err)
+	}
+}
+
+// path is where the file of an export is written
+func (es *ExportService) path(export model.Export) string {
+	return filepath.Join(es.dir, fmt.Sprintf("export-%d.%s", export.ID, export.Format))
+}
+
+// ProcessExports writes every pending export, including those a restart
+// interrupted, and removes expired ones
+func (es *ExportService) ProcessExports(ctx context.Context) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	expired, err := es.exports.DeleteExportsBefore(time.Now().Add(-ExportTTL))
+	if err != nil {
+		return err
+	}
+	for _, export := range expired {
+		es.removeFile(export)
+	}
+
+	unfinished, err := es.exports.UnfinishedExports()
+	if err != nil {
+		return err
+	}
+	for _, export := range unfinished {
+		if err := es.write(ctx, &export); err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				// Left running to be picked up again after a restart
+				return ctxErr
+			}
+			slog.Error("Export failed", "user_id", export.UserID, "export_id", export.ID, "error", err)
+			if err := es.finish(&export, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := es.finish(&export, nil); err != nil {
+			return err
+		}
+		// The account may have been deleted while it was written
+		if _, err := es.exports.FindExport(export.UserID, export.ID); errors.Is(err, ErrExportNotFound) {
+			es.removeFile(export)
+			continue
+		}
+		slog.Info("Export done", "user_id", export.UserID, "export_id", export.ID, "messages", export.Exported)
+	}
+	return nil
+}
+
+// finish records the outcome of an export
+func (es *ExportService) finish(export *model.Export, exportErr error) error {
+	now := time.Now()
+	export.FinishedAt = &now
+	export.Status = model.ExportStatusDone
+	if exportErr != nil {
+		export.Status = model.ExportStatusFailed
+		export.Error = exportErr.Error()
+	}
+	return es.exports.UpdateExport(*export)
+}
+
+// write writes the export file, recording progress after every batch. The
+// file only gets its final name once complete.
+func (es *ExportService) write(ctx context.Context, export *model.Export) error {
+	total, err := es.messages.CountUserMessages(export.UserID)
+	if err != nil {
+		return err
+	}
+	export.Status = model.ExportStatusRunning
+	export.Total = total
+	export.Exported = 0
+	if err := es.exports.UpdateExport(*export); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(es.dir, 0o700); err != nil {
+		return err
+	}
+	path := es.path(*export)
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path + ".tmp")
+	defer file.Close()
+
+	writer, err := newMessageWriter(file, export.Format)
+	if err != nil {
+		return err
+	}
+	users := map[int]exportedUser{}
+	afterID := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		messages, err := es.messages.ListUserMessages(export.UserID, afterID, exportBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, message := range messages {
+			exported, err := es.exportedMessage(ctx, users, message)
+			if err != nil {
+				return err
+			}
+			if err := writer.Write(exported); err != nil {
+				return err
+			}
+			afterID = message.ID
+		}
+		if len(messages) == 0 {
+			break
+		}
+		export.Exported += len(messages)
+		if err := es.exports.UpdateExport(*export); err != nil {
+			return err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// exportedMessage adds the usernames of both ends to a message, looking each
+// user up once per export
+func (es *ExportService) exportedMessage(ctx context.Context, users map[int]exportedUser, message model.Message) (exportedMessage, error) {
+	for _, userID := range []int{message.FromUserID, message.ToUserId} {
+		if _, ok := users[userID]; ok {
+			continue
+		}
+		user, err := es.userService.FindUserByID(ctx, userID)
+		if err != nil {
+			return exportedMessage{}, err
+		}
+		users[userID] = exportedUser{ID: user.ID, Username: user.Username}
+	}
+	return exportedMessage{
+		ID:      message.ID,
+		From:    users[message.FromUserID],
+		To:      users[message.ToUserId],
+		Text:    message.TextContent,
+		SentAt:  message.Time.UTC(),
+		ReplyTo: message.ReplyToID,
+	}, nil
+}
+
+// Run writes requested exports as they come in, and every interval, until
+// ctx is done
+func (es *ExportService) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := es.ProcessExports(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("Processing exports failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-es.wake:
+		}
+	}
+}
+
+type exportedUser struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+}
+
+// exportedMessage is a message as written to exports
+type exportedMessage struct {
+	ID     int          `json:"id"`
+	From   exportedUser `json:"from"`
+	To     exportedUser `json:"to"`
+	Text   string       `json:"text"`
+	SentAt time.Time    `json:"sent_at"`
+	// ReplyTo is the first message of the thread of replies
+	ReplyTo int `json:"reply_to,omitempty"`
+}
+
+type messageWriter interface {
+	Write(message exportedMessage) error
+	Close() error
+}
+
+func newMessageWriter(w io.Writer, format string) (messageWriter, error) {
+	switch format {
+	case model.ExportFormatNDJSON:
+		buffered := bufio.NewWriter(w)
+		return &ndjsonWriter{buffered: buffered, encoder: json.NewEncoder(buffered)}, nil
+	case model.ExportFormatZip:
+		archive := zip.NewWriter(w)
+		mbox, err := archive.Create("messages.mbox")
+		if err != nil {
+			return nil, err
+		}
+		return &mboxWriter{archive: archive, mbox: mbox}, nil
+	}
+	return nil, ErrInvalidExportFormat
+}
+
+// ndjsonWriter writes one JSON object per line
+type ndjsonWriter struct {
+	buffered *bufio.Writer
+	encoder  *json.Encoder
+}
+
+func (nw *ndjsonWriter) Write(message exportedMessage) error {
+	return nw.encoder.Encode(message)
+}
+
+func (nw *ndjsonWriter) Close() error {
+	return nw.buffered.Flush()
+}
+
+// mboxWriter writes messages as mail in an mbox file inside a zip archive,
+// so that mail clients can open them
+type mboxWriter struct {
+	archive *zip.Writer
+	mbox    io.Writer
+}
+
+func (mw *mboxWriter) Write(message exportedMessage) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From %s %s\n", mboxAddress(message.From), message.SentAt.Format(time.ANSIC))
+	fmt.Fprintf(&b, "From: %s <%s>\n", message.From.Username, mboxAddress(message.From))
+	fmt.Fprintf(&b, "To: %s <%s>\n", message.To.Username, mboxAddress(message.To))
+	fmt.Fprintf(&b, "Date: %s\n", message.SentAt.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <message-%d@cito>\n", message.ID)
+	if message.ReplyTo != 0 {
+		fmt.Fprintf(&b, "In-Reply-To: <message-%d@cito>\n", message.ReplyTo)
+	}
+	b.WriteString("Content-Type: text/plain; charset=utf-8\n\n")
+	for _, line := range strings.Split(message.Text, "\n") {
+		// Lines looking like the start of the next message are quoted
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			line = ">" + line
+		}
+		b.WriteString(line + "\n")
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(mw.mbox, b.String())
+	return err
+}
+
+func (mw *mboxWriter) Close() error {
+	return mw.archive.Close()
+}
+
+// mboxAddress is the address standing for a user in mbox exports
+func mboxAddress(user exportedUser) string {
+	return fmt.Sprintf("user-%d@cito", user.ID)
+}
@@ -0,0 +1,155 @@
+package service
+
+import (
+	"archive/zip"
+	"bufio"
+	"cito/server/model"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"cito/server/testutil"
+)
+
+// newTestExportService returns a service writing to a temporary directory,
+// with users 1 to 3
+func newTestExportService(t *testing.T) (*ExportService, *MemoryRepository) {
+	mr := NewMemoryRepository()
+	for i := 1; i <= 3; i++ {
+		_, err := mr.UpsertIdentity(model.GitHubUser{ID: int64(i), Login: "user"}.Identity(), SealedToken{AccessToken: "token"}, time.Now())
+		require.NoError(t, err)
+	}
+	return NewExportService(mr, mr, NewUserService(mr, testutil.NewTestKeyring(t)), t.TempDir()), mr
+}
+
+func TestExportService_NDJSON(t *testing.T) {
+	es, mr := newTestExportService(t)
+	sendMessages(t, mr, 1, 2, time.Hour, exportBatchSize+1)
+	sendMessages(t, mr, 3, 1, time.Minute, 1)
+	sendMessages(t, mr, 2, 3, time.Minute, 1)
+
+	export, err := es.RequestExport(1, model.ExportFormatNDJSON)
+	require.NoError(t, err)
+	assert.Equal(t, model.ExportStatusPending, export.Status)
+	_, err = es.RequestExport(1, model.ExportFormatZip)
+	assert.ErrorIs(t, err, ErrExportInProgress)
+	_, _, err = es.OpenExport(1, export.ID)
+	assert.ErrorIs(t, err, ErrExportNotReady)
+
+	require.NoError(t, es.ProcessExports(context.Background()))
+	export, err = es.FindExport(1, export.ID)
+	require.NoError(t, err)
+	assert.Equal(t, model.ExportStatusDone, export.Status)
+	assert.Equal(t, exportBatchSize+2, export.Total)
+	assert.Equal(t, exportBatchSize+2, export.Exported)
+	assert.NotNil(t, export.FinishedAt)
+
+	file, _, err := es.OpenExport(1, export.ID)
+	require.NoError(t, err)
+	defer file.Close()
+	var messages []exportedMessage
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var message exportedMessage
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &message))
+		messages = append(messages, message)
+	}
+	require.NoError(t, scanner.Err())
+	require.Len(t, messages, exportBatchSize+2, "only the user's own conversations are exported")
+	last := messages[len(messages)-1]
+	assert.Equal(t, exportedUser{ID: 3, Username: "user"}, last.From)
+	assert.Equal(t, 1, last.To.ID)
+
+	_, err = es.FindExport(2, export.ID)
+	assert.ErrorIs(t, err, ErrExportNotFound, "exports are private to their user")
+}
+
+func TestExportService_Zip(t *testing.T) {
+	es, mr := newTestExportService(t)
+	require.NoError(t, mr.SaveMessage(&model.Message{FromUserID: 2, ToUserId: 1, TextContent: "hi\nFrom here on", Time: time.Now()}))
+
+	export, err := es.RequestExport(1, model.ExportFormatZip)
+	require.NoError(t, err)
+	require.NoError(t, es.ProcessExports(context.Background()))
+
+	file, export, err := es.OpenExport(1, export.ID)
+	require.NoError(t, err)
+	defer file.Close()
+	info, err := file.Stat()
+	require.NoError(t, err)
+	archive, err := zip.NewReader(file, info.Size())
+	require.NoError(t, err)
+	require.Len(t, archive.File, 1)
+	assert.Equal(t, "messages.mbox", archive.File[0].Name)
+	mbox, err := archive.File[0].Open()
+	require.NoError(t, err)
+	defer mbox.Close()
+	content, err := io.ReadAll(mbox)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "From: user <user-2@cito>\nTo: user <user-1@cito>\n")
+	assert.Contains(t, string(content), "\nhi\n>From here on\n", "body lines starting with From are quoted")
+	assert.Equal(t, 1, export.Exported)
+}
+
+func TestExportService_RequestExport(t *testing.T) {
+	es, _ := newTestExportService(t)
+
+	_, err := es.RequestExport(1, "csv")
+	assert.ErrorIs(t, err, ErrInvalidExportFormat)
+
+	export, err := es.RequestExport(1, model.ExportFormatNDJSON)
+	require.NoError(t, err)
+	_, err = es.RequestExport(2, model.ExportFormatNDJSON)
+	assert.NoError(t, err, "other users export at the same time")
+
+	require.NoError(t, es.ProcessExports(context.Background()))
+	_, err = es.RequestExport(1, model.ExportFormatNDJSON)
+	assert.NoError(t, err, "a new export can follow a finished one")
+
+	exports, err := es.ListExports(1)
+	require.NoError(t, err)
+	require.Len(t, exports, 2)
+	assert.Equal(t, export.ID, exports[1].ID, "latest first")
+}
+
+func TestExportService_ProcessExportsRemovesExpired(t *testing.T) {
+	es, mr := newTestExportService(t)
+	export, err := es.RequestExport(1, model.ExportFormatNDJSON)
+	require.NoError(t, err)
+	require.NoError(t, es.ProcessExports(context.Background()))
+	path := es.path(*export)
+	require.FileExists(t, path)
+
+	mr.exports[export.ID].CreatedAt = time.Now().Add(-ExportTTL - time.Minute)
+	require.NoError(t, es.ProcessExports(context.Background()))
+	_, err = es.FindExport(1, export.ID)
+	assert.ErrorIs(t, err, ErrExportNotFound)
+	_, err = os.Stat(path)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestExportService_ProcessExportsStopsWithContext(t *testing.T) {
+	es, mr := newTestExportService(t)
+	sendMessages(t, mr, 1, 2, time.Hour, 1)
+	export, err := es.RequestExport(1, model.ExportFormatNDJSON)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, es.ProcessExports(ctx), context.Canceled)
+	export, err = es.FindExport(1, export.ID)
+	require.NoError(t, err)
+	assert.Equal(t, model.ExportStatusRunning, export.Status, "interrupted exports resume on the next round")
+
+	require.NoError(t, es.ProcessExports(context.Background()))
+	export, err = es.FindExport(1, export.ID)
+	require.NoError(t, err)
+	assert.Equal(t, model.ExportStatusDone, export.Status)
+	assert.Equal(t, 1, export.Exported)
+}
@@ -0,0 +1,167 @@
+package service
+
+import (
+	"cito/server/logging"
+	"cito/server/model"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// DefaultGitHubAPIURL is the API of github.com
+const DefaultGitHubAPIURL = "https://api.github.com"
+
+// GitHubProvider signs users in with a GitHub OAuth app or GitHub App
+type GitHubProvider struct {
+	oauthConfig OAuth2TokenExchanger
+	httpClient  *http.Client
+	// apiURL is the GitHub API base URL, GitHub Enterprise servers and tests
+	// use their own
+	apiURL string
+}
+
+// NewGitHubProvider talks to the GitHub API at apiURL, DefaultGitHubAPIURL
+// when empty
+func NewGitHubProvider(oauthConfig OAuth2TokenExchanger, httpClient *http.Client, apiURL string) *GitHubProvider {
+	if apiURL == "" {
+		apiURL = DefaultGitHubAPIURL
+	}
+	return &GitHubProvider{oauthConfig: oauthConfig, httpClient: httpClient, apiURL: strings.TrimSuffix(apiURL, "/")}
+}
+
+func (gp *GitHubProvider) Name() string {
+	return model.ProviderGitHub
+}
+
+func (gp *GitHubProvider) DisplayName() string {
+	return "GitHub"
+}
+
+func (gp *GitHubProvider) AuthCodeURL(attempt LoginAttempt) string {
+	return gp.oauthConfig.AuthCodeURL(attempt.State, oauth2.S256ChallengeOption(attempt.Verifier))
+}
+
+func (gp *GitHubProvider) Exchange(ctx context.Context, code string, verifier string) (*oauth2.Token, error) {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, gp.client())
+	return gp.oauthConfig.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+}
+
+// FetchProfile ignores nonce, GitHub does not issue ID tokens
+func (gp *GitHubProvider) FetchProfile(ctx context.Context, token *oauth2.Token, nonce string) (*model.Identity, error) {
+	githubUser, err := gp.FetchGitHubUser(ctx, token.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	identity := githubUser.Identity()
+	return &identity, nil
+}
+
+// VerifyToken checks token against the GitHub API. Expiring user tokens of
+// GitHub Apps are refreshed first.
+func (gp *GitHubProvider) VerifyToken(ctx context.Context, token *oauth2.Token) (*oauth2.Token, error) {
+	if token.RefreshToken != "" && !token.Valid() {
+		refreshed, err := gp.oauthConfig.TokenSource(context.WithValue(ctx, oauth2.HTTPClient, gp.client()), token).Token()
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "bad_refresh_token" {
+			return nil, fmt.Errorf("%w: refresh token rejected", ErrTokenRevoked)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to refresh token: %w", err)
+		}
+		token = refreshed
+	}
+
+	var githubUser model.GitHubUser
+	if err := gp.getJSON(ctx, "/user", token.AccessToken, &githubUser); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (gp *GitHubProvider) client() *http.Client {
+	if gp.httpClient == nil {
+		return &http.Client{}
+	}
+	return gp.httpClient
+}
+
+// getJSON calls the GitHub API with accessToken and decodes the response
+// into v. A rejected token is reported as ErrTokenRevoked.
+func (gp *GitHubProvider) getJSON(ctx context.Context, path string, accessToken string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", gp.apiURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+
+	resp, err := gp.client().Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch user info: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("%w: GitHub API returned status %d", ErrTokenRevoked, resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GitHub API returned status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %w", err)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("failed to parse GitHub response: %w", err)
+	}
+	return nil
+}
+
+// FetchGitHubUserEmail returns the primary email of the user and whether
+// GitHub verified it
+func (gp *GitHubProvider) FetchGitHubUserEmail(ctx context.Context, accessToken string) (string, bool, error) {
+	type Email struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	var emails []Email
+	if err := gp.getJSON(ctx, "/user/emails", accessToken, &emails); err != nil {
+		return "", false, err
+	}
+	logging.FromContext(ctx).Info("GitHub emails fetched", "count", len(emails))
+
+	for _, email := range emails {
+		if email.Primary {
+			return email.Email, email.Verified, nil
+		}
+	}
+	return "", false, errors.New("No email found")
+}
+
+// FetchGitHubUser fetches user information from GitHub API
+func (gp *GitHubProvider) FetchGitHubUser(ctx context.Context, accessToken string) (*model.GitHubUser, error) {
+	var githubUser model.GitHubUser
+	if err := gp.getJSON(ctx, "/user", accessToken, &githubUser); err != nil {
+		return nil, err
+	}
+
+	// GitHub only lets users make a verified address their public email
+	githubUser.EmailVerified = githubUser.Email != ""
+	if githubUser.Email == "" {
+		var err error
+		githubUser.Email, githubUser.EmailVerified, err = gp.FetchGitHubUserEmail(ctx, accessToken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch Email: %w", err)
+		}
+	}
+
+	return &githubUser, nil
+}
@@ -0,0 +1,194 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"cito/server/testutil"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestGitHubProvider_AuthCodeURL_PKCE(t *testing.T) {
+	conf := &oauth2.Config{
+		ClientID: "client",
+		Endpoint: oauth2.Endpoint{AuthURL: "https://github.com/login/oauth/authorize"},
+	}
+	as := NewAuthService(NewGitHubProvider(conf, nil, ""))
+	provider, err := as.Provider("github")
+	require.NoError(t, err)
+
+	attempt := as.NewLoginAttempt()
+	require.NotEmpty(t, attempt.Verifier)
+	require.NotEmpty(t, attempt.State)
+	next := as.NewLoginAttempt()
+	assert.NotEqual(t, attempt.Verifier, next.Verifier, "verifiers should be unique")
+	assert.NotEqual(t, attempt.State, next.State, "states should be unique")
+	assert.NotEqual(t, attempt.Nonce, next.Nonce, "nonces should be unique")
+
+	loginURL, err := url.Parse(provider.AuthCodeURL(attempt))
+	require.NoError(t, err)
+	query := loginURL.Query()
+	assert.Equal(t, attempt.State, query.Get("state"))
+	assert.Equal(t, "S256", query.Get("code_challenge_method"))
+	assert.Equal(t, oauth2.S256ChallengeFromVerifier(attempt.Verifier), query.Get("code_challenge"))
+	assert.Empty(t, query.Get("code_verifier"), "verifier must never leave the server on the login URL")
+}
+
+func TestGitHubProvider_Exchange_PassesVerifier(t *testing.T) {
+	var gotOpts []oauth2.AuthCodeOption
+	mockOAuth := &testutil.MockOAuth2Config{
+		ExchangeFunc: func(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+			gotOpts = opts
+			return &oauth2.Token{AccessToken: "token"}, nil
+		},
+	}
+
+	tok, err := NewGitHubProvider(mockOAuth, nil, "").Exchange(context.Background(), "code", "verifier")
+	require.NoError(t, err)
+	assert.Equal(t, "token", tok.AccessToken)
+	assert.Len(t, gotOpts, 1, "code_verifier should be sent with the exchange")
+}
+
+// newFakeGitHub serves the token endpoint and GET /user of the GitHub API.
+// Only validToken is accepted, refreshing with "good_refresh" issues it.
+func newFakeGitHub(t *testing.T, userStatus int) (*httptest.Server, *oauth2.Config) {
+	const validToken = "valid_token"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "good_refresh" {
+			// GitHub reports a bad refresh token with a 200 response
+			json.NewEncoder(w).Encode(map[string]string{"error": "bad_refresh_token"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  validToken,
+			"refresh_token": "next_refresh",
+			"expires_in":    28800,
+			"token_type":    "bearer",
+		})
+	})
+	mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+		if userStatus != http.StatusOK {
+			w.WriteHeader(userStatus)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+validToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"id": 1, "login": "octocat", "email": "octocat@example.com"})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	conf := &oauth2.Config{
+		ClientID: "client",
+		Endpoint: oauth2.Endpoint{TokenURL: server.URL + "/login/oauth/access_token"},
+	}
+	return server, conf
+}
+
+func TestGitHubProvider_VerifyToken(t *testing.T) {
+	expired := time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name        string
+		token       *oauth2.Token
+		userStatus  int
+		wantToken   string
+		wantRefresh string
+		wantRevoked bool
+		wantErr     bool
+	}{
+		{name: "valid token", token: &oauth2.Token{AccessToken: "valid_token"}, userStatus: http.StatusOK, wantToken: "valid_token"},
+		{name: "revoked token", token: &oauth2.Token{AccessToken: "revoked_token"}, userStatus: http.StatusOK, wantRevoked: true},
+		{
+			name:        "expired token is refreshed",
+			token:       &oauth2.Token{AccessToken: "old_token", RefreshToken: "good_refresh", Expiry: expired},
+			userStatus:  http.StatusOK,
+			wantToken:   "valid_token",
+			wantRefresh: "next_refresh",
+		},
+		{
+			name:        "rejected refresh token",
+			token:       &oauth2.Token{AccessToken: "old_token", RefreshToken: "bad_refresh", Expiry: expired},
+			userStatus:  http.StatusOK,
+			wantRevoked: true,
+		},
+		{name: "GitHub outage", token: &oauth2.Token{AccessToken: "valid_token"}, userStatus: http.StatusBadGateway, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, conf := newFakeGitHub(t, tt.userStatus)
+			provider := NewGitHubProvider(conf, server.Client(), server.URL+"/")
+
+			token, err := provider.VerifyToken(context.Background(), tt.token)
+			switch {
+			case tt.wantRevoked:
+				assert.ErrorIs(t, err, ErrTokenRevoked)
+			case tt.wantErr:
+				require.Error(t, err)
+				assert.NotErrorIs(t, err, ErrTokenRevoked, "outages must not sign users out")
+			default:
+				require.NoError(t, err)
+				assert.Equal(t, tt.wantToken, token.AccessToken)
+				if tt.wantRefresh != "" {
+					assert.Equal(t, tt.wantRefresh, token.RefreshToken)
+					assert.True(t, token.Expiry.After(time.Now()))
+				}
+			}
+		})
+	}
+}
+
+func TestGitHubProvider_FetchGitHubUser_Email(t *testing.T) {
+	tests := []struct {
+		name         string
+		publicEmail  string
+		emails       string
+		wantEmail    string
+		wantVerified bool
+	}{
+		{name: "public email", publicEmail: "octocat@example.com", wantEmail: "octocat@example.com", wantVerified: true},
+		{
+			name:         "verified primary email",
+			emails:       `[{"email": "old@example.com", "verified": true}, {"email": "octocat@example.com", "primary": true, "verified": true}]`,
+			wantEmail:    "octocat@example.com",
+			wantVerified: true,
+		},
+		{
+			name:      "unverified primary email",
+			emails:    `[{"email": "octocat@example.com", "primary": true, "verified": false}]`,
+			wantEmail: "octocat@example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/user", func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(map[string]any{"id": 1, "login": "octocat", "email": tt.publicEmail})
+			})
+			mux.HandleFunc("/user/emails", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.emails))
+			})
+			server := httptest.NewServer(mux)
+			t.Cleanup(server.Close)
+
+			user, err := NewGitHubProvider(&oauth2.Config{}, server.Client(), server.URL+"/").FetchGitHubUser(context.Background(), "token")
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantEmail, user.Email)
+			assert.Equal(t, tt.wantVerified, user.EmailVerified)
+		})
+	}
+}
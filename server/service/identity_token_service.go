@@ -0,0 +1,141 @@
+package service
+
+import (
+	"cito/server/model"
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+const (
+	// TokenCheckInterval is how long a verified provider token is trusted
+	// before it is checked again
+	TokenCheckInterval = 6 * time.Hour
+	// tokenCheckBatchSize limits the provider API calls of one check round
+	tokenCheckBatchSize = 100
+	// tokenRetryDelay is how long a token whose check failed waits before
+	// it is checked again
+	tokenRetryDelay = 30 * time.Minute
+)
+
+// IdentityTokenService keeps the provider tokens stored on identities
+// usable. Tokens are verified with their provider, refreshed when they
+// expire, and a revoked authorization signs the account out everywhere so
+// the user has to sign in with the provider again.
+type IdentityTokenService struct {
+	authService    *AuthService
+	userService    *UserService
+	sessionService *SessionService
+	tokenService   *TokenService
+	// disconnectUser drops the live connections of a signed out account
+	disconnectUser func(userID int)
+}
+
+func NewIdentityTokenService(authService *AuthService, userService *UserService, sessionService *SessionService, tokenService *TokenService, disconnectUser func(userID int)) *IdentityTokenService {
+	return &IdentityTokenService{
+		authService:    authService,
+		userService:    userService,
+		sessionService: sessionService,
+		tokenService:   tokenService,
+		disconnectUser: disconnectUser,
+	}
+}
+
+// VerifyIdentity checks the token of one of userID's identities right away
+// and returns the identity's state afterwards
+func (its *IdentityTokenService) VerifyIdentity(ctx context.Context, userID int, identityID int) (*model.Identity, error) {
+	identityToken, err := its.userService.FindIdentityToken(ctx, userID, identityID)
+	if err != nil {
+		return nil, err
+	}
+	if identityToken.Token != nil {
+		if err := its.verify(ctx, *identityToken); err != nil {
+			return nil, err
+		}
+	}
+
+	identities, err := its.userService.ListIdentities(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, identity := range identities {
+		if identity.ID == identityID {
+			return &identity, nil
+		}
+	}
+	return nil, ErrIdentityNotFound
+}
+
+// VerifyStale checks the tokens that were not verified within
+// TokenCheckInterval and returns how many were checked
+func (its *IdentityTokenService) VerifyStale(ctx context.Context) (int, error) {
+	checked := 0
+	for _, provider := range its.authService.VerificationProviders() {
+		identityTokens, err := its.userService.IdentityTokensToVerify(ctx, provider, time.Now().Add(-TokenCheckInterval), tokenCheckBatchSize)
+		if err != nil {
+			return checked, err
+		}
+		for _, identityToken := range identityTokens {
+			if err := its.verify(ctx, identityToken); err != nil {
+				// Provider outages must not stop the round. The token is
+				// retried after tokenRetryDelay and meanwhile makes room
+				// for the rest of the queue.
+				slog.Warn("Failed to verify identity token", "error", err, "identity_id", identityToken.IdentityID, "provider", provider)
+				retryAt := time.Now().Add(tokenRetryDelay - TokenCheckInterval)
+				if err := its.userService.MarkIdentityChecked(ctx, identityToken.IdentityID, retryAt); err != nil {
+					return checked, err
+				}
+				continue
+			}
+			checked++
+		}
+	}
+	return checked, nil
+}
+
+// Run verifies stale tokens every interval until ctx is done
+func (its *IdentityTokenService) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if checked, err := its.VerifyStale(ctx); err != nil {
+			slog.Error("Identity token check failed", "error", err)
+		} else if checked > 0 {
+			slog.Info("Verified identity tokens", "count", checked)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// verify checks one token and stores the outcome
+func (its *IdentityTokenService) verify(ctx context.Context, identityToken IdentityToken) error {
+	token, err := its.authService.VerifyToken(ctx, identityToken.Provider, identityToken.Token)
+	if errors.Is(err, ErrTokenRevoked) {
+		return its.revoke(ctx, identityToken)
+	}
+	if err != nil {
+		return err
+	}
+	return its.userService.UpdateIdentityToken(ctx, identityToken.IdentityID, token)
+}
+
+// revoke marks the identity and signs its account out everywhere: its
+// sessions and personal access tokens end and its connections are dropped
+func (its *IdentityTokenService) revoke(ctx context.Context, identityToken IdentityToken) error {
+	if _, err := its.userService.MarkIdentityRevoked(ctx, identityToken.IdentityID); err != nil {
+		return err
+	}
+	if _, err := its.sessionService.RevokeAllSessions(identityToken.UserID); err != nil {
+		return err
+	}
+	if _, err := its.tokenService.RevokeAllTokens(identityToken.UserID); err != nil {
+		return err
+	}
+	its.disconnectUser(identityToken.UserID)
+	return nil
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"cito/server/keyring"
+	"cito/server/testutil"
+)
+
+func TestIdentityTokenService_VerifyStale(t *testing.T) {
+	server, conf := newFakeGitHub(t, http.StatusOK)
+	keys := testutil.NewTestKeyring(t)
+	validToken, err := keys.Encrypt("valid_token")
+	require.NoError(t, err)
+	revokedToken, err := keys.Encrypt("revoked_token")
+	require.NoError(t, err)
+
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	mock.ExpectQuery(`SELECT (.+) FROM identities WHERE provider = \$1`).
+		WithArgs("github", sqlmock.AnyArg(), tokenCheckBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "provider", "access_token", "refresh_token", "token_expires_at"}).
+			AddRow(1, 5, "github", validToken, nil, nil).
+			AddRow(2, 6, "github", revokedToken, nil, nil))
+	mock.ExpectExec(`UPDATE identities SET access_token`).
+		WithArgs(testutil.EncryptedArg{Keys: keys, Plaintext: "valid_token"}, nil, nil, sqlmock.AnyArg(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`UPDATE identities SET revoked_at (.+) WHERE id = \$2 AND revoked_at IS NULL`).
+		WithArgs(sqlmock.AnyArg(), 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "provider", "subject", "username", "email", "email_verified", "created_at", "revoked_at"}).
+			AddRow(2, 6, "github", "42", "octocat", "", false, time.Now(), time.Now()))
+	mock.ExpectQuery(`DELETE FROM sessions WHERE user_id = \$1 RETURNING id`).WithArgs(6).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(11).AddRow(12))
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE device_authorizations SET status = \$1 WHERE user_id = \$2 AND status = \$3`).
+		WithArgs("denied", 6, "approved").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`DELETE FROM personal_access_tokens WHERE user_id = \$1 RETURNING id`).WithArgs(6).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectCommit()
+
+	var disconnected []int
+	authService := NewAuthService(NewGitHubProvider(conf, server.Client(), server.URL))
+	its := NewIdentityTokenService(authService, NewUserService(NewPostgresRepository(db), keys), NewSessionService(NewPostgresRepository(db)), NewTokenService(db), func(userID int) {
+		disconnected = append(disconnected, userID)
+	})
+
+	checked, err := its.VerifyStale(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, checked)
+	assert.Equal(t, []int{6}, disconnected, "connections of the revoked account are dropped")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestIdentityTokenService_VerifyStale_ProviderOutage(t *testing.T) {
+	server, conf := newFakeGitHub(t, http.StatusServiceUnavailable)
+	keys := testutil.NewTestKeyring(t)
+	token, err := keys.Encrypt("valid_token")
+	require.NoError(t, err)
+
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	mock.ExpectQuery(`SELECT (.+) FROM identities WHERE provider = \$1`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "provider", "access_token", "refresh_token", "token_expires_at"}).
+			AddRow(1, 5, "github", token, nil, nil))
+	mock.ExpectExec(`UPDATE identities SET token_checked_at = \$1 WHERE id = \$2`).
+		WithArgs(retryAfter{time.Now().Add(tokenRetryDelay - TokenCheckInterval)}, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	authService := NewAuthService(NewGitHubProvider(conf, server.Client(), server.URL))
+	its := NewIdentityTokenService(authService, NewUserService(NewPostgresRepository(db), keys), NewSessionService(NewPostgresRepository(db)), NewTokenService(db), func(int) {
+		t.Fatal("no account may be signed out during an outage")
+	})
+
+	checked, err := its.VerifyStale(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, checked)
+	assert.NoError(t, mock.ExpectationsWereMet(), "the token is left as is and retried later")
+}
+
+func TestIdentityTokenService_VerifyStale_UndecryptableToken(t *testing.T) {
+	server, conf := newFakeGitHub(t, http.StatusOK)
+	keys := testutil.NewTestKeyring(t)
+	validToken, err := keys.Encrypt("valid_token")
+	require.NoError(t, err)
+	retiredKeys, err := keyring.New(2, map[int][]byte{2: bytes.Repeat([]byte{0x43}, keyring.KeySize)})
+	require.NoError(t, err)
+	lostToken, err := retiredKeys.Encrypt("lost_token")
+	require.NoError(t, err)
+
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	mock.ExpectQuery(`SELECT (.+) FROM identities WHERE provider = \$1`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "provider", "access_token", "refresh_token", "token_expires_at"}).
+			AddRow(1, 5, "github", lostToken, nil, nil).
+			AddRow(2, 6, "github", validToken, nil, nil))
+	mock.ExpectExec(`UPDATE identities SET token_checked_at = \$1 WHERE id = \$2`).
+		WithArgs(sqlmock.AnyArg(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE identities SET access_token`).
+		WithArgs(testutil.EncryptedArg{Keys: keys, Plaintext: "valid_token"}, nil, nil, sqlmock.AnyArg(), 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	authService := NewAuthService(NewGitHubProvider(conf, server.Client(), server.URL))
+	its := NewIdentityTokenService(authService, NewUserService(NewPostgresRepository(db), keys), NewSessionService(NewPostgresRepository(db)), NewTokenService(db), func(int) {
+		t.Fatal("an undecryptable token must not sign the account out")
+	})
+
+	checked, err := its.VerifyStale(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, checked, "the undecryptable token doesn't hold up the batch")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+// retryAfter matches a check time that makes a token due again about
+// tokenRetryDelay from now
+type retryAfter struct {
+	want time.Time
+}
+
+func (r retryAfter) Match(v driver.Value) bool {
+	got, ok := v.(time.Time)
+	return ok && got.Sub(r.want).Abs() < time.Minute
+}
@@ -0,0 +1,1101 @@
+package service
+
+import (
+	"cito/server/model"
+	"errors"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryRepository implements Repository in memory. Nothing survives a
+// restart, it backs tests and local experiments.
+type MemoryRepository struct {
+	mu         sync.Mutex
+	users      map[int]model.UserModel
+	identities map[int]*memoryIdentity
+	sessions   map[int]*memorySession
+	messages   []model.Message
+	policies   map[model.Conversation]model.RetentionPolicy
+	archived   []model.Message
+	purgeRuns  []model.PurgeRun
+	exports    map[int]*model.Export
+	rooms      map[int]model.Room
+	// roomMembers holds the member IDs per room ID
+	roomMembers  map[int]map[int]bool
+	roomMessages []model.Message
+	// importedUsers, importedMessages, importedRooms and
+	// importedRoomMessages map external IDs to stored ones
+	importedUsers        map[importKey]model.ImportedUser
+	importedMessages     map[importKey]int
+	importedRooms        map[importKey]int
+	importedRoomMessages map[importKey]int
+	// lastID holds the last ID handed out per table
+	lastID struct{ user, identity, session, message, purgeRun, export, room, roomMessage int }
+}
+
+type importKey struct{ source, externalID string }
+
+type memoryIdentity struct {
+	identity  model.Identity
+	token     *SealedToken
+	checkedAt time.Time
+}
+
+type memorySession struct {
+	session           model.SessionModel
+	tokenHash         string
+	previousTokenHash string
+	rotatedAt         time.Time
+}
+
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		users:      make(map[int]model.UserModel),
+		identities: make(map[int]*memoryIdentity),
+		sessions:   make(map[int]*memorySession),
+		policies:   make(map[model.Conversation]model.RetentionPolicy),
+		exports:    make(map[int]*model.Export),
+		rooms:      make(map[int]model.Room),
+
+		roomMembers:          make(map[int]map[int]bool),
+		importedUsers:        make(map[importKey]model.ImportedUser),
+		importedMessages:     make(map[importKey]int),
+		importedRooms:        make(map[importKey]int),
+		importedRoomMessages: make(map[importKey]int),
+	}
+}
+
+// identityBySubject returns the identity with provider and subject, if any
+func (mr *MemoryRepository) identityBySubject(provider string, subject string) *memoryIdentity {
+	for _, stored := range mr.identities {
+		if stored.identity.Provider == provider && stored.identity.Subject == subject {
+			return stored
+		}
+	}
+	return nil
+}
+
+// update refreshes the profile and token of a stored identity
+func (stored *memoryIdentity) update(identity model.Identity, token SealedToken, now time.Time) {
+	stored.identity.Username = identity.Username
+	stored.identity.Email = identity.Email
+	stored.identity.EmailVerified = identity.EmailVerified
+	stored.identity.RevokedAt = nil
+	stored.token = &token
+	stored.checkedAt = now
+}
+
+// addIdentity stores a new identity of userID
+func (mr *MemoryRepository) addIdentity(userID int, identity model.Identity, token SealedToken, now time.Time) {
+	mr.lastID.identity++
+	identity.ID = mr.lastID.identity
+	identity.UserID = userID
+	identity.CreatedAt = now
+	identity.RevokedAt = nil
+	mr.identities[identity.ID] = &memoryIdentity{identity: identity, token: &token, checkedAt: now}
+}
+
+func (mr *MemoryRepository) UpsertIdentity(identity model.Identity, token SealedToken, now time.Time) (int, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if stored := mr.identityBySubject(identity.Provider, identity.Subject); stored != nil {
+		stored.update(identity, token, now)
+		return stored.identity.UserID, nil
+	}
+	userID, claimed := mr.claimPlaceholder(identity)
+	if !claimed {
+		mr.lastID.user++
+		userID = mr.lastID.user
+	}
+	mr.users[userID] = model.UserModel{ID: userID, Username: identity.Username, Email: identity.Email}
+	mr.addIdentity(userID, identity, token, now)
+	return userID, nil
+}
+
+// claimPlaceholder returns the oldest imported placeholder with the verified
+// email of identity, which becomes its account, and clears its suggested
+// users
+func (mr *MemoryRepository) claimPlaceholder(identity model.Identity) (int, bool) {
+	if !identity.EmailVerified || identity.Email == "" {
+		return 0, false
+	}
+	userID := 0
+	for _, imported := range mr.importedUsers {
+		user := mr.users[imported.UserID]
+		if strings.EqualFold(user.Email, identity.Email) && !mr.hasIdentities(user.ID) && (userID == 0 || user.ID < userID) {
+			userID = user.ID
+		}
+	}
+	if userID == 0 {
+		return 0, false
+	}
+	for key, imported := range mr.importedUsers {
+		if imported.UserID == userID {
+			imported.SuggestedUserID = 0
+			mr.importedUsers[key] = imported
+		}
+	}
+	return userID, true
+}
+
+// hasIdentities reports whether userID can sign in
+func (mr *MemoryRepository) hasIdentities(userID int) bool {
+	for _, stored := range mr.identities {
+		if stored.identity.UserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+func (mr *MemoryRepository) LinkIdentity(userID int, identity model.Identity, token SealedToken, now time.Time) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if _, ok := mr.users[userID]; !ok {
+		return ErrUserNotFound
+	}
+	stored := mr.identityBySubject(identity.Provider, identity.Subject)
+	if stored == nil {
+		mr.addIdentity(userID, identity, token, now)
+		return nil
+	}
+	if stored.identity.UserID != userID {
+		return ErrIdentityConflict
+	}
+	stored.update(identity, token, now)
+	return nil
+}
+
+// storedToken returns a copy of the token of an identity
+func (stored *memoryIdentity) storedToken() StoredIdentityToken {
+	identityToken := StoredIdentityToken{
+		IdentityID: stored.identity.ID,
+		UserID:     stored.identity.UserID,
+		Provider:   stored.identity.Provider,
+	}
+	if stored.token != nil {
+		token := *stored.token
+		identityToken.Token = &token
+	}
+	return identityToken
+}
+
+func (mr *MemoryRepository) FindIdentityToken(userID int, identityID int) (*StoredIdentityToken, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	stored, ok := mr.identities[identityID]
+	if !ok || stored.identity.UserID != userID {
+		return nil, ErrIdentityNotFound
+	}
+	identityToken := stored.storedToken()
+	return &identityToken, nil
+}
+
+func (mr *MemoryRepository) IdentityTokensToVerify(provider string, checkedBefore time.Time, limit int) ([]StoredIdentityToken, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	var due []*memoryIdentity
+	for _, stored := range mr.identities {
+		if stored.identity.Provider == provider && stored.token != nil && stored.checkedAt.Before(checkedBefore) {
+			due = append(due, stored)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].checkedAt.Equal(due[j].checkedAt) {
+			return due[i].checkedAt.Before(due[j].checkedAt)
+		}
+		return due[i].identity.ID < due[j].identity.ID
+	})
+
+	identityTokens := []StoredIdentityToken{}
+	for _, stored := range due {
+		if len(identityTokens) == limit {
+			break
+		}
+		identityTokens = append(identityTokens, stored.storedToken())
+	}
+	return identityTokens, nil
+}
+
+func (mr *MemoryRepository) UpdateIdentityToken(identityID int, token SealedToken, checkedAt time.Time) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if stored, ok := mr.identities[identityID]; ok {
+		stored.token = &token
+		stored.checkedAt = checkedAt
+	}
+	return nil
+}
+
+func (mr *MemoryRepository) MarkIdentityChecked(identityID int, checkedAt time.Time) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if stored, ok := mr.identities[identityID]; ok {
+		stored.checkedAt = checkedAt
+	}
+	return nil
+}
+
+func (mr *MemoryRepository) ResealTokens(reseal func(stored string) (string, bool, error)) (int, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	count := 0
+	for _, stored := range mr.identities {
+		if stored.token == nil {
+			continue
+		}
+		token := *stored.token
+		for _, field := range []*string{&token.AccessToken, &token.RefreshToken} {
+			if *field == "" {
+				continue
+			}
+			resealed, changed, err := reseal(*field)
+			if err != nil {
+				return count, err
+			}
+			if changed {
+				*field = resealed
+				count++
+			}
+		}
+		stored.token = &token
+	}
+	return count, nil
+}
+
+func (mr *MemoryRepository) MarkIdentityRevoked(identityID int, now time.Time) (*model.Identity, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	stored, ok := mr.identities[identityID]
+	if !ok || stored.identity.RevokedAt != nil {
+		return nil, ErrIdentityNotFound
+	}
+	stored.identity.RevokedAt = &now
+	stored.token = nil
+	identity := stored.identity
+	return &identity, nil
+}
+
+func (mr *MemoryRepository) ListIdentities(userID int) ([]model.Identity, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	identities := []model.Identity{}
+	for _, stored := range mr.identities {
+		if stored.identity.UserID == userID {
+			identities = append(identities, stored.identity)
+		}
+	}
+	sort.Slice(identities, func(i, j int) bool {
+		if !identities[i].CreatedAt.Equal(identities[j].CreatedAt) {
+			return identities[i].CreatedAt.Before(identities[j].CreatedAt)
+		}
+		return identities[i].ID < identities[j].ID
+	})
+	return identities, nil
+}
+
+func (mr *MemoryRepository) UnlinkIdentity(userID int, identityID int) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	stored, ok := mr.identities[identityID]
+	if !ok || stored.identity.UserID != userID {
+		return ErrIdentityNotFound
+	}
+	count := 0
+	for _, other := range mr.identities {
+		if other.identity.UserID == userID {
+			count++
+		}
+	}
+	if count <= 1 {
+		return ErrLastIdentity
+	}
+	delete(mr.identities, identityID)
+	return nil
+}
+
+func (mr *MemoryRepository) FindUserByID(userID int) (*model.UserModel, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	user, ok := mr.users[userID]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return &user, nil
+}
+
+func (mr *MemoryRepository) FindUserByEmail(email string, verified bool) (*model.UserModel, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	var found *model.UserModel
+	for _, stored := range mr.identities {
+		identity := stored.identity
+		if email == "" || !strings.EqualFold(identity.Email, email) || identity.EmailVerified != verified {
+			continue
+		}
+		if user, ok := mr.users[identity.UserID]; ok && (found == nil || user.ID < found.ID) {
+			found = &user
+		}
+	}
+	if found == nil {
+		return nil, ErrUserNotFound
+	}
+	return found, nil
+}
+
+func (mr *MemoryRepository) CreateUser(username string, email string) (int, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	mr.lastID.user++
+	userID := mr.lastID.user
+	mr.users[userID] = model.UserModel{ID: userID, Username: username, Email: email}
+	return userID, nil
+}
+
+func (mr *MemoryRepository) DeleteUser(userID int, placeholder string) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if err := mr.anonymizeUser(userID, ""); err != nil {
+		return err
+	}
+	delete(mr.users, userID)
+	received := func(message model.Message) bool {
+		return message.ToUserId == userID && message.FromUserID != userID
+	}
+	if slices.ContainsFunc(mr.messages, received) || slices.ContainsFunc(mr.archived, received) {
+		mr.lastID.user++
+		placeholderID := mr.lastID.user
+		mr.users[placeholderID] = model.UserModel{ID: placeholderID, Username: placeholder}
+		for _, messages := range [][]model.Message{mr.messages, mr.archived} {
+			for i := range messages {
+				if received(messages[i]) {
+					messages[i].ToUserId = placeholderID
+				}
+			}
+		}
+		for conversation, policy := range mr.policies {
+			otherUserID := conversation.UserID
+			if otherUserID == userID {
+				otherUserID = conversation.OtherUserID
+			}
+			if otherUserID != userID && (conversation.UserID == userID || conversation.OtherUserID == userID) {
+				delete(mr.policies, conversation)
+				mr.policies[model.NewConversation(otherUserID, placeholderID)] = policy
+			}
+		}
+	}
+	involved := func(message model.Message) bool {
+		return message.FromUserID == userID || message.ToUserId == userID
+	}
+	mr.messages = slices.DeleteFunc(mr.messages, func(message model.Message) bool {
+		if !involved(message) {
+			return false
+		}
+		forgetImportedMessage(mr.importedMessages, message.ID)
+		return true
+	})
+	mr.archived = slices.DeleteFunc(mr.archived, involved)
+	mr.roomMessages = slices.DeleteFunc(mr.roomMessages, func(message model.Message) bool {
+		if message.FromUserID != userID {
+			return false
+		}
+		forgetImportedMessage(mr.importedRoomMessages, message.ID)
+		return true
+	})
+	for conversation := range mr.policies {
+		if conversation.UserID == userID || conversation.OtherUserID == userID {
+			delete(mr.policies, conversation)
+		}
+	}
+	return nil
+}
+
+func (mr *MemoryRepository) AnonymizeUser(userID int, username string) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	return mr.anonymizeUser(userID, username)
+}
+
+// anonymizeUser removes what the memory repository keeps about a user
+// besides their row and messages
+func (mr *MemoryRepository) anonymizeUser(userID int, username string) error {
+	user, ok := mr.users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	mr.users[userID] = model.UserModel{ID: user.ID, Username: username}
+	maps.DeleteFunc(mr.identities, func(_ int, stored *memoryIdentity) bool { return stored.identity.UserID == userID })
+	maps.DeleteFunc(mr.sessions, func(_ int, stored *memorySession) bool { return stored.session.UserID == userID })
+	maps.DeleteFunc(mr.exports, func(_ int, export *model.Export) bool { return export.UserID == userID })
+	maps.DeleteFunc(mr.importedUsers, func(_ importKey, imported model.ImportedUser) bool { return imported.UserID == userID })
+	for _, members := range mr.roomMembers {
+		delete(members, userID)
+	}
+	for key, imported := range mr.importedUsers {
+		if imported.SuggestedUserID == userID {
+			imported.SuggestedUserID = 0
+			mr.importedUsers[key] = imported
+		}
+	}
+	return nil
+}
+
+func (mr *MemoryRepository) FindUserBySession(tokenHash string, now time.Time, rotatedAfter time.Time) (*model.UserModel, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	for _, stored := range mr.sessions {
+		matches := stored.tokenHash == tokenHash ||
+			(stored.previousTokenHash == tokenHash && stored.rotatedAt.After(rotatedAfter))
+		if !matches || !stored.session.ExpiresAt.After(now) {
+			continue
+		}
+		user, ok := mr.users[stored.session.UserID]
+		if !ok {
+			break
+		}
+		user.SessionID = stored.session.ID
+		return &user, nil
+	}
+	return nil, ErrUserNotFound
+}
+
+func (mr *MemoryRepository) CreateSession(session model.SessionModel, tokenHash string) (int, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if _, ok := mr.users[session.UserID]; !ok {
+		return 0, ErrUserNotFound
+	}
+	for _, stored := range mr.sessions {
+		if stored.tokenHash == tokenHash {
+			return 0, errors.New("duplicate session token")
+		}
+	}
+	mr.lastID.session++
+	session.ID = mr.lastID.session
+	session.LastSeenAt = session.CreatedAt
+	mr.sessions[session.ID] = &memorySession{session: session, tokenHash: tokenHash, rotatedAt: session.CreatedAt}
+	return session.ID, nil
+}
+
+func (mr *MemoryRepository) RenewSession(sessionID int, now time.Time, expiresAt time.Time, seenBefore time.Time) (time.Time, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	stored, ok := mr.sessions[sessionID]
+	if !ok || !stored.session.LastSeenAt.Before(seenBefore) {
+		return time.Time{}, ErrSessionNotFound
+	}
+	stored.session.LastSeenAt = now
+	stored.session.ExpiresAt = expiresAt
+	return stored.rotatedAt, nil
+}
+
+func (mr *MemoryRepository) RotateSession(sessionID int, tokenHash string, now time.Time) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if stored, ok := mr.sessions[sessionID]; ok {
+		stored.previousTokenHash = stored.tokenHash
+		stored.tokenHash = tokenHash
+		stored.rotatedAt = now
+	}
+	return nil
+}
+
+func (mr *MemoryRepository) DeleteSession(sessionID int) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	delete(mr.sessions, sessionID)
+	return nil
+}
+
+func (mr *MemoryRepository) ListSessions(userID int, now time.Time) ([]model.SessionModel, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	sessions := []model.SessionModel{}
+	for _, stored := range mr.sessions {
+		if stored.session.UserID == userID && stored.session.ExpiresAt.After(now) {
+			sessions = append(sessions, stored.session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt) })
+	return sessions, nil
+}
+
+func (mr *MemoryRepository) DeleteUserSession(userID int, sessionID int) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	stored, ok := mr.sessions[sessionID]
+	if !ok || stored.session.UserID != userID {
+		return ErrSessionNotFound
+	}
+	delete(mr.sessions, sessionID)
+	return nil
+}
+
+func (mr *MemoryRepository) DeleteOtherSessions(userID int, keepSessionID int) ([]int, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	return mr.deleteSessions(func(session model.SessionModel) bool {
+		return session.UserID == userID && session.ID != keepSessionID
+	}), nil
+}
+
+func (mr *MemoryRepository) DeleteAllSessions(userID int) ([]int, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	return mr.deleteSessions(func(session model.SessionModel) bool { return session.UserID == userID }), nil
+}
+
+// deleteSessions deletes the matching sessions and returns their IDs in
+// order
+func (mr *MemoryRepository) deleteSessions(match func(session model.SessionModel) bool) []int {
+	deleted := []int{}
+	for sessionID, stored := range mr.sessions {
+		if match(stored.session) {
+			delete(mr.sessions, sessionID)
+			deleted = append(deleted, sessionID)
+		}
+	}
+	sort.Ints(deleted)
+	return deleted
+}
+
+func (mr *MemoryRepository) SaveMessage(message *model.Message) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	mr.saveMessage(message)
+	return nil
+}
+
+func (mr *MemoryRepository) saveMessage(message *model.Message) {
+	mr.lastID.message++
+	message.ID = mr.lastID.message
+	mr.messages = append(mr.messages, *message)
+}
+
+func (mr *MemoryRepository) ListConversation(userID int, otherUserID int, before time.Time, limit int) ([]model.Message, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	messages := []model.Message{}
+	for _, message := range mr.messages {
+		between := (message.FromUserID == userID && message.ToUserId == otherUserID) ||
+			(message.FromUserID == otherUserID && message.ToUserId == userID)
+		if between && message.Time.Before(before) {
+			messages = append(messages, message)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if !messages[i].Time.Equal(messages[j].Time) {
+			return messages[i].Time.After(messages[j].Time)
+		}
+		return messages[i].ID > messages[j].ID
+	})
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+func (mr *MemoryRepository) ListUserMessages(userID int, afterID int, limit int) ([]model.Message, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	// Archived messages keep their ID, both lists are merged in ID order
+	messages := []model.Message{}
+	for _, stored := range [][]model.Message{mr.messages, mr.archived} {
+		for _, message := range stored {
+			if (message.FromUserID == userID || message.ToUserId == userID) && message.ID > afterID {
+				messages = append(messages, message)
+			}
+		}
+	}
+	slices.SortFunc(messages, func(a, b model.Message) int { return a.ID - b.ID })
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+func (mr *MemoryRepository) CountUserMessages(userID int) (int, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	count := 0
+	for _, stored := range [][]model.Message{mr.messages, mr.archived} {
+		for _, message := range stored {
+			if message.FromUserID == userID || message.ToUserId == userID {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+func (mr *MemoryRepository) CreateRoom(room *model.Room) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	mr.lastID.room++
+	room.ID = mr.lastID.room
+	mr.rooms[room.ID] = *room
+	mr.roomMembers[room.ID] = make(map[int]bool)
+	return nil
+}
+
+func (mr *MemoryRepository) AddRoomMember(roomID int, userID int) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	members, ok := mr.roomMembers[roomID]
+	if !ok {
+		return ErrRoomNotFound
+	}
+	if _, ok := mr.users[userID]; !ok {
+		return ErrUserNotFound
+	}
+	members[userID] = true
+	return nil
+}
+
+func (mr *MemoryRepository) ListRooms(userID int) ([]model.Room, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	rooms := []model.Room{}
+	for roomID, members := range mr.roomMembers {
+		if members[userID] {
+			rooms = append(rooms, mr.rooms[roomID])
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		if rooms[i].Name != rooms[j].Name {
+			return rooms[i].Name < rooms[j].Name
+		}
+		return rooms[i].ID < rooms[j].ID
+	})
+	return rooms, nil
+}
+
+func (mr *MemoryRepository) ListRoomMembers(roomID int) ([]int, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	members := slices.Collect(maps.Keys(mr.roomMembers[roomID]))
+	sort.Ints(members)
+	return members, nil
+}
+
+func (mr *MemoryRepository) SaveRoomMessage(message *model.Message) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if !mr.roomMembers[message.RoomID][message.FromUserID] {
+		return ErrRoomNotFound
+	}
+	mr.saveRoomMessage(message)
+	return nil
+}
+
+func (mr *MemoryRepository) saveRoomMessage(message *model.Message) {
+	mr.lastID.roomMessage++
+	message.ID = mr.lastID.roomMessage
+	mr.roomMessages = append(mr.roomMessages, *message)
+}
+
+func (mr *MemoryRepository) ListRoomMessages(roomID int, before time.Time, limit int) ([]model.Message, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	messages := []model.Message{}
+	for _, message := range mr.roomMessages {
+		if message.RoomID == roomID && message.Time.Before(before) {
+			messages = append(messages, message)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if !messages[i].Time.Equal(messages[j].Time) {
+			return messages[i].Time.After(messages[j].Time)
+		}
+		return messages[i].ID > messages[j].ID
+	})
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+func (mr *MemoryRepository) SetRetentionPolicy(conversation model.Conversation, policy model.RetentionPolicy, now time.Time) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if _, ok := mr.users[conversation.UserID]; !ok {
+		return ErrUserNotFound
+	}
+	if _, ok := mr.users[conversation.OtherUserID]; !ok {
+		return ErrUserNotFound
+	}
+	mr.policies[conversation] = policy
+	return nil
+}
+
+func (mr *MemoryRepository) DeleteRetentionPolicy(conversation model.Conversation) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if _, ok := mr.policies[conversation]; !ok {
+		return ErrRetentionPolicyNotFound
+	}
+	delete(mr.policies, conversation)
+	return nil
+}
+
+func (mr *MemoryRepository) RetentionPolicies() (map[model.Conversation]model.RetentionPolicy, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	policies := make(map[model.Conversation]model.RetentionPolicy, len(mr.policies))
+	for conversation, policy := range mr.policies {
+		policies[conversation] = policy
+	}
+	return policies, nil
+}
+
+func (mr *MemoryRepository) ListConversations() ([]model.Conversation, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	seen := make(map[model.Conversation]bool)
+	conversations := []model.Conversation{}
+	for _, message := range mr.messages {
+		conversation := model.NewConversation(message.FromUserID, message.ToUserId)
+		if !seen[conversation] {
+			seen[conversation] = true
+			conversations = append(conversations, conversation)
+		}
+	}
+	sort.Slice(conversations, func(i, j int) bool {
+		if conversations[i].UserID != conversations[j].UserID {
+			return conversations[i].UserID < conversations[j].UserID
+		}
+		return conversations[i].OtherUserID < conversations[j].OtherUserID
+	})
+	return conversations, nil
+}
+
+func (mr *MemoryRepository) PurgeMessages(conversation *model.Conversation, before time.Time, archive bool, limit int, now time.Time) (int, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	// Messages are appended in ID order
+	kept := mr.messages[:0]
+	purged := 0
+	for _, message := range mr.messages {
+		messageConversation := model.NewConversation(message.FromUserID, message.ToUserId)
+		_, override := mr.policies[messageConversation]
+		expired := message.Time.Before(before) && purged < limit &&
+			((conversation == nil && !override) || (conversation != nil && messageConversation == *conversation))
+		if !expired {
+			kept = append(kept, message)
+			continue
+		}
+		if archive {
+			mr.archived = append(mr.archived, message)
+		}
+		forgetImportedMessage(mr.importedMessages, message.ID)
+		purged++
+	}
+	mr.messages = kept
+	return purged, nil
+}
+
+func (mr *MemoryRepository) SavePurgeRun(run *model.PurgeRun) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	mr.lastID.purgeRun++
+	run.ID = mr.lastID.purgeRun
+	mr.purgeRuns = append(mr.purgeRuns, *run)
+	return nil
+}
+
+func (mr *MemoryRepository) ListPurgeRuns(limit int) ([]model.PurgeRun, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	runs := []model.PurgeRun{}
+	for i := len(mr.purgeRuns) - 1; i >= 0 && len(runs) < limit; i-- {
+		runs = append(runs, mr.purgeRuns[i])
+	}
+	return runs, nil
+}
+
+func (mr *MemoryRepository) CreateExport(export *model.Export) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if _, ok := mr.users[export.UserID]; !ok {
+		return ErrUserNotFound
+	}
+	for _, stored := range mr.exports {
+		if stored.UserID == export.UserID && !stored.Finished() {
+			return ErrExportInProgress
+		}
+	}
+	mr.lastID.export++
+	export.ID = mr.lastID.export
+	stored := *export
+	mr.exports[export.ID] = &stored
+	return nil
+}
+
+func (mr *MemoryRepository) FindExport(userID int, exportID int) (*model.Export, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	stored, ok := mr.exports[exportID]
+	if !ok || stored.UserID != userID {
+		return nil, ErrExportNotFound
+	}
+	export := *stored
+	return &export, nil
+}
+
+// sortedExports returns the exports matching keep in ID order
+func (mr *MemoryRepository) sortedExports(keep func(export *model.Export) bool) []model.Export {
+	exports := []model.Export{}
+	for _, export := range mr.exports {
+		if keep(export) {
+			exports = append(exports, *export)
+		}
+	}
+	sort.Slice(exports, func(i, j int) bool { return exports[i].ID < exports[j].ID })
+	return exports
+}
+
+func (mr *MemoryRepository) ListExports(userID int) ([]model.Export, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	exports := mr.sortedExports(func(export *model.Export) bool { return export.UserID == userID })
+	sort.SliceStable(exports, func(i, j int) bool { return exports[i].ID > exports[j].ID })
+	return exports, nil
+}
+
+func (mr *MemoryRepository) UnfinishedExports() ([]model.Export, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	return mr.sortedExports(func(export *model.Export) bool { return !export.Finished() }), nil
+}
+
+func (mr *MemoryRepository) UpdateExport(export model.Export) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	stored, ok := mr.exports[export.ID]
+	if !ok {
+		return nil
+	}
+	stored.Status = export.Status
+	stored.Exported = export.Exported
+	stored.Total = export.Total
+	stored.Error = export.Error
+	stored.FinishedAt = export.FinishedAt
+	return nil
+}
+
+func (mr *MemoryRepository) DeleteExportsBefore(before time.Time) ([]model.Export, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	deleted := mr.sortedExports(func(export *model.Export) bool { return export.CreatedAt.Before(before) })
+	for _, export := range deleted {
+		delete(mr.exports, export.ID)
+	}
+	return deleted, nil
+}
+
+func (mr *MemoryRepository) FindImportedUser(source string, externalID string) (int, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	imported, ok := mr.importedUsers[importKey{source, externalID}]
+	if !ok {
+		return 0, ErrUserNotFound
+	}
+	return imported.UserID, nil
+}
+
+func (mr *MemoryRepository) SaveImportedUser(source string, externalID string, userID int, suggestedUserID int) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if _, ok := mr.users[userID]; !ok {
+		return ErrUserNotFound
+	}
+	if _, ok := mr.users[suggestedUserID]; !ok && suggestedUserID != 0 {
+		return ErrUserNotFound
+	}
+	mr.importedUsers[importKey{source, externalID}] = model.ImportedUser{
+		Source: source, ExternalID: externalID, UserID: userID, SuggestedUserID: suggestedUserID,
+	}
+	return nil
+}
+
+func (mr *MemoryRepository) ListSuggestedImportedUsers(source string) ([]model.ImportedUser, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	imported := []model.ImportedUser{}
+	for _, user := range mr.importedUsers {
+		if user.Source == source && user.SuggestedUserID != 0 {
+			imported = append(imported, user)
+		}
+	}
+	sort.Slice(imported, func(i, j int) bool { return imported[i].ExternalID < imported[j].ExternalID })
+	return imported, nil
+}
+
+func (mr *MemoryRepository) ConfirmImportedUser(source string, externalID string, userID int) (*model.ImportedUser, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	user, ok := mr.importedUsers[importKey{source, externalID}]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	if userID != 0 {
+		if _, ok := mr.users[userID]; !ok || userID == user.UserID {
+			return nil, ErrUserNotFound
+		}
+		user.SuggestedUserID = userID
+	}
+	if user.SuggestedUserID == 0 {
+		return nil, ErrUserNotFound
+	}
+	if mr.hasIdentities(user.UserID) {
+		return nil, ErrNotPlaceholder
+	}
+	placeholderID, suggestedUserID := user.UserID, user.SuggestedUserID
+	for _, messages := range [][]model.Message{mr.messages, mr.archived} {
+		for i := range messages {
+			if messages[i].FromUserID == placeholderID {
+				messages[i].FromUserID = suggestedUserID
+			}
+			if messages[i].ToUserId == placeholderID {
+				messages[i].ToUserId = suggestedUserID
+			}
+		}
+	}
+	for i := range mr.roomMessages {
+		if mr.roomMessages[i].FromUserID == placeholderID {
+			mr.roomMessages[i].FromUserID = suggestedUserID
+		}
+	}
+	for _, members := range mr.roomMembers {
+		if members[placeholderID] {
+			delete(members, placeholderID)
+			members[suggestedUserID] = true
+		}
+	}
+	for key, imported := range mr.importedUsers {
+		if imported.UserID == placeholderID {
+			imported.UserID, imported.SuggestedUserID = suggestedUserID, 0
+			mr.importedUsers[key] = imported
+		}
+	}
+	delete(mr.users, placeholderID)
+	for conversation := range mr.policies {
+		if conversation.UserID == placeholderID || conversation.OtherUserID == placeholderID {
+			delete(mr.policies, conversation)
+		}
+	}
+	return &user, nil
+}
+
+func (mr *MemoryRepository) FindImportedRoom(source string, externalID string) (int, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	roomID, ok := mr.importedRooms[importKey{source, externalID}]
+	if !ok {
+		return 0, ErrRoomNotFound
+	}
+	return roomID, nil
+}
+
+func (mr *MemoryRepository) SaveImportedRoom(source string, externalID string, roomID int) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if _, ok := mr.rooms[roomID]; !ok {
+		return ErrRoomNotFound
+	}
+	mr.importedRooms[importKey{source, externalID}] = roomID
+	return nil
+}
+
+func (mr *MemoryRepository) SaveImportedMessage(source string, externalID string, message *model.Message) (bool, error) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	key := importKey{source, externalID}
+	if message.RoomID != 0 {
+		if messageID, ok := mr.importedRoomMessages[key]; ok {
+			message.ID = messageID
+			return false, nil
+		}
+		if _, ok := mr.rooms[message.RoomID]; !ok {
+			return false, ErrRoomNotFound
+		}
+		mr.saveRoomMessage(message)
+		mr.importedRoomMessages[key] = message.ID
+		return true, nil
+	}
+	if messageID, ok := mr.importedMessages[key]; ok {
+		message.ID = messageID
+		return false, nil
+	}
+	mr.saveMessage(message)
+	mr.importedMessages[key] = message.ID
+	return true, nil
+}
+
+// forgetImportedMessage keeps the import records of a message removed from
+// the store, without its ID, like the SET NULL foreign keys of the SQL schema
+func forgetImportedMessage(imported map[importKey]int, messageID int) {
+	for key, importedID := range imported {
+		if importedID == messageID {
+			imported[key] = 0
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package service
+
+import (
+	"cito/server/model"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"cito/server/testutil"
+)
+
+func TestMemoryRepository_Identities(t *testing.T) {
+	mr := NewMemoryRepository()
+	now := time.Now()
+	personal := model.GitHubUser{ID: 1, Login: "personal"}.Identity()
+	work := model.GitHubUser{ID: 2, Login: "work"}.Identity()
+
+	userID, err := mr.UpsertIdentity(personal, SealedToken{AccessToken: "a"}, now)
+	require.NoError(t, err)
+	again, err := mr.UpsertIdentity(personal, SealedToken{AccessToken: "b"}, now)
+	require.NoError(t, err)
+	assert.Equal(t, userID, again, "a known identity signs in to the same user")
+
+	require.NoError(t, mr.LinkIdentity(userID, work, SealedToken{AccessToken: "c"}, now))
+	otherID, err := mr.UpsertIdentity(model.GitHubUser{ID: 3, Login: "other"}.Identity(), SealedToken{AccessToken: "d"}, now)
+	require.NoError(t, err)
+	assert.ErrorIs(t, mr.LinkIdentity(otherID, work, SealedToken{AccessToken: "e"}, now), ErrIdentityConflict)
+
+	identities, err := mr.ListIdentities(userID)
+	require.NoError(t, err)
+	require.Len(t, identities, 2)
+	assert.Equal(t, "personal", identities[0].Username)
+
+	revoked, err := mr.MarkIdentityRevoked(identities[1].ID, now)
+	require.NoError(t, err)
+	assert.NotNil(t, revoked.RevokedAt)
+	_, err = mr.MarkIdentityRevoked(identities[1].ID, now)
+	assert.ErrorIs(t, err, ErrIdentityNotFound, "an identity is revoked once")
+	stored, err := mr.FindIdentityToken(userID, identities[1].ID)
+	require.NoError(t, err)
+	assert.Nil(t, stored.Token)
+
+	_, err = mr.FindIdentityToken(otherID, identities[0].ID)
+	assert.ErrorIs(t, err, ErrIdentityNotFound)
+	assert.ErrorIs(t, mr.UnlinkIdentity(otherID, identities[0].ID), ErrIdentityNotFound)
+	require.NoError(t, mr.UnlinkIdentity(userID, identities[1].ID))
+	assert.ErrorIs(t, mr.UnlinkIdentity(userID, identities[0].ID), ErrLastIdentity)
+}
+
+func TestMemoryRepository_ReencryptAccessTokens(t *testing.T) {
+	keys := testutil.NewTestKeyring(t)
+	mr := NewMemoryRepository()
+	us := NewUserService(mr, keys)
+
+	_, err := us.UpsertIdentity(context.Background(), model.GitHubUser{ID: 1, Login: "sealed"}.Identity(), &oauth2.Token{AccessToken: "token", RefreshToken: "refresh"})
+	require.NoError(t, err)
+	legacyID, err := mr.UpsertIdentity(model.GitHubUser{ID: 2, Login: "legacy"}.Identity(), SealedToken{AccessToken: "legacy_plaintext"}, time.Now())
+	require.NoError(t, err)
+
+	count, err := us.ReencryptAccessTokens(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, count, "only the plaintext token is rewritten")
+
+	identities, err := mr.ListIdentities(legacyID)
+	require.NoError(t, err)
+	identityToken, err := us.FindIdentityToken(context.Background(), legacyID, identities[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, "legacy_plaintext", identityToken.Token.AccessToken)
+}
+
+func TestMemoryRepository_IdentityTokensToVerify(t *testing.T) {
+	mr := NewMemoryRepository()
+	now := time.Now()
+	for i, checked := range []time.Duration{time.Hour, 3 * time.Hour, 0} {
+		identity := model.GitHubUser{ID: int64(i + 1), Login: "user"}.Identity()
+		_, err := mr.UpsertIdentity(identity, SealedToken{AccessToken: "token"}, now.Add(-checked))
+		require.NoError(t, err)
+	}
+
+	due, err := mr.IdentityTokensToVerify("github", now.Add(-30*time.Minute), 10)
+	require.NoError(t, err)
+	require.Len(t, due, 2, "the token checked just now is not due")
+	assert.Equal(t, 2, due[0].IdentityID, "least recently checked first")
+	assert.Equal(t, 1, due[1].IdentityID)
+
+	due, err = mr.IdentityTokensToVerify("github", now.Add(-30*time.Minute), 1)
+	require.NoError(t, err)
+	assert.Len(t, due, 1)
+}
+
+func TestMemoryRepository_Sessions(t *testing.T) {
+	keys := testutil.NewTestKeyring(t)
+	mr := NewMemoryRepository()
+	us := NewUserService(mr, keys)
+	ss := NewSessionService(mr)
+
+	userID, err := us.UpsertIdentity(context.Background(), model.GitHubUser{ID: 1, Login: "testuser"}.Identity(), &oauth2.Token{AccessToken: "token"})
+	require.NoError(t, err)
+	token, err := ss.CreateSession(userID, "laptop", "10.0.0.1")
+	require.NoError(t, err)
+
+	user, err := us.FindUserBySession(context.Background(), token)
+	require.NoError(t, err)
+	assert.Equal(t, userID, user.ID)
+	assert.Equal(t, model.AllScopes, user.Scopes)
+
+	renewed, err := ss.RenewSession(user.SessionID, token)
+	require.NoError(t, err)
+	assert.Empty(t, renewed, "a session just used is not renewed again")
+
+	rotated, err := ss.rotateSession(user.SessionID, time.Now())
+	require.NoError(t, err)
+	_, err = us.FindUserBySession(context.Background(), rotated)
+	require.NoError(t, err)
+	_, err = us.FindUserBySession(context.Background(), token)
+	assert.NoError(t, err, "the previous token works during the grace period")
+
+	_, err = mr.FindUserBySession(hashToken(token), time.Now(), time.Now())
+	assert.ErrorIs(t, err, ErrUserNotFound, "the previous token stops working after the grace period")
+	_, err = mr.FindUserBySession(hashToken(rotated), time.Now().Add(SessionTTL), time.Now())
+	assert.ErrorIs(t, err, ErrUserNotFound, "expired sessions are not found")
+
+	other, err := ss.CreateSession(userID, "phone", "10.0.0.2")
+	require.NoError(t, err)
+	sessions, err := ss.ListSessions(userID)
+	require.NoError(t, err)
+	assert.Len(t, sessions, 2)
+
+	assert.ErrorIs(t, ss.RevokeSession(userID+1, user.SessionID), ErrSessionNotFound)
+	revoked, err := ss.RevokeOtherSessions(userID, user.SessionID)
+	require.NoError(t, err)
+	assert.Len(t, revoked, 1)
+	_, err = us.FindUserBySession(context.Background(), other)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	revoked, err = ss.RevokeAllSessions(userID)
+	require.NoError(t, err)
+	assert.Equal(t, []int{user.SessionID}, revoked)
+	sessions, err = ss.ListSessions(userID)
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+}
+
+func TestMemoryRepository_ListConversation(t *testing.T) {
+	mr := NewMemoryRepository()
+	start := time.Now().Add(-time.Hour)
+	messages := []model.Message{
+		{FromUserID: 1, ToUserId: 2, TextContent: "first", Time: start},
+		{FromUserID: 2, ToUserId: 1, TextContent: "second", Time: start.Add(time.Minute)},
+		{FromUserID: 1, ToUserId: 3, TextContent: "elsewhere", Time: start.Add(2 * time.Minute)},
+		{FromUserID: 1, ToUserId: 2, TextContent: "third", Time: start.Add(3 * time.Minute)},
+	}
+	for i := range messages {
+		require.NoError(t, mr.SaveMessage(&messages[i]))
+		assert.Equal(t, i+1, messages[i].ID)
+	}
+
+	tests := []struct {
+		name   string
+		before time.Time
+		limit  int
+		want   []string
+	}{
+		{name: "newest first", before: time.Now(), limit: 10, want: []string{"third", "second", "first"}},
+		{name: "limited", before: time.Now(), limit: 2, want: []string{"third", "second"}},
+		{name: "paged", before: start.Add(3 * time.Minute), limit: 10, want: []string{"second", "first"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conversation, err := mr.ListConversation(2, 1, tt.before, tt.limit)
+			require.NoError(t, err)
+			var got []string
+			for _, message := range conversation {
+				got = append(got, message.TextContent)
+			}
+			assert.Equal(t, strings.Join(tt.want, ","), strings.Join(got, ","))
+		})
+	}
+}
+
+func TestMemoryRepository_PurgedImports(t *testing.T) {
+	mr := NewMemoryRepository()
+	alice, err := mr.CreateUser("alice", "")
+	require.NoError(t, err)
+	bob, err := mr.CreateUser("bob", "")
+	require.NoError(t, err)
+	now := time.Now()
+	_, err = mr.SaveImportedMessage(SlackSource, "D1/1", &model.Message{FromUserID: alice, ToUserId: bob, TextContent: "old", Time: now.Add(-2 * time.Hour)})
+	require.NoError(t, err)
+	_, err = mr.SaveImportedMessage(SlackSource, "D1/2", &model.Message{FromUserID: bob, ToUserId: alice, TextContent: "new", Time: now})
+	require.NoError(t, err)
+
+	_, err = mr.PurgeMessages(nil, now.Add(-time.Hour), true, 10, now)
+	require.NoError(t, err)
+	messages, err := mr.ListUserMessages(alice, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, messages, 2, "archived messages are listed")
+	assert.Equal(t, "old", messages[0].TextContent)
+	count, err := mr.CountUserMessages(alice)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	require.NoError(t, mr.DeleteUser(bob, model.DeletedUsername))
+
+	for _, externalID := range []string{"D1/1", "D1/2"} {
+		again := model.Message{FromUserID: alice, ToUserId: alice, TextContent: "again", Time: now}
+		stored, err := mr.SaveImportedMessage(SlackSource, externalID, &again)
+		require.NoError(t, err)
+		assert.False(t, stored, externalID)
+		assert.Zero(t, again.ID, externalID)
+	}
+}
+
+func TestMemoryRepository_DeleteUser(t *testing.T) {
+	mr := NewMemoryRepository()
+	alice, err := mr.CreateUser("alice", "")
+	require.NoError(t, err)
+	bob, err := mr.CreateUser("bob", "")
+	require.NoError(t, err)
+	require.NoError(t, mr.SaveMessage(&model.Message{FromUserID: alice, ToUserId: bob, TextContent: "sent", Time: time.Now()}))
+	require.NoError(t, mr.SaveMessage(&model.Message{FromUserID: bob, ToUserId: alice, TextContent: "received", Time: time.Now()}))
+	policy := model.RetentionPolicy{MaxAge: time.Hour}
+	require.NoError(t, mr.SetRetentionPolicy(model.NewConversation(alice, bob), policy, time.Now()))
+
+	require.NoError(t, mr.DeleteUser(alice, model.DeletedUsername))
+	_, err = mr.FindUserByID(alice)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	messages, err := mr.ListUserMessages(bob, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	assert.Equal(t, "received", messages[0].TextContent)
+	placeholder, err := mr.FindUserByID(messages[0].ToUserId)
+	require.NoError(t, err)
+	assert.Equal(t, model.DeletedUsername, placeholder.Username)
+	policies, err := mr.RetentionPolicies()
+	require.NoError(t, err)
+	assert.Equal(t, map[model.Conversation]model.RetentionPolicy{model.NewConversation(bob, placeholder.ID): policy}, policies)
+
+	assert.ErrorIs(t, mr.DeleteUser(alice, model.DeletedUsername), ErrUserNotFound)
+}
@@ -0,0 +1,365 @@
+package service
+
+import (
+	"cito/server/model"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	// idTokenLeeway tolerates clock skew between cito and the provider
+	idTokenLeeway = time.Minute
+	// jwksRefreshInterval limits how often an unknown key ID refetches the JWKS
+	jwksRefreshInterval = time.Minute
+)
+
+var ErrInvalidIDToken = errors.New("invalid ID token")
+
+// OIDCConfig configures a generic OpenID Connect provider
+type OIDCConfig struct {
+	Name         string
+	DisplayName  string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+// oidcDiscovery is the subset of the discovery document cito uses
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+// OIDCProvider signs users in with any OpenID Connect provider. The identity
+// is taken from the ID token after checking its signature against the
+// provider's JWKS.
+type OIDCProvider struct {
+	name        string
+	displayName string
+	issuer      string
+	clientID    string
+	userinfoURL string
+	jwksURL     string
+	oauthConfig *oauth2.Config
+	httpClient  *http.Client
+
+	mu            sync.Mutex
+	keys          map[string]*rsa.PublicKey
+	keysFetchedAt time.Time
+}
+
+// NewOIDCProvider reads the provider's discovery document
+func NewOIDCProvider(ctx context.Context, config OIDCConfig, httpClient *http.Client) (*OIDCProvider, error) {
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+	issuer := strings.TrimSuffix(config.Issuer, "/")
+	provider := &OIDCProvider{
+		name:        config.Name,
+		displayName: config.DisplayName,
+		issuer:      issuer,
+		clientID:    config.ClientID,
+		httpClient:  httpClient,
+	}
+
+	var discovery oidcDiscovery
+	if err := provider.getJSON(ctx, issuer+"/.well-known/openid-configuration", "", &discovery); err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("OIDC discovery returned issuer %q, expected %q", discovery.Issuer, issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("OIDC discovery document is missing endpoints")
+	}
+
+	provider.userinfoURL = discovery.UserinfoEndpoint
+	provider.jwksURL = discovery.JWKSURI
+	provider.oauthConfig = &oauth2.Config{
+		ClientID:     config.ClientID,
+		ClientSecret: config.ClientSecret,
+		RedirectURL:  config.RedirectURL,
+		Scopes:       []string{"openid", "profile", "email"},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  discovery.AuthorizationEndpoint,
+			TokenURL: discovery.TokenEndpoint,
+		},
+	}
+	return provider, nil
+}
+
+func (op *OIDCProvider) Name() string {
+	return op.name
+}
+
+func (op *OIDCProvider) DisplayName() string {
+	return op.displayName
+}
+
+func (op *OIDCProvider) AuthCodeURL(attempt LoginAttempt) string {
+	return op.oauthConfig.AuthCodeURL(attempt.State, oauth2.S256ChallengeOption(attempt.Verifier),
+		oauth2.SetAuthURLParam("nonce", attempt.Nonce))
+}
+
+func (op *OIDCProvider) Exchange(ctx context.Context, code string, verifier string) (*oauth2.Token, error) {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, op.httpClient)
+	return op.oauthConfig.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+}
+
+// idTokenClaims are the ID token claims cito reads
+type idTokenClaims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	ExpiresAt         int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	EmailVerified     flag     `json:"email_verified"`
+	PreferredUsername string   `json:"preferred_username"`
+	Name              string   `json:"name"`
+}
+
+// audience accepts both forms of the aud claim, a string or a list
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// flag accepts a boolean claim as sent by most providers, true, or as a
+// string, "true", as some send email_verified
+type flag bool
+
+func (f *flag) UnmarshalJSON(data []byte) error {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case bool:
+		*f = flag(value)
+	case string:
+		*f = flag(value == "true")
+	default:
+		*f = false
+	}
+	return nil
+}
+
+func (op *OIDCProvider) FetchProfile(ctx context.Context, token *oauth2.Token, nonce string) (*model.Identity, error) {
+	rawIDToken, _ := token.Extra("id_token").(string)
+	if rawIDToken == "" {
+		return nil, fmt.Errorf("%w: token response has no id_token", ErrInvalidIDToken)
+	}
+	claims, err := op.verifyIDToken(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	// A token issued for another login attempt, such as a replayed one, is
+	// refused
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+
+	// An email is only taken as verified when the provider says so
+	email, emailVerified := claims.Email, bool(claims.EmailVerified)
+	if email == "" && op.userinfoURL != "" {
+		var userinfo struct {
+			Subject       string `json:"sub"`
+			Email         string `json:"email"`
+			EmailVerified flag   `json:"email_verified"`
+		}
+		if err := op.getJSON(ctx, op.userinfoURL, token.AccessToken, &userinfo); err != nil {
+			return nil, err
+		}
+		// The userinfo response must describe the ID token's subject
+		if userinfo.Subject == claims.Subject {
+			email, emailVerified = userinfo.Email, bool(userinfo.EmailVerified)
+		}
+	}
+
+	username := claims.PreferredUsername
+	if username == "" {
+		username = claims.Name
+	}
+	if username == "" && email != "" {
+		username, _, _ = strings.Cut(email, "@")
+	}
+	if username == "" {
+		username = claims.Subject
+	}
+
+	return &model.Identity{
+		Provider:      op.name,
+		Subject:       claims.Subject,
+		Username:      username,
+		Email:         email,
+		EmailVerified: emailVerified,
+	}, nil
+}
+
+// verifyIDToken checks the signature, issuer, audience and lifetime of a
+// compact serialized ID token and returns its claims
+func (op *OIDCProvider) verifyIDToken(ctx context.Context, rawIDToken string) (*idTokenClaims, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed token", ErrInvalidIDToken)
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	if header.Algorithm != "RS256" {
+		return nil, fmt.Errorf("%w: unsupported signing algorithm %q", ErrInvalidIDToken, header.Algorithm)
+	}
+	key, err := op.publicKey(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidIDToken)
+	}
+
+	var claims idTokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	now := time.Now()
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != op.issuer:
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidIDToken, claims.Issuer)
+	case !claims.Audience.contains(op.clientID):
+		return nil, fmt.Errorf("%w: token is not meant for this client", ErrInvalidIDToken)
+	case now.After(time.Unix(claims.ExpiresAt, 0).Add(idTokenLeeway)):
+		return nil, fmt.Errorf("%w: token expired", ErrInvalidIDToken)
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(idTokenLeeway)):
+		return nil, fmt.Errorf("%w: token issued in the future", ErrInvalidIDToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidIDToken)
+	}
+	return &claims, nil
+}
+
+func (a audience) contains(clientID string) bool {
+	for _, aud := range a {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// publicKey returns the signing key with keyID. The JWKS is refetched when
+// the key is unknown so that provider key rotation is picked up.
+func (op *OIDCProvider) publicKey(ctx context.Context, keyID string) (*rsa.PublicKey, error) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+
+	if key, ok := op.keys[keyID]; ok {
+		return key, nil
+	}
+	if time.Since(op.keysFetchedAt) < jwksRefreshInterval {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidIDToken, keyID)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			Use     string `json:"use"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := op.getJSON(ctx, op.jwksURL, "", &jwks); err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	op.keysFetchedAt = time.Now()
+	op.keys = make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.KeyType != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		op.keys[jwk.KeyID] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	if key, ok := op.keys[keyID]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidIDToken, keyID)
+}
+
+// getJSON fetches url, with accessToken as bearer credential when set, and
+// decodes the response into v
+func (op *OIDCProvider) getJSON(ctx context.Context, url string, accessToken string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if accessToken != "" {
+		req.Header.Add("Authorization", "Bearer "+accessToken)
+	}
+	resp, err := op.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,251 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+// fakeOIDCServer is a minimal OpenID Connect provider: discovery, JWKS and
+// a token endpoint returning idToken
+type fakeOIDCServer struct {
+	*httptest.Server
+	key         *rsa.PrivateKey
+	keyID       string
+	idToken     string
+	jwksFetches int
+}
+
+func newFakeOIDCServer(t *testing.T) *fakeOIDCServer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	fake := &fakeOIDCServer{key: key, keyID: "key-1"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 fake.URL,
+			"authorization_endpoint": fake.URL + "/authorize",
+			"token_endpoint":         fake.URL + "/token",
+			"jwks_uri":               fake.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		fake.jwksFetches++
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"use": "sig",
+				"kid": fake.keyID,
+				"n":   base64.RawURLEncoding.EncodeToString(fake.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(fake.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "oidc_access_token",
+			"token_type":   "Bearer",
+			"id_token":     fake.idToken,
+		})
+	})
+	fake.Server = httptest.NewServer(mux)
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+// sign returns a compact RS256 JWT for claims
+func (fake *fakeOIDCServer) sign(t *testing.T, key *rsa.PrivateKey, claims map[string]any) string {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": fake.keyID})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (fake *fakeOIDCServer) claims() map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":                fake.URL,
+		"sub":                "user-123",
+		"aud":                "cito",
+		"exp":                now.Add(time.Hour).Unix(),
+		"iat":                now.Unix(),
+		"email":              "alice@example.com",
+		"preferred_username": "alice",
+		"nonce":              "nonce",
+	}
+}
+
+func newTestOIDCProvider(t *testing.T, fake *fakeOIDCServer) *OIDCProvider {
+	provider, err := NewOIDCProvider(context.Background(), OIDCConfig{
+		Name:        "corp",
+		DisplayName: "Corp SSO",
+		Issuer:      fake.URL,
+		ClientID:    "cito",
+		RedirectURL: "http://localhost/oauth2/callback/corp",
+	}, fake.Client())
+	require.NoError(t, err)
+	return provider
+}
+
+func TestOIDCProvider_Discovery(t *testing.T) {
+	fake := newFakeOIDCServer(t)
+	provider := newTestOIDCProvider(t, fake)
+
+	loginURL, err := url.Parse(provider.AuthCodeURL(LoginAttempt{State: "state", Nonce: "nonce", Verifier: "verifier"}))
+	require.NoError(t, err)
+	assert.Equal(t, fake.URL+"/authorize", loginURL.Scheme+"://"+loginURL.Host+loginURL.Path)
+	assert.Equal(t, "openid profile email", loginURL.Query().Get("scope"))
+	assert.Equal(t, "S256", loginURL.Query().Get("code_challenge_method"))
+	assert.Equal(t, "state", loginURL.Query().Get("state"))
+	assert.Equal(t, "nonce", loginURL.Query().Get("nonce"))
+
+	_, err = NewOIDCProvider(context.Background(), OIDCConfig{Issuer: fake.URL + "/other"}, fake.Client())
+	assert.Error(t, err, "discovery must fail for an issuer the server does not serve")
+}
+
+func TestOIDCProvider_ExchangeAndFetchProfile(t *testing.T) {
+	fake := newFakeOIDCServer(t)
+	provider := newTestOIDCProvider(t, fake)
+	fake.idToken = fake.sign(t, fake.key, fake.claims())
+
+	token, err := provider.Exchange(context.Background(), "code", "verifier")
+	require.NoError(t, err)
+	identity, err := provider.FetchProfile(context.Background(), token, "nonce")
+	require.NoError(t, err)
+	assert.Equal(t, "corp", identity.Provider)
+	assert.Equal(t, "user-123", identity.Subject)
+	assert.Equal(t, "alice", identity.Username)
+	assert.Equal(t, "alice@example.com", identity.Email)
+
+	_, err = provider.FetchProfile(context.Background(), token, "other login")
+	assert.ErrorIs(t, err, ErrInvalidIDToken, "the nonce must be the one of the login attempt")
+}
+
+func TestOIDCProvider_FetchProfile_EmailVerified(t *testing.T) {
+	tests := []struct {
+		name          string
+		emailVerified any
+		want          bool
+	}{
+		{name: "claim missing"},
+		{name: "verified", emailVerified: true, want: true},
+		{name: "not verified", emailVerified: false},
+		{name: "verified as a string", emailVerified: "true", want: true},
+		{name: "not verified as a string", emailVerified: "false"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeOIDCServer(t)
+			provider := newTestOIDCProvider(t, fake)
+			claims := fake.claims()
+			if tt.emailVerified != nil {
+				claims["email_verified"] = tt.emailVerified
+			}
+			fake.idToken = fake.sign(t, fake.key, claims)
+
+			token, err := provider.Exchange(context.Background(), "code", "verifier")
+			require.NoError(t, err)
+			identity, err := provider.FetchProfile(context.Background(), token, "nonce")
+			require.NoError(t, err)
+			assert.Equal(t, "alice@example.com", identity.Email)
+			assert.Equal(t, tt.want, identity.EmailVerified)
+		})
+	}
+}
+
+func TestOIDCProvider_verifyIDToken(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		modify func(claims map[string]any)
+		key    *rsa.PrivateKey
+		valid  bool
+	}{
+		{name: "valid token", valid: true},
+		{name: "audience list containing the client", modify: func(c map[string]any) { c["aud"] = []string{"other", "cito"} }, valid: true},
+		{name: "wrong audience", modify: func(c map[string]any) { c["aud"] = "other" }},
+		{name: "wrong issuer", modify: func(c map[string]any) { c["iss"] = "https://evil.example.com" }},
+		{name: "expired", modify: func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{name: "issued in the future", modify: func(c map[string]any) { c["iat"] = time.Now().Add(time.Hour).Unix() }},
+		{name: "missing subject", modify: func(c map[string]any) { delete(c, "sub") }},
+		{name: "signed by another key", key: otherKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := newFakeOIDCServer(t)
+			provider := newTestOIDCProvider(t, fake)
+			claims := fake.claims()
+			if tt.modify != nil {
+				tt.modify(claims)
+			}
+			key := fake.key
+			if tt.key != nil {
+				key = tt.key
+			}
+
+			_, err := provider.verifyIDToken(context.Background(), fake.sign(t, key, claims))
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrInvalidIDToken)
+			}
+		})
+	}
+}
+
+func TestOIDCProvider_FetchProfile_RequiresIDToken(t *testing.T) {
+	fake := newFakeOIDCServer(t)
+	provider := newTestOIDCProvider(t, fake)
+
+	_, err := provider.FetchProfile(context.Background(), &oauth2.Token{AccessToken: "token"}, "nonce")
+	assert.ErrorIs(t, err, ErrInvalidIDToken)
+}
+
+func TestOIDCProvider_KeyRotation(t *testing.T) {
+	fake := newFakeOIDCServer(t)
+	provider := newTestOIDCProvider(t, fake)
+
+	_, err := provider.verifyIDToken(context.Background(), fake.sign(t, fake.key, fake.claims()))
+	require.NoError(t, err)
+	assert.Equal(t, 1, fake.jwksFetches, "JWKS should be cached")
+
+	_, err = provider.verifyIDToken(context.Background(), fake.sign(t, fake.key, fake.claims()))
+	require.NoError(t, err)
+	assert.Equal(t, 1, fake.jwksFetches, "known keys should not refetch the JWKS")
+
+	// The provider rotates its key; the new key ID is fetched once the
+	// refresh interval has passed
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	fake.key, fake.keyID = newKey, "key-2"
+	provider.keysFetchedAt = time.Now().Add(-jwksRefreshInterval)
+
+	_, err = provider.verifyIDToken(context.Background(), fake.sign(t, fake.key, fake.claims()))
+	require.NoError(t, err)
+	assert.Equal(t, 2, fake.jwksFetches)
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"cito/server/model"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const exportColumns = `id, user_id, format, status, exported, total, COALESCE(error, ''), created_at, finished_at`
+
+// scanExport reads the exportColumns
+func scanExport(scan func(dest ...any) error) (*model.Export, error) {
+	var export model.Export
+	err := scan(&export.ID, &export.UserID, &export.Format, &export.Status, &export.Exported, &export.Total,
+		&export.Error, &export.CreatedAt, &export.FinishedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &export, nil
+}
+
+// queryExports runs a query selecting the exportColumns
+func (pr *PostgresRepository) queryExports(query string, args ...any) ([]model.Export, error) {
+	rows, err := pr.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exports := []model.Export{}
+	for rows.Next() {
+		export, err := scanExport(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, *export)
+	}
+	return exports, rows.Err()
+}
+
+func (pr *PostgresRepository) CreateExport(export *model.Export) error {
+	// The unique index on the unfinished exports of a user settles races:
+	// the insert is skipped when one exists
+	err := pr.db.QueryRow(`
+		INSERT INTO exports (user_id, format, status, created_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) WHERE status IN ('pending', 'running') DO NOTHING
+		RETURNING id
+	`, export.UserID, export.Format, export.Status, export.CreatedAt).Scan(&export.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrExportInProgress
+	}
+	return err
+}
+
+func (pr *PostgresRepository) FindExport(userID int, exportID int) (*model.Export, error) {
+	export, err := scanExport(pr.db.QueryRow(`SELECT `+exportColumns+` FROM exports WHERE id = $1 AND user_id = $2`,
+		exportID, userID).Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrExportNotFound
+	}
+	return export, err
+}
+
+func (pr *PostgresRepository) ListExports(userID int) ([]model.Export, error) {
+	return pr.queryExports(`SELECT `+exportColumns+` FROM exports WHERE user_id = $1 ORDER BY created_at DESC, id DESC`, userID)
+}
+
+func (pr *PostgresRepository) UnfinishedExports() ([]model.Export, error) {
+	return pr.queryExports(`SELECT `+exportColumns+` FROM exports WHERE status IN ($1, $2) ORDER BY id`,
+		model.ExportStatusPending, model.ExportStatusRunning)
+}
+
+func (pr *PostgresRepository) UpdateExport(export model.Export) error {
+	exportError := sql.NullString{String: export.Error, Valid: export.Error != ""}
+	_, err := pr.db.Exec(`
+		UPDATE exports SET status = $1, exported = $2, total = $3, error = $4, finished_at = $5
+		WHERE id = $6
+	`, export.Status, export.Exported, export.Total, exportError, export.FinishedAt, export.ID)
+	return err
+}
+
+func (pr *PostgresRepository) DeleteExportsBefore(before time.Time) ([]model.Export, error) {
+	return pr.queryExports(`DELETE FROM exports WHERE created_at < $1 RETURNING `+exportColumns, before)
+}
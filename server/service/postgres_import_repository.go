@@ -0,0 +1,184 @@
+package service
+
+import (
+	"cito/server/model"
+	"database/sql"
+	"errors"
+)
+
+func (pr *PostgresRepository) FindImportedUser(source string, externalID string) (int, error) {
+	var userID int
+	err := pr.db.QueryRow(`SELECT user_id FROM imported_users WHERE source = $1 AND external_id = $2`,
+		source, externalID).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrUserNotFound
+	}
+	return userID, err
+}
+
+func (pr *PostgresRepository) SaveImportedUser(source string, externalID string, userID int, suggestedUserID int) error {
+	_, err := pr.db.Exec(`
+		INSERT INTO imported_users (source, external_id, user_id, suggested_user_id) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (source, external_id) DO UPDATE SET user_id = EXCLUDED.user_id, suggested_user_id = EXCLUDED.suggested_user_id
+	`, source, externalID, userID, sql.NullInt64{Int64: int64(suggestedUserID), Valid: suggestedUserID != 0})
+	return err
+}
+
+func (pr *PostgresRepository) ListSuggestedImportedUsers(source string) ([]model.ImportedUser, error) {
+	rows, err := pr.db.Query(`
+		SELECT source, external_id, user_id, suggested_user_id FROM imported_users
+		WHERE source = $1 AND suggested_user_id IS NOT NULL
+		ORDER BY external_id
+	`, source)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	imported := []model.ImportedUser{}
+	for rows.Next() {
+		var user model.ImportedUser
+		if err := rows.Scan(&user.Source, &user.ExternalID, &user.UserID, &user.SuggestedUserID); err != nil {
+			return nil, err
+		}
+		imported = append(imported, user)
+	}
+	return imported, rows.Err()
+}
+
+func (pr *PostgresRepository) ConfirmImportedUser(source string, externalID string, userID int) (*model.ImportedUser, error) {
+	tx, err := pr.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	user := model.ImportedUser{Source: source, ExternalID: externalID}
+	var placeholder bool
+	err = tx.QueryRow(`
+		SELECT user_id, COALESCE(suggested_user_id, 0), NOT EXISTS (SELECT 1 FROM identities i WHERE i.user_id = u.user_id)
+		FROM imported_users u
+		WHERE source = $1 AND external_id = $2
+	`, source, externalID).Scan(&user.UserID, &user.SuggestedUserID, &placeholder)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if userID != 0 {
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if !exists || userID == user.UserID {
+			return nil, ErrUserNotFound
+		}
+		user.SuggestedUserID = userID
+	}
+	if user.SuggestedUserID == 0 {
+		return nil, ErrUserNotFound
+	}
+	if !placeholder {
+		return nil, ErrNotPlaceholder
+	}
+	// The placeholder goes with its row, what it was sent and sent moves to
+	// the suggested user first
+	for _, query := range []string{
+		`UPDATE messages SET from_user_id = $2 WHERE from_user_id = $1`,
+		`UPDATE messages SET to_user_id = $2 WHERE to_user_id = $1`,
+		`UPDATE archived_messages SET from_user_id = $2 WHERE from_user_id = $1`,
+		`UPDATE archived_messages SET to_user_id = $2 WHERE to_user_id = $1`,
+		`UPDATE room_messages SET from_user_id = $2 WHERE from_user_id = $1`,
+		`INSERT INTO room_members (room_id, user_id) SELECT room_id, $2 FROM room_members WHERE user_id = $1 ON CONFLICT DO NOTHING`,
+		`UPDATE imported_users SET user_id = $2, suggested_user_id = NULL WHERE user_id = $1`,
+	} {
+		if _, err := tx.Exec(query, user.UserID, user.SuggestedUserID); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM users WHERE id = $1`, user.UserID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (pr *PostgresRepository) FindImportedRoom(source string, externalID string) (int, error) {
+	var roomID int
+	err := pr.db.QueryRow(`SELECT room_id FROM imported_rooms WHERE source = $1 AND external_id = $2`,
+		source, externalID).Scan(&roomID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrRoomNotFound
+	}
+	return roomID, err
+}
+
+func (pr *PostgresRepository) SaveImportedRoom(source string, externalID string, roomID int) error {
+	_, err := pr.db.Exec(`
+		INSERT INTO imported_rooms (source, external_id, room_id) VALUES ($1, $2, $3)
+		ON CONFLICT (source, external_id) DO UPDATE SET room_id = EXCLUDED.room_id
+	`, source, externalID, roomID)
+	return err
+}
+
+func (pr *PostgresRepository) SaveImportedMessage(source string, externalID string, message *model.Message) (bool, error) {
+	if message.RoomID != 0 {
+		return pr.saveImportedRoomMessage(source, externalID, message)
+	}
+	tx, err := pr.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var messageID sql.NullInt64
+	err = tx.QueryRow(`SELECT message_id FROM imported_messages WHERE source = $1 AND external_id = $2`,
+		source, externalID).Scan(&messageID)
+	if err == nil {
+		message.ID = int(messageID.Int64)
+		return false, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+	if err := saveMessage(tx, message); err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(`INSERT INTO imported_messages (source, external_id, message_id) VALUES ($1, $2, $3)`,
+		source, externalID, message.ID)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (pr *PostgresRepository) saveImportedRoomMessage(source string, externalID string, message *model.Message) (bool, error) {
+	tx, err := pr.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var messageID sql.NullInt64
+	err = tx.QueryRow(`SELECT room_message_id FROM imported_room_messages WHERE source = $1 AND external_id = $2`,
+		source, externalID).Scan(&messageID)
+	if err == nil {
+		message.ID = int(messageID.Int64)
+		return false, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+	if err := saveRoomMessage(tx, message); err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(`INSERT INTO imported_room_messages (source, external_id, room_message_id) VALUES ($1, $2, $3)`,
+		source, externalID, message.ID)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"cito/server/model"
+	"database/sql"
+	"time"
+)
+
+// queryer is what SaveMessage needs of a database or transaction
+type queryer interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func (pr *PostgresRepository) SaveMessage(message *model.Message) error {
+	return saveMessage(pr.db, message)
+}
+
+func saveMessage(db queryer, message *model.Message) error {
+	replyToID := sql.NullInt64{Int64: int64(message.ReplyToID), Valid: message.ReplyToID != 0}
+	return db.QueryRow(`
+		INSERT INTO messages (from_user_id, to_user_id, text_content, created_at, reply_to_id)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, message.FromUserID, message.ToUserId, message.TextContent, message.Time, replyToID).Scan(&message.ID)
+}
+
+// scanMessage reads id, from_user_id, to_user_id, text_content, created_at
+// and reply_to_id
+func scanMessage(rows *sql.Rows) (model.Message, error) {
+	var message model.Message
+	var replyToID sql.NullInt64
+	err := rows.Scan(&message.ID, &message.FromUserID, &message.ToUserId, &message.TextContent, &message.Time, &replyToID)
+	message.ReplyToID = int(replyToID.Int64)
+	return message, err
+}
+
+func (pr *PostgresRepository) ListConversation(userID int, otherUserID int, before time.Time, limit int) ([]model.Message, error) {
+	rows, err := pr.db.Query(`
+		SELECT id, from_user_id, to_user_id, text_content, created_at, reply_to_id
+		FROM messages
+		WHERE ((from_user_id = $1 AND to_user_id = $2) OR (from_user_id = $2 AND to_user_id = $1))
+			AND created_at < $3
+		ORDER BY created_at DESC, id DESC
+		LIMIT $4
+	`, userID, otherUserID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []model.Message{}
+	for rows.Next() {
+		message, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+func (pr *PostgresRepository) ListUserMessages(userID int, afterID int, limit int) ([]model.Message, error) {
+	rows, err := pr.db.Query(`
+		SELECT id, from_user_id, to_user_id, text_content, created_at, reply_to_id FROM (
+			SELECT id, from_user_id, to_user_id, text_content, created_at, reply_to_id
+			FROM messages
+			WHERE (from_user_id = $1 OR to_user_id = $1) AND id > $2
+			UNION ALL
+			SELECT id, from_user_id, to_user_id, text_content, created_at, NULL
+			FROM archived_messages
+			WHERE (from_user_id = $1 OR to_user_id = $1) AND id > $2
+		) user_messages
+		ORDER BY id
+		LIMIT $3
+	`, userID, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []model.Message{}
+	for rows.Next() {
+		message, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+func (pr *PostgresRepository) CountUserMessages(userID int) (int, error) {
+	var count int
+	err := pr.db.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM messages WHERE from_user_id = $1 OR to_user_id = $1)
+			+ (SELECT COUNT(*) FROM archived_messages WHERE from_user_id = $1 OR to_user_id = $1)
+	`, userID).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,477 @@
+package service
+
+import (
+	"cito/server/model"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// PostgresRepository implements UserRepository, SessionRepository and
+// MessageRepository on a PostgreSQL database migrated by the migrations
+// package
+type PostgresRepository struct {
+	db *sql.DB
+}
+
+func NewPostgresRepository(db *sql.DB) *PostgresRepository {
+	return &PostgresRepository{db: db}
+}
+
+// nullableToken converts the optional parts of a sealed token to columns
+func nullableToken(token SealedToken) (sql.NullString, sql.NullTime) {
+	refreshToken := sql.NullString{String: token.RefreshToken, Valid: token.RefreshToken != ""}
+	expiresAt := sql.NullTime{Time: token.ExpiresAt, Valid: !token.ExpiresAt.IsZero()}
+	return refreshToken, expiresAt
+}
+
+func (pr *PostgresRepository) UpsertIdentity(identity model.Identity, token SealedToken, now time.Time) (int, error) {
+	refreshToken, expiresAt := nullableToken(token)
+
+	tx, err := pr.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRow(`
+		UPDATE identities SET username = $1, email = $2, email_verified = $3, access_token = $4, refresh_token = $5,
+			token_expires_at = $6, token_checked_at = $7, revoked_at = NULL
+		WHERE provider = $8 AND subject = $9
+		RETURNING user_id
+	`, identity.Username, identity.Email, identity.EmailVerified, token.AccessToken, refreshToken, expiresAt, now,
+		identity.Provider, identity.Subject).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		userID, err = claimPlaceholder(tx, identity)
+		if errors.Is(err, sql.ErrNoRows) {
+			err = tx.QueryRow(`INSERT INTO users (username, email) VALUES ($1, $2) RETURNING id`,
+				identity.Username, identity.Email).Scan(&userID)
+		}
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO identities (user_id, provider, subject, username, email, email_verified, access_token, refresh_token,
+				token_expires_at, token_checked_at, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $10)
+		`, userID, identity.Provider, identity.Subject, identity.Username, identity.Email, identity.EmailVerified,
+			token.AccessToken, refreshToken, expiresAt, now)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// claimPlaceholder turns the oldest imported placeholder with the verified
+// email of identity into its account, with the messages and rooms imported
+// for it. It returns sql.ErrNoRows when there is none.
+func claimPlaceholder(tx *sql.Tx, identity model.Identity) (int, error) {
+	if !identity.EmailVerified || identity.Email == "" {
+		return 0, sql.ErrNoRows
+	}
+	var userID int
+	err := tx.QueryRow(`
+		UPDATE users SET username = $1, email = $2
+		WHERE id = (
+			SELECT u.id FROM users u
+			WHERE LOWER(u.email) = LOWER($2)
+				AND EXISTS (SELECT 1 FROM imported_users i WHERE i.user_id = u.id)
+				AND NOT EXISTS (SELECT 1 FROM identities i WHERE i.user_id = u.id)
+			ORDER BY u.id
+			LIMIT 1
+		)
+		RETURNING id
+	`, identity.Username, identity.Email).Scan(&userID)
+	if err != nil {
+		return 0, err
+	}
+	// Whoever shared the email unverified is no longer a candidate
+	_, err = tx.Exec(`UPDATE imported_users SET suggested_user_id = NULL WHERE user_id = $1`, userID)
+	return userID, err
+}
+
+func (pr *PostgresRepository) LinkIdentity(userID int, identity model.Identity, token SealedToken, now time.Time) error {
+	refreshToken, expiresAt := nullableToken(token)
+
+	// The unique (provider, subject) constraint settles races: the insert is
+	// skipped when the identity exists and the owner is checked afterwards
+	var ownerID int
+	err := pr.db.QueryRow(`
+		INSERT INTO identities (user_id, provider, subject, username, email, email_verified, access_token, refresh_token,
+			token_expires_at, token_checked_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $10)
+		ON CONFLICT (provider, subject) DO UPDATE SET
+			username = EXCLUDED.username,
+			email = EXCLUDED.email,
+			email_verified = EXCLUDED.email_verified,
+			access_token = EXCLUDED.access_token,
+			refresh_token = EXCLUDED.refresh_token,
+			token_expires_at = EXCLUDED.token_expires_at,
+			token_checked_at = EXCLUDED.token_checked_at,
+			revoked_at = NULL
+		WHERE identities.user_id = EXCLUDED.user_id
+		RETURNING user_id
+	`, userID, identity.Provider, identity.Subject, identity.Username, identity.Email, identity.EmailVerified,
+		token.AccessToken, refreshToken, expiresAt, now).Scan(&ownerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrIdentityConflict
+	}
+	return err
+}
+
+// scanIdentityToken reads id, user_id, provider, access_token, refresh_token
+// and token_expires_at
+func scanIdentityToken(scan func(dest ...any) error) (*StoredIdentityToken, error) {
+	var identityToken StoredIdentityToken
+	var accessToken, refreshToken sql.NullString
+	var expiresAt sql.NullTime
+	if err := scan(&identityToken.IdentityID, &identityToken.UserID, &identityToken.Provider, &accessToken, &refreshToken, &expiresAt); err != nil {
+		return nil, err
+	}
+	if accessToken.Valid {
+		identityToken.Token = &SealedToken{AccessToken: accessToken.String, RefreshToken: refreshToken.String, ExpiresAt: expiresAt.Time}
+	}
+	return &identityToken, nil
+}
+
+func (pr *PostgresRepository) FindIdentityToken(userID int, identityID int) (*StoredIdentityToken, error) {
+	identityToken, err := scanIdentityToken(pr.db.QueryRow(`
+		SELECT id, user_id, provider, access_token, refresh_token, token_expires_at
+		FROM identities WHERE id = $1 AND user_id = $2
+	`, identityID, userID).Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrIdentityNotFound
+	}
+	return identityToken, err
+}
+
+func (pr *PostgresRepository) IdentityTokensToVerify(provider string, checkedBefore time.Time, limit int) ([]StoredIdentityToken, error) {
+	rows, err := pr.db.Query(`
+		SELECT id, user_id, provider, access_token, refresh_token, token_expires_at
+		FROM identities
+		WHERE provider = $1 AND access_token IS NOT NULL AND revoked_at IS NULL
+			AND (token_checked_at IS NULL OR token_checked_at < $2)
+		ORDER BY token_checked_at NULLS FIRST, id
+		LIMIT $3
+	`, provider, checkedBefore, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identityTokens := []StoredIdentityToken{}
+	for rows.Next() {
+		identityToken, err := scanIdentityToken(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		identityTokens = append(identityTokens, *identityToken)
+	}
+	return identityTokens, rows.Err()
+}
+
+func (pr *PostgresRepository) UpdateIdentityToken(identityID int, token SealedToken, checkedAt time.Time) error {
+	refreshToken, expiresAt := nullableToken(token)
+	_, err := pr.db.Exec(`
+		UPDATE identities SET access_token = $1, refresh_token = $2, token_expires_at = $3, token_checked_at = $4
+		WHERE id = $5
+	`, token.AccessToken, refreshToken, expiresAt, checkedAt, identityID)
+	return err
+}
+
+func (pr *PostgresRepository) MarkIdentityChecked(identityID int, checkedAt time.Time) error {
+	_, err := pr.db.Exec(`UPDATE identities SET token_checked_at = $1 WHERE id = $2`, checkedAt, identityID)
+	return err
+}
+
+func (pr *PostgresRepository) ResealTokens(reseal func(stored string) (string, bool, error)) (int, error) {
+	total := 0
+	for _, sealed := range []struct{ table, key, column string }{
+		{"identities", "id", "access_token"},
+		{"identities", "id", "refresh_token"},
+		{"user_totp", "user_id", "secret"},
+	} {
+		count, err := pr.resealColumn(sealed.table, sealed.key, sealed.column, reseal)
+		if err != nil {
+			return total, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// resealColumn reseals the values of one column, addressing rows by key
+func (pr *PostgresRepository) resealColumn(table, key, column string, reseal func(stored string) (string, bool, error)) (int, error) {
+	rows, err := pr.db.Query(`SELECT ` + key + `, ` + column + ` FROM ` + table + ` WHERE ` + column + ` IS NOT NULL`)
+	if err != nil {
+		return 0, err
+	}
+	stale := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var stored string
+		if err := rows.Scan(&id, &stored); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		resealed, changed, err := reseal(stored)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if changed {
+			stale[id] = resealed
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for id, resealed := range stale {
+		if _, err := pr.db.Exec(`UPDATE `+table+` SET `+column+` = $1 WHERE `+key+` = $2`, resealed, id); err != nil {
+			return 0, err
+		}
+	}
+	return len(stale), nil
+}
+
+func (pr *PostgresRepository) MarkIdentityRevoked(identityID int, now time.Time) (*model.Identity, error) {
+	var identity model.Identity
+	err := pr.db.QueryRow(`
+		UPDATE identities SET revoked_at = $1, access_token = NULL, refresh_token = NULL, token_expires_at = NULL
+		WHERE id = $2 AND revoked_at IS NULL
+		RETURNING id, user_id, provider, subject, username, COALESCE(email, ''), email_verified, created_at, revoked_at
+	`, now, identityID).Scan(&identity.ID, &identity.UserID, &identity.Provider, &identity.Subject,
+		&identity.Username, &identity.Email, &identity.EmailVerified, &identity.CreatedAt, &identity.RevokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrIdentityNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+func (pr *PostgresRepository) ListIdentities(userID int) ([]model.Identity, error) {
+	rows, err := pr.db.Query(`
+		SELECT id, user_id, provider, subject, username, COALESCE(email, ''), email_verified, created_at, revoked_at
+		FROM identities WHERE user_id = $1 ORDER BY created_at, id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []model.Identity{}
+	for rows.Next() {
+		var identity model.Identity
+		if err := rows.Scan(&identity.ID, &identity.UserID, &identity.Provider, &identity.Subject, &identity.Username, &identity.Email, &identity.EmailVerified, &identity.CreatedAt, &identity.RevokedAt); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+func (pr *PostgresRepository) UnlinkIdentity(userID int, identityID int) error {
+	// Lock the account's identities so two concurrent unlinks cannot remove
+	// the last two
+	return unlinkIdentity(pr.db, `SELECT id FROM identities WHERE user_id = $1 FOR UPDATE`, userID, identityID)
+}
+
+// unlinkIdentity deletes an identity in a transaction that selects the
+// user's identities with selectIdentities first
+func unlinkIdentity(db *sql.DB, selectIdentities string, userID int, identityID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(selectIdentities, userID)
+	if err != nil {
+		return err
+	}
+	found, count := false, 0
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		found = found || id == identityID
+		count++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if !found {
+		return ErrIdentityNotFound
+	}
+	if count <= 1 {
+		return ErrLastIdentity
+	}
+
+	if _, err := tx.Exec(`DELETE FROM identities WHERE id = $1 AND user_id = $2`, identityID, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (pr *PostgresRepository) FindUserByID(userID int) (*model.UserModel, error) {
+	var user model.UserModel
+	err := pr.db.QueryRow(`SELECT id, username, COALESCE(email, '') FROM users WHERE id = $1`, userID).Scan(
+		&user.ID,
+		&user.Username,
+		&user.Email,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (pr *PostgresRepository) FindUserByEmail(email string, verified bool) (*model.UserModel, error) {
+	var user model.UserModel
+	err := pr.db.QueryRow(`
+		SELECT u.id, u.username, COALESCE(u.email, '') FROM identities i
+		JOIN users u ON u.id = i.user_id
+		WHERE LOWER(i.email) = LOWER($1) AND i.email_verified = $2
+		ORDER BY u.id
+		LIMIT 1
+	`, email, verified).Scan(&user.ID, &user.Username, &user.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (pr *PostgresRepository) CreateUser(username string, email string) (int, error) {
+	var userID int
+	err := pr.db.QueryRow(`INSERT INTO users (username, email) VALUES ($1, $2) RETURNING id`,
+		username, sql.NullString{String: email, Valid: email != ""}).Scan(&userID)
+	return userID, err
+}
+
+func (pr *PostgresRepository) DeleteUser(userID int, placeholder string) error {
+	tx, err := pr.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+	// Messages others sent to the user stay theirs, addressed to a new
+	// placeholder instead, along with the retention policies of those
+	// conversations
+	var received bool
+	err = tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM messages WHERE to_user_id = $1 AND from_user_id <> $1)
+			OR EXISTS (SELECT 1 FROM archived_messages WHERE to_user_id = $1 AND from_user_id <> $1)
+	`, userID).Scan(&received)
+	if err != nil {
+		return err
+	}
+	if received {
+		var placeholderID int
+		if err := tx.QueryRow(`INSERT INTO users (username) VALUES ($1) RETURNING id`, placeholder).Scan(&placeholderID); err != nil {
+			return err
+		}
+		for _, query := range []string{
+			`UPDATE messages SET to_user_id = $2 WHERE to_user_id = $1 AND from_user_id <> $1`,
+			`UPDATE archived_messages SET to_user_id = $2 WHERE to_user_id = $1 AND from_user_id <> $1`,
+			// The placeholder has the highest ID, it goes second in the pair
+			`UPDATE retention_policies SET user_id = other_user_id, other_user_id = $2 WHERE user_id = $1`,
+			`UPDATE retention_policies SET other_user_id = $2 WHERE other_user_id = $1`,
+		} {
+			if _, err := tx.Exec(query, userID, placeholderID); err != nil {
+				return err
+			}
+		}
+	}
+	// Everything else about the user goes with the row, the messages they
+	// sent included
+	if _, err := tx.Exec(`DELETE FROM users WHERE id = $1`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// anonymizedTables hold what AnonymizeUser removes, by their user_id column
+var anonymizedTables = []string{
+	"identities", "sessions", "personal_access_tokens", "device_authorizations", "user_totp",
+	"recovery_codes", "login_challenges", "workspace_members", "room_members", "exports", "imported_users",
+}
+
+func (pr *PostgresRepository) AnonymizeUser(userID int, username string) error {
+	tx, err := pr.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE users SET username = $1, email = NULL WHERE id = $2`, username, userID)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrUserNotFound
+	}
+	for _, table := range anonymizedTables {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE user_id = $1`, userID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE imported_users SET suggested_user_id = NULL WHERE suggested_user_id = $1`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (pr *PostgresRepository) FindUserBySession(tokenHash string, now time.Time, rotatedAfter time.Time) (*model.UserModel, error) {
+	query := `
+		SELECT u.id, u.username, u.email, s.id
+		FROM sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE (s.token_hash = $1 OR (s.previous_token_hash = $1 AND s.rotated_at > $3))
+		AND s.expires_at > $2
+	`
+
+	var user model.UserModel
+	err := pr.db.QueryRow(query, tokenHash, now, rotatedAfter).Scan(
+		&user.ID,
+		&user.Username,
+		&user.Email,
+		&user.SessionID,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"cito/server/model"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"cito/server/testutil"
+)
+
+func TestPostgresRepository_Messages(t *testing.T) {
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	sent := time.Now()
+	mock.ExpectQuery(`INSERT INTO messages`).
+		WithArgs(1, 2, "hello", sent, nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+	mock.ExpectQuery(`SELECT (.+) FROM messages`).
+		WithArgs(2, 1, sqlmock.AnyArg(), 50).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "from_user_id", "to_user_id", "text_content", "created_at", "reply_to_id"}).
+			AddRow(5, 1, 2, "hello", sent, nil))
+
+	pr := NewPostgresRepository(db)
+	message := model.Message{FromUserID: 1, ToUserId: 2, TextContent: "hello", Time: sent}
+	require.NoError(t, pr.SaveMessage(&message))
+	assert.Equal(t, 5, message.ID)
+
+	conversation, err := pr.ListConversation(2, 1, time.Now(), 50)
+	require.NoError(t, err)
+	assert.Equal(t, []model.Message{message}, conversation)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,213 @@
+package service
+
+import (
+	"cito/server/model"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+func (pr *PostgresRepository) SetRetentionPolicy(conversation model.Conversation, policy model.RetentionPolicy, now time.Time) error {
+	_, err := pr.db.Exec(`
+		INSERT INTO retention_policies (user_id, other_user_id, max_age_seconds, archive, updated_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, other_user_id) DO UPDATE SET
+			max_age_seconds = EXCLUDED.max_age_seconds,
+			archive = EXCLUDED.archive,
+			updated_at = EXCLUDED.updated_at
+	`, conversation.UserID, conversation.OtherUserID, int64(policy.MaxAge/time.Second), policy.Archive, now)
+	return err
+}
+
+func (pr *PostgresRepository) DeleteRetentionPolicy(conversation model.Conversation) error {
+	result, err := pr.db.Exec(`DELETE FROM retention_policies WHERE user_id = $1 AND other_user_id = $2`,
+		conversation.UserID, conversation.OtherUserID)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrRetentionPolicyNotFound
+	}
+	return nil
+}
+
+func (pr *PostgresRepository) RetentionPolicies() (map[model.Conversation]model.RetentionPolicy, error) {
+	rows, err := pr.db.Query(`SELECT user_id, other_user_id, max_age_seconds, archive FROM retention_policies`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := make(map[model.Conversation]model.RetentionPolicy)
+	for rows.Next() {
+		var conversation model.Conversation
+		var maxAgeSeconds int64
+		var policy model.RetentionPolicy
+		if err := rows.Scan(&conversation.UserID, &conversation.OtherUserID, &maxAgeSeconds, &policy.Archive); err != nil {
+			return nil, err
+		}
+		policy.MaxAge = time.Duration(maxAgeSeconds) * time.Second
+		policies[conversation] = policy
+	}
+	return policies, rows.Err()
+}
+
+func (pr *PostgresRepository) ListConversations() ([]model.Conversation, error) {
+	rows, err := pr.db.Query(`
+		SELECT DISTINCT
+			CASE WHEN from_user_id < to_user_id THEN from_user_id ELSE to_user_id END AS user_id,
+			CASE WHEN from_user_id < to_user_id THEN to_user_id ELSE from_user_id END AS other_user_id
+		FROM messages
+		ORDER BY user_id, other_user_id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conversations := []model.Conversation{}
+	for rows.Next() {
+		var conversation model.Conversation
+		if err := rows.Scan(&conversation.UserID, &conversation.OtherUserID); err != nil {
+			return nil, err
+		}
+		conversations = append(conversations, conversation)
+	}
+	return conversations, rows.Err()
+}
+
+func (pr *PostgresRepository) PurgeMessages(conversation *model.Conversation, before time.Time, archive bool, limit int, now time.Time) (int, error) {
+	query := `
+		SELECT id, from_user_id, to_user_id, text_content, created_at
+		FROM messages m
+		WHERE created_at < $1 AND NOT EXISTS (
+			SELECT 1 FROM retention_policies p
+			WHERE (p.user_id = m.from_user_id AND p.other_user_id = m.to_user_id)
+				OR (p.user_id = m.to_user_id AND p.other_user_id = m.from_user_id)
+		)
+		ORDER BY id
+		LIMIT $2
+	`
+	args := []any{before, limit}
+	if conversation != nil {
+		query = `
+			SELECT id, from_user_id, to_user_id, text_content, created_at
+			FROM messages
+			WHERE created_at < $1
+				AND ((from_user_id = $3 AND to_user_id = $4) OR (from_user_id = $4 AND to_user_id = $3))
+			ORDER BY id
+			LIMIT $2
+		`
+		args = append(args, conversation.UserID, conversation.OtherUserID)
+	}
+
+	// Each batch is its own short transaction, so purging a large backlog
+	// never blocks message writes for long
+	tx, err := pr.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	expired, err := queryMessages(tx, query, args...)
+	if err != nil || len(expired) == 0 {
+		return 0, err
+	}
+	if archive {
+		if err := archiveMessages(tx, expired, now); err != nil {
+			return 0, err
+		}
+	}
+
+	ids := make([]any, len(expired))
+	for i, message := range expired {
+		ids[i] = message.ID
+	}
+	if _, err := tx.Exec(`DELETE FROM messages WHERE id IN (`+placeholders(1, len(ids))+`)`, ids...); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(expired), nil
+}
+
+// queryMessages reads id, from_user_id, to_user_id, text_content and
+// created_at rows
+func queryMessages(tx *sql.Tx, query string, args ...any) ([]model.Message, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []model.Message{}
+	for rows.Next() {
+		var message model.Message
+		if err := rows.Scan(&message.ID, &message.FromUserID, &message.ToUserId, &message.TextContent, &message.Time); err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+// archiveMessages copies messages to archived_messages
+func archiveMessages(tx *sql.Tx, messages []model.Message, now time.Time) error {
+	values := make([]string, len(messages))
+	args := make([]any, 0, 6*len(messages))
+	for i, message := range messages {
+		values[i] = "(" + placeholders(len(args)+1, 6) + ")"
+		args = append(args, message.ID, message.FromUserID, message.ToUserId, message.TextContent, message.Time, now)
+	}
+	_, err := tx.Exec(`
+		INSERT INTO archived_messages (id, from_user_id, to_user_id, text_content, created_at, archived_at)
+		VALUES `+strings.Join(values, ", "), args...)
+	return err
+}
+
+// placeholders returns count numbered parameters starting at $first
+func placeholders(first int, count int) string {
+	params := make([]string, count)
+	for i := range params {
+		params[i] = fmt.Sprintf("$%d", first+i)
+	}
+	return strings.Join(params, ", ")
+}
+
+func (pr *PostgresRepository) SavePurgeRun(run *model.PurgeRun) error {
+	runError := sql.NullString{String: run.Error, Valid: run.Error != ""}
+	return pr.db.QueryRow(`
+		INSERT INTO purge_runs (started_at, finished_at, deleted, archived, error)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, run.StartedAt, run.FinishedAt, run.Deleted, run.Archived, runError).Scan(&run.ID)
+}
+
+func (pr *PostgresRepository) ListPurgeRuns(limit int) ([]model.PurgeRun, error) {
+	rows, err := pr.db.Query(`
+		SELECT id, started_at, finished_at, deleted, archived, COALESCE(error, '')
+		FROM purge_runs
+		ORDER BY started_at DESC, id DESC
+		LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []model.PurgeRun{}
+	for rows.Next() {
+		var run model.PurgeRun
+		if err := rows.Scan(&run.ID, &run.StartedAt, &run.FinishedAt, &run.Deleted, &run.Archived, &run.Error); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"cito/server/model"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+func (pr *PostgresRepository) CreateRoom(room *model.Room) error {
+	return pr.db.QueryRow(`INSERT INTO rooms (name, created_at) VALUES ($1, $2) RETURNING id`,
+		room.Name, room.CreatedAt).Scan(&room.ID)
+}
+
+func (pr *PostgresRepository) AddRoomMember(roomID int, userID int) error {
+	var exists bool
+	if err := pr.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM rooms WHERE id = $1)`, roomID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrRoomNotFound
+	}
+	_, err := pr.db.Exec(`INSERT INTO room_members (room_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, roomID, userID)
+	return err
+}
+
+func (pr *PostgresRepository) ListRooms(userID int) ([]model.Room, error) {
+	rows, err := pr.db.Query(`
+		SELECT r.id, r.name, r.created_at
+		FROM rooms r
+		JOIN room_members m ON m.room_id = r.id
+		WHERE m.user_id = $1
+		ORDER BY r.name, r.id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rooms := []model.Room{}
+	for rows.Next() {
+		var room model.Room
+		if err := rows.Scan(&room.ID, &room.Name, &room.CreatedAt); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+func (pr *PostgresRepository) ListRoomMembers(roomID int) ([]int, error) {
+	rows, err := pr.db.Query(`SELECT user_id FROM room_members WHERE room_id = $1 ORDER BY user_id`, roomID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []int{}
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		members = append(members, userID)
+	}
+	return members, rows.Err()
+}
+
+func (pr *PostgresRepository) SaveRoomMessage(message *model.Message) error {
+	replyToID := sql.NullInt64{Int64: int64(message.ReplyToID), Valid: message.ReplyToID != 0}
+	err := pr.db.QueryRow(`
+		INSERT INTO room_messages (room_id, from_user_id, text_content, created_at, reply_to_id)
+		SELECT room_id, user_id, $3, $4, $5 FROM room_members WHERE room_id = $1 AND user_id = $2
+		RETURNING id
+	`, message.RoomID, message.FromUserID, message.TextContent, message.Time, replyToID).Scan(&message.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrRoomNotFound
+	}
+	return err
+}
+
+// saveRoomMessage stores a room message whether or not its sender is a
+// member, as imported history may be of people who left
+func saveRoomMessage(db queryer, message *model.Message) error {
+	replyToID := sql.NullInt64{Int64: int64(message.ReplyToID), Valid: message.ReplyToID != 0}
+	return db.QueryRow(`
+		INSERT INTO room_messages (room_id, from_user_id, text_content, created_at, reply_to_id)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, message.RoomID, message.FromUserID, message.TextContent, message.Time, replyToID).Scan(&message.ID)
+}
+
+func (pr *PostgresRepository) ListRoomMessages(roomID int, before time.Time, limit int) ([]model.Message, error) {
+	rows, err := pr.db.Query(`
+		SELECT id, room_id, from_user_id, text_content, created_at, reply_to_id
+		FROM room_messages
+		WHERE room_id = $1 AND created_at < $2
+		ORDER BY created_at DESC, id DESC
+		LIMIT $3
+	`, roomID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []model.Message{}
+	for rows.Next() {
+		var message model.Message
+		var replyToID sql.NullInt64
+		if err := rows.Scan(&message.ID, &message.RoomID, &message.FromUserID, &message.TextContent, &message.Time, &replyToID); err != nil {
+			return nil, err
+		}
+		message.ReplyToID = int(replyToID.Int64)
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
@@ -0,0 +1,124 @@
+package service
+
+import (
+	"cito/server/model"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+func (pr *PostgresRepository) CreateSession(session model.SessionModel, tokenHash string) (int, error) {
+	query := `
+		INSERT INTO sessions (token_hash, user_id, created_at, last_seen_at, rotated_at, expires_at, user_agent, ip_address)
+		VALUES ($1, $2, $3, $3, $3, $4, $5, $6)
+		RETURNING id
+	`
+
+	var sessionID int
+	err := pr.db.QueryRow(query, tokenHash, session.UserID, session.CreatedAt, session.ExpiresAt, session.UserAgent, session.IPAddress).Scan(&sessionID)
+	return sessionID, err
+}
+
+func (pr *PostgresRepository) RenewSession(sessionID int, now time.Time, expiresAt time.Time, seenBefore time.Time) (time.Time, error) {
+	query := `
+		UPDATE sessions SET last_seen_at = $2, expires_at = $3
+		WHERE id = $1 AND last_seen_at < $4
+		RETURNING rotated_at
+	`
+
+	var rotatedAt time.Time
+	err := pr.db.QueryRow(query, sessionID, now, expiresAt, seenBefore).Scan(&rotatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, ErrSessionNotFound
+	}
+	return rotatedAt, err
+}
+
+func (pr *PostgresRepository) RotateSession(sessionID int, tokenHash string, now time.Time) error {
+	query := `
+		UPDATE sessions SET previous_token_hash = token_hash, token_hash = $2, rotated_at = $3
+		WHERE id = $1
+	`
+	_, err := pr.db.Exec(query, sessionID, tokenHash, now)
+	return err
+}
+
+func (pr *PostgresRepository) DeleteSession(sessionID int) error {
+	_, err := pr.db.Exec(`DELETE FROM sessions WHERE id = $1`, sessionID)
+	return err
+}
+
+func (pr *PostgresRepository) ListSessions(userID int, now time.Time) ([]model.SessionModel, error) {
+	query := `
+		SELECT id, user_id, created_at, last_seen_at, expires_at, COALESCE(user_agent, ''), COALESCE(ip_address, '')
+		FROM sessions
+		WHERE user_id = $1 AND expires_at > $2
+		ORDER BY last_seen_at DESC
+	`
+	rows, err := pr.db.Query(query, userID, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []model.SessionModel{}
+	for rows.Next() {
+		var session model.SessionModel
+		err := rows.Scan(
+			&session.ID,
+			&session.UserID,
+			&session.CreatedAt,
+			&session.LastSeenAt,
+			&session.ExpiresAt,
+			&session.UserAgent,
+			&session.IPAddress,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (pr *PostgresRepository) DeleteUserSession(userID int, sessionID int) error {
+	result, err := pr.db.Exec(`DELETE FROM sessions WHERE id = $1 AND user_id = $2`, sessionID, userID)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+func (pr *PostgresRepository) DeleteOtherSessions(userID int, keepSessionID int) ([]int, error) {
+	return pr.deleteSessions(`DELETE FROM sessions WHERE user_id = $1 AND id <> $2 RETURNING id`, userID, keepSessionID)
+}
+
+func (pr *PostgresRepository) DeleteAllSessions(userID int) ([]int, error) {
+	return pr.deleteSessions(`DELETE FROM sessions WHERE user_id = $1 RETURNING id`, userID)
+}
+
+// deleteSessions runs a query deleting sessions and returns their IDs
+func (pr *PostgresRepository) deleteSessions(query string, args ...any) ([]int, error) {
+	rows, err := pr.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deleted := []int{}
+	for rows.Next() {
+		var sessionID int
+		if err := rows.Scan(&sessionID); err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, sessionID)
+	}
+	return deleted, rows.Err()
+}
@@ -0,0 +1,256 @@
+package service
+
+import (
+	"cito/server/model"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrUserNotFound is returned when a user, or the credential used to
+	// look one up, does not exist
+	ErrUserNotFound = errors.New("user not found")
+	// ErrRetentionPolicyNotFound is returned for conversations following the
+	// default retention policy
+	ErrRetentionPolicyNotFound = errors.New("retention policy not found")
+	ErrExportNotFound          = errors.New("export not found")
+	// ErrRoomNotFound is returned for unknown rooms and rooms the user is
+	// not a member of
+	ErrRoomNotFound = errors.New("room not found")
+	// ErrNotPlaceholder is returned when moving an imported user that was
+	// mapped to an account someone signs in with
+	ErrNotPlaceholder = errors.New("imported user is mapped to an account")
+)
+
+var (
+	_ Repository = (*PostgresRepository)(nil)
+	_ Repository = (*SQLiteRepository)(nil)
+	_ Repository = (*MemoryRepository)(nil)
+)
+
+// Repository is the storage of users, sessions and messages
+type Repository interface {
+	UserRepository
+	SessionRepository
+	MessageRepository
+	RoomRepository
+	RetentionRepository
+	ExportRepository
+	ImportRepository
+}
+
+// SealedToken is a provider token as stored on an identity, with the access
+// and refresh tokens encrypted by the keyring
+type SealedToken struct {
+	AccessToken string
+	// RefreshToken is empty when the provider did not issue one
+	RefreshToken string
+	// ExpiresAt is zero for tokens that do not expire
+	ExpiresAt time.Time
+}
+
+// StoredIdentityToken is the sealed token of an identity
+type StoredIdentityToken struct {
+	IdentityID int
+	UserID     int
+	Provider   string
+	// Token is nil once the authorization was revoked
+	Token *SealedToken
+}
+
+// UserRepository stores users and the provider identities they sign in with
+type UserRepository interface {
+	// UpsertIdentity updates the identity with the same provider and subject,
+	// or creates it together with a new user, and returns the user ID. A new
+	// identity with a verified email claims the imported placeholder with
+	// that email instead of creating a user.
+	UpsertIdentity(identity model.Identity, token SealedToken, now time.Time) (int, error)
+	// LinkIdentity attaches identity to userID or updates it when the user
+	// already has it. It returns ErrIdentityConflict when another user owns it.
+	LinkIdentity(userID int, identity model.Identity, token SealedToken, now time.Time) error
+	// FindIdentityToken returns ErrIdentityNotFound unless the identity
+	// belongs to userID
+	FindIdentityToken(userID int, identityID int) (*StoredIdentityToken, error)
+	// IdentityTokensToVerify returns up to limit unrevoked tokens of provider
+	// last checked before checkedBefore, least recently checked first
+	IdentityTokensToVerify(provider string, checkedBefore time.Time, limit int) ([]StoredIdentityToken, error)
+	// UpdateIdentityToken replaces the token of an identity after it was
+	// checked at checkedAt
+	UpdateIdentityToken(identityID int, token SealedToken, checkedAt time.Time) error
+	// MarkIdentityChecked records checkedAt as the last check of an
+	// identity's token without changing the token
+	MarkIdentityChecked(identityID int, checkedAt time.Time) error
+	// ResealTokens passes every stored access and refresh token and TOTP
+	// secret to reseal and stores the result where it reports a change. It
+	// returns how many values were rewritten.
+	ResealTokens(reseal func(stored string) (string, bool, error)) (int, error)
+	// MarkIdentityRevoked drops the token of an identity and records the
+	// revocation. It returns ErrIdentityNotFound when the identity is unknown
+	// or already revoked.
+	MarkIdentityRevoked(identityID int, now time.Time) (*model.Identity, error)
+	// ListIdentities returns the identities of userID, oldest first
+	ListIdentities(userID int) ([]model.Identity, error)
+	// UnlinkIdentity removes an identity of userID. It returns
+	// ErrIdentityNotFound or ErrLastIdentity and removes nothing when the
+	// identity is not the user's or the only one left.
+	UnlinkIdentity(userID int, identityID int) error
+	// FindUserByID returns ErrUserNotFound for unknown users
+	FindUserByID(userID int) (*model.UserModel, error)
+	// FindUserByEmail returns the oldest user with an identity whose email
+	// is email, compared case insensitively, and verified by its provider or,
+	// when verified is false, not. It returns ErrUserNotFound otherwise.
+	FindUserByEmail(email string, verified bool) (*model.UserModel, error)
+	// CreateUser stores a user without identities, who cannot sign in, and
+	// returns its ID
+	CreateUser(username string, email string) (int, error)
+	// DeleteUser removes a user with everything stored about them and the
+	// messages they sent. Messages others sent them are kept, addressed to a
+	// new user named placeholder. It returns ErrUserNotFound for unknown
+	// users.
+	DeleteUser(userID int, placeholder string) error
+	// AnonymizeUser renames a user to username and removes their email,
+	// identities, sessions, tokens, second factor, workspace and room
+	// memberships and exports, leaving their messages. It returns ErrUserNotFound for unknown
+	// users.
+	AnonymizeUser(userID int, username string) error
+	// FindUserBySession returns the user of the session holding tokenHash
+	// and unexpired at now, with SessionID set. A previous token hash matches
+	// as long as the session was rotated after rotatedAfter.
+	FindUserBySession(tokenHash string, now time.Time, rotatedAfter time.Time) (*model.UserModel, error)
+}
+
+// SessionRepository stores browser sessions by the hash of their token
+type SessionRepository interface {
+	// CreateSession stores a session and returns its ID. CreatedAt also
+	// counts as the first use and rotation.
+	CreateSession(session model.SessionModel, tokenHash string) (int, error)
+	// RenewSession moves the expiry of a session last seen before seenBefore
+	// and returns when its token was last rotated. It returns
+	// ErrSessionNotFound when no session was renewed.
+	RenewSession(sessionID int, now time.Time, expiresAt time.Time, seenBefore time.Time) (time.Time, error)
+	// RotateSession replaces the token hash of a session, the replaced hash
+	// is kept as the previous one
+	RotateSession(sessionID int, tokenHash string, now time.Time) error
+	DeleteSession(sessionID int) error
+	// ListSessions returns the sessions of userID unexpired at now, most
+	// recently used first
+	ListSessions(userID int, now time.Time) ([]model.SessionModel, error)
+	// DeleteUserSession returns ErrSessionNotFound unless the session
+	// belongs to userID
+	DeleteUserSession(userID int, sessionID int) error
+	// DeleteOtherSessions deletes the sessions of userID except
+	// keepSessionID and returns the IDs of the deleted ones
+	DeleteOtherSessions(userID int, keepSessionID int) ([]int, error)
+	// DeleteAllSessions deletes every session of userID and returns the IDs
+	// of the deleted ones
+	DeleteAllSessions(userID int) ([]int, error)
+}
+
+// MessageRepository stores the messages exchanged between users
+type MessageRepository interface {
+	// SaveMessage stores message and sets its ID
+	SaveMessage(message *model.Message) error
+	// ListConversation returns up to limit messages between two users sent
+	// before before, newest first
+	ListConversation(userID int, otherUserID int, before time.Time, limit int) ([]model.Message, error)
+	// ListUserMessages returns up to limit messages sent or received by
+	// userID with an ID above afterID, in ID order, archived ones included
+	ListUserMessages(userID int, afterID int, limit int) ([]model.Message, error)
+	// CountUserMessages returns how many messages userID sent or received,
+	// archived ones included
+	CountUserMessages(userID int) (int, error)
+}
+
+// RoomRepository stores rooms, their members and the messages sent to them
+type RoomRepository interface {
+	// CreateRoom stores room and sets its ID
+	CreateRoom(room *model.Room) error
+	// AddRoomMember adds userID to a room unless they are a member already.
+	// It returns ErrRoomNotFound for unknown rooms.
+	AddRoomMember(roomID int, userID int) error
+	// ListRooms returns the rooms userID is a member of, by name
+	ListRooms(userID int) ([]model.Room, error)
+	// ListRoomMembers returns the IDs of the members of a room
+	ListRoomMembers(roomID int) ([]int, error)
+	// SaveRoomMessage stores a message sent to message.RoomID and sets its
+	// ID. It returns ErrRoomNotFound unless the sender is a member.
+	SaveRoomMessage(message *model.Message) error
+	// ListRoomMessages returns up to limit messages of a room sent before
+	// before, newest first
+	ListRoomMessages(roomID int, before time.Time, limit int) ([]model.Message, error)
+}
+
+// RetentionRepository stores message retention policies and removes the
+// messages they expire
+type RetentionRepository interface {
+	// SetRetentionPolicy gives a conversation its own policy
+	SetRetentionPolicy(conversation model.Conversation, policy model.RetentionPolicy, now time.Time) error
+	// DeleteRetentionPolicy returns the conversation to the default policy.
+	// It returns ErrRetentionPolicyNotFound when it already follows it.
+	DeleteRetentionPolicy(conversation model.Conversation) error
+	// RetentionPolicies returns the conversations with their own policy
+	RetentionPolicies() (map[model.Conversation]model.RetentionPolicy, error)
+	// ListConversations returns the conversations with stored messages
+	ListConversations() ([]model.Conversation, error)
+	// PurgeMessages removes up to limit messages sent before before, in the
+	// order they were stored, and returns how many it removed. Archived messages are copied to
+	// the archive first. Without a conversation it only purges conversations
+	// following the default policy.
+	PurgeMessages(conversation *model.Conversation, before time.Time, archive bool, limit int, now time.Time) (int, error)
+	// SavePurgeRun stores run and sets its ID
+	SavePurgeRun(run *model.PurgeRun) error
+	// ListPurgeRuns returns up to limit runs, latest first
+	ListPurgeRuns(limit int) ([]model.PurgeRun, error)
+}
+
+// ExportRepository stores conversation export jobs
+type ExportRepository interface {
+	// CreateExport stores export and sets its ID. It returns
+	// ErrExportInProgress when the user has a pending or running export.
+	CreateExport(export *model.Export) error
+	// FindExport returns ErrExportNotFound unless the export belongs to
+	// userID
+	FindExport(userID int, exportID int) (*model.Export, error)
+	// ListExports returns the exports of userID, latest first
+	ListExports(userID int) ([]model.Export, error)
+	// UnfinishedExports returns the pending and running exports of every
+	// user, oldest first
+	UnfinishedExports() ([]model.Export, error)
+	// UpdateExport stores the status, progress and error of export
+	UpdateExport(export model.Export) error
+	// DeleteExportsBefore deletes the exports created before before and
+	// returns them
+	DeleteExportsBefore(before time.Time) ([]model.Export, error)
+}
+
+// ImportRepository remembers what was brought in from other chat services,
+// by source and the ID there, so imports can run again without duplicates
+type ImportRepository interface {
+	// FindImportedUser returns the user an external user was mapped to, or
+	// ErrUserNotFound
+	FindImportedUser(source string, externalID string) (int, error)
+	// SaveImportedUser maps an external user to userID. suggestedUserID, if
+	// not 0, is an existing user who may be the same person.
+	SaveImportedUser(source string, externalID string, userID int, suggestedUserID int) error
+	// ListSuggestedImportedUsers returns the imported users of source with a
+	// suggested user an admin has yet to confirm
+	ListSuggestedImportedUsers(source string) ([]model.ImportedUser, error)
+	// ConfirmImportedUser maps an external user to userID, or to its
+	// suggested user when userID is 0. The messages and rooms of the
+	// placeholder it was mapped to move to that user and the placeholder is
+	// deleted. It returns ErrUserNotFound when the external user has no
+	// suggested user or userID is unknown, and ErrNotPlaceholder when the
+	// external user is mapped to an account someone signs in with.
+	ConfirmImportedUser(source string, externalID string, userID int) (*model.ImportedUser, error)
+	// FindImportedRoom returns the room an external conversation was
+	// imported into, or ErrRoomNotFound
+	FindImportedRoom(source string, externalID string) (int, error)
+	// SaveImportedRoom maps an external conversation to roomID
+	SaveImportedRoom(source string, externalID string, roomID int) error
+	// SaveImportedMessage stores message unless it was imported before and
+	// sets its ID either way. It reports whether the message was stored.
+	// Messages with a RoomID go to that room whether or not their sender is
+	// still a member. A message purged or deleted since it was imported
+	// stays imported, its ID is then 0.
+	SaveImportedMessage(source string, externalID string, message *model.Message) (bool, error)
+}
@@ -0,0 +1,217 @@
+package service
+
+import (
+	"cito/server/logging"
+	"cito/server/model"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+const (
+	// purgeBatchSize limits the messages removed in one transaction
+	purgeBatchSize = 500
+	// purgeRunsShown is how many purge runs admins see
+	purgeRunsShown = 50
+)
+
+var (
+	ErrNotAdmin         = errors.New("not a server admin")
+	ErrInvalidRetention = errors.New("invalid retention policy")
+)
+
+// RetentionService enforces how long messages are kept. A default policy
+// applies to every conversation unless admins give one its own. Expired
+// messages are removed in the background, in batches, and every round is
+// recorded as a purge run.
+type RetentionService struct {
+	retention     RetentionRepository
+	userService   *UserService
+	defaultPolicy model.RetentionPolicy
+	admins        map[int]bool
+}
+
+// NewRetentionService returns a service applying defaultPolicy. adminIDs are
+// the users allowed to see and change policies.
+func NewRetentionService(retention RetentionRepository, userService *UserService, defaultPolicy model.RetentionPolicy, adminIDs []int) *RetentionService {
+	admins := make(map[int]bool, len(adminIDs))
+	for _, id := range adminIDs {
+		admins[id] = true
+	}
+	return &RetentionService{retention: retention, userService: userService, defaultPolicy: defaultPolicy, admins: admins}
+}
+
+// requireAdmin checks that userID is a server admin
+func (rs *RetentionService) requireAdmin(userID int) error {
+	if !rs.admins[userID] {
+		return ErrNotAdmin
+	}
+	return nil
+}
+
+// DefaultPolicy returns the policy of conversations without their own
+func (rs *RetentionService) DefaultPolicy(adminID int) (model.RetentionPolicy, error) {
+	if err := rs.requireAdmin(adminID); err != nil {
+		return model.RetentionPolicy{}, err
+	}
+	return rs.defaultPolicy, nil
+}
+
+// ListConversationPolicies returns the policy in effect for every
+// conversation with messages or a policy of its own
+func (rs *RetentionService) ListConversationPolicies(adminID int) ([]model.ConversationRetention, error) {
+	if err := rs.requireAdmin(adminID); err != nil {
+		return nil, err
+	}
+	policies, err := rs.retention.RetentionPolicies()
+	if err != nil {
+		return nil, err
+	}
+	conversations, err := rs.retention.ListConversations()
+	if err != nil {
+		return nil, err
+	}
+
+	effective := []model.ConversationRetention{}
+	for _, conversation := range conversations {
+		policy, override := policies[conversation]
+		if !override {
+			policy = rs.defaultPolicy
+		}
+		effective = append(effective, model.ConversationRetention{Conversation: conversation, Policy: policy, Override: override})
+		delete(policies, conversation)
+	}
+	// Policies set before the first message was sent
+	for conversation, policy := range policies {
+		effective = append(effective, model.ConversationRetention{Conversation: conversation, Policy: policy, Override: true})
+	}
+	sort.Slice(effective, func(i, j int) bool {
+		if effective[i].UserID != effective[j].UserID {
+			return effective[i].UserID < effective[j].UserID
+		}
+		return effective[i].OtherUserID < effective[j].OtherUserID
+	})
+	return effective, nil
+}
+
+// SetConversationPolicy gives the conversation of two users its own policy
+func (rs *RetentionService) SetConversationPolicy(ctx context.Context, adminID int, conversation model.Conversation, policy model.RetentionPolicy) error {
+	if err := rs.requireAdmin(adminID); err != nil {
+		return err
+	}
+	if policy.MaxAge < 0 {
+		return fmt.Errorf("%w: max age must not be negative", ErrInvalidRetention)
+	}
+	conversation = model.NewConversation(conversation.UserID, conversation.OtherUserID)
+	for _, userID := range []int{conversation.UserID, conversation.OtherUserID} {
+		if _, err := rs.userService.FindUserByID(ctx, userID); err != nil {
+			return err
+		}
+	}
+	if err := rs.retention.SetRetentionPolicy(conversation, policy, time.Now()); err != nil {
+		return err
+	}
+
+	logging.FromContext(ctx).Info("Conversation retention policy set", "user_id", conversation.UserID, "other_user_id", conversation.OtherUserID,
+		"max_age", model.FormatMaxAge(policy.MaxAge), "archive", policy.Archive, "admin_id", adminID)
+	return nil
+}
+
+// ClearConversationPolicy returns a conversation to the default policy
+func (rs *RetentionService) ClearConversationPolicy(ctx context.Context, adminID int, conversation model.Conversation) error {
+	if err := rs.requireAdmin(adminID); err != nil {
+		return err
+	}
+	conversation = model.NewConversation(conversation.UserID, conversation.OtherUserID)
+	if err := rs.retention.DeleteRetentionPolicy(conversation); err != nil {
+		return err
+	}
+
+	logging.FromContext(ctx).Info("Conversation retention policy cleared", "user_id", conversation.UserID, "other_user_id", conversation.OtherUserID, "admin_id", adminID)
+	return nil
+}
+
+// ListPurgeRuns returns the latest purge runs, latest first
+func (rs *RetentionService) ListPurgeRuns(adminID int) ([]model.PurgeRun, error) {
+	if err := rs.requireAdmin(adminID); err != nil {
+		return nil, err
+	}
+	return rs.retention.ListPurgeRuns(purgeRunsShown)
+}
+
+// Purge removes the messages every policy expired and records the round
+func (rs *RetentionService) Purge(ctx context.Context) (*model.PurgeRun, error) {
+	run := &model.PurgeRun{StartedAt: time.Now()}
+	err := rs.purge(ctx, run)
+	if err != nil {
+		run.Error = err.Error()
+	}
+	run.FinishedAt = time.Now()
+	if saveErr := rs.retention.SavePurgeRun(run); saveErr != nil {
+		return run, errors.Join(err, saveErr)
+	}
+	return run, err
+}
+
+func (rs *RetentionService) purge(ctx context.Context, run *model.PurgeRun) error {
+	policies, err := rs.retention.RetentionPolicies()
+	if err != nil {
+		return err
+	}
+	if err := rs.purgeExpired(ctx, run, nil, rs.defaultPolicy); err != nil {
+		return err
+	}
+	for conversation, policy := range policies {
+		if err := rs.purgeExpired(ctx, run, &conversation, policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// purgeExpired removes the messages policy expired in batches, in one
+// conversation or, without one, in conversations following the default
+func (rs *RetentionService) purgeExpired(ctx context.Context, run *model.PurgeRun, conversation *model.Conversation, policy model.RetentionPolicy) error {
+	if policy.MaxAge == 0 {
+		return nil
+	}
+	before := run.StartedAt.Add(-policy.MaxAge)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		purged, err := rs.retention.PurgeMessages(conversation, before, policy.Archive, purgeBatchSize, time.Now())
+		if err != nil {
+			return err
+		}
+		if policy.Archive {
+			run.Archived += purged
+		} else {
+			run.Deleted += purged
+		}
+		if purged < purgeBatchSize {
+			return nil
+		}
+	}
+}
+
+// Run purges expired messages every interval until ctx is done
+func (rs *RetentionService) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if run, err := rs.Purge(ctx); err != nil {
+			slog.Error("Message purge failed", "error", err)
+		} else if run.Deleted+run.Archived > 0 {
+			slog.Info("Purged expired messages", "deleted", run.Deleted, "archived", run.Archived)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
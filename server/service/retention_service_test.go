@@ -0,0 +1,111 @@
+package service
+
+import (
+	"cito/server/model"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"cito/server/testutil"
+)
+
+// newTestRetentionService returns a service with admin user 1 and three
+// users, 1 to 3
+func newTestRetentionService(t *testing.T, defaultPolicy model.RetentionPolicy) (*RetentionService, *MemoryRepository) {
+	mr := NewMemoryRepository()
+	for i := 1; i <= 3; i++ {
+		_, err := mr.UpsertIdentity(model.GitHubUser{ID: int64(i), Login: "user"}.Identity(), SealedToken{AccessToken: "token"}, time.Now())
+		require.NoError(t, err)
+	}
+	return NewRetentionService(mr, NewUserService(mr, testutil.NewTestKeyring(t)), defaultPolicy, []int{1}), mr
+}
+
+// sendMessages stores count messages from one user to another, sent age ago
+func sendMessages(t *testing.T, mr *MemoryRepository, from int, to int, age time.Duration, count int) {
+	for i := 0; i < count; i++ {
+		require.NoError(t, mr.SaveMessage(&model.Message{FromUserID: from, ToUserId: to, TextContent: "hi", Time: time.Now().Add(-age)}))
+	}
+}
+
+func TestRetentionService_Purge(t *testing.T) {
+	rs, mr := newTestRetentionService(t, model.RetentionPolicy{MaxAge: 30 * 24 * time.Hour})
+	sendMessages(t, mr, 1, 2, 40*24*time.Hour, purgeBatchSize+1)
+	sendMessages(t, mr, 2, 1, time.Hour, 1)
+	// 1 and 3 keep their messages for a week and archive them
+	sendMessages(t, mr, 3, 1, 10*24*time.Hour, 2)
+	sendMessages(t, mr, 1, 3, time.Hour, 1)
+	require.NoError(t, rs.SetConversationPolicy(context.Background(), 1, model.Conversation{UserID: 3, OtherUserID: 1}, model.RetentionPolicy{MaxAge: 7 * 24 * time.Hour, Archive: true}))
+
+	run, err := rs.Purge(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, purgeBatchSize+1, run.Deleted, "expired messages are deleted over several batches")
+	assert.Equal(t, 2, run.Archived)
+	assert.Len(t, mr.archived, 2)
+
+	recent, err := mr.ListConversation(1, 2, time.Now(), 10)
+	require.NoError(t, err)
+	assert.Len(t, recent, 1, "recent messages are kept")
+	recent, err = mr.ListConversation(1, 3, time.Now(), 10)
+	require.NoError(t, err)
+	assert.Len(t, recent, 1)
+
+	runs, err := rs.ListPurgeRuns(1)
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	assert.Equal(t, run.ID, runs[0].ID)
+}
+
+func TestRetentionService_PurgeKeepsForever(t *testing.T) {
+	rs, mr := newTestRetentionService(t, model.RetentionPolicy{})
+	sendMessages(t, mr, 1, 2, 400*24*time.Hour, 3)
+
+	run, err := rs.Purge(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, run.Deleted+run.Archived)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rs.defaultPolicy = model.RetentionPolicy{MaxAge: time.Hour}
+	run, err = rs.Purge(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NotEmpty(t, run.Error, "failed runs are recorded")
+}
+
+func TestRetentionService_ListConversationPolicies(t *testing.T) {
+	defaultPolicy := model.RetentionPolicy{MaxAge: 90 * 24 * time.Hour}
+	rs, mr := newTestRetentionService(t, defaultPolicy)
+	sendMessages(t, mr, 2, 1, time.Hour, 1)
+	sendMessages(t, mr, 1, 3, time.Hour, 1)
+	override := model.RetentionPolicy{MaxAge: 24 * time.Hour}
+	require.NoError(t, rs.SetConversationPolicy(context.Background(), 1, model.Conversation{UserID: 1, OtherUserID: 3}, override))
+	require.NoError(t, rs.SetConversationPolicy(context.Background(), 1, model.Conversation{UserID: 2, OtherUserID: 3}, override))
+
+	policies, err := rs.ListConversationPolicies(1)
+	require.NoError(t, err)
+	assert.Equal(t, []model.ConversationRetention{
+		{Conversation: model.Conversation{UserID: 1, OtherUserID: 2}, Policy: defaultPolicy},
+		{Conversation: model.Conversation{UserID: 1, OtherUserID: 3}, Policy: override, Override: true},
+		{Conversation: model.Conversation{UserID: 2, OtherUserID: 3}, Policy: override, Override: true},
+	}, policies)
+
+	require.NoError(t, rs.ClearConversationPolicy(context.Background(), 1, model.Conversation{UserID: 3, OtherUserID: 1}))
+	assert.ErrorIs(t, rs.ClearConversationPolicy(context.Background(), 1, model.Conversation{UserID: 1, OtherUserID: 3}), ErrRetentionPolicyNotFound)
+}
+
+func TestRetentionService_RequiresAdmin(t *testing.T) {
+	rs, _ := newTestRetentionService(t, model.RetentionPolicy{})
+	conversation := model.Conversation{UserID: 1, OtherUserID: 2}
+
+	_, err := rs.ListConversationPolicies(2)
+	assert.ErrorIs(t, err, ErrNotAdmin)
+	assert.ErrorIs(t, rs.SetConversationPolicy(context.Background(), 2, conversation, model.RetentionPolicy{}), ErrNotAdmin)
+	assert.ErrorIs(t, rs.ClearConversationPolicy(context.Background(), 2, conversation), ErrNotAdmin)
+	_, err = rs.ListPurgeRuns(2)
+	assert.ErrorIs(t, err, ErrNotAdmin)
+
+	assert.ErrorIs(t, rs.SetConversationPolicy(context.Background(), 1, model.Conversation{UserID: 1, OtherUserID: 9}, model.RetentionPolicy{}), ErrUserNotFound)
+	assert.ErrorIs(t, rs.SetConversationPolicy(context.Background(), 1, conversation, model.RetentionPolicy{MaxAge: -time.Hour}), ErrInvalidRetention)
+}
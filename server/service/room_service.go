@@ -0,0 +1,38 @@
+package service
+
+import (
+	"cito/server/model"
+	"slices"
+	"time"
+)
+
+// RoomMessagePageSize is how many room messages ListMessages returns at most
+const RoomMessagePageSize = 100
+
+// RoomService gives room members their rooms and the history of each
+type RoomService struct {
+	rooms RoomRepository
+}
+
+func NewRoomService(rooms RoomRepository) *RoomService {
+	return &RoomService{rooms: rooms}
+}
+
+// ListRooms returns the rooms userID is a member of
+func (rs *RoomService) ListRooms(userID int) ([]model.Room, error) {
+	return rs.rooms.ListRooms(userID)
+}
+
+// ListMessages returns up to RoomMessagePageSize messages of a room sent
+// before before, newest first. It returns ErrRoomNotFound unless userID is a
+// member.
+func (rs *RoomService) ListMessages(userID int, roomID int, before time.Time) ([]model.Message, error) {
+	members, err := rs.rooms.ListRoomMembers(roomID)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(members, userID) {
+		return nil, ErrRoomNotFound
+	}
+	return rs.rooms.ListRoomMessages(roomID, before, RoomMessagePageSize)
+}
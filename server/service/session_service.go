@@ -0,0 +1,175 @@
+package service
+
+import (
+	"cito/server/model"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// ErrSessionNotFound is returned when a session does not exist or belongs to
+// another user
+var ErrSessionNotFound = errors.New("session not found")
+
+const (
+	// SessionTTL is how long a session stays valid without activity, unless
+	// configured otherwise
+	SessionTTL = 7 * 24 * time.Hour
+	// SessionRotateInterval is how often an active session gets a new token,
+	// unless configured otherwise
+	SessionRotateInterval = 24 * time.Hour
+	// sessionRenewInterval throttles the sliding expiry writes
+	sessionRenewInterval = time.Minute
+	// sessionRotationGrace keeps the previous token usable for requests
+	// that were already in flight when the token was rotated
+	sessionRotationGrace = time.Minute
+)
+
+type SessionService struct {
+	sessions       SessionRepository
+	ttl            time.Duration
+	rotateInterval time.Duration
+}
+
+func NewSessionService(sessions SessionRepository) *SessionService {
+	return &SessionService{sessions: sessions, ttl: SessionTTL, rotateInterval: SessionRotateInterval}
+}
+
+// SetLifetimes changes how long sessions stay valid without activity and how
+// often their tokens are rotated
+func (ss *SessionService) SetLifetimes(ttl time.Duration, rotateInterval time.Duration) {
+	ss.ttl = ttl
+	ss.rotateInterval = rotateInterval
+}
+
+// TTL is how long a session stays valid without activity
+func (ss *SessionService) TTL() time.Duration {
+	return ss.ttl
+}
+
+// generateSessionToken creates a random hex session token
+func generateSessionToken() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// hashToken returns the SHA-256 hex digest stored in place of a session or
+// personal access token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession opens a new session for userID and returns its token.
+// Existing sessions of the user are left untouched.
+func (ss *SessionService) CreateSession(userID int, userAgent string, ipAddress string) (string, error) {
+	sessionToken, err := generateSessionToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	sessionID, err := ss.sessions.CreateSession(model.SessionModel{
+		UserID:    userID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ss.ttl),
+		UserAgent: userAgent,
+		IPAddress: ipAddress,
+	}, hashToken(sessionToken))
+	if err != nil {
+		return "", err
+	}
+
+	slog.Info("Created session", "user_id", userID, "session_id", sessionID)
+	return sessionToken, nil
+}
+
+// RenewSession slides the expiry of an active session and rotates its token
+// once it is older than the rotate interval. It returns the token the client
+// should hold from now on, or an empty string if nothing changed.
+func (ss *SessionService) RenewSession(sessionID int, sessionToken string) (string, error) {
+	now := time.Now()
+	rotatedAt, err := ss.sessions.RenewSession(sessionID, now, now.Add(ss.ttl), now.Add(-sessionRenewInterval))
+	if errors.Is(err, ErrSessionNotFound) {
+		// Renewed recently
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if now.Sub(rotatedAt) < ss.rotateInterval {
+		return sessionToken, nil
+	}
+	return ss.rotateSession(sessionID, now)
+}
+
+// rotateSession replaces the token of a session, keeping the old one valid
+// for sessionRotationGrace
+func (ss *SessionService) rotateSession(sessionID int, now time.Time) (string, error) {
+	sessionToken, err := generateSessionToken()
+	if err != nil {
+		return "", err
+	}
+	if err := ss.sessions.RotateSession(sessionID, hashToken(sessionToken), now); err != nil {
+		return "", err
+	}
+
+	slog.Info("Rotated session token", "session_id", sessionID)
+	return sessionToken, nil
+}
+
+// DeleteSession ends a session, its token stops working immediately
+func (ss *SessionService) DeleteSession(sessionID int) error {
+	if err := ss.sessions.DeleteSession(sessionID); err != nil {
+		return err
+	}
+
+	slog.Info("Deleted session", "session_id", sessionID)
+	return nil
+}
+
+// ListSessions returns the unexpired sessions of a user, most recently used first
+func (ss *SessionService) ListSessions(userID int) ([]model.SessionModel, error) {
+	return ss.sessions.ListSessions(userID, time.Now())
+}
+
+// RevokeSession deletes a session of userID. It returns ErrSessionNotFound if
+// the session does not belong to the user.
+func (ss *SessionService) RevokeSession(userID int, sessionID int) error {
+	if err := ss.sessions.DeleteUserSession(userID, sessionID); err != nil {
+		return err
+	}
+
+	slog.Info("Revoked session", "user_id", userID, "session_id", sessionID)
+	return nil
+}
+
+// RevokeOtherSessions deletes every session of userID except keepSessionID
+// and returns the IDs of the deleted sessions
+func (ss *SessionService) RevokeOtherSessions(userID int, keepSessionID int) ([]int, error) {
+	revoked, err := ss.sessions.DeleteOtherSessions(userID, keepSessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("Revoked other sessions", "user_id", userID, "count", len(revoked))
+	return revoked, nil
+}
+
+// RevokeAllSessions deletes every session of userID, signing them out
+// everywhere, and returns the IDs of the deleted sessions
+func (ss *SessionService) RevokeAllSessions(userID int) ([]int, error) {
+	revoked, err := ss.sessions.DeleteAllSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("Revoked all sessions", "user_id", userID, "count", len(revoked))
+	return revoked, nil
+}
@@ -0,0 +1,186 @@
+package service
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"cito/server/testutil"
+)
+
+func TestGenerateSessionToken(t *testing.T) {
+	// Test that session token is generated
+	token, err := generateSessionToken()
+	require.NoError(t, err, "should generate token without error")
+	assert.NotEmpty(t, token, "token should not be empty")
+	assert.Equal(t, 64, len(token), "token should be 64 characters (32 bytes hex encoded)")
+
+	// Test that tokens are unique
+	token2, err := generateSessionToken()
+	require.NoError(t, err)
+	assert.NotEqual(t, token, token2, "consecutive tokens should be unique")
+}
+
+func TestHashToken(t *testing.T) {
+	hash := hashToken("token")
+	assert.Equal(t, 64, len(hash), "hash should be hex encoded SHA-256")
+	assert.NotEqual(t, "token", hash)
+	assert.Equal(t, hash, hashToken("token"), "hash should be deterministic")
+	assert.NotEqual(t, hash, hashToken("other"))
+}
+
+func TestSessionService_CreateSession(t *testing.T) {
+	tests := []struct {
+		name      string
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   bool
+	}{
+		{
+			name: "stores hashed token and device details",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`INSERT INTO sessions`).
+					WithArgs(sqlmock.AnyArg(), 7, sqlmock.AnyArg(), sqlmock.AnyArg(), "curl/8.0", "10.0.0.1").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+			},
+			wantErr: false,
+		},
+		{
+			name: "handles database error",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`INSERT INTO sessions`).
+					WillReturnError(sql.ErrConnDone)
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.SetupMockDB(t)
+			defer cleanup()
+
+			tt.mockSetup(mock)
+
+			ss := NewSessionService(NewPostgresRepository(db))
+			token, err := ss.CreateSession(7, "curl/8.0", "10.0.0.1")
+
+			if tt.wantErr {
+				require.Error(t, err)
+				assert.Empty(t, token)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, 64, len(token), "should return the raw session token")
+			}
+
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestSessionService_RenewSession(t *testing.T) {
+	tests := []struct {
+		name      string
+		mockSetup func(sqlmock.Sqlmock)
+		wantToken string
+		rotated   bool
+		wantErr   bool
+	}{
+		{
+			name: "recently renewed session is left alone",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`UPDATE sessions SET last_seen_at`).
+					WithArgs(3, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnError(sql.ErrNoRows)
+			},
+			wantToken: "",
+		},
+		{
+			name: "slides expiry and keeps token",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`UPDATE sessions SET last_seen_at`).
+					WithArgs(3, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"rotated_at"}).AddRow(time.Now().Add(-time.Hour)))
+			},
+			wantToken: "current_token",
+		},
+		{
+			name: "rotates token of an old session",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`UPDATE sessions SET last_seen_at`).
+					WithArgs(3, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"rotated_at"}).AddRow(time.Now().Add(-SessionRotateInterval - time.Hour)))
+				mock.ExpectExec(`UPDATE sessions SET previous_token_hash = token_hash`).
+					WithArgs(3, sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			rotated: true,
+		},
+		{
+			name: "handles database error",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`UPDATE sessions SET last_seen_at`).
+					WillReturnError(sql.ErrConnDone)
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.SetupMockDB(t)
+			defer cleanup()
+
+			tt.mockSetup(mock)
+
+			ss := NewSessionService(NewPostgresRepository(db))
+			token, err := ss.RenewSession(3, "current_token")
+
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				if tt.rotated {
+					assert.Equal(t, 64, len(token), "should return a fresh token")
+					assert.NotEqual(t, "current_token", token)
+				} else {
+					assert.Equal(t, tt.wantToken, token)
+				}
+			}
+
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestSessionService_DeleteSession(t *testing.T) {
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	mock.ExpectExec(`DELETE FROM sessions WHERE id`).
+		WithArgs(5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	ss := NewSessionService(NewPostgresRepository(db))
+	require.NoError(t, ss.DeleteSession(5))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestSessionService_SetLifetimes(t *testing.T) {
+	mr := NewMemoryRepository()
+	ss := NewSessionService(mr)
+	ss.SetLifetimes(time.Hour, time.Minute)
+	assert.Equal(t, time.Hour, ss.TTL())
+
+	userID, err := mr.CreateUser("alice", "")
+	require.NoError(t, err)
+	_, err = ss.CreateSession(userID, "browser", "127.0.0.1")
+	require.NoError(t, err)
+	sessions, err := ss.ListSessions(userID)
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), sessions[0].ExpiresAt, time.Minute)
+}
@@ -0,0 +1,414 @@
+package service
+
+import (
+	"archive/zip"
+	"cito/server/model"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SlackSource is the import source of Slack workspace exports
+const SlackSource = "slack"
+
+// slackMessageTypes are the message subtypes carrying something people
+// wrote, joins, topic changes and the like are left out
+var slackMessageTypes = map[string]bool{"": true, "thread_broadcast": true, "me_message": true, "file_share": true}
+
+// slackMarkup matches Slack's <...> mentions and links
+var slackMarkup = regexp.MustCompile(`<([^<>]*)>`)
+
+// SlackImport counts what an import brought in
+type SlackImport struct {
+	// UsersMatched were mapped to existing users by verified email
+	UsersMatched int
+	// UsersCreated got placeholder accounts
+	UsersCreated int
+	// UsersToConfirm are placeholders sharing an unverified email with an
+	// existing user, an admin confirms whether they are the same person
+	UsersToConfirm int
+	// Rooms are the channels and group conversations imported as rooms
+	Rooms    int
+	Messages int
+	// Duplicates were brought in by an earlier import
+	Duplicates int
+	// Skipped are messages of bots, of unknown users or without content
+	Skipped int
+	// SkippedConversations are notes to self, which have nobody to go to
+	SkippedConversations int
+}
+
+// SlackImporter brings a Slack workspace export into cito. Channels and
+// group conversations become rooms with their members, direct conversations
+// stay direct. Slack users are mapped to the cito user with the same
+// verified email, or to a placeholder account, and thread replies point at
+// the first message of their thread. Imports can be run again: what was
+// imported is skipped.
+type SlackImporter struct {
+	users   UserRepository
+	rooms   RoomRepository
+	imports ImportRepository
+}
+
+func NewSlackImporter(users UserRepository, rooms RoomRepository, imports ImportRepository) *SlackImporter {
+	return &SlackImporter{users: users, rooms: rooms, imports: imports}
+}
+
+type slackUser struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	IsBot   bool   `json:"is_bot"`
+	Profile struct {
+		Email string `json:"email"`
+	} `json:"profile"`
+}
+
+type slackConversation struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Created int64    `json:"created"`
+	Members []string `json:"members"`
+}
+
+type slackMessage struct {
+	Subtype  string `json:"subtype"`
+	User     string `json:"user"`
+	Text     string `json:"text"`
+	TS       string `json:"ts"`
+	ThreadTS string `json:"thread_ts"`
+	Files    []struct {
+		Name string `json:"name"`
+	} `json:"files"`
+}
+
+// slackImport is the state of one import
+type slackImport struct {
+	result   SlackImport
+	archive  *zip.Reader
+	users    map[string]slackUser
+	userIDs  map[string]int
+	messages map[string]int
+}
+
+// Import reads a Slack export archive
+func (si *SlackImporter) Import(ctx context.Context, archive *zip.Reader) (*SlackImport, error) {
+	state := &slackImport{archive: archive, users: map[string]slackUser{}, userIDs: map[string]int{}, messages: map[string]int{}}
+
+	var users []slackUser
+	if err := readSlackFile(archive, "users.json", &users); err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		state.users[user.ID] = user
+	}
+	// Public channels, private channels and group conversations; only
+	// exports made with access to private conversations have the latter
+	for _, name := range []string{"channels.json", "groups.json", "mpims.json"} {
+		var conversations []slackConversation
+		if err := readSlackFile(archive, name, &conversations); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		for _, conversation := range conversations {
+			if err := si.importRoom(ctx, state, conversation); err != nil {
+				return &state.result, fmt.Errorf("importing conversation %s: %w", conversation.ID, err)
+			}
+		}
+	}
+	// Only exports made with access to direct messages have them
+	var dms []slackConversation
+	if err := readSlackFile(archive, "dms.json", &dms); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	for _, dm := range dms {
+		if err := si.importDM(ctx, state, dm); err != nil {
+			return &state.result, fmt.Errorf("importing conversation %s: %w", dm.ID, err)
+		}
+	}
+
+	slog.Info("Imported Slack export", "rooms", state.result.Rooms, "messages", state.result.Messages, "users_matched", state.result.UsersMatched,
+		"users_created", state.result.UsersCreated, "users_to_confirm", state.result.UsersToConfirm,
+		"skipped_conversations", state.result.SkippedConversations)
+	return &state.result, nil
+}
+
+// importRoom imports a channel or group conversation into the room it was
+// imported into before, or a new one, and adds the members it has in Slack
+func (si *SlackImporter) importRoom(ctx context.Context, state *slackImport, conversation slackConversation) error {
+	name := conversation.Name
+	if name == "" {
+		name = conversation.ID
+	}
+	roomID, err := si.imports.FindImportedRoom(SlackSource, conversation.ID)
+	if errors.Is(err, ErrRoomNotFound) {
+		room := model.Room{Name: name, CreatedAt: time.Unix(conversation.Created, 0)}
+		if err := si.rooms.CreateRoom(&room); err != nil {
+			return err
+		}
+		roomID = room.ID
+		err = si.imports.SaveImportedRoom(SlackSource, conversation.ID, roomID)
+	}
+	if err != nil {
+		return err
+	}
+	for _, member := range conversation.Members {
+		user, known := state.users[member]
+		if !known || user.IsBot {
+			continue
+		}
+		userID, err := si.userID(state, user)
+		if err != nil {
+			return err
+		}
+		if err := si.rooms.AddRoomMember(roomID, userID); err != nil {
+			return err
+		}
+	}
+	state.result.Rooms++
+	// Channel and group conversations are stored in directories named after
+	// them, direct conversations by their ID
+	return si.importMessages(ctx, state, conversation.ID, name, func(message *model.Message, _ string) (bool, error) {
+		message.RoomID = roomID
+		return true, nil
+	})
+}
+
+// importDM imports the messages of a direct conversation
+func (si *SlackImporter) importDM(ctx context.Context, state *slackImport, dm slackConversation) error {
+	if len(dm.Members) != 2 || dm.Members[0] == dm.Members[1] {
+		// Notes to self
+		state.result.SkippedConversations++
+		return nil
+	}
+	return si.importMessages(ctx, state, dm.ID, dm.ID, func(message *model.Message, author string) (bool, error) {
+		if author != dm.Members[0] && author != dm.Members[1] {
+			return false, nil
+		}
+		to := dm.Members[0]
+		if author == to {
+			to = dm.Members[1]
+		}
+		recipient, known := state.users[to]
+		if !known {
+			return false, nil
+		}
+		toUserID, err := si.userID(state, recipient)
+		if err != nil {
+			return false, err
+		}
+		message.ToUserId = toUserID
+		return true, nil
+	})
+}
+
+// importMessages imports the messages of a conversation, stored as a file
+// per day in dir. address sets where a message of author goes, or reports
+// that it is skipped.
+func (si *SlackImporter) importMessages(ctx context.Context, state *slackImport, conversationID string, dir string,
+	address func(message *model.Message, author string) (bool, error)) error {
+	var days []string
+	for _, file := range state.archive.File {
+		if path.Dir(file.Name) == dir && path.Ext(file.Name) == ".json" {
+			days = append(days, file.Name)
+		}
+	}
+	sort.Strings(days)
+
+	for _, day := range days {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var messages []slackMessage
+		if err := readSlackFile(state.archive, day, &messages); err != nil {
+			return err
+		}
+		sort.SliceStable(messages, func(i, j int) bool { return slackTime(messages[i].TS).Before(slackTime(messages[j].TS)) })
+		for _, message := range messages {
+			if err := si.importMessage(state, conversationID, message, address); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (si *SlackImporter) importMessage(state *slackImport, conversationID string, slackMessage slackMessage,
+	address func(message *model.Message, author string) (bool, error)) error {
+	author, known := state.users[slackMessage.User]
+	text := slackText(state.users, slackMessage)
+	if !slackMessageTypes[slackMessage.Subtype] || !known || author.IsBot || text == "" {
+		state.result.Skipped++
+		return nil
+	}
+	message := model.Message{TextContent: text, Time: slackTime(slackMessage.TS)}
+	if addressed, err := address(&message, slackMessage.User); err != nil || !addressed {
+		if err == nil {
+			state.result.Skipped++
+		}
+		return err
+	}
+	fromUserID, err := si.userID(state, author)
+	if err != nil {
+		return err
+	}
+	message.FromUserID = fromUserID
+	if slackMessage.ThreadTS != "" && slackMessage.ThreadTS != slackMessage.TS {
+		message.ReplyToID = state.messages[conversationID+"/"+slackMessage.ThreadTS]
+	}
+	externalID := conversationID + "/" + slackMessage.TS
+	stored, err := si.imports.SaveImportedMessage(SlackSource, externalID, &message)
+	if err != nil {
+		return err
+	}
+	state.messages[externalID] = message.ID
+	if stored {
+		state.result.Messages++
+	} else {
+		state.result.Duplicates++
+	}
+	return nil
+}
+
+// userID returns the cito user of a Slack user: the one it was mapped to
+// before, the one with the same email or a new placeholder
+func (si *SlackImporter) userID(state *slackImport, user slackUser) (int, error) {
+	if userID, ok := state.userIDs[user.ID]; ok {
+		return userID, nil
+	}
+	userID, err := si.imports.FindImportedUser(SlackSource, user.ID)
+	if errors.Is(err, ErrUserNotFound) {
+		userID, err = si.mapUser(state, user)
+	}
+	if err != nil {
+		return 0, err
+	}
+	state.userIDs[user.ID] = userID
+	return userID, nil
+}
+
+func (si *SlackImporter) mapUser(state *slackImport, user slackUser) (int, error) {
+	// Anyone can put any address in their Slack profile, only an email a
+	// provider verified for a cito user maps to them. A user with the email
+	// unverified is suggested for an admin to confirm instead.
+	email := user.Profile.Email
+	suggestedUserID := 0
+	if email != "" {
+		existing, err := si.users.FindUserByEmail(email, true)
+		if err == nil {
+			state.result.UsersMatched++
+			return existing.ID, si.imports.SaveImportedUser(SlackSource, user.ID, existing.ID, 0)
+		}
+		if !errors.Is(err, ErrUserNotFound) {
+			return 0, err
+		}
+		suggested, err := si.users.FindUserByEmail(email, false)
+		if err == nil {
+			suggestedUserID = suggested.ID
+		} else if !errors.Is(err, ErrUserNotFound) {
+			return 0, err
+		}
+	}
+	username := user.Name
+	if username == "" {
+		username = user.ID
+	}
+	userID, err := si.users.CreateUser(username, email)
+	if err != nil {
+		return 0, err
+	}
+	state.result.UsersCreated++
+	if suggestedUserID != 0 {
+		state.result.UsersToConfirm++
+		slog.Warn("Slack user shares an unverified email with a user, confirm the mapping", "user_id", userID,
+			"slack_user", user.ID, "suggested_user_id", suggestedUserID)
+	} else {
+		slog.Info("Created placeholder user for Slack user", "user_id", userID, "slack_user", user.ID)
+	}
+	return userID, si.imports.SaveImportedUser(SlackSource, user.ID, userID, suggestedUserID)
+}
+
+// SuggestedUsers returns the Slack users mapped to a placeholder while an
+// existing user shares their unverified email
+func (si *SlackImporter) SuggestedUsers() ([]model.ImportedUser, error) {
+	return si.imports.ListSuggestedImportedUsers(SlackSource)
+}
+
+// ConfirmUser maps a Slack user mapped to a placeholder to userID, or to
+// the existing user suggested for them when userID is 0, with the messages
+// and rooms imported so far. It returns ErrUserNotFound when the Slack user
+// has no suggested user or userID is unknown, and ErrNotPlaceholder when the
+// Slack user is mapped to an account already.
+func (si *SlackImporter) ConfirmUser(slackUserID string, userID int) (*model.ImportedUser, error) {
+	confirmed, err := si.imports.ConfirmImportedUser(SlackSource, slackUserID, userID)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Confirmed Slack user mapping", "slack_user", slackUserID, "user_id", confirmed.SuggestedUserID,
+		"placeholder_user_id", confirmed.UserID)
+	return confirmed, nil
+}
+
+// readSlackFile decodes a JSON file of the archive into v. It returns an
+// error matching fs.ErrNotExist when the archive has no such file.
+func readSlackFile(archive *zip.Reader, name string, v any) error {
+	file, err := archive.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := json.NewDecoder(file).Decode(v); err != nil {
+		return fmt.Errorf("reading %s: %w", name, err)
+	}
+	return nil
+}
+
+// slackTime reads a message timestamp, seconds and microseconds since the
+// epoch such as "1610000000.000200"
+func slackTime(ts string) time.Time {
+	seconds, fraction, _ := strings.Cut(ts, ".")
+	sec, _ := strconv.ParseInt(seconds, 10, 64)
+	usec, _ := strconv.ParseInt((fraction + "000000")[:6], 10, 64)
+	return time.Unix(sec, usec*1000)
+}
+
+// slackText turns Slack markup into plain text and lists shared files
+func slackText(users map[string]slackUser, message slackMessage) string {
+	text := slackMarkup.ReplaceAllStringFunc(message.Text, func(markup string) string {
+		target, label, hasLabel := strings.Cut(markup[1:len(markup)-1], "|")
+		if !hasLabel {
+			label = strings.TrimLeft(target, "@#!")
+		}
+		switch {
+		case strings.HasPrefix(target, "@"):
+			if user, ok := users[target[1:]]; ok {
+				return "@" + user.Name
+			}
+			return "@" + label
+		case strings.HasPrefix(target, "#"):
+			return "#" + label
+		case strings.HasPrefix(target, "!"):
+			// @here and the like, or dates and groups with a fallback label
+			if hasLabel {
+				return label
+			}
+			return "@" + label
+		case hasLabel:
+			return label + " (" + target + ")"
+		}
+		return target
+	})
+	text = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&").Replace(text)
+	for _, file := range message.Files {
+		text += "\n[file: " + file.Name + "]"
+	}
+	return strings.TrimSpace(text)
+}
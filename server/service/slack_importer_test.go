@@ -0,0 +1,222 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"cito/server/model"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSlackExport zips files, named by their path in the archive
+func newSlackExport(t *testing.T, files map[string]string) *zip.Reader {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := archive.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, archive.Close())
+	reader, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	return reader
+}
+
+var slackExportFiles = map[string]string{
+	"users.json": `[
+		{"id": "U1", "name": "alice", "profile": {"email": "Alice@Example.com"}},
+		{"id": "U2", "name": "bob", "profile": {"email": "bob@example.com"}},
+		{"id": "B1", "name": "deploybot", "is_bot": true, "profile": {}}
+	]`,
+	"channels.json": `[
+		{"id": "C1", "name": "general", "created": 1600000000, "members": ["U1", "U2", "B1"]},
+		{"id": "C2", "name": "random", "created": 1600000000, "members": ["U1"]}
+	]`,
+	"mpims.json": `[{"id": "G1", "name": "mpdm-alice--bob-1", "created": 1600000000, "members": ["U1", "U2"]}]`,
+	"dms.json":   `[{"id": "D1", "members": ["U1", "U2"]}, {"id": "D2", "members": ["U1", "U1"]}]`,
+	"general/2021-01-07.json": `[
+		{"type": "message", "user": "U2", "text": "welcome back", "ts": "1610000200.000000", "thread_ts": "1610000000.000100"},
+		{"type": "message", "user": "U1", "text": "back from leave", "ts": "1610000000.000100", "thread_ts": "1610000000.000100"}
+	]`,
+	"mpdm-alice--bob-1/2021-01-07.json": `[{"type": "message", "user": "U2", "text": "lunch?", "ts": "1610000300.000000"}]`,
+	"D1/2021-01-07.json": `[
+		{"type": "message", "user": "U2", "text": "reply", "ts": "1610000100.000300", "thread_ts": "1610000000.000100"},
+		{"type": "message", "user": "U1", "text": "hey <@U2>, see <https://example.com|this> &amp; that", "ts": "1610000000.000100", "thread_ts": "1610000000.000100"},
+		{"type": "message", "subtype": "channel_join", "user": "U2", "text": "joined", "ts": "1610000050.000000"},
+		{"type": "message", "user": "B1", "text": "deployed", "ts": "1610000060.000000"}
+	]`,
+	"D1/2021-01-08.json": `[
+		{"type": "message", "subtype": "file_share", "user": "U2", "text": "", "ts": "1610100000.000000", "files": [{"name": "notes.txt"}]}
+	]`,
+}
+
+func TestSlackImporter_Import(t *testing.T) {
+	mr := NewMemoryRepository()
+	alice, err := mr.UpsertIdentity(model.Identity{Provider: "github", Subject: "1", Username: "alice", Email: "alice@example.com", EmailVerified: true}, SealedToken{AccessToken: "token"}, time.Now())
+	require.NoError(t, err)
+	importer := NewSlackImporter(mr, mr, mr)
+
+	result, err := importer.Import(context.Background(), newSlackExport(t, slackExportFiles))
+	require.NoError(t, err)
+	assert.Equal(t, &SlackImport{UsersMatched: 1, UsersCreated: 1, Rooms: 3, Messages: 6, Skipped: 2, SkippedConversations: 1}, result)
+
+	bob, err := mr.FindImportedUser(SlackSource, "U2")
+	require.NoError(t, err)
+	placeholder, err := mr.FindUserByID(bob)
+	require.NoError(t, err)
+	assert.Equal(t, "bob", placeholder.Username)
+	assert.Equal(t, "bob@example.com", placeholder.Email)
+
+	messages, err := mr.ListUserMessages(alice, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, messages, 3)
+	assert.Equal(t, "hey @bob, see this (https://example.com) & that", messages[0].TextContent)
+	assert.Equal(t, alice, messages[0].FromUserID)
+	assert.Equal(t, bob, messages[0].ToUserId)
+	assert.True(t, time.Unix(1610000000, 100000).Equal(messages[0].Time), "original timestamps are kept")
+	assert.Zero(t, messages[0].ReplyToID)
+	assert.Equal(t, "reply", messages[1].TextContent)
+	assert.Equal(t, messages[0].ID, messages[1].ReplyToID, "replies point at their thread")
+	assert.Equal(t, "[file: notes.txt]", messages[2].TextContent)
+
+	rooms, err := mr.ListRooms(alice)
+	require.NoError(t, err)
+	require.Len(t, rooms, 3)
+	assert.Equal(t, []string{"general", "mpdm-alice--bob-1", "random"}, []string{rooms[0].Name, rooms[1].Name, rooms[2].Name})
+	assert.True(t, time.Unix(1600000000, 0).Equal(rooms[0].CreatedAt))
+	members, err := mr.ListRoomMembers(rooms[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, []int{alice, bob}, members, "bots are no members")
+	roomMessages, err := mr.ListRoomMessages(rooms[0].ID, time.Now(), 10)
+	require.NoError(t, err)
+	require.Len(t, roomMessages, 2)
+	assert.Equal(t, "welcome back", roomMessages[0].TextContent)
+	assert.Equal(t, bob, roomMessages[0].FromUserID)
+	assert.True(t, time.Unix(1610000200, 0).Equal(roomMessages[0].Time), "original timestamps are kept")
+	assert.Equal(t, roomMessages[1].ID, roomMessages[0].ReplyToID, "replies point at their thread")
+
+	result, err = importer.Import(context.Background(), newSlackExport(t, slackExportFiles))
+	require.NoError(t, err)
+	assert.Equal(t, 6, result.Duplicates, "running again imports nothing twice")
+	assert.Zero(t, result.Messages+result.UsersCreated+result.UsersMatched)
+	rooms, err = mr.ListRooms(alice)
+	require.NoError(t, err)
+	assert.Len(t, rooms, 3, "rooms are not created twice")
+	count, err := mr.CountUserMessages(alice)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
+
+func TestSlackImporter_UnverifiedEmail(t *testing.T) {
+	mr := NewMemoryRepository()
+	alice, err := mr.UpsertIdentity(model.Identity{Provider: "github", Subject: "1", Username: "alice", Email: "alice@example.com"}, SealedToken{AccessToken: "token"}, time.Now())
+	require.NoError(t, err)
+	importer := NewSlackImporter(mr, mr, mr)
+
+	result, err := importer.Import(context.Background(), newSlackExport(t, slackExportFiles))
+	require.NoError(t, err)
+	assert.Zero(t, result.UsersMatched, "an unverified email maps to no one")
+	assert.Equal(t, 2, result.UsersCreated)
+	assert.Equal(t, 1, result.UsersToConfirm)
+	count, err := mr.CountUserMessages(alice)
+	require.NoError(t, err)
+	assert.Zero(t, count)
+
+	suggested, err := importer.SuggestedUsers()
+	require.NoError(t, err)
+	require.Len(t, suggested, 1)
+	assert.Equal(t, "U1", suggested[0].ExternalID)
+	assert.Equal(t, alice, suggested[0].SuggestedUserID)
+
+	_, err = importer.ConfirmUser("U2", 0)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	confirmed, err := importer.ConfirmUser("U1", 0)
+	require.NoError(t, err)
+	_, err = mr.FindUserByID(confirmed.UserID)
+	assert.ErrorIs(t, err, ErrUserNotFound, "the placeholder is deleted")
+	count, err = mr.CountUserMessages(alice)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count, "the imported messages move to the confirmed user")
+	rooms, err := mr.ListRooms(alice)
+	require.NoError(t, err)
+	assert.Len(t, rooms, 3, "and so do the room memberships")
+
+	result, err = importer.Import(context.Background(), newSlackExport(t, slackExportFiles))
+	require.NoError(t, err)
+	assert.Equal(t, 6, result.Duplicates)
+	assert.Zero(t, result.UsersCreated+result.UsersToConfirm)
+}
+
+func TestSlackImporter_ClaimPlaceholder(t *testing.T) {
+	mr := NewMemoryRepository()
+	importer := NewSlackImporter(mr, mr, mr)
+	_, err := importer.Import(context.Background(), newSlackExport(t, slackExportFiles))
+	require.NoError(t, err)
+	alice, err := mr.FindImportedUser(SlackSource, "U1")
+	require.NoError(t, err)
+	bob, err := mr.FindImportedUser(SlackSource, "U2")
+	require.NoError(t, err)
+
+	unverified, err := mr.UpsertIdentity(model.Identity{Provider: "github", Subject: "1", Username: "alice", Email: "alice@example.com"}, SealedToken{AccessToken: "token"}, time.Now())
+	require.NoError(t, err)
+	assert.NotEqual(t, alice, unverified, "an unverified email claims nothing")
+	signedIn, err := mr.UpsertIdentity(model.Identity{Provider: "oidc", Subject: "1", Username: "alice", Email: "ALICE@example.com", EmailVerified: true}, SealedToken{AccessToken: "token"}, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, alice, signedIn, "the first sign-in with the verified email claims the placeholder")
+	count, err := mr.CountUserMessages(alice)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+	again, err := mr.UpsertIdentity(model.Identity{Provider: "github", Subject: "2", Username: "alice2", Email: "alice@example.com", EmailVerified: true}, SealedToken{AccessToken: "token"}, time.Now())
+	require.NoError(t, err)
+	assert.NotEqual(t, alice, again, "a claimed placeholder is an account")
+
+	_, err = importer.ConfirmUser("U1", again)
+	assert.ErrorIs(t, err, ErrNotPlaceholder, "accounts are not moved")
+	_, err = importer.ConfirmUser("U2", 99)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	confirmed, err := importer.ConfirmUser("U2", again)
+	require.NoError(t, err)
+	assert.Equal(t, bob, confirmed.UserID)
+	mapped, err := mr.FindImportedUser(SlackSource, "U2")
+	require.NoError(t, err)
+	assert.Equal(t, again, mapped, "an admin maps a placeholder to any user")
+	rooms, err := mr.ListRooms(again)
+	require.NoError(t, err)
+	assert.Len(t, rooms, 2)
+}
+
+func TestSlackImporter_ImportWithoutUsers(t *testing.T) {
+	importer := NewSlackImporter(NewMemoryRepository(), NewMemoryRepository(), NewMemoryRepository())
+
+	_, err := importer.Import(context.Background(), newSlackExport(t, map[string]string{"channels.json": `[]`}))
+	assert.Error(t, err, "users.json is required")
+	_, err = importer.Import(context.Background(), newSlackExport(t, map[string]string{"users.json": `{`}))
+	assert.Error(t, err)
+}
+
+func TestSlackText(t *testing.T) {
+	users := map[string]slackUser{"U1": {ID: "U1", Name: "alice"}}
+	tests := []struct {
+		text string
+		want string
+	}{
+		{text: "hi <@U1>", want: "hi @alice"},
+		{text: "hi <@U9|carol>", want: "hi @carol"},
+		{text: "see <#C1|general>", want: "see #general"},
+		{text: "<!here> lunch", want: "@here lunch"},
+		{text: "<https://example.com>", want: "https://example.com"},
+		{text: "1 &lt; 2 &amp;&amp; 3 &gt; 2", want: "1 < 2 && 3 > 2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			assert.Equal(t, tt.want, slackText(users, slackMessage{Text: tt.text}))
+		})
+	}
+}
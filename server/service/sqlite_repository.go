@@ -0,0 +1,20 @@
+package service
+
+import "database/sql"
+
+// SQLiteRepository implements Repository on a SQLite database opened by the
+// database package. SQLite runs the PostgreSQL queries as they are, except
+// for row locks, so only the queries taking them are replaced.
+type SQLiteRepository struct {
+	*PostgresRepository
+}
+
+func NewSQLiteRepository(db *sql.DB) *SQLiteRepository {
+	return &SQLiteRepository{PostgresRepository: NewPostgresRepository(db)}
+}
+
+func (sr *SQLiteRepository) UnlinkIdentity(userID int, identityID int) error {
+	// Transactions begin with the database write lock, which already keeps
+	// two concurrent unlinks from removing the last two identities
+	return unlinkIdentity(sr.db, `SELECT id FROM identities WHERE user_id = $1`, userID, identityID)
+}
@@ -0,0 +1,482 @@
+package service
+
+import (
+	"bytes"
+	"cito/server/database"
+	"cito/server/keyring"
+	"cito/server/migrations"
+	"cito/server/model"
+	"cito/server/totp"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+
+	"cito/server/testutil"
+)
+
+// newTestSQLiteRepository returns a repository on a migrated database file
+func newTestSQLiteRepository(t *testing.T) *SQLiteRepository {
+	db, err := database.Open(database.SQLite, filepath.Join(t.TempDir(), "cito.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	migrator, err := migrations.New(db, database.SQLite)
+	require.NoError(t, err)
+	_, err = migrator.Up(context.Background())
+	require.NoError(t, err)
+	return NewSQLiteRepository(db)
+}
+
+func TestSQLiteRepository_Identities(t *testing.T) {
+	sr := newTestSQLiteRepository(t)
+	now := time.Now()
+	personal := model.GitHubUser{ID: 1, Login: "personal"}.Identity()
+	work := model.GitHubUser{ID: 2, Login: "work"}.Identity()
+
+	userID, err := sr.UpsertIdentity(personal, SealedToken{AccessToken: "a", ExpiresAt: now.Add(time.Hour)}, now)
+	require.NoError(t, err)
+	again, err := sr.UpsertIdentity(personal, SealedToken{AccessToken: "b"}, now)
+	require.NoError(t, err)
+	assert.Equal(t, userID, again, "a known identity signs in to the same user")
+
+	require.NoError(t, sr.LinkIdentity(userID, work, SealedToken{AccessToken: "c"}, now))
+	otherID, err := sr.UpsertIdentity(model.GitHubUser{ID: 3, Login: "other"}.Identity(), SealedToken{AccessToken: "d"}, now)
+	require.NoError(t, err)
+	assert.ErrorIs(t, sr.LinkIdentity(otherID, work, SealedToken{AccessToken: "e"}, now), ErrIdentityConflict)
+
+	identities, err := sr.ListIdentities(userID)
+	require.NoError(t, err)
+	require.Len(t, identities, 2)
+	assert.Equal(t, "personal", identities[0].Username)
+
+	require.NoError(t, sr.UpdateIdentityToken(identities[1].ID, SealedToken{AccessToken: "c", RefreshToken: "r"}, now.Add(-time.Hour)))
+	due, err := sr.IdentityTokensToVerify("github", now.Add(-30*time.Minute), 10)
+	require.NoError(t, err)
+	require.Len(t, due, 1, "only the token checked an hour ago is due")
+	assert.Equal(t, identities[1].ID, due[0].IdentityID)
+	assert.Equal(t, "r", due[0].Token.RefreshToken)
+
+	revoked, err := sr.MarkIdentityRevoked(identities[1].ID, now)
+	require.NoError(t, err)
+	assert.NotNil(t, revoked.RevokedAt)
+	stored, err := sr.FindIdentityToken(userID, identities[1].ID)
+	require.NoError(t, err)
+	assert.Nil(t, stored.Token)
+
+	assert.ErrorIs(t, sr.UnlinkIdentity(otherID, identities[0].ID), ErrIdentityNotFound)
+	require.NoError(t, sr.UnlinkIdentity(userID, identities[1].ID))
+	assert.ErrorIs(t, sr.UnlinkIdentity(userID, identities[0].ID), ErrLastIdentity)
+}
+
+func TestSQLiteRepository_Sessions(t *testing.T) {
+	sr := newTestSQLiteRepository(t)
+	us := NewUserService(sr, testutil.NewTestKeyring(t))
+	ss := NewSessionService(sr)
+
+	userID, err := us.UpsertIdentity(context.Background(), model.GitHubUser{ID: 1, Login: "testuser"}.Identity(), &oauth2.Token{AccessToken: "token"})
+	require.NoError(t, err)
+	token, err := ss.CreateSession(userID, "laptop", "10.0.0.1")
+	require.NoError(t, err)
+
+	user, err := us.FindUserBySession(context.Background(), token)
+	require.NoError(t, err)
+	assert.Equal(t, userID, user.ID)
+
+	rotated, err := ss.rotateSession(user.SessionID, time.Now())
+	require.NoError(t, err)
+	_, err = us.FindUserBySession(context.Background(), rotated)
+	require.NoError(t, err)
+	_, err = sr.FindUserBySession(hashToken(token), time.Now(), time.Now())
+	assert.ErrorIs(t, err, ErrUserNotFound, "the previous token stops working after the grace period")
+
+	other, err := ss.CreateSession(userID, "phone", "10.0.0.2")
+	require.NoError(t, err)
+	sessions, err := ss.ListSessions(userID)
+	require.NoError(t, err)
+	assert.Len(t, sessions, 2)
+
+	revoked, err := ss.RevokeOtherSessions(userID, user.SessionID)
+	require.NoError(t, err)
+	assert.Len(t, revoked, 1)
+	_, err = us.FindUserBySession(context.Background(), other)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	revoked, err = ss.RevokeAllSessions(userID)
+	require.NoError(t, err)
+	assert.Equal(t, []int{user.SessionID}, revoked)
+	sessions, err = ss.ListSessions(userID)
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+}
+
+func TestSQLiteRepository_ListConversation(t *testing.T) {
+	sr := newTestSQLiteRepository(t)
+	now := time.Now()
+	alice, err := sr.UpsertIdentity(model.GitHubUser{ID: 1, Login: "alice"}.Identity(), SealedToken{AccessToken: "a"}, now)
+	require.NoError(t, err)
+	bob, err := sr.UpsertIdentity(model.GitHubUser{ID: 2, Login: "bob"}.Identity(), SealedToken{AccessToken: "b"}, now)
+	require.NoError(t, err)
+
+	start := now.Add(-time.Hour)
+	for i, text := range []string{"first", "second", "third"} {
+		message := model.Message{FromUserID: alice, ToUserId: bob, TextContent: text, Time: start.Add(time.Duration(i) * time.Minute)}
+		require.NoError(t, sr.SaveMessage(&message))
+		assert.NotZero(t, message.ID)
+	}
+
+	conversation, err := sr.ListConversation(bob, alice, start.Add(2*time.Minute), 10)
+	require.NoError(t, err)
+	require.Len(t, conversation, 2)
+	assert.Equal(t, "second", conversation[0].TextContent)
+	assert.Equal(t, "first", conversation[1].TextContent)
+}
+
+func TestSQLiteRepository_PurgeMessages(t *testing.T) {
+	sr := newTestSQLiteRepository(t)
+	now := time.Now()
+	var users []int
+	for i := 1; i <= 3; i++ {
+		userID, err := sr.UpsertIdentity(model.GitHubUser{ID: int64(i), Login: "user"}.Identity(), SealedToken{AccessToken: "token"}, now)
+		require.NoError(t, err)
+		users = append(users, userID)
+	}
+	for _, message := range []model.Message{
+		{FromUserID: users[0], ToUserId: users[1], TextContent: "old", Time: now.Add(-48 * time.Hour)},
+		{FromUserID: users[1], ToUserId: users[0], TextContent: "old too", Time: now.Add(-47 * time.Hour)},
+		{FromUserID: users[0], ToUserId: users[1], TextContent: "new", Time: now},
+		{FromUserID: users[2], ToUserId: users[0], TextContent: "kept longer", Time: now.Add(-48 * time.Hour)},
+	} {
+		require.NoError(t, sr.SaveMessage(&message))
+	}
+	override := model.NewConversation(users[2], users[0])
+	require.NoError(t, sr.SetRetentionPolicy(override, model.RetentionPolicy{MaxAge: 72 * time.Hour, Archive: true}, now))
+
+	conversations, err := sr.ListConversations()
+	require.NoError(t, err)
+	assert.Equal(t, []model.Conversation{model.NewConversation(users[0], users[1]), override}, conversations)
+	policies, err := sr.RetentionPolicies()
+	require.NoError(t, err)
+	assert.Equal(t, map[model.Conversation]model.RetentionPolicy{override: {MaxAge: 72 * time.Hour, Archive: true}}, policies)
+
+	purged, err := sr.PurgeMessages(nil, now.Add(-time.Hour), false, 1, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged, "batches are limited")
+	purged, err = sr.PurgeMessages(nil, now.Add(-time.Hour), false, 10, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged, "conversations with their own policy are skipped")
+	remaining, err := sr.ListConversation(users[0], users[1], now.Add(time.Minute), 10)
+	require.NoError(t, err)
+	require.Len(t, remaining, 1)
+	assert.Equal(t, "new", remaining[0].TextContent)
+
+	purged, err = sr.PurgeMessages(&override, now.Add(-time.Hour), true, 10, now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	var archived string
+	require.NoError(t, sr.db.QueryRow(`SELECT text_content FROM archived_messages`).Scan(&archived))
+	assert.Equal(t, "kept longer", archived)
+	count, err := sr.CountUserMessages(users[0])
+	require.NoError(t, err)
+	assert.Equal(t, 2, count, "archived messages are counted")
+	messages, err := sr.ListUserMessages(users[0], 0, 10)
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	assert.Equal(t, "new", messages[0].TextContent)
+	assert.Equal(t, "kept longer", messages[1].TextContent, "archived messages are listed in ID order")
+
+	run := model.PurgeRun{StartedAt: now, FinishedAt: now, Deleted: 2, Archived: 1}
+	require.NoError(t, sr.SavePurgeRun(&run))
+	runs, err := sr.ListPurgeRuns(10)
+	require.NoError(t, err)
+	require.Len(t, runs, 1)
+	assert.Equal(t, 2, runs[0].Deleted)
+	assert.Empty(t, runs[0].Error)
+
+	require.NoError(t, sr.DeleteRetentionPolicy(override))
+	assert.ErrorIs(t, sr.DeleteRetentionPolicy(override), ErrRetentionPolicyNotFound)
+}
+
+func TestSQLiteRepository_Exports(t *testing.T) {
+	sr := newTestSQLiteRepository(t)
+	now := time.Now()
+	var users []int
+	for i := 1; i <= 3; i++ {
+		userID, err := sr.UpsertIdentity(model.GitHubUser{ID: int64(i), Login: "user"}.Identity(), SealedToken{AccessToken: "token"}, now)
+		require.NoError(t, err)
+		users = append(users, userID)
+	}
+	for _, message := range []model.Message{
+		{FromUserID: users[0], ToUserId: users[1], TextContent: "first", Time: now},
+		{FromUserID: users[1], ToUserId: users[2], TextContent: "not ours", Time: now},
+		{FromUserID: users[2], ToUserId: users[0], TextContent: "second", Time: now},
+	} {
+		require.NoError(t, sr.SaveMessage(&message))
+	}
+
+	count, err := sr.CountUserMessages(users[0])
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	messages, err := sr.ListUserMessages(users[0], 0, 1)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	assert.Equal(t, "first", messages[0].TextContent)
+	messages, err = sr.ListUserMessages(users[0], messages[0].ID, 10)
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+	assert.Equal(t, "second", messages[0].TextContent)
+
+	old := &model.Export{UserID: users[1], Format: model.ExportFormatZip, Status: model.ExportStatusPending, CreatedAt: now.Add(-48 * time.Hour)}
+	require.NoError(t, sr.CreateExport(old))
+	export := &model.Export{UserID: users[0], Format: model.ExportFormatNDJSON, Status: model.ExportStatusPending, CreatedAt: now}
+	require.NoError(t, sr.CreateExport(export))
+	assert.ErrorIs(t, sr.CreateExport(&model.Export{UserID: users[0], Format: model.ExportFormatZip, Status: model.ExportStatusPending, CreatedAt: now}),
+		ErrExportInProgress, "one unfinished export per user")
+
+	unfinished, err := sr.UnfinishedExports()
+	require.NoError(t, err)
+	require.Len(t, unfinished, 2)
+	assert.Equal(t, old.ID, unfinished[0].ID, "oldest first")
+
+	finishedAt := now.Add(time.Minute)
+	export.Status = model.ExportStatusDone
+	export.Exported, export.Total = 2, 2
+	export.FinishedAt = &finishedAt
+	require.NoError(t, sr.UpdateExport(*export))
+	found, err := sr.FindExport(users[0], export.ID)
+	require.NoError(t, err)
+	assert.Equal(t, model.ExportStatusDone, found.Status)
+	assert.Equal(t, 2, found.Exported)
+	require.NotNil(t, found.FinishedAt)
+	assert.WithinDuration(t, finishedAt, *found.FinishedAt, time.Second)
+	_, err = sr.FindExport(users[1], export.ID)
+	assert.ErrorIs(t, err, ErrExportNotFound)
+
+	deleted, err := sr.DeleteExportsBefore(now.Add(-24 * time.Hour))
+	require.NoError(t, err)
+	require.Len(t, deleted, 1)
+	assert.Equal(t, old.ID, deleted[0].ID)
+	exports, err := sr.ListExports(users[0])
+	require.NoError(t, err)
+	require.Len(t, exports, 1)
+	assert.Equal(t, export.ID, exports[0].ID)
+}
+
+func TestSQLiteRepository_Imports(t *testing.T) {
+	sr := newTestSQLiteRepository(t)
+	userID, err := sr.UpsertIdentity(model.Identity{Provider: "github", Subject: "1", Username: "alice", Email: "alice@example.com", EmailVerified: true}, SealedToken{AccessToken: "token"}, time.Now())
+	require.NoError(t, err)
+	carolID, err := sr.UpsertIdentity(model.Identity{Provider: "github", Subject: "3", Username: "carol", Email: "carol@example.com"}, SealedToken{AccessToken: "token"}, time.Now())
+	require.NoError(t, err)
+
+	found, err := sr.FindUserByEmail("ALICE@example.com", true)
+	require.NoError(t, err)
+	assert.Equal(t, userID, found.ID)
+	_, err = sr.FindUserByEmail("carol@example.com", true)
+	assert.ErrorIs(t, err, ErrUserNotFound, "unverified emails do not match")
+	found, err = sr.FindUserByEmail("carol@example.com", false)
+	require.NoError(t, err)
+	assert.Equal(t, carolID, found.ID)
+	_, err = sr.FindUserByEmail("bob@example.com", false)
+	assert.ErrorIs(t, err, ErrUserNotFound)
+
+	placeholderID, err := sr.CreateUser("bob", "")
+	require.NoError(t, err)
+	placeholder, err := sr.FindUserByID(placeholderID)
+	require.NoError(t, err)
+	assert.Equal(t, "bob", placeholder.Username)
+	identities, err := sr.ListIdentities(placeholderID)
+	require.NoError(t, err)
+	assert.Empty(t, identities, "placeholders cannot sign in")
+
+	_, err = sr.FindImportedUser(SlackSource, "U2")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	require.NoError(t, sr.SaveImportedUser(SlackSource, "U2", placeholderID, 0))
+	importedID, err := sr.FindImportedUser(SlackSource, "U2")
+	require.NoError(t, err)
+	assert.Equal(t, placeholderID, importedID)
+
+	parent := model.Message{FromUserID: userID, ToUserId: placeholderID, TextContent: "question", Time: time.Now()}
+	stored, err := sr.SaveImportedMessage(SlackSource, "D1/1", &parent)
+	require.NoError(t, err)
+	assert.True(t, stored)
+	reply := model.Message{FromUserID: placeholderID, ToUserId: userID, TextContent: "answer", Time: time.Now(), ReplyToID: parent.ID}
+	_, err = sr.SaveImportedMessage(SlackSource, "D1/2", &reply)
+	require.NoError(t, err)
+	again := model.Message{FromUserID: userID, ToUserId: placeholderID, TextContent: "question", Time: time.Now()}
+	stored, err = sr.SaveImportedMessage(SlackSource, "D1/1", &again)
+	require.NoError(t, err)
+	assert.False(t, stored)
+	assert.Equal(t, parent.ID, again.ID, "the earlier import is returned")
+
+	messages, err := sr.ListUserMessages(userID, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	assert.Zero(t, messages[0].ReplyToID)
+	assert.Equal(t, parent.ID, messages[1].ReplyToID)
+
+	t.Run("confirming a suggested user moves the placeholder's messages", func(t *testing.T) {
+		carolPlaceholderID, err := sr.CreateUser("carol", "carol@example.com")
+		require.NoError(t, err)
+		require.NoError(t, sr.SaveImportedUser(SlackSource, "U3", carolPlaceholderID, carolID))
+		require.NoError(t, sr.SaveMessage(&model.Message{FromUserID: carolPlaceholderID, ToUserId: userID, TextContent: "hi", Time: time.Now()}))
+
+		suggested, err := sr.ListSuggestedImportedUsers(SlackSource)
+		require.NoError(t, err)
+		assert.Equal(t, []model.ImportedUser{{Source: SlackSource, ExternalID: "U3", UserID: carolPlaceholderID, SuggestedUserID: carolID}}, suggested)
+		_, err = sr.ConfirmImportedUser(SlackSource, "U2", 0)
+		assert.ErrorIs(t, err, ErrUserNotFound, "U2 has no suggested user")
+
+		confirmed, err := sr.ConfirmImportedUser(SlackSource, "U3", 0)
+		require.NoError(t, err)
+		assert.Equal(t, carolPlaceholderID, confirmed.UserID)
+		importedID, err := sr.FindImportedUser(SlackSource, "U3")
+		require.NoError(t, err)
+		assert.Equal(t, carolID, importedID)
+		_, err = sr.FindUserByID(carolPlaceholderID)
+		assert.ErrorIs(t, err, ErrUserNotFound, "the placeholder is deleted")
+		messages, err := sr.ListUserMessages(carolID, 0, 10)
+		require.NoError(t, err)
+		require.Len(t, messages, 1)
+		assert.Equal(t, "hi", messages[0].TextContent)
+		suggested, err = sr.ListSuggestedImportedUsers(SlackSource)
+		require.NoError(t, err)
+		assert.Empty(t, suggested)
+	})
+
+	t.Run("a verified sign-in claims the placeholder with its email", func(t *testing.T) {
+		davePlaceholderID, err := sr.CreateUser("dave", "dave@example.com")
+		require.NoError(t, err)
+		require.NoError(t, sr.SaveImportedUser(SlackSource, "U4", davePlaceholderID, carolID))
+
+		daveID, err := sr.UpsertIdentity(model.Identity{Provider: "github", Subject: "4", Username: "dave", Email: "Dave@example.com", EmailVerified: true}, SealedToken{AccessToken: "token"}, time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, davePlaceholderID, daveID)
+		suggested, err := sr.ListSuggestedImportedUsers(SlackSource)
+		require.NoError(t, err)
+		assert.Empty(t, suggested, "the unverified candidate is dropped")
+		_, err = sr.ConfirmImportedUser(SlackSource, "U4", userID)
+		assert.ErrorIs(t, err, ErrNotPlaceholder)
+
+		otherID, err := sr.UpsertIdentity(model.Identity{Provider: "github", Subject: "5", Username: "dave", Email: "dave@example.com", EmailVerified: true}, SealedToken{AccessToken: "token"}, time.Now())
+		require.NoError(t, err)
+		assert.NotEqual(t, daveID, otherID, "a claimed placeholder is claimed once")
+	})
+
+	t.Run("an admin maps a placeholder to any user", func(t *testing.T) {
+		_, err = sr.ConfirmImportedUser(SlackSource, "U2", 9999)
+		assert.ErrorIs(t, err, ErrUserNotFound)
+		confirmed, err := sr.ConfirmImportedUser(SlackSource, "U2", carolID)
+		require.NoError(t, err)
+		assert.Equal(t, placeholderID, confirmed.UserID)
+		assert.Equal(t, carolID, confirmed.SuggestedUserID)
+		messages, err := sr.ListUserMessages(carolID, 0, 10)
+		require.NoError(t, err)
+		assert.Len(t, messages, 3, "the placeholder's messages move along")
+	})
+
+	t.Run("a purged import stays imported", func(t *testing.T) {
+		now := time.Now()
+		_, err := sr.PurgeMessages(nil, now.Add(time.Hour), false, 100, now)
+		require.NoError(t, err)
+
+		again := model.Message{FromUserID: userID, ToUserId: carolID, TextContent: "question", Time: now}
+		stored, err := sr.SaveImportedMessage(SlackSource, "D1/1", &again)
+		require.NoError(t, err)
+		assert.False(t, stored)
+		assert.Zero(t, again.ID)
+		count, err := sr.CountUserMessages(userID)
+		require.NoError(t, err)
+		assert.Zero(t, count)
+	})
+}
+
+func TestSQLiteRepository_Rooms(t *testing.T) {
+	sr := newTestSQLiteRepository(t)
+	now := time.Now()
+	var users []int
+	for _, name := range []string{"alice", "bob", "carol"} {
+		userID, err := sr.CreateUser(name, "")
+		require.NoError(t, err)
+		users = append(users, userID)
+	}
+
+	room := model.Room{Name: "general", CreatedAt: now}
+	require.NoError(t, sr.CreateRoom(&room))
+	assert.ErrorIs(t, sr.AddRoomMember(room.ID+1, users[0]), ErrRoomNotFound)
+	for _, userID := range users[:2] {
+		require.NoError(t, sr.AddRoomMember(room.ID, userID))
+	}
+	require.NoError(t, sr.AddRoomMember(room.ID, users[0]), "adding a member again changes nothing")
+	members, err := sr.ListRoomMembers(room.ID)
+	require.NoError(t, err)
+	assert.Equal(t, users[:2], members)
+	rooms, err := sr.ListRooms(users[0])
+	require.NoError(t, err)
+	require.Len(t, rooms, 1)
+	assert.Equal(t, "general", rooms[0].Name)
+
+	first := model.Message{RoomID: room.ID, FromUserID: users[0], TextContent: "hi all", Time: now.Add(-time.Minute)}
+	require.NoError(t, sr.SaveRoomMessage(&first))
+	reply := model.Message{RoomID: room.ID, FromUserID: users[1], TextContent: "hi", Time: now, ReplyToID: first.ID}
+	require.NoError(t, sr.SaveRoomMessage(&reply))
+	outsider := model.Message{RoomID: room.ID, FromUserID: users[2], TextContent: "let me in", Time: now}
+	assert.ErrorIs(t, sr.SaveRoomMessage(&outsider), ErrRoomNotFound, "only members send to a room")
+
+	messages, err := sr.ListRoomMessages(room.ID, now.Add(time.Second), 10)
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+	assert.Equal(t, reply.ID, messages[0].ID, "newest first")
+	assert.Equal(t, first.ID, messages[0].ReplyToID)
+	assert.Equal(t, room.ID, messages[0].RoomID)
+
+	imported := model.Message{RoomID: room.ID, FromUserID: users[2], TextContent: "before I left", Time: now.Add(-time.Hour)}
+	stored, err := sr.SaveImportedMessage(SlackSource, "C1/1", &imported)
+	require.NoError(t, err)
+	assert.True(t, stored, "imported history keeps messages of people who left")
+	again := imported
+	stored, err = sr.SaveImportedMessage(SlackSource, "C1/1", &again)
+	require.NoError(t, err)
+	assert.False(t, stored)
+	assert.Equal(t, imported.ID, again.ID)
+
+	require.NoError(t, sr.AnonymizeUser(users[1], "deleted"))
+	members, err = sr.ListRoomMembers(room.ID)
+	require.NoError(t, err)
+	assert.Equal(t, users[:1], members, "anonymized users leave their rooms")
+}
+
+func TestSQLiteRepository_ResealTOTPSecret(t *testing.T) {
+	sr := newTestSQLiteRepository(t)
+	now := time.Now()
+	userID, err := sr.UpsertIdentity(model.GitHubUser{ID: 1, Login: "alice"}.Identity(), SealedToken{AccessToken: "a"}, now)
+	require.NoError(t, err)
+
+	oldKey := bytes.Repeat([]byte{0x42}, keyring.KeySize)
+	newKey := bytes.Repeat([]byte{0x43}, keyring.KeySize)
+	oldKeys, err := keyring.New(1, map[int][]byte{1: oldKey})
+	require.NoError(t, err)
+	secret, _, err := NewTwoFactorService(sr.db, oldKeys, NewWorkspaceService(sr.db)).BeginEnrollment(userID, "alice")
+	require.NoError(t, err)
+	code, err := totp.Code(secret, now)
+	require.NoError(t, err)
+	_, err = NewTwoFactorService(sr.db, oldKeys, NewWorkspaceService(sr.db)).ConfirmEnrollment(userID, code)
+	require.NoError(t, err)
+
+	rotatedKeys, err := keyring.New(2, map[int][]byte{1: oldKey, 2: newKey})
+	require.NoError(t, err)
+	count, err := NewUserService(sr, rotatedKeys).ReencryptAccessTokens(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, count, "the access token and the TOTP secret move to the new key")
+
+	// The old key is retired once everything is resealed
+	newKeys, err := keyring.New(2, map[int][]byte{2: newKey})
+	require.NoError(t, err)
+	code, err = totp.Code(secret, now.Add(totp.Period))
+	require.NoError(t, err)
+	assert.NoError(t, NewTwoFactorService(sr.db, newKeys, NewWorkspaceService(sr.db)).Verify(userID, code))
+}
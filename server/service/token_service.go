@@ -0,0 +1,228 @@
+package service
+
+import (
+	"cito/server/model"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const (
+	// PersonalTokenPrefix marks personal access tokens so they are easy to
+	// recognise in scripts and secret scanners
+	PersonalTokenPrefix = "cito_pat_"
+	// MaxPersonalTokenTTL caps how long a personal access token may live
+	MaxPersonalTokenTTL = 365 * 24 * time.Hour
+	// tokenTouchInterval throttles last_used_at writes
+	tokenTouchInterval = time.Minute
+)
+
+var (
+	// ErrTokenNotFound is returned when a token does not exist or belongs to
+	// another user
+	ErrTokenNotFound = errors.New("token not found")
+	// ErrInvalidToken is returned for malformed token requests
+	ErrInvalidToken = errors.New("invalid token request")
+)
+
+type TokenService struct {
+	db *sql.DB
+}
+
+func NewTokenService(db *sql.DB) *TokenService {
+	return &TokenService{db: db}
+}
+
+// CreateToken issues a personal access token for userID. The raw token is
+// returned once and never stored.
+func (ts *TokenService) CreateToken(userID int, name string, scopes model.Scopes, ttl time.Duration) (string, *model.PersonalAccessToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 255 {
+		return "", nil, fmt.Errorf("%w: name must be 1 to 255 characters", ErrInvalidToken)
+	}
+	if len(scopes) == 0 {
+		return "", nil, fmt.Errorf("%w: at least one scope is required", ErrInvalidToken)
+	}
+	for _, scope := range scopes {
+		if !scope.Valid() {
+			return "", nil, fmt.Errorf("%w: unknown scope %q", ErrInvalidToken, scope)
+		}
+	}
+	if ttl <= 0 || ttl > MaxPersonalTokenTTL {
+		return "", nil, fmt.Errorf("%w: expiry must be between 1 and 365 days", ErrInvalidToken)
+	}
+
+	rawToken, token, err := createToken(ts.db, userID, name, scopes, ttl)
+	if err != nil {
+		return "", nil, err
+	}
+
+	slog.Info("Created personal access token", "user_id", userID, "token_id", token.ID, "scopes", scopes.String())
+	return rawToken, token, nil
+}
+
+// createToken stores a new personal access token through db, which may be a
+// transaction, and returns it with its raw value
+func createToken(db queryer, userID int, name string, scopes model.Scopes, ttl time.Duration) (string, *model.PersonalAccessToken, error) {
+	random, err := generateSessionToken()
+	if err != nil {
+		return "", nil, err
+	}
+	rawToken := PersonalTokenPrefix + random
+	now := time.Now()
+	token := &model.PersonalAccessToken{
+		UserID:    userID,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	query := `
+		INSERT INTO personal_access_tokens (user_id, name, token_hash, scopes, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`
+	err = db.QueryRow(query, userID, name, hashToken(rawToken), scopes.String(), token.CreatedAt, token.ExpiresAt).Scan(&token.ID)
+	if err != nil {
+		return "", nil, err
+	}
+	return rawToken, token, nil
+}
+
+// ListTokens returns the personal access tokens of a user, newest first
+func (ts *TokenService) ListTokens(userID int) ([]model.PersonalAccessToken, error) {
+	query := `
+		SELECT id, user_id, name, scopes, created_at, expires_at, last_used_at
+		FROM personal_access_tokens
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`
+	rows, err := ts.db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []model.PersonalAccessToken{}
+	for rows.Next() {
+		var token model.PersonalAccessToken
+		var scopes string
+		var lastUsedAt sql.NullTime
+		err := rows.Scan(&token.ID, &token.UserID, &token.Name, &scopes, &token.CreatedAt, &token.ExpiresAt, &lastUsedAt)
+		if err != nil {
+			return nil, err
+		}
+		token.Scopes = model.ParseScopes(scopes)
+		if lastUsedAt.Valid {
+			token.LastUsedAt = &lastUsedAt.Time
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeToken deletes a personal access token of userID
+func (ts *TokenService) RevokeToken(userID int, tokenID int) error {
+	result, err := ts.db.Exec(`DELETE FROM personal_access_tokens WHERE id = $1 AND user_id = $2`, tokenID, userID)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrTokenNotFound
+	}
+
+	slog.Info("Revoked personal access token", "user_id", userID, "token_id", tokenID)
+	return nil
+}
+
+// RevokeAllTokens deletes every personal access token of userID, those
+// issued to devices included, and denies the device authorizations approved
+// but not exchanged yet. It returns the IDs of the deleted tokens.
+func (ts *TokenService) RevokeAllTokens(userID int) ([]int, error) {
+	tx, err := ts.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE device_authorizations SET status = $1 WHERE user_id = $2 AND status = $3`,
+		model.DeviceStatusDenied, userID, model.DeviceStatusApproved)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(`DELETE FROM personal_access_tokens WHERE user_id = $1 RETURNING id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revoked := []int{}
+	for rows.Next() {
+		var tokenID int
+		if err := rows.Scan(&tokenID); err != nil {
+			return nil, err
+		}
+		revoked = append(revoked, tokenID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	slog.Info("Revoked all personal access tokens", "user_id", userID, "count", len(revoked))
+	return revoked, nil
+}
+
+// TouchToken records that a token was just used
+func (ts *TokenService) TouchToken(tokenID int) error {
+	now := time.Now()
+	query := `
+		UPDATE personal_access_tokens SET last_used_at = $2
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < $3)
+	`
+	_, err := ts.db.Exec(query, tokenID, now, now.Add(-tokenTouchInterval))
+	return err
+}
+
+// FindUserByPersonalToken looks up a user through an unexpired personal
+// access token. The returned user carries the token's scopes.
+func (ts *TokenService) FindUserByPersonalToken(rawToken string) (*model.UserModel, error) {
+	if !strings.HasPrefix(rawToken, PersonalTokenPrefix) {
+		return nil, ErrTokenNotFound
+	}
+	query := `
+		SELECT u.id, u.username, u.email, t.id, t.scopes
+		FROM personal_access_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1 AND t.expires_at > $2
+	`
+
+	var user model.UserModel
+	var scopes string
+	err := ts.db.QueryRow(query, hashToken(rawToken), time.Now()).Scan(
+		&user.ID,
+		&user.Username,
+		&user.Email,
+		&user.TokenID,
+		&scopes,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user.Scopes = model.ParseScopes(scopes)
+	return &user, nil
+}
@@ -0,0 +1,189 @@
+package service
+
+import (
+	"cito/server/model"
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"cito/server/testutil"
+)
+
+func TestTokenService_CreateToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		tokenName string
+		scopes    model.Scopes
+		ttl       time.Duration
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+	}{
+		{
+			name:      "creates token with hashed value",
+			tokenName: "deploy bot",
+			scopes:    model.Scopes{model.ScopeRead, model.ScopeWrite},
+			ttl:       30 * 24 * time.Hour,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`INSERT INTO personal_access_tokens`).
+					WithArgs(1, "deploy bot", sqlmock.AnyArg(), "read,write", sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(5))
+			},
+		},
+		{
+			name:      "rejects empty name",
+			tokenName: "  ",
+			scopes:    model.Scopes{model.ScopeRead},
+			ttl:       time.Hour,
+			mockSetup: func(mock sqlmock.Sqlmock) {},
+			wantErr:   ErrInvalidToken,
+		},
+		{
+			name:      "rejects missing scopes",
+			tokenName: "bot",
+			ttl:       time.Hour,
+			mockSetup: func(mock sqlmock.Sqlmock) {},
+			wantErr:   ErrInvalidToken,
+		},
+		{
+			name:      "rejects unknown scope",
+			tokenName: "bot",
+			scopes:    model.Scopes{"superuser"},
+			ttl:       time.Hour,
+			mockSetup: func(mock sqlmock.Sqlmock) {},
+			wantErr:   ErrInvalidToken,
+		},
+		{
+			name:      "rejects expiry beyond a year",
+			tokenName: "bot",
+			scopes:    model.Scopes{model.ScopeRead},
+			ttl:       MaxPersonalTokenTTL + time.Hour,
+			mockSetup: func(mock sqlmock.Sqlmock) {},
+			wantErr:   ErrInvalidToken,
+		},
+		{
+			name:      "handles database error",
+			tokenName: "bot",
+			scopes:    model.Scopes{model.ScopeRead},
+			ttl:       time.Hour,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`INSERT INTO personal_access_tokens`).
+					WillReturnError(sql.ErrConnDone)
+			},
+			wantErr: sql.ErrConnDone,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.SetupMockDB(t)
+			defer cleanup()
+			tt.mockSetup(mock)
+
+			ts := NewTokenService(db)
+			rawToken, token, err := ts.CreateToken(1, tt.tokenName, tt.scopes, tt.ttl)
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				assert.Empty(t, rawToken)
+			} else {
+				require.NoError(t, err)
+				assert.True(t, strings.HasPrefix(rawToken, PersonalTokenPrefix))
+				assert.Equal(t, 5, token.ID)
+				assert.Equal(t, tt.scopes, token.Scopes)
+				assert.WithinDuration(t, time.Now().Add(tt.ttl), token.ExpiresAt, time.Minute)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestTokenService_ListTokens(t *testing.T) {
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	now := time.Now()
+	mock.ExpectQuery(`SELECT (.+) FROM personal_access_tokens WHERE user_id`).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "name", "scopes", "created_at", "expires_at", "last_used_at"}).
+			AddRow(2, 1, "cli", "read,write", now, now.Add(time.Hour), now).
+			AddRow(1, 1, "script", "admin", now, now.Add(time.Hour), nil))
+
+	tokens, err := NewTokenService(db).ListTokens(1)
+	require.NoError(t, err)
+	require.Len(t, tokens, 2)
+	assert.Equal(t, model.Scopes{model.ScopeRead, model.ScopeWrite}, tokens[0].Scopes)
+	assert.NotNil(t, tokens[0].LastUsedAt)
+	assert.Nil(t, tokens[1].LastUsedAt)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTokenService_RevokeToken(t *testing.T) {
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	mock.ExpectExec(`DELETE FROM personal_access_tokens WHERE id = \$1 AND user_id = \$2`).
+		WithArgs(2, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM personal_access_tokens WHERE id = \$1 AND user_id = \$2`).
+		WithArgs(3, 1).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	ts := NewTokenService(db)
+	require.NoError(t, ts.RevokeToken(1, 2))
+	assert.ErrorIs(t, ts.RevokeToken(1, 3), ErrTokenNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTokenService_RevokeAllTokens(t *testing.T) {
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE device_authorizations SET status = \$1 WHERE user_id = \$2 AND status = \$3`).
+		WithArgs(model.DeviceStatusDenied, 1, model.DeviceStatusApproved).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`DELETE FROM personal_access_tokens WHERE user_id = \$1 RETURNING id`).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2).AddRow(3))
+	mock.ExpectCommit()
+
+	revoked, err := NewTokenService(db).RevokeAllTokens(1)
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 3}, revoked)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTokenService_FindUserByPersonalToken(t *testing.T) {
+	t.Run("valid token returns user with token scopes", func(t *testing.T) {
+		db, mock, cleanup := testutil.SetupMockDB(t)
+		defer cleanup()
+
+		rawToken := PersonalTokenPrefix + "abc"
+		mock.ExpectQuery(`SELECT (.+) FROM personal_access_tokens t JOIN users u`).
+			WithArgs(hashToken(rawToken), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email", "token_id", "scopes"}).
+				AddRow(1, "testuser", "test@example.com", 7, "read"))
+
+		user, err := NewTokenService(db).FindUserByPersonalToken(rawToken)
+		require.NoError(t, err)
+		assert.Equal(t, 7, user.TokenID)
+		assert.Zero(t, user.SessionID)
+		assert.Equal(t, model.Scopes{model.ScopeRead}, user.Scopes)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("session tokens are not accepted as personal tokens", func(t *testing.T) {
+		db, mock, cleanup := testutil.SetupMockDB(t)
+		defer cleanup()
+
+		user, err := NewTokenService(db).FindUserByPersonalToken("0123abcd")
+		assert.ErrorIs(t, err, ErrTokenNotFound)
+		assert.Nil(t, user)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
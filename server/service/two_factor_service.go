@@ -0,0 +1,367 @@
+package service
+
+import (
+	"cito/server/keyring"
+	"cito/server/totp"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const (
+	// RecoveryCodeCount is how many single use recovery codes a user gets
+	RecoveryCodeCount = 10
+	// LoginChallengeTTL is how long a user has to enter their second factor
+	LoginChallengeTTL = 5 * time.Minute
+	// maxChallengeAttempts limits guessing codes for one sign-in
+	maxChallengeAttempts = 5
+	// totpSkew accepts codes one step before or after the current one
+	totpSkew   = 1
+	totpIssuer = "cito"
+)
+
+var (
+	ErrTwoFactorNotEnrolled     = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorAlreadyEnabled  = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorRequired        = errors.New("two-factor authentication is required by a workspace")
+	ErrInvalidCode              = errors.New("invalid code")
+	ErrChallengeNotFound        = errors.New("login challenge not found")
+	ErrTooManyChallengeAttempts = errors.New("too many attempts")
+)
+
+// TwoFactorService manages TOTP enrollment, recovery codes and the pending
+// sign-ins waiting for a second factor
+type TwoFactorService struct {
+	db *sql.DB
+	// keyring encrypts TOTP secrets at rest
+	keyring          *keyring.Keyring
+	workspaceService *WorkspaceService
+}
+
+func NewTwoFactorService(db *sql.DB, keyring *keyring.Keyring, workspaceService *WorkspaceService) *TwoFactorService {
+	return &TwoFactorService{db: db, keyring: keyring, workspaceService: workspaceService}
+}
+
+// TwoFactorStatus describes the second factor state of a user
+type TwoFactorStatus struct {
+	Enabled bool `json:"enabled"`
+	// Required is set when a workspace of the user requires two-factor
+	// authentication
+	Required               bool `json:"required"`
+	RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+}
+
+// Status returns the second factor state of userID
+func (tfs *TwoFactorService) Status(userID int) (*TwoFactorStatus, error) {
+	var status TwoFactorStatus
+	err := tfs.db.QueryRow(`
+		SELECT
+			EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL),
+			(SELECT COUNT(*) FROM recovery_codes WHERE user_id = $1 AND used_at IS NULL)
+	`, userID).Scan(&status.Enabled, &status.RecoveryCodesRemaining)
+	if err != nil {
+		return nil, err
+	}
+	status.Required, err = tfs.workspaceService.RequiresTwoFactor(userID)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// NeedsSecondFactor reports whether signing in as userID takes a second
+// step, either to enter a code or to enroll because a workspace requires it
+func (tfs *TwoFactorService) NeedsSecondFactor(userID int) (bool, error) {
+	status, err := tfs.Status(userID)
+	if err != nil {
+		return false, err
+	}
+	return status.Enabled || status.Required, nil
+}
+
+// BeginEnrollment generates a new TOTP secret for userID. It only takes
+// effect once confirmed with a code from the authenticator app.
+func (tfs *TwoFactorService) BeginEnrollment(userID int, accountName string) (string, string, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", "", err
+	}
+	encryptedSecret, err := tfs.keyring.Encrypt(secret)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to encrypt TOTP secret: %w", err)
+	}
+
+	// An enabled secret is never replaced, disable two-factor first
+	result, err := tfs.db.Exec(`
+		INSERT INTO user_totp (user_id, secret, last_used_step, created_at) VALUES ($1, $2, 0, $3)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, created_at = EXCLUDED.created_at
+		WHERE user_totp.enabled_at IS NULL
+	`, userID, encryptedSecret, time.Now())
+	if err != nil {
+		return "", "", err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return "", "", err
+	} else if affected == 0 {
+		return "", "", ErrTwoFactorAlreadyEnabled
+	}
+
+	return secret, totp.URI(totpIssuer, accountName, secret), nil
+}
+
+// ResumeEnrollment returns the pending secret of userID, so that a page
+// shown again keeps the one already added to an authenticator app. It
+// begins an enrollment when none is pending.
+func (tfs *TwoFactorService) ResumeEnrollment(userID int, accountName string) (string, string, error) {
+	secret, err := tfs.pendingSecret(userID)
+	if errors.Is(err, ErrTwoFactorNotEnrolled) {
+		return tfs.BeginEnrollment(userID, accountName)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return secret, totp.URI(totpIssuer, accountName, secret), nil
+}
+
+// pendingSecret returns the secret of userID awaiting confirmation
+func (tfs *TwoFactorService) pendingSecret(userID int) (string, error) {
+	var encryptedSecret string
+	var enabledAt sql.NullTime
+	err := tfs.db.QueryRow(`SELECT secret, enabled_at FROM user_totp WHERE user_id = $1`, userID).Scan(&encryptedSecret, &enabledAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrTwoFactorNotEnrolled
+	}
+	if err != nil {
+		return "", err
+	}
+	if enabledAt.Valid {
+		return "", ErrTwoFactorAlreadyEnabled
+	}
+	secret, err := tfs.keyring.Decrypt(encryptedSecret)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt TOTP secret: %w", err)
+	}
+	return secret, nil
+}
+
+// ConfirmEnrollment enables two-factor authentication once code matches the
+// pending secret and returns a fresh set of recovery codes
+func (tfs *TwoFactorService) ConfirmEnrollment(userID int, code string) ([]string, error) {
+	secret, err := tfs.pendingSecret(userID)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := totp.Validate(secret, code, time.Now(), totpSkew)
+	if !ok {
+		return nil, ErrInvalidCode
+	}
+
+	tx, err := tfs.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE user_totp SET enabled_at = $1, last_used_step = $2 WHERE user_id = $3`, time.Now(), step, userID); err != nil {
+		return nil, err
+	}
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	slog.Info("Two-factor authentication enabled", "user_id", userID)
+	return codes, nil
+}
+
+// generateRecoveryCode returns a code like "abcde-fghij"
+func generateRecoveryCode() (string, error) {
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+// normalizeRecoveryCode accepts user input in any case, with or without the dash
+func normalizeRecoveryCode(input string) string {
+	code := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(input))
+	if len(code) != 10 {
+		return code
+	}
+	return code[:5] + "-" + code[5:]
+}
+
+// replaceRecoveryCodes drops the recovery codes of userID and stores new ones
+func replaceRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, RecoveryCodeCount)
+	for i := 0; i < RecoveryCodeCount; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`, userID, hashToken(code)); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// Verify checks a TOTP code or an unused recovery code for userID. Each
+// TOTP code and each recovery code is accepted only once.
+func (tfs *TwoFactorService) Verify(userID int, code string) error {
+	code = strings.TrimSpace(code)
+	var encryptedSecret string
+	err := tfs.db.QueryRow(`SELECT secret FROM user_totp WHERE user_id = $1 AND enabled_at IS NOT NULL`, userID).Scan(&encryptedSecret)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrTwoFactorNotEnrolled
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(strings.ReplaceAll(code, " ", "")) == totp.Digits {
+		secret, err := tfs.keyring.Decrypt(encryptedSecret)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt TOTP secret: %w", err)
+		}
+		step, ok := totp.Validate(secret, code, time.Now(), totpSkew)
+		if !ok {
+			return ErrInvalidCode
+		}
+		// Moving last_used_step forward only succeeds once per code
+		result, err := tfs.db.Exec(`UPDATE user_totp SET last_used_step = $1 WHERE user_id = $2 AND last_used_step < $1`, step, userID)
+		if err != nil {
+			return err
+		}
+		if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+			return ErrInvalidCode
+		}
+		return nil
+	}
+
+	result, err := tfs.db.Exec(`
+		UPDATE recovery_codes SET used_at = $1
+		WHERE user_id = $2 AND code_hash = $3 AND used_at IS NULL
+	`, time.Now(), userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil || affected == 0 {
+		return ErrInvalidCode
+	}
+	slog.Info("Recovery code used", "user_id", userID)
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of userID after
+// checking code
+func (tfs *TwoFactorService) RegenerateRecoveryCodes(userID int, code string) ([]string, error) {
+	if err := tfs.Verify(userID, code); err != nil {
+		return nil, err
+	}
+	tx, err := tfs.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// Disable turns two-factor authentication off after checking code. It is
+// refused while a workspace of the user requires it.
+func (tfs *TwoFactorService) Disable(userID int, code string) error {
+	required, err := tfs.workspaceService.RequiresTwoFactor(userID)
+	if err != nil {
+		return err
+	}
+	if required {
+		return ErrTwoFactorRequired
+	}
+	if err := tfs.Verify(userID, code); err != nil {
+		return err
+	}
+
+	tx, err := tfs.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM user_totp WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	slog.Info("Two-factor authentication disabled", "user_id", userID)
+	return nil
+}
+
+// CreateChallenge records a sign-in of userID that passed the identity
+// provider and waits for the second factor. It returns the challenge token.
+func (tfs *TwoFactorService) CreateChallenge(userID int) (string, error) {
+	token, err := generateSessionToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	_, err = tfs.db.Exec(`
+		INSERT INTO login_challenges (token_hash, user_id, attempts, created_at, expires_at)
+		VALUES ($1, $2, 0, $3, $4)
+	`, hashToken(token), userID, now, now.Add(LoginChallengeTTL))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// FindChallenge returns the user of an unexpired challenge that has
+// attempts left
+func (tfs *TwoFactorService) FindChallenge(token string) (int, error) {
+	var userID, attempts int
+	err := tfs.db.QueryRow(`
+		SELECT user_id, attempts FROM login_challenges WHERE token_hash = $1 AND expires_at > $2
+	`, hashToken(token), time.Now()).Scan(&userID, &attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrChallengeNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	if attempts >= maxChallengeAttempts {
+		return 0, ErrTooManyChallengeAttempts
+	}
+	return userID, nil
+}
+
+// RecordFailedAttempt counts a wrong code against a challenge
+func (tfs *TwoFactorService) RecordFailedAttempt(token string) error {
+	_, err := tfs.db.Exec(`UPDATE login_challenges SET attempts = attempts + 1 WHERE token_hash = $1`, hashToken(token))
+	return err
+}
+
+// DeleteChallenge ends a challenge once the sign-in completed
+func (tfs *TwoFactorService) DeleteChallenge(token string) error {
+	_, err := tfs.db.Exec(`DELETE FROM login_challenges WHERE token_hash = $1`, hashToken(token))
+	return err
+}
@@ -0,0 +1,265 @@
+package service
+
+import (
+	"cito/server/testutil"
+	"cito/server/totp"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func newTestTwoFactorService(t *testing.T, db *sql.DB) *TwoFactorService {
+	return NewTwoFactorService(db, testutil.NewTestKeyring(t), NewWorkspaceService(db))
+}
+
+func TestGenerateRecoveryCode(t *testing.T) {
+	code, err := generateRecoveryCode()
+	require.NoError(t, err)
+	assert.Regexp(t, `^[a-z2-7]{5}-[a-z2-7]{5}$`, code)
+	assert.Equal(t, code, normalizeRecoveryCode(" "+code[:5]+code[6:]+" "))
+}
+
+func TestTwoFactorService_BeginEnrollment(t *testing.T) {
+	tests := []struct {
+		name     string
+		affected int64
+		wantErr  error
+	}{
+		{name: "stores pending secret", affected: 1},
+		{name: "already enabled", affected: 0, wantErr: ErrTwoFactorAlreadyEnabled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.SetupMockDB(t)
+			defer cleanup()
+
+			mock.ExpectExec(`INSERT INTO user_totp (.+) WHERE user_totp.enabled_at IS NULL`).
+				WithArgs(1, sqlmock.AnyArg(), sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(0, tt.affected))
+
+			secret, uri, err := newTestTwoFactorService(t, db).BeginEnrollment(1, "alice")
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+				assert.Len(t, secret, 32)
+				assert.Contains(t, uri, "otpauth://totp/cito:alice?")
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestTwoFactorService_ResumeEnrollment(t *testing.T) {
+	keys := testutil.NewTestKeyring(t)
+	encrypted, err := keys.Encrypt(testTOTPSecret)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		rows       *sqlmock.Rows
+		begins     bool
+		wantSecret string
+		wantErr    error
+	}{
+		{name: "pending secret", rows: sqlmock.NewRows([]string{"secret", "enabled_at"}).AddRow(encrypted, nil), wantSecret: testTOTPSecret},
+		{name: "nothing pending", rows: sqlmock.NewRows([]string{"secret", "enabled_at"}), begins: true},
+		{name: "already enabled", rows: sqlmock.NewRows([]string{"secret", "enabled_at"}).AddRow(encrypted, time.Now()), wantErr: ErrTwoFactorAlreadyEnabled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.SetupMockDB(t)
+			defer cleanup()
+
+			mock.ExpectQuery(`SELECT secret, enabled_at FROM user_totp`).WithArgs(1).WillReturnRows(tt.rows)
+			if tt.begins {
+				mock.ExpectExec(`INSERT INTO user_totp`).WithArgs(1, sqlmock.AnyArg(), sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			secret, uri, err := NewTwoFactorService(db, keys, NewWorkspaceService(db)).ResumeEnrollment(1, "alice")
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+				assert.Contains(t, uri, "otpauth://totp/cito:alice?")
+				assert.Contains(t, uri, "secret="+secret)
+			}
+			if tt.wantSecret != "" {
+				assert.Equal(t, tt.wantSecret, secret)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestTwoFactorService_ConfirmEnrollment(t *testing.T) {
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	keys := testutil.NewTestKeyring(t)
+	encrypted, err := keys.Encrypt(testTOTPSecret)
+	require.NoError(t, err)
+	code, err := totp.Code(testTOTPSecret, time.Now())
+	require.NoError(t, err)
+
+	mock.ExpectQuery(`SELECT secret, enabled_at FROM user_totp`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"secret", "enabled_at"}).AddRow(encrypted, nil))
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE user_totp SET enabled_at`).WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM recovery_codes`).WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 0; i < RecoveryCodeCount; i++ {
+		mock.ExpectExec(`INSERT INTO recovery_codes`).WithArgs(1, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	tfs := NewTwoFactorService(db, keys, NewWorkspaceService(db))
+	codes, err := tfs.ConfirmEnrollment(1, code)
+	require.NoError(t, err)
+	assert.Len(t, codes, RecoveryCodeCount)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTwoFactorService_Verify(t *testing.T) {
+	keys := testutil.NewTestKeyring(t)
+	encrypted, err := keys.Encrypt(testTOTPSecret)
+	require.NoError(t, err)
+	code, err := totp.Code(testTOTPSecret, time.Now())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		code      string
+		enrolled  bool
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+	}{
+		{
+			name:     "current TOTP code",
+			code:     code,
+			enrolled: true,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`UPDATE user_totp SET last_used_step (.+) AND last_used_step <`).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+		},
+		{
+			name:     "replayed TOTP code",
+			code:     code,
+			enrolled: true,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`UPDATE user_totp SET last_used_step`).WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			wantErr: ErrInvalidCode,
+		},
+		{
+			name:      "wrong TOTP code",
+			code:      "000000",
+			enrolled:  true,
+			mockSetup: func(mock sqlmock.Sqlmock) {},
+			wantErr:   ErrInvalidCode,
+		},
+		{
+			name:     "unused recovery code",
+			code:     "ABCDE-FGHIJ",
+			enrolled: true,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`UPDATE recovery_codes SET used_at`).
+					WithArgs(sqlmock.AnyArg(), 1, hashToken("abcde-fghij")).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+		},
+		{
+			name:     "used recovery code",
+			code:     "abcde-fghij",
+			enrolled: true,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(`UPDATE recovery_codes SET used_at`).WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+			wantErr: ErrInvalidCode,
+		},
+		{
+			name:      "not enrolled",
+			code:      code,
+			mockSetup: func(mock sqlmock.Sqlmock) {},
+			wantErr:   ErrTwoFactorNotEnrolled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.SetupMockDB(t)
+			defer cleanup()
+
+			query := mock.ExpectQuery(`SELECT secret FROM user_totp`).WithArgs(1)
+			if tt.enrolled {
+				query.WillReturnRows(sqlmock.NewRows([]string{"secret"}).AddRow(encrypted))
+			} else {
+				query.WillReturnError(sql.ErrNoRows)
+			}
+			tt.mockSetup(mock)
+
+			err := NewTwoFactorService(db, keys, NewWorkspaceService(db)).Verify(1, tt.code)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestTwoFactorService_Disable_RequiredByWorkspace(t *testing.T) {
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	mock.ExpectQuery(`FROM workspace_members`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	err := newTestTwoFactorService(t, db).Disable(1, "123456")
+	assert.ErrorIs(t, err, ErrTwoFactorRequired)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestTwoFactorService_FindChallenge(t *testing.T) {
+	tests := []struct {
+		name     string
+		rows     *sqlmock.Rows
+		wantUser int
+		wantErr  error
+	}{
+		{name: "pending challenge", rows: sqlmock.NewRows([]string{"user_id", "attempts"}).AddRow(7, 2), wantUser: 7},
+		{name: "too many attempts", rows: sqlmock.NewRows([]string{"user_id", "attempts"}).AddRow(7, maxChallengeAttempts), wantErr: ErrTooManyChallengeAttempts},
+		{name: "unknown or expired", rows: sqlmock.NewRows([]string{"user_id", "attempts"}), wantErr: ErrChallengeNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.SetupMockDB(t)
+			defer cleanup()
+
+			mock.ExpectQuery(`SELECT user_id, attempts FROM login_challenges`).
+				WithArgs(hashToken("challenge"), sqlmock.AnyArg()).
+				WillReturnRows(tt.rows)
+
+			userID, err := newTestTwoFactorService(t, db).FindChallenge("challenge")
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tt.wantUser, userID)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -1,75 +1,291 @@
 package service
 
 import (
+	"cito/server/keyring"
+	"cito/server/logging"
 	"cito/server/model"
-	"crypto/rand"
-	"database/sql"
-	"encoding/hex"
+	"cito/server/tracing"
+	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
+)
+
+var (
+	// ErrIdentityConflict is returned when linking an identity that already
+	// belongs to another account
+	ErrIdentityConflict = errors.New("identity is linked to another account")
+	// ErrLastIdentity is returned when unlinking would leave an account
+	// without any way to sign in
+	ErrLastIdentity     = errors.New("cannot unlink the last identity")
+	ErrIdentityNotFound = errors.New("identity not found")
 )
 
 type UserService struct {
-	db *sql.DB
+	users UserRepository
+	// keyring encrypts identity provider access tokens at rest
+	keyring *keyring.Keyring
+}
+
+func NewUserService(users UserRepository, keyring *keyring.Keyring) *UserService {
+	return &UserService{users: users, keyring: keyring}
 }
 
-func NewUserService(db *sql.DB) *UserService {
-	return &UserService{db: db}
+// querySpan starts the span of a query to the users repository, named after
+// the repository method
+func querySpan(ctx context.Context, operation string) trace.Span {
+	_, span := tracing.Tracer().Start(ctx, "users."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.operation.name", operation)))
+	return span
 }
 
-// generateSessionToken creates a random hex session token
-func generateSessionToken() (string, error) {
-	bytes := make([]byte, 32)
-	if _, err := rand.Read(bytes); err != nil {
-		return "", err
+// UpsertIdentity signs in a provider identity. The identity's profile and
+// tokens are refreshed and a revoked authorization counts as granted again;
+// an identity seen for the first time gets a new user, or the imported
+// placeholder with its verified email. It returns the user ID.
+func (us *UserService) UpsertIdentity(ctx context.Context, identity model.Identity, token *oauth2.Token) (int, error) {
+	sealed, err := us.sealToken(token)
+	if err != nil {
+		return 0, err
+	}
+	span := querySpan(ctx, "UpsertIdentity")
+	userID, err := us.users.UpsertIdentity(identity, sealed, time.Now())
+	tracing.End(span, err)
+	if err != nil {
+		return 0, err
 	}
-	return hex.EncodeToString(bytes), nil
+
+	logging.FromContext(ctx).Info("Upserted identity", "provider", identity.Provider, "subject", identity.Subject, "username", identity.Username, "user_id", userID)
+	return userID, nil
 }
 
-// UpsertUser inserts or updates a user based on GitHub ID
-func (us *UserService) UpsertUser(githubUser model.GitHubUser, accessToken string) (string, error) {
-	sessionToken, err := generateSessionToken()
+// LinkIdentity attaches identity to the existing account userID. Linking an
+// identity the account already has refreshes its profile and tokens.
+func (us *UserService) LinkIdentity(ctx context.Context, userID int, identity model.Identity, token *oauth2.Token) error {
+	sealed, err := us.sealToken(token)
 	if err != nil {
-		return "", err
-	}
-	query := `
-		INSERT INTO users (github_id, username, email, access_token, session_token)
-		VALUES ($1, $2, $3, $4, $5)
-		ON CONFLICT (github_id)
-		DO UPDATE SET
-			username = EXCLUDED.username,
-			email = EXCLUDED.email,
-			access_token = EXCLUDED.access_token,
-			session_token = EXCLUDED.session_token
-		RETURNING session_token
-	`
-
-	var returnedToken string
-	err = us.db.QueryRow(query, githubUser.ID, githubUser.Login, githubUser.Email, accessToken, sessionToken).Scan(&returnedToken)
+		return err
+	}
+	span := querySpan(ctx, "LinkIdentity")
+	err = us.users.LinkIdentity(userID, identity, sealed, time.Now())
+	tracing.End(span, err)
+	if errors.Is(err, ErrIdentityConflict) {
+		logging.FromContext(ctx).Warn("Identity already linked to another account", "provider", identity.Provider, "subject", identity.Subject, "user_id", userID)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	logging.FromContext(ctx).Info("Linked identity", "provider", identity.Provider, "subject", identity.Subject, "user_id", userID)
+	return nil
+}
+
+// sealToken encrypts the access and refresh tokens of token
+func (us *UserService) sealToken(token *oauth2.Token) (SealedToken, error) {
+	sealed := SealedToken{ExpiresAt: token.Expiry}
+	var err error
+	sealed.AccessToken, err = us.keyring.Encrypt(token.AccessToken)
 	if err != nil {
-		return "", err
+		return sealed, fmt.Errorf("failed to encrypt access token: %w", err)
+	}
+	if token.RefreshToken != "" {
+		sealed.RefreshToken, err = us.keyring.Encrypt(token.RefreshToken)
+		if err != nil {
+			return sealed, fmt.Errorf("failed to encrypt refresh token: %w", err)
+		}
 	}
+	return sealed, nil
+}
 
-	slog.Info("Upserted user", "github_id", githubUser.ID, "username", githubUser.Login, "session_token", returnedToken)
-	return returnedToken, nil
+// IdentityToken is the provider token stored for an identity
+type IdentityToken struct {
+	IdentityID int
+	UserID     int
+	Provider   string
+	// Token is nil once the authorization was revoked
+	Token *oauth2.Token
 }
 
-// FindUserBySession looks up a user by their session token
-func (us *UserService) FindUserBySession(sessionToken string) (*model.UserModel, error) {
-	query := `SELECT id, github_id, username, email, access_token, session_token FROM users WHERE session_token = $1`
+// openToken decrypts a stored identity token
+func (us *UserService) openToken(stored StoredIdentityToken) (*IdentityToken, error) {
+	identityToken := IdentityToken{IdentityID: stored.IdentityID, UserID: stored.UserID, Provider: stored.Provider}
+	if stored.Token == nil {
+		return &identityToken, nil
+	}
 
-	var user model.UserModel
-	err := us.db.QueryRow(query, sessionToken).Scan(
-		&user.ID,
-		&user.GithubID,
-		&user.Username,
-		&user.Email,
-		&user.AccessToken,
-		&user.SessionToken,
-	)
+	token := &oauth2.Token{TokenType: "Bearer", Expiry: stored.Token.ExpiresAt}
+	var err error
+	if token.AccessToken, err = us.keyring.Decrypt(stored.Token.AccessToken); err != nil {
+		return nil, fmt.Errorf("identity %d: %w", stored.IdentityID, err)
+	}
+	if stored.Token.RefreshToken != "" {
+		if token.RefreshToken, err = us.keyring.Decrypt(stored.Token.RefreshToken); err != nil {
+			return nil, fmt.Errorf("identity %d: %w", stored.IdentityID, err)
+		}
+	}
+	identityToken.Token = token
+	return &identityToken, nil
+}
 
+// FindIdentityToken returns the stored token of one of userID's identities
+func (us *UserService) FindIdentityToken(ctx context.Context, userID int, identityID int) (*IdentityToken, error) {
+	span := querySpan(ctx, "FindIdentityToken")
+	stored, err := us.users.FindIdentityToken(userID, identityID)
+	tracing.End(span, err)
 	if err != nil {
 		return nil, err
 	}
+	return us.openToken(*stored)
+}
 
-	return &user, nil
+// IdentityTokensToVerify returns up to limit tokens of provider that were
+// last verified before checkedBefore, least recently verified first. Tokens
+// that can't be decrypted are left out and count as checked, so they don't
+// hold up the rest of the queue.
+func (us *UserService) IdentityTokensToVerify(ctx context.Context, provider string, checkedBefore time.Time, limit int) ([]IdentityToken, error) {
+	span := querySpan(ctx, "IdentityTokensToVerify")
+	stored, err := us.users.IdentityTokensToVerify(provider, checkedBefore, limit)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	identityTokens := make([]IdentityToken, 0, len(stored))
+	for _, storedToken := range stored {
+		identityToken, err := us.openToken(storedToken)
+		if err != nil {
+			slog.Warn("Failed to decrypt identity token", "error", err, "identity_id", storedToken.IdentityID, "provider", provider)
+			if err := us.MarkIdentityChecked(ctx, storedToken.IdentityID, time.Now()); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		identityTokens = append(identityTokens, *identityToken)
+	}
+	return identityTokens, nil
+}
+
+// MarkIdentityChecked records checkedAt as the last check of an identity's
+// token, which moves it behind the tokens checked before then
+func (us *UserService) MarkIdentityChecked(ctx context.Context, identityID int, checkedAt time.Time) error {
+	span := querySpan(ctx, "MarkIdentityChecked")
+	err := us.users.MarkIdentityChecked(identityID, checkedAt)
+	tracing.End(span, err)
+	return err
+}
+
+// UpdateIdentityToken stores a verified, possibly refreshed, token
+func (us *UserService) UpdateIdentityToken(ctx context.Context, identityID int, token *oauth2.Token) error {
+	sealed, err := us.sealToken(token)
+	if err != nil {
+		return err
+	}
+	span := querySpan(ctx, "UpdateIdentityToken")
+	err = us.users.UpdateIdentityToken(identityID, sealed, time.Now())
+	tracing.End(span, err)
+	return err
+}
+
+// MarkIdentityRevoked records that the provider no longer accepts the
+// identity's token and drops the token. It returns ErrIdentityNotFound when
+// the identity is unknown or already marked.
+func (us *UserService) MarkIdentityRevoked(ctx context.Context, identityID int) (*model.Identity, error) {
+	span := querySpan(ctx, "MarkIdentityRevoked")
+	identity, err := us.users.MarkIdentityRevoked(identityID, time.Now())
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	logging.FromContext(ctx).Warn("Identity authorization revoked", "identity_id", identityID, "provider", identity.Provider, "user_id", identity.UserID)
+	return identity, nil
+}
+
+// ListIdentities returns the identities linked to userID, oldest first
+func (us *UserService) ListIdentities(ctx context.Context, userID int) ([]model.Identity, error) {
+	span := querySpan(ctx, "ListIdentities")
+	identities, err := us.users.ListIdentities(userID)
+	tracing.End(span, err)
+	return identities, err
+}
+
+// UnlinkIdentity removes one of userID's identities as long as another one
+// remains to sign in with
+func (us *UserService) UnlinkIdentity(ctx context.Context, userID int, identityID int) error {
+	span := querySpan(ctx, "UnlinkIdentity")
+	err := us.users.UnlinkIdentity(userID, identityID)
+	tracing.End(span, err)
+	if err != nil {
+		return err
+	}
+
+	logging.FromContext(ctx).Info("Unlinked identity", "identity_id", identityID, "user_id", userID)
+	return nil
+}
+
+// FindUserByID returns the profile of a user
+func (us *UserService) FindUserByID(ctx context.Context, userID int) (*model.UserModel, error) {
+	span := querySpan(ctx, "FindUserByID")
+	user, err := us.users.FindUserByID(userID)
+	tracing.End(span, err)
+	return user, err
+}
+
+// FindUserBySession looks up a user through the unexpired session owning the
+// token. A token replaced by rotation is still accepted for a short grace period.
+func (us *UserService) FindUserBySession(ctx context.Context, sessionToken string) (*model.UserModel, error) {
+	now := time.Now()
+	span := querySpan(ctx, "FindUserBySession")
+	user, err := us.users.FindUserBySession(hashToken(sessionToken), now, now.Add(-sessionRotationGrace))
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	// Browser sessions may do everything the user can
+	user.Scopes = model.AllScopes
+
+	return user, nil
+}
+
+// ReencryptAccessTokens seals every stored access and refresh token and TOTP
+// secret with the current key. It picks up tokens written before encryption
+// existed as well as values sealed with a retired key, and returns how many
+// were rewritten.
+func (us *UserService) ReencryptAccessTokens(ctx context.Context) (int, error) {
+	span := querySpan(ctx, "ResealTokens")
+	total, err := us.users.ResealTokens(us.reseal)
+	tracing.End(span, err)
+	if err != nil {
+		return total, err
+	}
+
+	slog.Info("Re-encrypted access tokens and TOTP secrets", "count", total, "key_version", us.keyring.CurrentVersion())
+	return total, nil
+}
+
+// reseal encrypts a stored token with the current key unless it already is
+func (us *UserService) reseal(stored string) (string, bool, error) {
+	if !us.keyring.NeedsRotation(stored) {
+		return stored, false, nil
+	}
+	plaintext := stored
+	if _, _, sealed := keyring.Version(stored); sealed {
+		var err error
+		if plaintext, err = us.keyring.Decrypt(stored); err != nil {
+			return "", false, err
+		}
+	}
+	resealed, err := us.keyring.Encrypt(plaintext)
+	if err != nil {
+		return "", false, err
+	}
+	return resealed, true, nil
 }
@@ -1,83 +1,78 @@
 package service
 
 import (
+	"bytes"
+	"cito/server/keyring"
 	"cito/server/model"
+	"cito/server/tracing"
+	"context"
 	"database/sql"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
 
 	"cito/server/testutil"
 )
 
-func TestGenerateSessionToken(t *testing.T) {
-	// Test that session token is generated
-	token, err := generateSessionToken()
-	require.NoError(t, err, "should generate token without error")
-	assert.NotEmpty(t, token, "token should not be empty")
-	assert.Equal(t, 64, len(token), "token should be 64 characters (32 bytes hex encoded)")
+func TestUserService_UpsertIdentity(t *testing.T) {
+	keys := testutil.NewTestKeyring(t)
+	identity := model.GitHubUser{ID: 12345, Login: "testuser", Email: "test@example.com", EmailVerified: true}.Identity()
+	expiry := time.Now().Add(8 * time.Hour)
+	token := &oauth2.Token{AccessToken: "github_token_123", RefreshToken: "refresh_123", Expiry: expiry}
+	tokenArg := testutil.EncryptedArg{Keys: keys, Plaintext: "github_token_123"}
+	refreshArg := testutil.EncryptedArg{Keys: keys, Plaintext: "refresh_123"}
 
-	// Test that tokens are unique
-	token2, err := generateSessionToken()
-	require.NoError(t, err)
-	assert.NotEqual(t, token, token2, "consecutive tokens should be unique")
-}
-
-func TestUserService_UpsertUser(t *testing.T) {
 	tests := []struct {
 		name        string
-		githubUser  model.GitHubUser
-		accessToken string
 		mockSetup   func(sqlmock.Sqlmock)
-		wantErr     bool
+		wantUserID  int
 		errContains string
 	}{
 		{
-			name: "successfully inserts new user",
-			githubUser: model.GitHubUser{
-				ID:    12345,
-				Login: "testuser",
-				Email: "test@example.com",
-			},
-			accessToken: "github_token_123",
+			name: "first login creates a user and links the identity",
 			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery(`UPDATE identities SET username`).
+					WithArgs("testuser", "test@example.com", true, tokenArg, refreshArg, expiry, sqlmock.AnyArg(), "github", "12345").
+					WillReturnError(sql.ErrNoRows)
+				mock.ExpectQuery(`UPDATE users SET username = \$1, email = \$2 WHERE id = \(`).
+					WithArgs("testuser", "test@example.com").
+					WillReturnError(sql.ErrNoRows)
 				mock.ExpectQuery(`INSERT INTO users`).
-					WithArgs(int64(12345), "testuser", "test@example.com", "github_token_123", sqlmock.AnyArg()).
-					WillReturnRows(sqlmock.NewRows([]string{"session_token"}).AddRow("generated_session_token"))
+					WithArgs("testuser", "test@example.com").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				mock.ExpectExec(`INSERT INTO identities`).
+					WithArgs(1, "github", "12345", "testuser", "test@example.com", true, tokenArg, refreshArg, expiry, sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
 			},
-			wantErr: false,
+			wantUserID: 1,
 		},
 		{
-			name: "successfully updates existing user",
-			githubUser: model.GitHubUser{
-				ID:    12345,
-				Login: "updateduser",
-				Email: "updated@example.com",
-			},
-			accessToken: "new_github_token",
+			name: "known identity refreshes its profile and token",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery(`INSERT INTO users`).
-					WithArgs(int64(12345), "updateduser", "updated@example.com", "new_github_token", sqlmock.AnyArg()).
-					WillReturnRows(sqlmock.NewRows([]string{"session_token"}).AddRow("new_session_token"))
+				mock.ExpectBegin()
+				mock.ExpectQuery(`UPDATE identities SET username`).
+					WithArgs("testuser", "test@example.com", true, tokenArg, refreshArg, expiry, sqlmock.AnyArg(), "github", "12345").
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(7))
+				mock.ExpectCommit()
 			},
-			wantErr: false,
+			wantUserID: 7,
 		},
 		{
 			name: "handles database error",
-			githubUser: model.GitHubUser{
-				ID:    12345,
-				Login: "testuser",
-				Email: "test@example.com",
-			},
-			accessToken: "github_token_123",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery(`INSERT INTO users`).
-					WithArgs(int64(12345), "testuser", "test@example.com", "github_token_123", sqlmock.AnyArg()).
+				mock.ExpectBegin()
+				mock.ExpectQuery(`UPDATE identities SET username`).
 					WillReturnError(sql.ErrConnDone)
+				mock.ExpectRollback()
 			},
-			wantErr:     true,
 			errContains: "connection",
 		},
 	}
@@ -89,18 +84,16 @@ func TestUserService_UpsertUser(t *testing.T) {
 
 			tt.mockSetup(mock)
 
-			us := NewUserService(db)
-			token, err := us.UpsertUser(tt.githubUser, tt.accessToken)
+			us := NewUserService(NewPostgresRepository(db), keys)
+			userID, err := us.UpsertIdentity(context.Background(), identity, token)
 
-			if tt.wantErr {
+			if tt.errContains != "" {
 				require.Error(t, err)
-				if tt.errContains != "" {
-					assert.Contains(t, err.Error(), tt.errContains)
-				}
-				assert.Empty(t, token)
+				assert.Contains(t, err.Error(), tt.errContains)
+				assert.Zero(t, userID)
 			} else {
 				require.NoError(t, err)
-				assert.NotEmpty(t, token, "should return session token")
+				assert.Equal(t, tt.wantUserID, userID, "should return user ID")
 			}
 
 			assert.NoError(t, mock.ExpectationsWereMet())
@@ -109,6 +102,8 @@ func TestUserService_UpsertUser(t *testing.T) {
 }
 
 func TestUserService_FindUserBySession(t *testing.T) {
+	keys := testutil.NewTestKeyring(t)
+
 	tests := []struct {
 		name         string
 		sessionToken string
@@ -121,19 +116,17 @@ func TestUserService_FindUserBySession(t *testing.T) {
 			name:         "valid session token returns user",
 			sessionToken: "valid_token_123",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				rows := sqlmock.NewRows([]string{"id", "github_id", "username", "email", "access_token", "session_token"}).
-					AddRow(1, int64(12345), "testuser", "test@example.com", "gh_token", "valid_token_123")
-				mock.ExpectQuery(`SELECT (.+) FROM users WHERE session_token`).
-					WithArgs("valid_token_123").
+				rows := sqlmock.NewRows([]string{"id", "username", "email", "session_id"}).
+					AddRow(1, "testuser", "test@example.com", 10)
+				mock.ExpectQuery(`SELECT (.+) FROM sessions s JOIN users u`).
+					WithArgs(hashToken("valid_token_123"), sqlmock.AnyArg(), sqlmock.AnyArg()).
 					WillReturnRows(rows)
 			},
 			wantUser: &model.UserModel{
-				ID:           1,
-				GithubID:     12345,
-				Username:     "testuser",
-				Email:        "test@example.com",
-				AccessToken:  "gh_token",
-				SessionToken: "valid_token_123",
+				ID:        1,
+				Username:  "testuser",
+				Email:     "test@example.com",
+				SessionID: 10,
 			},
 			wantErr: false,
 		},
@@ -141,20 +134,20 @@ func TestUserService_FindUserBySession(t *testing.T) {
 			name:         "invalid session token returns error",
 			sessionToken: "invalid_token",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery(`SELECT (.+) FROM users WHERE session_token`).
-					WithArgs("invalid_token").
+				mock.ExpectQuery(`SELECT (.+) FROM sessions s JOIN users u`).
+					WithArgs(hashToken("invalid_token"), sqlmock.AnyArg(), sqlmock.AnyArg()).
 					WillReturnError(sql.ErrNoRows)
 			},
 			wantUser:    nil,
 			wantErr:     true,
-			errContains: "no rows",
+			errContains: "user not found",
 		},
 		{
 			name:         "database error returns error",
 			sessionToken: "any_token",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery(`SELECT (.+) FROM users WHERE session_token`).
-					WithArgs("any_token").
+				mock.ExpectQuery(`SELECT (.+) FROM sessions s JOIN users u`).
+					WithArgs(hashToken("any_token"), sqlmock.AnyArg(), sqlmock.AnyArg()).
 					WillReturnError(sql.ErrConnDone)
 			},
 			wantUser:    nil,
@@ -165,13 +158,13 @@ func TestUserService_FindUserBySession(t *testing.T) {
 			name:         "empty session token",
 			sessionToken: "",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery(`SELECT (.+) FROM users WHERE session_token`).
-					WithArgs("").
+				mock.ExpectQuery(`SELECT (.+) FROM sessions s JOIN users u`).
+					WithArgs(hashToken(""), sqlmock.AnyArg(), sqlmock.AnyArg()).
 					WillReturnError(sql.ErrNoRows)
 			},
 			wantUser:    nil,
 			wantErr:     true,
-			errContains: "no rows",
+			errContains: "user not found",
 		},
 	}
 
@@ -182,8 +175,8 @@ func TestUserService_FindUserBySession(t *testing.T) {
 
 			tt.mockSetup(mock)
 
-			us := NewUserService(db)
-			user, err := us.FindUserBySession(tt.sessionToken)
+			us := NewUserService(NewPostgresRepository(db), keys)
+			user, err := us.FindUserBySession(context.Background(), tt.sessionToken)
 
 			if tt.wantErr {
 				require.Error(t, err)
@@ -195,14 +188,161 @@ func TestUserService_FindUserBySession(t *testing.T) {
 				require.NoError(t, err)
 				require.NotNil(t, user)
 				assert.Equal(t, tt.wantUser.ID, user.ID)
-				assert.Equal(t, tt.wantUser.GithubID, user.GithubID)
 				assert.Equal(t, tt.wantUser.Username, user.Username)
 				assert.Equal(t, tt.wantUser.Email, user.Email)
-				assert.Equal(t, tt.wantUser.AccessToken, user.AccessToken)
-				assert.Equal(t, tt.wantUser.SessionToken, user.SessionToken)
+				assert.Equal(t, tt.wantUser.SessionID, user.SessionID)
+			}
+
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestUserService_ReencryptAccessTokens(t *testing.T) {
+	oldKeys := testutil.NewTestKeyring(t)
+	oldCiphertext, err := oldKeys.Encrypt("old_token")
+	require.NoError(t, err)
+
+	rotatedKeys, err := keyring.New(2, map[int][]byte{
+		1: bytes.Repeat([]byte{0x42}, keyring.KeySize),
+		2: bytes.Repeat([]byte{0x43}, keyring.KeySize),
+	})
+	require.NoError(t, err)
+	current, err := rotatedKeys.Encrypt("current_token")
+	require.NoError(t, err)
+
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	mock.ExpectQuery(`SELECT id, access_token FROM identities`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "access_token"}).
+			AddRow(1, current).
+			AddRow(2, oldCiphertext).
+			AddRow(3, "legacy_plaintext"))
+	mock.MatchExpectationsInOrder(false)
+	mock.ExpectExec(`UPDATE identities SET access_token`).
+		WithArgs(testutil.EncryptedArg{Keys: rotatedKeys, Plaintext: "old_token"}, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE identities SET access_token`).
+		WithArgs(testutil.EncryptedArg{Keys: rotatedKeys, Plaintext: "legacy_plaintext"}, 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT id, refresh_token FROM identities`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "refresh_token"}).AddRow(1, current))
+	mock.ExpectQuery(`SELECT user_id, secret FROM user_totp`).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "secret"}).AddRow(1, current))
+
+	us := NewUserService(NewPostgresRepository(db), rotatedKeys)
+	count, err := us.ReencryptAccessTokens(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, count, "only stale rows should be rewritten")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUserService_LinkIdentity(t *testing.T) {
+	keys := testutil.NewTestKeyring(t)
+	identity := model.GitHubUser{ID: 777, Login: "work", Email: "work@example.com"}.Identity()
+
+	tests := []struct {
+		name      string
+		mockSetup func(sqlmock.Sqlmock)
+		wantErr   error
+	}{
+		{
+			name: "links a new identity",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`INSERT INTO identities (.+) ON CONFLICT`).
+					WithArgs(1, "github", "777", "work", "work@example.com", false, testutil.EncryptedArg{Keys: keys, Plaintext: "token"}, nil, nil, sqlmock.AnyArg()).
+					WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+			},
+		},
+		{
+			name: "identity owned by another account",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`INSERT INTO identities (.+) ON CONFLICT`).
+					WillReturnError(sql.ErrNoRows)
+			},
+			wantErr: ErrIdentityConflict,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.SetupMockDB(t)
+			defer cleanup()
+			tt.mockSetup(mock)
+
+			err := NewUserService(NewPostgresRepository(db), keys).LinkIdentity(context.Background(), 1, identity, &oauth2.Token{AccessToken: "token"})
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
 			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
 
+func TestUserService_UnlinkIdentity(t *testing.T) {
+	tests := []struct {
+		name        string
+		identityIDs []int
+		unlink      int
+		wantErr     error
+	}{
+		{name: "unlinks one of two identities", identityIDs: []int{1, 2}, unlink: 2},
+		{name: "refuses to unlink the last identity", identityIDs: []int{1}, unlink: 1, wantErr: ErrLastIdentity},
+		{name: "identity of another account", identityIDs: []int{1, 2}, unlink: 3, wantErr: ErrIdentityNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.SetupMockDB(t)
+			defer cleanup()
+
+			rows := sqlmock.NewRows([]string{"id"})
+			for _, id := range tt.identityIDs {
+				rows.AddRow(id)
+			}
+			mock.ExpectBegin()
+			mock.ExpectQuery(`SELECT id FROM identities WHERE user_id = \$1 FOR UPDATE`).
+				WithArgs(5).
+				WillReturnRows(rows)
+			if tt.wantErr == nil {
+				mock.ExpectExec(`DELETE FROM identities WHERE id = \$1 AND user_id = \$2`).
+					WithArgs(tt.unlink, 5).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			err := NewUserService(NewPostgresRepository(db), testutil.NewTestKeyring(t)).UnlinkIdentity(context.Background(), 5, tt.unlink)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
 			assert.NoError(t, mock.ExpectationsWereMet())
 		})
 	}
 }
+
+func TestUserService_TracesQueries(t *testing.T) {
+	recorder := testutil.RecordSpans(t)
+	us := NewUserService(NewMemoryRepository(), testutil.NewTestKeyring(t))
+	ctx, request := tracing.Tracer().Start(context.Background(), "GET /api/account/data")
+
+	userID, err := us.UpsertIdentity(ctx, model.GitHubUser{ID: 1, Login: "traced"}.Identity(), &oauth2.Token{AccessToken: "token"})
+	require.NoError(t, err)
+	_, err = us.FindUserByID(ctx, userID+1)
+	require.Error(t, err)
+	request.End()
+
+	assert.Equal(t, []string{"users.UpsertIdentity", "users.FindUserByID", "GET /api/account/data"}, testutil.SpanNames(recorder))
+	spans := recorder.Ended()
+	for _, query := range spans[:2] {
+		assert.Equal(t, request.SpanContext().SpanID(), query.Parent().SpanID(), "%s belongs to the request", query.Name())
+		assert.Equal(t, trace.SpanKindClient, query.SpanKind())
+	}
+	assert.Equal(t, codes.Error, spans[1].Status().Code, "failed queries are marked")
+}
@@ -0,0 +1,229 @@
+package service
+
+import (
+	"cito/server/model"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+var (
+	ErrWorkspaceNotFound = errors.New("workspace not found")
+	ErrNotWorkspaceAdmin = errors.New("not a workspace admin")
+	ErrInvalidWorkspace  = errors.New("invalid workspace")
+	ErrInviteNotFound    = errors.New("invite not found")
+)
+
+type WorkspaceService struct {
+	db *sql.DB
+}
+
+func NewWorkspaceService(db *sql.DB) *WorkspaceService {
+	return &WorkspaceService{db: db}
+}
+
+// CreateWorkspace creates a workspace with userID as its first admin
+func (ws *WorkspaceService) CreateWorkspace(userID int, name string) (*model.Workspace, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > 255 {
+		return nil, fmt.Errorf("%w: name must be 1 to 255 characters", ErrInvalidWorkspace)
+	}
+
+	tx, err := ws.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	workspace := &model.Workspace{Name: name, CreatedAt: time.Now(), Role: model.WorkspaceRoleAdmin}
+	err = tx.QueryRow(`INSERT INTO workspaces (name, require_two_factor, created_at) VALUES ($1, FALSE, $2) RETURNING id`,
+		name, workspace.CreatedAt).Scan(&workspace.ID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`INSERT INTO workspace_members (workspace_id, user_id, role, created_at, accepted_at) VALUES ($1, $2, $3, $4, $4)`,
+		workspace.ID, userID, model.WorkspaceRoleAdmin, workspace.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	slog.Info("Created workspace", "workspace_id", workspace.ID, "user_id", userID)
+	return workspace, nil
+}
+
+// ListWorkspaces returns the workspaces userID is a member of
+func (ws *WorkspaceService) ListWorkspaces(userID int) ([]model.Workspace, error) {
+	return ws.listWorkspaces(userID, true)
+}
+
+// ListInvites returns the workspaces userID is invited to and has not
+// answered yet, with the role they were offered
+func (ws *WorkspaceService) ListInvites(userID int) ([]model.Workspace, error) {
+	return ws.listWorkspaces(userID, false)
+}
+
+func (ws *WorkspaceService) listWorkspaces(userID int, accepted bool) ([]model.Workspace, error) {
+	rows, err := ws.db.Query(`
+		SELECT w.id, w.name, w.require_two_factor, w.created_at, m.role
+		FROM workspace_members m
+		JOIN workspaces w ON w.id = m.workspace_id
+		WHERE m.user_id = $1 AND (m.accepted_at IS NOT NULL) = $2
+		ORDER BY w.name
+	`, userID, accepted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workspaces := []model.Workspace{}
+	for rows.Next() {
+		var workspace model.Workspace
+		if err := rows.Scan(&workspace.ID, &workspace.Name, &workspace.RequireTwoFactor, &workspace.CreatedAt, &workspace.Role); err != nil {
+			return nil, err
+		}
+		workspaces = append(workspaces, workspace)
+	}
+	return workspaces, rows.Err()
+}
+
+// requireAdmin checks that userID administers workspaceID, an invite to
+// administer it is not enough
+func (ws *WorkspaceService) requireAdmin(userID int, workspaceID int) error {
+	var role string
+	err := ws.db.QueryRow(`SELECT role FROM workspace_members WHERE workspace_id = $1 AND user_id = $2 AND accepted_at IS NOT NULL`,
+		workspaceID, userID).Scan(&role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrWorkspaceNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if role != model.WorkspaceRoleAdmin {
+		return ErrNotWorkspaceAdmin
+	}
+	return nil
+}
+
+// InviteMember invites memberID to the workspace, or changes the role of a
+// member or invitee. Only workspace admins may do so. The invitee joins, and
+// its policies apply to them, once they accept.
+func (ws *WorkspaceService) InviteMember(adminID int, workspaceID int, memberID int, role string) error {
+	if role != model.WorkspaceRoleAdmin && role != model.WorkspaceRoleMember {
+		return fmt.Errorf("%w: unknown role %q", ErrInvalidWorkspace, role)
+	}
+	if err := ws.requireAdmin(adminID, workspaceID); err != nil {
+		return err
+	}
+	_, err := ws.db.Exec(`
+		INSERT INTO workspace_members (workspace_id, user_id, role, created_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (workspace_id, user_id) DO UPDATE SET role = EXCLUDED.role
+	`, workspaceID, memberID, role, time.Now())
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Invited workspace member", "workspace_id", workspaceID, "user_id", memberID, "role", role, "admin_id", adminID)
+	return nil
+}
+
+// AcceptInvite makes userID a member of the workspace they were invited to
+func (ws *WorkspaceService) AcceptInvite(userID int, workspaceID int) error {
+	result, err := ws.db.Exec(`UPDATE workspace_members SET accepted_at = $1 WHERE workspace_id = $2 AND user_id = $3 AND accepted_at IS NULL`,
+		time.Now(), workspaceID, userID)
+	if err != nil {
+		return err
+	}
+	if err := inviteAnswered(result); err != nil {
+		return err
+	}
+
+	slog.Info("Accepted workspace invite", "workspace_id", workspaceID, "user_id", userID)
+	return nil
+}
+
+// DeclineInvite drops the invite of userID to the workspace
+func (ws *WorkspaceService) DeclineInvite(userID int, workspaceID int) error {
+	result, err := ws.db.Exec(`DELETE FROM workspace_members WHERE workspace_id = $1 AND user_id = $2 AND accepted_at IS NULL`,
+		workspaceID, userID)
+	if err != nil {
+		return err
+	}
+	if err := inviteAnswered(result); err != nil {
+		return err
+	}
+
+	slog.Info("Declined workspace invite", "workspace_id", workspaceID, "user_id", userID)
+	return nil
+}
+
+// inviteAnswered checks that answering an invite changed a row
+func inviteAnswered(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+// SetRequireTwoFactor turns the two-factor requirement of a workspace on or
+// off. Members without two-factor authentication must enroll at their next
+// sign-in, see MembersWithoutTwoFactor.
+func (ws *WorkspaceService) SetRequireTwoFactor(adminID int, workspaceID int, required bool) error {
+	if err := ws.requireAdmin(adminID, workspaceID); err != nil {
+		return err
+	}
+	if _, err := ws.db.Exec(`UPDATE workspaces SET require_two_factor = $1 WHERE id = $2`, required, workspaceID); err != nil {
+		return err
+	}
+
+	slog.Info("Workspace two-factor requirement changed", "workspace_id", workspaceID, "required", required, "admin_id", adminID)
+	return nil
+}
+
+// MembersWithoutTwoFactor returns the IDs of the members of a workspace who
+// have not enabled two-factor authentication. Pending invites do not count.
+func (ws *WorkspaceService) MembersWithoutTwoFactor(workspaceID int) ([]int, error) {
+	rows, err := ws.db.Query(`
+		SELECT m.user_id FROM workspace_members m
+		WHERE m.workspace_id = $1 AND m.accepted_at IS NOT NULL
+			AND NOT EXISTS (SELECT 1 FROM user_totp t WHERE t.user_id = m.user_id AND t.enabled_at IS NOT NULL)
+		ORDER BY m.user_id
+	`, workspaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	userIDs := []int{}
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
+
+// RequiresTwoFactor reports whether any workspace userID has joined requires
+// two-factor authentication. Pending invites do not count.
+func (ws *WorkspaceService) RequiresTwoFactor(userID int) (bool, error) {
+	var required bool
+	err := ws.db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM workspace_members m
+			JOIN workspaces w ON w.id = m.workspace_id
+			WHERE m.user_id = $1 AND m.accepted_at IS NOT NULL AND w.require_two_factor
+		)
+	`, userID).Scan(&required)
+	return required, err
+}
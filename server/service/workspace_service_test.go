@@ -0,0 +1,148 @@
+package service
+
+import (
+	"cito/server/model"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"cito/server/testutil"
+)
+
+func TestWorkspaceService_CreateWorkspace(t *testing.T) {
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO workspaces`).WithArgs("Team", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+	mock.ExpectExec(`INSERT INTO workspace_members (.+) accepted_at`).WithArgs(4, 1, model.WorkspaceRoleAdmin, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	workspace, err := NewWorkspaceService(db).CreateWorkspace(1, " Team ")
+	require.NoError(t, err)
+	assert.Equal(t, 4, workspace.ID)
+	assert.Equal(t, "Team", workspace.Name)
+	assert.Equal(t, model.WorkspaceRoleAdmin, workspace.Role)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	_, err = NewWorkspaceService(db).CreateWorkspace(1, "  ")
+	assert.ErrorIs(t, err, ErrInvalidWorkspace)
+}
+
+func TestWorkspaceService_SetRequireTwoFactor(t *testing.T) {
+	tests := []struct {
+		name    string
+		role    *string
+		wantErr error
+	}{
+		{name: "admin changes the policy", role: ptr(model.WorkspaceRoleAdmin)},
+		{name: "member is refused", role: ptr(model.WorkspaceRoleMember), wantErr: ErrNotWorkspaceAdmin},
+		{name: "not a member", wantErr: ErrWorkspaceNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.SetupMockDB(t)
+			defer cleanup()
+
+			rows := sqlmock.NewRows([]string{"role"})
+			if tt.role != nil {
+				rows.AddRow(*tt.role)
+			}
+			mock.ExpectQuery(`SELECT role FROM workspace_members`).WithArgs(2, 1).WillReturnRows(rows)
+			if tt.wantErr == nil {
+				mock.ExpectExec(`UPDATE workspaces SET require_two_factor`).WithArgs(true, 2).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+
+			err := NewWorkspaceService(db).SetRequireTwoFactor(1, 2, true)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestWorkspaceService_InviteMember(t *testing.T) {
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	mock.ExpectQuery(`SELECT role FROM workspace_members WHERE (.+) AND accepted_at IS NOT NULL`).WithArgs(2, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(model.WorkspaceRoleAdmin))
+	mock.ExpectExec(`INSERT INTO workspace_members \(workspace_id, user_id, role, created_at\) VALUES`).
+		WithArgs(2, 5, model.WorkspaceRoleMember, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	ws := NewWorkspaceService(db)
+	require.NoError(t, ws.InviteMember(1, 2, 5, model.WorkspaceRoleMember))
+	assert.ErrorIs(t, ws.InviteMember(1, 2, 5, "owner"), ErrInvalidWorkspace)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWorkspaceService_AnswerInvite(t *testing.T) {
+	tests := []struct {
+		name    string
+		accept  bool
+		pending bool
+		wantErr error
+	}{
+		{name: "accepts invite", accept: true, pending: true},
+		{name: "declines invite", pending: true},
+		{name: "no invite to accept", accept: true, wantErr: ErrInviteNotFound},
+		{name: "no invite to decline", wantErr: ErrInviteNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, cleanup := testutil.SetupMockDB(t)
+			defer cleanup()
+
+			affected := int64(0)
+			if tt.pending {
+				affected = 1
+			}
+			ws := NewWorkspaceService(db)
+			var err error
+			if tt.accept {
+				mock.ExpectExec(`UPDATE workspace_members SET accepted_at = \$1 WHERE (.+) AND accepted_at IS NULL`).
+					WithArgs(sqlmock.AnyArg(), 2, 5).WillReturnResult(sqlmock.NewResult(0, affected))
+				err = ws.AcceptInvite(5, 2)
+			} else {
+				mock.ExpectExec(`DELETE FROM workspace_members WHERE (.+) AND accepted_at IS NULL`).
+					WithArgs(2, 5).WillReturnResult(sqlmock.NewResult(0, affected))
+				err = ws.DeclineInvite(5, 2)
+			}
+
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestWorkspaceService_RequiresTwoFactor_JoinedOnly(t *testing.T) {
+	db, mock, cleanup := testutil.SetupMockDB(t)
+	defer cleanup()
+
+	mock.ExpectQuery(`FROM workspace_members m (.+) m.accepted_at IS NOT NULL AND w.require_two_factor`).WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	required, err := NewWorkspaceService(db).RequiresTwoFactor(5)
+	require.NoError(t, err)
+	assert.False(t, required)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func ptr(s string) *string {
+	return &s
+}
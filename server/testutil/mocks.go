@@ -3,7 +3,6 @@ package testutil
 import (
 	"bytes"
 	"context"
-	"database/sql"
 	"io"
 	"net/http"
 
@@ -42,6 +41,7 @@ func NewMockHTTPClient(statusCode int, body string) *MockHTTPClient {
 type MockOAuth2Config struct {
 	ExchangeFunc    func(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error)
 	AuthCodeURLFunc func(state string, opts ...oauth2.AuthCodeOption) string
+	TokenSourceFunc func(ctx context.Context, t *oauth2.Token) oauth2.TokenSource
 }
 
 func (m *MockOAuth2Config) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
@@ -58,36 +58,23 @@ func (m *MockOAuth2Config) AuthCodeURL(state string, opts ...oauth2.AuthCodeOpti
 	return "https://github.com/login/oauth/authorize?client_id=test&state=" + state
 }
 
-// MockUserService is a mock implementation of UserService
-type MockUserService struct {
-	UpsertUserFunc        func(githubUser interface{}, accessToken string) (string, error)
-	FindUserBySessionFunc func(sessionToken string) (interface{}, error)
-}
-
-func (m *MockUserService) UpsertUser(githubUser interface{}, accessToken string) (string, error) {
-	if m.UpsertUserFunc != nil {
-		return m.UpsertUserFunc(githubUser, accessToken)
-	}
-	return "mock_session_token", nil
-}
-
-func (m *MockUserService) FindUserBySession(sessionToken string) (interface{}, error) {
-	if m.FindUserBySessionFunc != nil {
-		return m.FindUserBySessionFunc(sessionToken)
+func (m *MockOAuth2Config) TokenSource(ctx context.Context, t *oauth2.Token) oauth2.TokenSource {
+	if m.TokenSourceFunc != nil {
+		return m.TokenSourceFunc(ctx, t)
 	}
-	return nil, sql.ErrNoRows
+	return oauth2.StaticTokenSource(t)
 }
 
 // AuthService
 type MockAuthSerice struct {
-	GetLoginURLFunc func() string
-	GetGHTokenFunc  func(ctx context.Context, code string) (*oauth2.Token, error)
+	GetLoginURLFunc func(verifier string) string
+	GetGHTokenFunc  func(ctx context.Context, code string, verifier string) (*oauth2.Token, error)
 }
 
-func (as *MockAuthSerice) GetLoginURL() string {
+func (as *MockAuthSerice) GetLoginURL(verifier string) string {
 	return "https://github.com/login/oauth/authorize?client_id=test&state=test"
 }
 
-func (as *MockAuthSerice) GetGHToken(ctx context.Context, code string) (*oauth2.Token, error) {
+func (as *MockAuthSerice) GetGHToken(ctx context.Context, code string, verifier string) (*oauth2.Token, error) {
 	return &oauth2.Token{AccessToken: "mock_access_token"}, nil
 }
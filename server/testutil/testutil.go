@@ -1,7 +1,10 @@
 package testutil
 
 import (
+	"bytes"
+	"cito/server/keyring"
 	"database/sql"
+	"database/sql/driver"
 	"os"
 	"testing"
 
@@ -22,6 +25,31 @@ func SetupMockDB(t *testing.T) (*sql.DB, sqlmock.Sqlmock, func()) {
 	return db, mock, cleanup
 }
 
+// NewTestKeyring returns a keyring with a fixed version 1 key
+func NewTestKeyring(t *testing.T) *keyring.Keyring {
+	k, err := keyring.New(1, map[int][]byte{1: bytes.Repeat([]byte{0x42}, keyring.KeySize)})
+	if err != nil {
+		t.Fatalf("failed to create keyring: %v", err)
+	}
+	return k
+}
+
+// EncryptedArg is a sqlmock argument matcher for a value sealed by Keys
+// that decrypts to Plaintext
+type EncryptedArg struct {
+	Keys      *keyring.Keyring
+	Plaintext string
+}
+
+func (a EncryptedArg) Match(v driver.Value) bool {
+	ciphertext, ok := v.(string)
+	if !ok || ciphertext == a.Plaintext {
+		return false
+	}
+	plaintext, err := a.Keys.Decrypt(ciphertext)
+	return err == nil && plaintext == a.Plaintext
+}
+
 // NewMockRows is a helper to create sqlmock.Rows (re-export for convenience)
 var NewMockRows = sqlmock.NewRows
 
@@ -38,6 +66,7 @@ func SetTestEnv(t *testing.T) func() {
 		"GITHUB_CLIENT_SECRET": os.Getenv("GITHUB_CLIENT_SECRET"),
 		"GITHUB_REDIRECT_URL":  os.Getenv("GITHUB_REDIRECT_URL"),
 		"SERVER_ADDR":          os.Getenv("SERVER_ADDR"),
+		"ACCESS_TOKEN_KEYS":    os.Getenv("ACCESS_TOKEN_KEYS"),
 	}
 
 	// Set test values
@@ -50,6 +79,7 @@ func SetTestEnv(t *testing.T) func() {
 	os.Setenv("GITHUB_CLIENT_SECRET", "test_secret")
 	os.Setenv("GITHUB_REDIRECT_URL", "http://localhost:8080/oauth2/callback")
 	os.Setenv("SERVER_ADDR", "127.0.0.1:0")
+	os.Setenv("ACCESS_TOKEN_KEYS", "1:QkJCQkJCQkJCQkJCQkJCQkJCQkJCQkJCQkJCQkJCQkI=")
 
 	// Return cleanup function
 	return func() {
@@ -0,0 +1,120 @@
+// Package tracing sets up OpenTelemetry tracing and holds the tracer the
+// server starts its spans with
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters spans can be sent with
+const (
+	// ExporterOTLP sends spans to an OpenTelemetry collector over OTLP/HTTP
+	ExporterOTLP = "otlp"
+	// ExporterStdout prints spans, for local testing
+	ExporterStdout = "stdout"
+)
+
+// Tracer starts the spans of the server, from the installed provider. They
+// are dropped until Setup installs an exporter.
+func Tracer() trace.Tracer {
+	return otel.Tracer("cito/server")
+}
+
+// Setup sends the spans of ratio of the new traces to exporter, and to
+// endpoint for OTLP, the collector's default when empty. Tracing stays off
+// when exporter is empty. The returned function flushes the spans left, on
+// shutdown.
+func Setup(ctx context.Context, exporter string, endpoint string, ratio float64) (func(context.Context) error, error) {
+	if exporter == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	spanExporter, err := newExporter(ctx, exporter, endpoint, os.Stdout)
+	if err != nil {
+		return nil, err
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES win over the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "cito")),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(res),
+		// Traces started upstream keep the caller's sampling decision
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// newExporter returns the span exporter called name, the stdout one
+// printing to w
+func newExporter(ctx context.Context, name string, endpoint string, w io.Writer) (sdktrace.SpanExporter, error) {
+	switch name {
+	case ExporterOTLP:
+		var opts []otlptracehttp.Option
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	case ExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(w))
+	}
+	return nil, fmt.Errorf("unknown trace exporter %q", name)
+}
+
+// End ends span, marking it failed when err is set
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Handler starts a span for every request to next, continuing the trace of
+// the caller, except for the untraced paths such as probes. Spans are named
+// after the route pattern that matched.
+func Handler(next http.Handler, untraced ...string) http.Handler {
+	return otelhttp.NewHandler(next, "http",
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return !slices.Contains(untraced, r.URL.Path)
+		}),
+		otelhttp.WithSpanNameFormatter(func(operation string, r *http.Request) string {
+			switch {
+			case r.Pattern == "":
+				return r.Method
+			case r.Pattern[0] == '/':
+				return r.Method + " " + r.Pattern
+			}
+			return r.Pattern
+		}),
+	)
+}
+
+// Transport traces the requests sent through base, such as identity
+// provider API calls, and passes the trace on to the server
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base)
+}
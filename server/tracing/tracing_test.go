@@ -0,0 +1,70 @@
+package tracing
+
+import (
+	"bytes"
+	"cito/server/testutil"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSetup(t *testing.T) {
+	shutdown, err := Setup(context.Background(), "", "", 1)
+	require.NoError(t, err, "tracing stays off without an exporter")
+	assert.NoError(t, shutdown(context.Background()))
+
+	_, err = Setup(context.Background(), "zipkin", "", 1)
+	assert.ErrorContains(t, err, "unknown trace exporter")
+}
+
+func TestNewExporter_Stdout(t *testing.T) {
+	var out bytes.Buffer
+	exporter, err := newExporter(context.Background(), ExporterStdout, "", &out)
+	require.NoError(t, err)
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	_, span := provider.Tracer("test").Start(context.Background(), "hub.route")
+	span.End()
+	require.NoError(t, provider.Shutdown(context.Background()))
+	assert.Contains(t, out.String(), `"Name":"hub.route"`)
+}
+
+func TestEnd(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+	_, ok := tracer.Start(context.Background(), "ok")
+	End(ok, nil)
+	_, failed := tracer.Start(context.Background(), "failed")
+	End(failed, errors.New("connection refused"))
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2)
+	assert.Equal(t, codes.Unset, spans[0].Status().Code)
+	assert.Equal(t, codes.Error, spans[1].Status().Code)
+	assert.Equal(t, "connection refused", spans[1].Status().Description)
+	assert.Len(t, spans[1].Events(), 1, "the error is recorded")
+}
+
+func TestHandler_NamesSpansAfterRoutes(t *testing.T) {
+	recorder := testutil.RecordSpans(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/tokens/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {})
+	handler := Handler(mux, "/healthz")
+
+	for _, path := range []string{"/api/tokens/7", "/login", "/healthz", "/missing"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	assert.Equal(t, []string{"GET /api/tokens/{id}", "GET /login", "GET"}, testutil.SpanNames(recorder))
+}